@@ -4,7 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
+	"sort"
 	"strconv"
 	"time"
 
@@ -29,7 +31,7 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostUsersRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
 	if req.Username == "" || req.FirstName == "" || req.LastName == "" || req.DateOfBirth == "" {
@@ -37,9 +39,18 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userID := ulid.Make().String()
-	accessToken := secureRandomStr(32)
-	invitationCode := secureRandomStr(15)
+	now := time.Now()
+	user := &User{
+		ID:          ulid.Make().String(),
+		Username:    req.Username,
+		Firstname:   req.FirstName,
+		Lastname:    req.LastName,
+		DateOfBirth: req.DateOfBirth,
+		AccessToken: secureRandomStr(32),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	userID := user.ID
 
 	tx, err := db.Beginx()
 	if err != nil {
@@ -48,15 +59,18 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	_, err = tx.ExecContext(
-		ctx,
-		"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		userID, req.Username, req.FirstName, req.LastName, req.DateOfBirth, accessToken, invitationCode,
-	)
+	invitationCode, err := insertUserWithInvitationCode(ctx, tx, user)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	user.InvitationCode = invitationCode
+	committed := false
+	defer func() {
+		if !committed {
+			releaseInvitationCode(invitationCode)
+		}
+	}()
 
 	// 初回登録キャンペーンのクーポンを付与
 	_, err = tx.ExecContext(
@@ -70,10 +84,11 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 招待コードを使った登録
+	var inviterID, rewardCode string
 	if req.InvitationCode != nil && *req.InvitationCode != "" {
 		// 招待する側の招待数をチェック
 		var coupons []Coupon
-		err = tx.SelectContext(ctx, &coupons, "SELECT * FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
+		err = tx.SelectContext(ctx, &coupons, "SELECT "+couponColumns+" FROM coupons WHERE code = ? FOR UPDATE", "INV_"+*req.InvitationCode)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
@@ -84,14 +99,10 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// ユーザーチェック
-		var inviter User
-		err = tx.GetContext(ctx, &inviter, "SELECT * FROM users WHERE invitation_code = ?", *req.InvitationCode)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
-				return
-			}
-			writeError(w, http.StatusInternalServerError, err)
+		var ok bool
+		inviterID, ok = lookupInviter(ctx, *req.InvitationCode)
+		if !ok {
+			writeError(w, http.StatusBadRequest, errors.New("この招待コードは使用できません。"))
 			return
 		}
 
@@ -106,10 +117,11 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// 招待した人にもRewardを付与
+		rewardCode = fmt.Sprintf("RWD_%s_%d", *req.InvitationCode, time.Now().UnixMilli())
 		_, err = tx.ExecContext(
 			ctx,
-			"INSERT INTO coupons (user_id, code, discount) VALUES (?, CONCAT(?, '_', FLOOR(UNIX_TIMESTAMP(NOW(3))*1000)), ?)",
-			inviter.ID, "RWD_"+*req.InvitationCode, 1000,
+			"INSERT INTO coupons (user_id, code, discount) VALUES (?, ?, ?)",
+			inviterID, rewardCode, 1000,
 		)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
@@ -121,11 +133,20 @@ func appPostUsers(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	committed = true
+
+	// 登録直後のリクエストもキャッシュに当たるよう、レスポンスを返す前に載せておく
+	cacheUser(currentCaches(), user)
+	grantLedgerCoupon(currentCaches(), Coupon{UserID: userID, Code: "CP_NEW2024", Discount: 3000, CreatedAt: now})
+	if inviterID != "" {
+		grantLedgerCoupon(currentCaches(), Coupon{UserID: userID, Code: "INV_" + *req.InvitationCode, Discount: 1500, CreatedAt: now})
+		grantLedgerCoupon(currentCaches(), Coupon{UserID: inviterID, Code: rewardCode, Discount: 1000, CreatedAt: now})
+	}
 
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "app_session",
-		Value: accessToken,
+		Value: user.AccessToken,
 	})
 
 	writeJSON(w, http.StatusCreated, &appPostUsersResponse{
@@ -142,7 +163,7 @@ func appPostPaymentMethods(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostPaymentMethodsRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
 	if req.Token == "" {
@@ -199,13 +220,8 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	rides := []Ride{}
-	if err := tx.SelectContext(
-		ctx,
-		&rides,
-		`SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC`,
-		user.ID,
-	); err != nil {
+	rides, err := selectRidesContext(ctx, tx, `SELECT `+rideColumns+` FROM rides WHERE user_id = ? ORDER BY created_at DESC`, user.ID)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -229,11 +245,17 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 		// 	return
 		// }
 		status := statuses[ride.ID]
-		if status != "COMPLETED" {
+		if status != RideStateCompleted {
 			continue
 		}
 
-		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+		fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, ride.Pickup(), ride.Destination())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		view, err := getRideView(ctx, tx, &ride)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
@@ -241,31 +263,26 @@ func appGetRides(w http.ResponseWriter, r *http.Request) {
 
 		item := getAppRidesResponseItem{
 			ID:                    ride.ID,
-			PickupCoordinate:      Coordinate{Latitude: ride.PickupLatitude, Longitude: ride.PickupLongitude},
-			DestinationCoordinate: Coordinate{Latitude: ride.DestinationLatitude, Longitude: ride.DestinationLongitude},
+			PickupCoordinate:      view.PickupCoordinate(),
+			DestinationCoordinate: view.DestinationCoordinate(),
 			Fare:                  fare,
 			Evaluation:            *ride.Evaluation,
-			RequestedAt:           ride.CreatedAt.UnixMilli(),
-			CompletedAt:           ride.UpdatedAt.UnixMilli(),
+			RequestedAt:           epochMilli(ride.CreatedAt),
+			CompletedAt:           epochMilli(ride.UpdatedAt),
 		}
 
-		item.Chair = getAppRidesResponseItemChair{}
+		if view.Chair != nil {
+			item.Chair.ID = view.Chair.ID
+			item.Chair.Name = view.Chair.Name
+			item.Chair.Model = view.Chair.Model
 
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-		item.Chair.ID = chair.ID
-		item.Chair.Name = chair.Name
-		item.Chair.Model = chair.Model
-
-		owner := &Owner{}
-		if err := tx.GetContext(ctx, owner, `SELECT * FROM owners WHERE id = ?`, chair.OwnerID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			owner := &Owner{}
+			if err := tx.GetContext(ctx, owner, `SELECT `+ownerColumns+` FROM owners WHERE id = ?`, view.Chair.OwnerID); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			item.Chair.Owner = owner.Name
 		}
-		item.Chair.Owner = owner.Name
 
 		items = append(items, item)
 	}
@@ -286,26 +303,49 @@ type appPostRidesRequest struct {
 }
 
 type appPostRidesResponse struct {
-	RideID string `json:"ride_id"`
-	Fare   int    `json:"fare"`
+	RideID        string        `json:"ride_id"`
+	Fare          int           `json:"fare"`
+	FareBreakdown fareBreakdown `json:"fare_breakdown"`
 }
 
 type executableGet interface {
 	Get(dest interface{}, query string, args ...interface{}) error
 	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
 	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
 }
 
-func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (string, error) {
-	status := ""
-	if err := tx.GetContext(ctx, &status, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`, rideID); err != nil {
+func getLatestRideStatus(ctx context.Context, tx executableGet, rideID string) (RideState, error) {
+	status, ok := latestRideStatusFromCache(rideID)
+	recordCacheLookup(ctx, "ride_statuses", ok)
+	if ok {
+		verifyCacheRead(ctx, "ride_statuses", rideID, status, func() (RideState, error) {
+			var s RideState
+			err := tx.QueryRowContext(ctx, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY seq DESC LIMIT 1`, rideID).Scan(&s)
+			return s, err
+		})
+		return status, nil
+	}
+
+	if err := tx.QueryRowContext(ctx, `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY seq DESC LIMIT 1`, rideID).Scan(&status); err != nil {
 		return "", err
 	}
 	return status, nil
 }
 
-func getLatestRideStatusMany(ctx context.Context, tx executableGet, rideIDs []string) (map[string]string, error) {
-	statuses := map[string]string{}
+func getLatestRideStatusMany(ctx context.Context, tx executableGet, rideIDs []string) (map[string]RideState, error) {
+	statuses := map[string]RideState{}
+	missing := rideIDs[:0:0]
+	for _, id := range rideIDs {
+		status, ok := latestRideStatusFromCache(id)
+		recordCacheLookup(ctx, "ride_statuses", ok)
+		if ok {
+			statuses[id] = status
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	rideIDs = missing
 	if len(rideIDs) == 0 {
 		return statuses, nil
 	}
@@ -314,7 +354,7 @@ func getLatestRideStatusMany(ctx context.Context, tx executableGet, rideIDs []st
 			SELECT
 				ride_id,
 				status,
-				ROW_NUMBER() OVER (PARTITION BY ride_id ORDER BY created_at DESC) AS rn
+				ROW_NUMBER() OVER (PARTITION BY ride_id ORDER BY seq DESC) AS rn
 			FROM ride_statuses
 			WHERE ride_id IN (?)
 		) sq WHERE rn = 1`,
@@ -325,8 +365,8 @@ func getLatestRideStatusMany(ctx context.Context, tx executableGet, rideIDs []st
 	}
 
 	res := []struct {
-		RideID string `db:"ride_id"`
-		Status string `db:"status"`
+		RideID string    `db:"ride_id"`
+		Status RideState `db:"status"`
 	}{}
 
 	if err := tx.SelectContext(ctx, &res, query, args...); err != nil {
@@ -340,17 +380,56 @@ func getLatestRideStatusMany(ctx context.Context, tx executableGet, rideIDs []st
 	return statuses, nil
 }
 
+// 地図上の有効範囲 (両端を含む)
+const (
+	mapMinCoordinate = -500
+	mapMaxCoordinate = 500
+)
+
+var errSamePickupAndDestination = errors.New("pickup_coordinate and destination_coordinate must be different")
+
+type coordinateOutOfRegionError struct {
+	Field      string
+	Coordinate Coordinate
+}
+
+func (e *coordinateOutOfRegionError) Error() string {
+	return fmt.Sprintf("%s (%d, %d) is out of the map region", e.Field, e.Coordinate.Latitude, e.Coordinate.Longitude)
+}
+
+func inMapRegion(c Coordinate) bool {
+	return mapMinCoordinate <= c.Latitude && c.Latitude <= mapMaxCoordinate &&
+		mapMinCoordinate <= c.Longitude && c.Longitude <= mapMaxCoordinate
+}
+
+func validateRideCoordinates(pickup, destination Coordinate) error {
+	if !inMapRegion(pickup) {
+		return &coordinateOutOfRegionError{Field: "pickup_coordinate", Coordinate: pickup}
+	}
+	if !inMapRegion(destination) {
+		return &coordinateOutOfRegionError{Field: "destination_coordinate", Coordinate: destination}
+	}
+	if pickup == destination {
+		return errSamePickupAndDestination
+	}
+	return nil
+}
+
 func appPostRides(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostRidesRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
 	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
 		writeError(w, http.StatusBadRequest, errors.New("required fields(pickup_coordinate, destination_coordinate) are empty"))
 		return
 	}
+	if err := validateRideCoordinates(*req.PickupCoordinate, *req.DestinationCoordinate); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
 
 	user := ctx.Value("user").(*User)
 	rideID := ulid.Make().String()
@@ -362,8 +441,8 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	rides := []Ride{}
-	if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ?`, user.ID); err != nil {
+	rides, err := selectRidesContext(ctx, tx, `SELECT `+rideColumns+` FROM rides WHERE user_id = ?`, user.ID)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -383,7 +462,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		// 	return
 		// }
 		status := statuses[ride.ID]
-		if status != "COMPLETED" {
+		if status != RideStateCompleted {
 			continuingRideCount++
 		}
 	}
@@ -403,11 +482,8 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "MATCHING",
-	); err != nil {
+	matchingStatus, err := insertRideStatus(ctx, tx, rideID, RideStateMatching)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -418,53 +494,84 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var coupon []Coupon
-	// クーポンを全て取得
-	if err := tx.SelectContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at FOR UPDATE", user.ID); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	// 初回ライドかどうかは同時に作られたライドと取り合うので、押さえられたものだけを初回とする
+	firstRide := rideCount == 1 && claimFirstRide(user.ID, rideID)
+	defer releaseFirstRide(user.ID, rideID)
+
+	var couponCode string
+	reserved, ok, known := reserveLedgerCoupon(user.ID, rideID, firstRide)
+	recordCacheLookup(ctx, "coupon_ledger", known)
+	if known {
+		if ok {
+			couponCode = reserved.Code
+			// コミットまで進めば release は何もしない
+			defer releaseLedgerCoupon(user.ID, couponCode, rideID)
+
+			result, err := tx.ExecContext(
+				ctx,
+				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ? AND used_by IS NULL",
+				rideID, user.ID, couponCode,
+			)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			} else if n == 0 {
+				writeError(w, http.StatusConflict, errors.New("coupon already used"))
+				return
+			}
 		}
 	} else {
-		var couponCode string
-		// 初回利用で、初回利用クーポンがあれば必ず使う
-		if rideCount == 1 && len(coupon) > 0 {
-			for _, c := range coupon {
-				if c.Code == "CP_NEW2024" {
+		var coupon []Coupon
+		// クーポンを全て取得
+		if err := tx.SelectContext(ctx, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at FOR UPDATE", user.ID); err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				writeError(w, http.StatusInternalServerError, err)
+				return
+			}
+		} else {
+			// 初回利用で、初回利用クーポンがあれば必ず使う
+			if firstRide && len(coupon) > 0 {
+				for _, c := range coupon {
+					if c.Code == "CP_NEW2024" {
+						couponCode = c.Code
+						break
+					}
+				}
+			}
+			// 無ければ他のクーポンを付与された順番に使う
+			if couponCode == "" {
+				for _, c := range coupon {
 					couponCode = c.Code
 					break
 				}
 			}
-		}
-		// 無ければ他のクーポンを付与された順番に使う
-		if couponCode == "" {
-			for _, c := range coupon {
-				couponCode = c.Code
-				break
-			}
-		}
 
-		if couponCode != "" {
-			if _, err := tx.ExecContext(
-				ctx,
-				"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
-				rideID, user.ID, couponCode,
-			); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
+			if couponCode != "" {
+				if _, err := tx.ExecContext(
+					ctx,
+					"UPDATE coupons SET used_by = ? WHERE user_id = ? AND code = ?",
+					rideID, user.ID, couponCode,
+				); err != nil {
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
 			}
 		}
 	}
 	// if rideCount == 1 {
 	// 	// 初回利用で、初回利用クーポンがあれば必ず使う
-	// 	if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
+	// 	if err := tx.GetContext(ctx, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL FOR UPDATE", user.ID); err != nil {
 	// 		if !errors.Is(err, sql.ErrNoRows) {
 	// 			writeError(w, http.StatusInternalServerError, err)
 	// 			return
 	// 		}
 
 	// 		// 無ければ他のクーポンを付与された順番に使う
-	// 		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+	// 		if err := tx.GetContext(ctx, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
 	// 			if !errors.Is(err, sql.ErrNoRows) {
 	// 				writeError(w, http.StatusInternalServerError, err)
 	// 				return
@@ -491,7 +598,7 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	// 	}
 	// } else {
 	// 	// 他のクーポンを付与された順番に使う
-	// 	if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
+	// 	if err := tx.GetContext(ctx, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1 FOR UPDATE", user.ID); err != nil {
 	// 		if !errors.Is(err, sql.ErrNoRows) {
 	// 			writeError(w, http.StatusInternalServerError, err)
 	// 			return
@@ -509,12 +616,12 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 	// }
 
 	ride := Ride{}
-	if err := tx.GetContext(ctx, &ride, "SELECT * FROM rides WHERE id = ?", rideID); err != nil {
+	if err := getRideContext(ctx, tx, &ride, "SELECT "+rideColumns+" FROM rides WHERE id = ?", rideID); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, &ride, *req.PickupCoordinate, *req.DestinationCoordinate)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -525,9 +632,20 @@ func appPostRides(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	cacheRideStatuses(currentCaches(), matchingStatus)
+	recordRideCreated(rideID, time.Now())
+	usersWithRide.Set(user.ID, struct{}{})
+	rideUsers.Set(rideID, user.ID)
+	if couponCode != "" {
+		commitLedgerCoupon(user.ID, couponCode, rideID)
+	}
+	publishRideEvent(rideEvent{Type: rideEventCreated, RideID: rideID, Status: matchingStatus.Status})
+	go claimEstimateHold(context.Background(), user.ID, &ride)
+
 	writeJSON(w, http.StatusAccepted, &appPostRidesResponse{
-		RideID: rideID,
-		Fare:   fare,
+		RideID:        rideID,
+		Fare:          fare,
+		FareBreakdown: newFareBreakdown(&ride, fare),
 	})
 }
 
@@ -545,7 +663,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &appPostRidesEstimatedFareRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
 	if req.PickupCoordinate == nil || req.DestinationCoordinate == nil {
@@ -562,7 +680,7 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude)
+	discounted, err := calculateDiscountedFare(ctx, tx, user.ID, nil, *req.PickupCoordinate, *req.DestinationCoordinate)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -572,17 +690,36 @@ func appPostRidesEstimatedFare(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	holdChairForEstimate(user.ID, *req.PickupCoordinate)
 
 	writeJSON(w, http.StatusOK, &appPostRidesEstimatedFareResponse{
 		Fare:     discounted,
-		Discount: calculateFare(req.PickupCoordinate.Latitude, req.PickupCoordinate.Longitude, req.DestinationCoordinate.Latitude, req.DestinationCoordinate.Longitude) - discounted,
+		Discount: calculateFare(*req.PickupCoordinate, *req.DestinationCoordinate) - discounted,
 	})
 }
 
-// マンハッタン距離を求める
-func calculateDistance(aLatitude, aLongitude, bLatitude, bLongitude int) int {
-	return abs(aLatitude-bLatitude) + abs(aLongitude-bLongitude)
+// ベンチマーカーは同じ乗車地と目的地の組を繰り返し使うので、運賃計算用の距離は覚えておく。0 なら無効
+var routeDistanceCacheSize = getEnvInt("ISUCON_ROUTE_DISTANCE_CACHE_SIZE", 4096)
+
+type routeKey struct {
+	Pickup, Destination Coordinate
+}
+
+var routeDistanceCache = newLRUCache[routeKey, int](routeDistanceCacheSize)
+
+func calculateRouteDistance(pickup, destination Coordinate) int {
+	if routeDistanceCacheSize <= 0 {
+		return pickup.DistanceTo(destination)
+	}
+	key := routeKey{pickup, destination}
+	if d, ok := routeDistanceCache.Get(key); ok {
+		return d
+	}
+	d := pickup.DistanceTo(destination)
+	routeDistanceCache.Set(key, d)
+	return d
 }
+
 func abs(a int) int {
 	if a < 0 {
 		return -a
@@ -598,131 +735,196 @@ type appPostRideEvaluationResponse struct {
 	CompletedAt int64 `json:"completed_at"`
 }
 
+// 評価は 1〜5 の整数だけ受け付ける。範囲外の値が椅子やオーナーの平均評価に混ざらないようにする
+const (
+	minEvaluation = 1
+	maxEvaluation = 5
+)
+
+type invalidEvaluationError struct {
+	Evaluation int
+}
+
+func (e *invalidEvaluationError) Error() string {
+	return fmt.Sprintf("evaluation must be between %d and %d: %d", minEvaluation, maxEvaluation, e.Evaluation)
+}
+
+var errRideAlreadyEvaluated = errors.New("ride has already been evaluated")
+
+// 完了済みのライドはキャッシュに運賃が載っているので、トランザクションを張る前に二重送信を弾ける
+func isRideEvaluated(rideID string) bool {
+	_, ok := completedRideFareCache.Get(rideID)
+	return ok
+}
+
 func appPostRideEvaluatation(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	rideID := r.PathValue("ride_id")
 
 	req := &appPostRideEvaluationRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
-	if req.Evaluation < 1 || req.Evaluation > 5 {
-		writeError(w, http.StatusBadRequest, errors.New("evaluation must be between 1 and 5"))
+	if req.Evaluation < minEvaluation || req.Evaluation > maxEvaluation {
+		writeError(w, http.StatusBadRequest, &invalidEvaluationError{Evaluation: req.Evaluation})
 		return
 	}
-
-	tx, err := db.Beginx()
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	if isRideEvaluated(rideID) {
+		metricCounter("ride_evaluation_duplicates_total").Inc()
+		writeError(w, http.StatusConflict, errRideAlreadyEvaluated)
 		return
 	}
-	defer tx.Rollback()
-
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, errors.New("ride not found"))
-			return
-		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	status, err := getLatestRideStatus(ctx, tx, ride.ID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
+	// 評価で決済が積まれるので、drain 中は受け付けない
+	release, ok := beginPaymentWrite()
+	if !ok {
+		metricCounter("ride_evaluation_drain_rejected_total").Inc()
+		writeError(w, http.StatusServiceUnavailable, errDraining)
 		return
 	}
+	defer release()
 
-	if status != "ARRIVED" {
-		writeError(w, http.StatusBadRequest, errors.New("not arrived yet"))
-		return
-	}
+	var (
+		ride              *Ride
+		completedStatus   RideStatus
+		ownerID           string
+		paymentToken      *PaymentToken
+		fare              int
+		paymentGatewayURL string
+	)
+	defer locks.ForRide(rideID)()
+	err := withTx(ctx, func(tx *sqlx.Tx) error {
+		ride = &Ride{}
+		// 同時に送られた評価が両方とも ARRIVED を見て完了させないよう、ライドの行をロックする
+		if err := getRideContext(ctx, tx, ride, `SELECT `+rideColumns+` FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return &statusError{http.StatusNotFound, errors.New("ride not found")}
+			}
+			return err
+		}
+		if ride.Evaluation != nil {
+			return &statusError{http.StatusConflict, errRideAlreadyEvaluated}
+		}
+		status, err := getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			return err
+		}
 
-	result, err := tx.ExecContext(
-		ctx,
-		`UPDATE rides SET evaluation = ? WHERE id = ?`,
-		req.Evaluation, rideID)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	if count, err := result.RowsAffected(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	} else if count == 0 {
-		writeError(w, http.StatusNotFound, errors.New("ride not found"))
-		return
-	}
+		if status == RideStateCompleted {
+			return &statusError{http.StatusConflict, errRideAlreadyEvaluated}
+		}
+		if status != RideStateArrived {
+			return &statusError{http.StatusBadRequest, errors.New("not arrived yet")}
+		}
 
-	_, err = tx.ExecContext(
-		ctx,
-		`INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)`,
-		ulid.Make().String(), rideID, "COMPLETED")
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
+		result, err := tx.ExecContext(
+			ctx,
+			`UPDATE rides SET evaluation = ? WHERE id = ? AND evaluation IS NULL`,
+			req.Evaluation, rideID)
+		if err != nil {
+			return err
+		}
+		if count, err := result.RowsAffected(); err != nil {
+			return err
+		} else if count == 0 {
+			return &statusError{http.StatusConflict, errRideAlreadyEvaluated}
+		}
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE id = ?`, rideID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusNotFound, errors.New("ride not found"))
-			return
+		completedStatus, err = insertRideStatus(ctx, tx, rideID, RideStateCompleted)
+		if err != nil {
+			return err
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
 
-	paymentToken := &PaymentToken{}
-	if err := tx.GetContext(ctx, paymentToken, `SELECT * FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeError(w, http.StatusBadRequest, errors.New("payment token not registered"))
-			return
+		if err := getRideContext(ctx, tx, ride, `SELECT `+rideColumns+` FROM rides WHERE id = ?`, rideID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return &statusError{http.StatusNotFound, errors.New("ride not found")}
+			}
+			return err
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
 
-	fare, err := calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
-	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
-	paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
-		Amount: fare,
-	}
+		if ownerID, err = getChairOwnerID(ctx, tx, ride.ChairID.String); err != nil {
+			return err
+		}
 
-	var paymentGatewayURL string
-	if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
-	}
+		paymentToken = &PaymentToken{}
+		if err := tx.GetContext(ctx, paymentToken, `SELECT `+paymentTokenColumns+` FROM payment_tokens WHERE user_id = ?`, ride.UserID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return &statusError{http.StatusBadRequest, errors.New("payment token not registered")}
+			}
+			return err
+		}
 
-	if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID); err != nil {
-			return nil, err
+		fare, err = calculateDiscountedFare(ctx, tx, ride.UserID, ride, ride.Pickup(), ride.Destination())
+		if err != nil {
+			return err
 		}
-		return rides, nil
-	}); err != nil {
-		if errors.Is(err, erroredUpstream) {
-			writeError(w, http.StatusBadGateway, err)
-			return
+
+		if err := tx.GetContext(ctx, &paymentGatewayURL, "SELECT value FROM settings WHERE name = 'payment_gateway_url'"); err != nil {
+			return err
 		}
-		writeError(w, http.StatusInternalServerError, err)
+		if asyncPayments.Enabled() {
+			return nil
+		}
+		// 最後に置くので、デッドロックでやり直すのはコミットが失敗したときだけ
+		// そのときの二重の決済は、決済サービスの件数の確認 (requestPaymentGatewayPostPayment) で気付ける
+		paymentGatewayRequest := &paymentGatewayPostPaymentRequest{
+			Amount: fare,
+		}
+		if err := requestPaymentGatewayPostPayment(ctx, paymentGatewayURL, paymentToken.Token, paymentGatewayRequest, func() ([]Ride, error) {
+			return selectRidesContext(ctx, tx, `SELECT `+rideColumns+` FROM rides WHERE user_id = ? ORDER BY created_at ASC`, ride.UserID)
+		}); err != nil {
+			if errors.Is(err, erroredUpstream) {
+				return &statusError{http.StatusBadGateway, err}
+			}
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		writeTxError(w, err)
 		return
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	cacheRideStatuses(currentCaches(), completedStatus)
+	publishStatusEvents(ride.ChairID.String, completedStatus)
+	completedFare := rideFare{Sale: calculateSale(*ride), Charged: fare}
+	completedRideFareCache.Set(ride.ID, completedFare)
+	addUserCompletedRide(currentCaches(), ride.UserID, completedFare)
+	addChairCompletedRide(currentCaches(), ride.ChairID.String, calculateSale(*ride), req.Evaluation)
+	addChairRideHistory(currentCaches(), ride.ChairID.String, ride, completedFare, req.Evaluation)
+	addOwnerEvaluation(currentCaches(), ownerID, req.Evaluation)
+	addOwnerSale(currentCaches(), ownerID, calculateSale(*ride), completedStatus.CreatedAt)
+	if asyncPayments.Enabled() {
+		// 決済に失敗すると上の集計から取り消すので、積み終えてから渡す
+		enqueuePayment(paymentJob{
+			RideID:        ride.ID,
+			UserID:        ride.UserID,
+			RideCreatedAt: ride.CreatedAt,
+			Token:         paymentToken.Token,
+			GatewayURL:    paymentGatewayURL,
+			Amount:        fare,
+			OwnerID:       ownerID,
+			ChairID:       ride.ChairID.String,
+			Sale:          calculateSale(*ride),
+			CompletedAt:   completedStatus.CreatedAt,
+		})
+	} else {
+		settlePayment(ride.ID, ridePaymentResult{Amount: fare, Succeeded: true, CompletedAt: time.Now()})
 	}
+	chairNotifier.Notify(ride.ChairID.String)
+	// コミット済みなので、ここで失敗しても評価は成功として返す。クライアントにやり直させない
+	completePendingDeactivation(context.WithoutCancel(ctx), ride.ChairID.String)
 
 	writeJSON(w, http.StatusOK, &appPostRideEvaluationResponse{
-		CompletedAt: ride.UpdatedAt.UnixMilli(),
+		CompletedAt: epochMilli(ride.UpdatedAt),
 	})
 }
 
+const (
+	appNotificationRetryAfterMs = 30
+	appNotificationMaxWait      = 30 * time.Second
+)
+
 type appGetNotificationResponse struct {
 	Data         *appGetNotificationResponseData `json:"data"`
 	RetryAfterMs int                             `json:"retry_after_ms"`
@@ -733,8 +935,12 @@ type appGetNotificationResponseData struct {
 	PickupCoordinate      Coordinate                       `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate                       `json:"destination_coordinate"`
 	Fare                  int                              `json:"fare"`
-	Status                string                           `json:"status"`
+	Status                RideState                        `json:"status"`
 	Chair                 *appGetNotificationResponseChair `json:"chair,omitempty"`
+	EstimatedPickupSecs   *int                             `json:"estimated_pickup_seconds,omitempty"`
+	EstimatedArrivalSecs  *int                             `json:"estimated_arrival_seconds,omitempty"`
+	QueuePosition         *int                             `json:"queue_position,omitempty"`
+	EstimatedWaitSecs     *int                             `json:"estimated_wait_seconds,omitempty"`
 	CreatedAt             int64                            `json:"created_at"`
 	UpdateAt              int64                            `json:"updated_at"`
 }
@@ -751,175 +957,151 @@ type appGetNotificationResponseChairStats struct {
 	TotalEvaluationAvg float64 `json:"total_evaluation_avg"`
 }
 
+// wait クエリ (秒) を指定すると、新しいイベントが来るかタイムアウトするまでレスポンスを保留する
 func appGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value("user").(*User)
 
-	tx, err := db.Beginx()
+	wait, err := parseNotificationWait(r, appNotificationMaxWait)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	seen := appNotifier.Version(user.ID)
+	res, fresh, err := buildAppNotification(ctx, user)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
-	defer tx.Rollback()
+	if fresh || wait == 0 {
+		writeAppNotification(w, res)
+		return
+	}
 
-	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, user.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &appGetNotificationResponse{
-				RetryAfterMs: 30,
-			})
-			return
-		}
+	// 以降の組み立てはワーカーに任せ、結果が来るのを待つ
+	res, ok, err := appNotifier.longPoll(ctx, user.ID, user, seen, res, wait)
+	if !ok {
+		return
+	}
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	writeAppNotification(w, res)
+}
 
-	yetSentRideStatus := RideStatus{}
-	status := ""
-	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
+// res が nil ならまだライドが無い
+func writeAppNotification(w http.ResponseWriter, res *appGetNotificationResponse) {
+	if res == nil {
+		writeRawJSON(w, http.StatusOK, appEmptyNotification)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 未送信のステータスがあれば fresh = true を返し、そのステータスを送信済みにする
+// 一度もライドを作っていなければ、DB を見ずに nil を返す
+func buildAppNotification(ctx context.Context, user *User) (*appGetNotificationResponse, bool, error) {
+	if _, ok := usersWithRide.Get(user.ID); !ok {
+		return nil, false, nil
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	target, err := getAppNotificationTarget(ctx, tx, user.ID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			status, err = getLatestRideStatus(ctx, tx, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			return nil, false, nil
 		}
-	} else {
+		return nil, false, err
+	}
+	ride, yetSentRideStatus, status := target.Ride, target.Unsent, target.Latest
+	if yetSentRideStatus != nil {
 		status = yetSentRideStatus.Status
 	}
+	rideUsers.Set(ride.ID, user.ID)
 
-	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	fare, err := calculateDiscountedFare(ctx, tx, user.ID, ride, ride.Pickup(), ride.Destination())
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
+	}
+
+	view, err := getRideView(ctx, tx, ride)
+	if err != nil {
+		return nil, false, err
 	}
 
 	response := &appGetNotificationResponse{
 		Data: &appGetNotificationResponseData{
-			RideID: ride.ID,
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Fare:      fare,
-			Status:    status,
-			CreatedAt: ride.CreatedAt.UnixMilli(),
-			UpdateAt:  ride.UpdatedAt.UnixMilli(),
+			RideID:                ride.ID,
+			PickupCoordinate:      view.PickupCoordinate(),
+			DestinationCoordinate: view.DestinationCoordinate(),
+			Fare:                  fare,
+			Status:                status,
+			CreatedAt:             epochMilli(ride.CreatedAt),
+			UpdateAt:              epochMilli(ride.UpdatedAt),
 		},
-		RetryAfterMs: 30,
+		RetryAfterMs: appNotificationRetryAfterMs,
 	}
 
-	if ride.ChairID.Valid {
-		chair := &Chair{}
-		if err := tx.GetContext(ctx, chair, `SELECT * FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		stats, err := getChairStats(ctx, tx, chair.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
+	if view.Chair != nil {
 		response.Data.Chair = &appGetNotificationResponseChair{
-			ID:    chair.ID,
-			Name:  chair.Name,
-			Model: chair.Model,
-			Stats: stats,
-		}
-	}
-
-	if yetSentRideStatus.ID != "" {
-		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET app_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+			ID:    view.Chair.ID,
+			Name:  view.Chair.Name,
+			Model: view.Chair.Model,
+			Stats: getChairStats(view.Chair.ID),
 		}
+		response.Data.EstimatedPickupSecs, response.Data.EstimatedArrivalSecs = view.ETA(status)
+	} else if status == RideStateMatching {
+		response.Data.QueuePosition, response.Data.EstimatedWaitSecs = matchingQueuePosition(ride.ID)
 	}
 
 	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
-	writeJSON(w, http.StatusOK, response)
-}
-
-var rideEvalCache = NewCache[string, int]()
-
-func getChairStats(ctx context.Context, tx *sqlx.Tx, chairID string) (appGetNotificationResponseChairStats, error) {
-	stats := appGetNotificationResponseChairStats{}
-
-	rides := []Ride{}
-	err := tx.SelectContext(
-		ctx,
-		&rides,
-		`SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC`,
-		chairID,
-	)
-	if err != nil {
-		return stats, err
+	if yetSentRideStatus != nil {
+		enqueueStamp(sentAtApp, yetSentRideStatus)
+	}
+	if view.Chair != nil {
+		recordAppNotified(ride.ID)
 	}
 
-	totalRideCount := 0
-	totalEvaluation := 0.0
-	for _, ride := range rides {
-		if eval, ok := rideEvalCache.Get(ride.ID); ok {
-			totalRideCount++
-			totalEvaluation += float64(eval)
-			continue
-		}
-
-		rideStatuses := []RideStatus{}
-		err = tx.SelectContext(
-			ctx,
-			&rideStatuses,
-			`SELECT * FROM ride_statuses WHERE ride_id = ? ORDER BY created_at`,
-			ride.ID,
-		)
-		if err != nil {
-			return stats, err
-		}
+	return response, yetSentRideStatus != nil, nil
+}
 
-		var arrivedAt, pickupedAt *time.Time
-		var isCompleted bool
-		for _, status := range rideStatuses {
-			if status.Status == "ARRIVED" {
-				arrivedAt = &status.CreatedAt
-			} else if status.Status == "CARRYING" {
-				pickupedAt = &status.CreatedAt
-			}
-			if status.Status == "COMPLETED" {
-				isCompleted = true
-			}
-		}
-		if arrivedAt == nil || pickupedAt == nil {
-			continue
-		}
-		if !isCompleted {
-			continue
-		}
+// ライドに割り当てられた椅子の情報。割り当て時に載せておき、通知で JOIN しないで済むようにする
+type rideChairSummary struct {
+	ID      string
+	OwnerID string
+	Name    string
+	Model   string
+}
 
-		rideEvalCache.Set(ride.ID, *ride.Evaluation)
+var rideChairCache = NewCache[string, rideChairSummary]().withBudget("ride_chairs", cacheBudgetMB("ride_chairs", 64), func(k string, v rideChairSummary) int {
+	return 64 + len(k) + len(v.ID) + len(v.OwnerID) + len(v.Name) + len(v.Model)
+})
 
-		totalRideCount++
-		totalEvaluation += float64(*ride.Evaluation)
-	}
+func cacheRideChair(s *cacheSet, rideID string, chair *Chair) rideChairSummary {
+	summary := rideChairSummary{ID: chair.ID, OwnerID: chair.OwnerID, Name: chair.Name, Model: chair.Model}
+	rideChairCache.in(s).Set(rideID, summary)
+	chairsWithRide.in(s).Set(chair.ID, struct{}{})
+	return summary
+}
 
-	stats.TotalRidesCount = totalRideCount
-	if totalRideCount > 0 {
-		stats.TotalEvaluationAvg = totalEvaluation / float64(totalRideCount)
+func getChairStats(chairID string) appGetNotificationResponseChairStats {
+	stats := appGetNotificationResponseChairStats{}
+	cached, _ := chairRideStatsCache.Get(chairID)
+	stats.TotalRidesCount = cached.CompletedRides
+	if cached.CompletedRides > 0 {
+		stats.TotalEvaluationAvg = float64(cached.EvaluationSum) / float64(cached.CompletedRides)
 	}
-
-	return stats, nil
+	return stats
 }
 
 type appGetNearbyChairsResponse struct {
@@ -974,12 +1156,7 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	chairs := []Chair{}
-	err = tx.SelectContext(
-		ctx,
-		&chairs,
-		`SELECT * FROM chairs`,
-	)
+	chairs, err := selectChairsContext(ctx, tx, `SELECT `+chairColumns+` FROM chairs`)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
@@ -991,8 +1168,8 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		rides := []*Ride{}
-		if err := tx.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id = ? ORDER BY created_at DESC`, chair.ID); err != nil {
+		rides, err := selectRidesContext(ctx, tx, `SELECT `+rideColumns+` FROM rides WHERE chair_id = ? ORDER BY created_at DESC`, chair.ID)
+		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -1017,7 +1194,7 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 			// 	return
 			// }
 			status := statuses[ride.ID]
-			if status != "COMPLETED" {
+			if status != RideStateCompleted {
 				skip = true
 				break
 			}
@@ -1028,19 +1205,17 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 
 		// 最新の位置情報を取得
 		loc, ok := chairPositionCache.Get(chair.ID)
+		recordCacheLookup(ctx, "chair_positions", ok)
 		if !ok {
 			// use zero value?
 		}
 
-		if calculateDistance(coordinate.Latitude, coordinate.Longitude, loc.LastLat, loc.LastLong) <= distance {
+		if coordinate.DistanceTo(loc.Position()) <= distance {
 			nearbyChairs = append(nearbyChairs, appGetNearbyChairsResponseChair{
-				ID:    chair.ID,
-				Name:  chair.Name,
-				Model: chair.Model,
-				CurrentCoordinate: Coordinate{
-					Latitude:  loc.LastLat,
-					Longitude: loc.LastLong,
-				},
+				ID:                chair.ID,
+				Name:              chair.Name,
+				Model:             chair.Model,
+				CurrentCoordinate: loc.Position(),
 			})
 		}
 	}
@@ -1058,41 +1233,111 @@ func appGetNearbyChairs(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, &appGetNearbyChairsResponse{
 		Chairs:      nearbyChairs,
-		RetrievedAt: retrievedAt.UnixMilli(),
+		RetrievedAt: epochMilli(*retrievedAt),
+	})
+}
+
+type appGetChairModelsResponse struct {
+	Models []appGetChairModelsResponseModel `json:"models"`
+}
+
+type appGetChairModelsResponseModel struct {
+	Name  string `json:"name"`
+	Speed int    `json:"speed"`
+}
+
+// 椅子のモデルと速さの一覧。速い順 (同じなら名前順) に並べる
+func appGetChairModels(w http.ResponseWriter, r *http.Request) {
+	models := chairModelSpeedCache.Snapshot()
+	res := appGetChairModelsResponse{Models: make([]appGetChairModelsResponseModel, 0, len(models))}
+	for name, speed := range models {
+		res.Models = append(res.Models, appGetChairModelsResponseModel{Name: name, Speed: speed})
+	}
+	sort.Slice(res.Models, func(i, j int) bool {
+		if res.Models[i].Speed != res.Models[j].Speed {
+			return res.Models[i].Speed > res.Models[j].Speed
+		}
+		return res.Models[i].Name < res.Models[j].Name
 	})
+	writeJSON(w, http.StatusOK, res)
 }
 
-func calculateFare(pickupLatitude, pickupLongitude, destLatitude, destLongitude int) int {
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+func calculateFare(pickup, destination Coordinate) int {
+	meteredFare := farePerDistance * calculateRouteDistance(pickup, destination)
 	return initialFare + meteredFare
 }
 
-func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickupLatitude, pickupLongitude, destLatitude, destLongitude int) (int, error) {
+// 運賃の内訳。割引は距離料金にだけかかる
+type fareBreakdown struct {
+	InitialFare int `json:"initial_fare"`
+	MeteredFare int `json:"metered_fare"`
+	Discount    int `json:"discount"`
+	Total       int `json:"total"`
+}
+
+// calculateDiscountedFare で出した割引後の運賃から内訳を組み立てる
+func newFareBreakdown(ride *Ride, total int) fareBreakdown {
+	metered := farePerDistance * calculateRouteDistance(ride.Pickup(), ride.Destination())
+	return fareBreakdown{
+		InitialFare: initialFare,
+		MeteredFare: metered,
+		Discount:    initialFare + metered - total,
+		Total:       total,
+	}
+}
+
+type rideFare struct {
+	Sale    int // 割引前の運賃。売上の集計に使う
+	Charged int // 実際に決済した金額
+}
+
+// 完了したライドの運賃。決済時に確定した金額をそのまま使い回す
+// 予算を超えると捨てられるので、無いときは運賃を計算し直す
+var completedRideFareCache = NewCache[string, rideFare]().withBudget("ride_fares", cacheBudgetMB("ride_fares", 64), func(k string, _ rideFare) int {
+	return 64 + len(k)
+})
+
+func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ride *Ride, pickup, destination Coordinate) (int, error) {
 	var coupon Coupon
 	discount := 0
 	if ride != nil {
-		destLatitude = ride.DestinationLatitude
-		destLongitude = ride.DestinationLongitude
-		pickupLatitude = ride.PickupLatitude
-		pickupLongitude = ride.PickupLongitude
+		fare, ok := completedRideFareCache.Get(ride.ID)
+		recordCacheLookup(ctx, "ride_fares", ok)
+		if ok {
+			verifyCacheRead(ctx, "ride_fares", ride.ID, fare.Charged, func() (int, error) {
+				var discount int
+				err := tx.GetContext(ctx, &discount, "SELECT IFNULL(MAX(discount), 0) FROM coupons WHERE used_by = ?", ride.ID)
+				metered := farePerDistance * ride.Pickup().DistanceTo(ride.Destination())
+				return initialFare + max(metered-discount, 0), err
+			})
+			return fare.Charged, nil
+		}
+
+		pickup, destination = ride.Pickup(), ride.Destination()
 
 		// すでにクーポンが紐づいているならそれの割引額を参照
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE used_by = ?", ride.ID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE used_by = ?", ride.ID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
 				return 0, err
 			}
 		} else {
 			discount = coupon.Discount
 		}
+	} else if c, ok, known := nextLedgerCoupon(userID); known {
+		recordCacheLookup(ctx, "coupon_ledger", true)
+		if ok {
+			discount = c.Discount
+		}
 	} else {
+		recordCacheLookup(ctx, "coupon_ledger", false)
 		// 初回利用クーポンを最優先で使う
-		if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
+		if err := tx.GetContext(ctx, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE user_id = ? AND code = 'CP_NEW2024' AND used_by IS NULL", userID); err != nil {
 			if !errors.Is(err, sql.ErrNoRows) {
 				return 0, err
 			}
 
 			// 無いなら他のクーポンを付与された順番に使う
-			if err := tx.GetContext(ctx, &coupon, "SELECT * FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
+			if err := tx.GetContext(ctx, &coupon, "SELECT "+couponColumns+" FROM coupons WHERE user_id = ? AND used_by IS NULL ORDER BY created_at LIMIT 1", userID); err != nil {
 				if !errors.Is(err, sql.ErrNoRows) {
 					return 0, err
 				}
@@ -1104,8 +1349,43 @@ func calculateDiscountedFare(ctx context.Context, tx *sqlx.Tx, userID string, ri
 		}
 	}
 
-	meteredFare := farePerDistance * calculateDistance(pickupLatitude, pickupLongitude, destLatitude, destLongitude)
+	meteredFare := farePerDistance * calculateRouteDistance(pickup, destination)
 	discountedMeteredFare := max(meteredFare-discount, 0)
 
 	return initialFare + discountedMeteredFare, nil
 }
+
+type userRideStats struct {
+	TotalRides    int
+	TotalSpend    int
+	TotalDiscount int
+}
+
+// ユーザーごとの完了ライドの集計。評価 (完了) 時に積み上げる
+var userRideStatsCache = NewCache[string, userRideStats]()
+
+func addUserCompletedRide(s *cacheSet, userID string, fare rideFare) {
+	userRideStatsCache.in(s).Update(userID, func(stats userRideStats, _ bool) userRideStats {
+		stats.TotalRides++
+		stats.TotalSpend += fare.Charged
+		stats.TotalDiscount += fare.Sale - fare.Charged
+		return stats
+	})
+}
+
+type appGetStatsResponse struct {
+	TotalRides    int `json:"total_rides"`
+	TotalSpend    int `json:"total_spend"`
+	TotalDiscount int `json:"total_discount"`
+}
+
+func appGetStats(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value("user").(*User)
+
+	stats, _ := userRideStatsCache.Get(user.ID)
+	writeJSON(w, http.StatusOK, appGetStatsResponse{
+		TotalRides:    stats.TotalRides,
+		TotalSpend:    stats.TotalSpend,
+		TotalDiscount: stats.TotalDiscount,
+	})
+}
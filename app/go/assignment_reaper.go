@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 割り当てからこの時間内に ENROUTE が来なければライドを待ち行列に戻す。0 なら無効
+var assignmentAckTimeout = time.Duration(getEnvInt("ISUCON_ASSIGNMENT_ACK_TIMEOUT_SECONDS", 30)) * time.Second
+
+// 割り当てを受けなかった椅子をマッチングから外しておく時間
+var chairPenaltyDuration = time.Duration(getEnvInt("ISUCON_CHAIR_PENALTY_SECONDS", 60)) * time.Second
+
+// ENROUTE を待っている割り当て
+var awaitingAckCache = NewCache[string, rideAssignment]()
+
+// 椅子ID → マッチングに戻してよい時刻
+var chairPenaltyBox = NewCache[string, time.Time]()
+
+func isChairPenalized(chairID string, now time.Time) bool {
+	until, ok := chairPenaltyBox.Get(chairID)
+	return ok && now.Before(until)
+}
+
+func runAssignmentReaper() {
+	if assignmentAckTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		pruneChairPenaltyBox(now)
+		for rideID, a := range awaitingAckCache.Snapshot() {
+			if now.Sub(a.AssignedAt) < assignmentAckTimeout {
+				continue
+			}
+			if err := reapAssignment(context.Background(), rideID, a, now); err != nil {
+				slog.Error("failed to reap assignment", "ride_id", rideID, "chair_id", a.ChairID, "err", err)
+			}
+		}
+	}
+}
+
+// 期限の過ぎた椅子を消す。消さないと一度でも回収された椅子が initialize まで残り続ける
+func pruneChairPenaltyBox(now time.Time) {
+	for chairID := range chairPenaltyBox.Snapshot() {
+		chairPenaltyBox.DeleteIf(chairID, func(until time.Time) bool {
+			return !now.Before(until)
+		})
+	}
+}
+
+// ENROUTE が来ないまま時間切れになった割り当てを外し、椅子はしばらくペナルティボックスに入れる
+func reapAssignment(ctx context.Context, rideID string, a rideAssignment, now time.Time) error {
+	defer locks.ForRide(rideID)()
+	released := false
+	var matching RideStatus
+	err := withTx(ctx, func(tx *sqlx.Tx) error {
+		released = false
+		var chairID sql.NullString
+		if err := tx.GetContext(ctx, &chairID, `SELECT chair_id FROM rides WHERE id = ? FOR UPDATE`, rideID); err != nil {
+			return err
+		}
+		if chairID.String != a.ChairID {
+			return nil
+		}
+		// コミット直後でキャッシュに載っていない ENROUTE を見落とさないよう DB を見る
+		if err := tx.GetContext(ctx, &matching, `SELECT id, ride_id, status FROM ride_statuses WHERE ride_id = ? ORDER BY seq DESC LIMIT 1`, rideID); err != nil {
+			return err
+		}
+		if matching.Status != RideStateMatching {
+			return nil
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE rides SET chair_id = NULL WHERE id = ?`, rideID); err != nil {
+			return err
+		}
+		// 次の椅子にも MATCHING を通知するので、前の椅子に送った印を消す
+		// stamper は割り当てから ENROUTE の待ち時間より十分前に書き終えているので、後から上書きされることはない
+		if _, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = NULL WHERE id = ?`, matching.ID); err != nil {
+			return err
+		}
+		released = true
+		return nil
+	})
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	awaitingAckCache.Delete(rideID)
+	if !released {
+		return nil
+	}
+
+	releaseAssignment(rideID, a.ChairID, matching.ID, now)
+	metricCounter("assignment_timeouts_total").Inc()
+	slog.Warn("assignment timed out; ride returned to pending",
+		"ride_id", rideID,
+		"chair_id", a.ChairID,
+		"assigned_at", a.AssignedAt,
+	)
+	publishRideEvent(rideEvent{Type: rideEventUnassigned, RideID: rideID, ChairID: a.ChairID})
+	chairNotifier.Notify(a.ChairID)
+	return nil
+}
+
+// DB で割り当てを外した後に、キャッシュをライドが待ち行列にいる状態に戻す
+func releaseAssignment(rideID, chairID, matchingStatusID string, now time.Time) {
+	rideChairCache.Delete(rideID)
+	rideAssignmentCache.Delete(rideID)
+	if current, _ := chairCurrentRideCache.Get(chairID); current == rideID {
+		chairCurrentRideCache.Delete(chairID)
+	}
+	chairSentStatusCache.Delete(matchingStatusID)
+	recordRideUnassigned(rideID)
+	chairPenaltyBox.Set(chairID, now.Add(chairPenaltyDuration))
+}
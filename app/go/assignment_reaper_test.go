@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPruneChairPenaltyBox(t *testing.T) {
+	useFreshCaches(t)
+	now := time.Now()
+	chairPenaltyBox.Set("expired", now.Add(-time.Second))
+	chairPenaltyBox.Set("boundary", now)
+	chairPenaltyBox.Set("penalized", now.Add(time.Second))
+
+	pruneChairPenaltyBox(now)
+
+	for _, chairID := range []string{"expired", "boundary"} {
+		if _, ok := chairPenaltyBox.Get(chairID); ok {
+			t.Errorf("%s: expired penalty was not pruned", chairID)
+		}
+	}
+	if !isChairPenalized("penalized", now) {
+		t.Error("penalty still in effect was pruned")
+	}
+}
+
+func TestReleaseAssignment(t *testing.T) {
+	useFreshCaches(t)
+	const rideID, chairID = "ride", "chair"
+	createdAt := time.Now().Add(-time.Minute)
+	now := time.Now()
+	matching := RideStatus{ID: "status-matching", RideID: rideID, Status: RideStateMatching}
+
+	recordRideCreated(rideID, createdAt)
+	recordRideAssigned(rideID, createdAt.Add(time.Second))
+	recordChairNotified(rideID)
+	cacheRideChair(currentCaches(), rideID, &Chair{ID: chairID})
+	rideAssignmentCache.Set(rideID, rideAssignment{ChairID: chairID, AssignedAt: createdAt.Add(time.Second)})
+	chairCurrentRideCache.Set(chairID, rideID)
+	enqueueStamp(sentAtChair, &matching)
+	<-stampQueue
+	stampPending.Add(-1)
+
+	releaseAssignment(rideID, chairID, matching.ID, now)
+
+	if _, ok := rideChairCache.Get(rideID); ok {
+		t.Error("ride still has the released chair")
+	}
+	if _, ok := rideAssignmentCache.Get(rideID); ok {
+		t.Error("assignment was not cleared")
+	}
+	if _, ok := chairCurrentRideCache.Get(chairID); ok {
+		t.Error("released chair still points at the ride")
+	}
+	// 次の椅子に MATCHING をもう一度通知する
+	if got := firstUnsentStatus(sentAtChair, []RideStatus{matching}); got == nil || got.ID != matching.ID {
+		t.Errorf("MATCHING is still marked as sent to a chair: %v", got)
+	}
+	if v, ok := rideLatencyCache.Get(rideID); !ok || !v.CreatedAt.Equal(createdAt) || !v.AssignedAt.IsZero() || v.ChairNotified {
+		t.Errorf("ride latency was not reset to pending: %+v, %v", v, ok)
+	}
+	if !isChairPenalized(chairID, now) {
+		t.Error("released chair is not penalized")
+	}
+}
+
+func TestReleaseAssignmentKeepsChairsNextRide(t *testing.T) {
+	useFreshCaches(t)
+	chairCurrentRideCache.Set("chair", "next-ride")
+
+	releaseAssignment("ride", "chair", "status-matching", time.Now())
+
+	if current, _ := chairCurrentRideCache.Get("chair"); current != "next-ride" {
+		t.Errorf("chair's current ride = %q, want next-ride", current)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+)
+
+// セッション cookie のアクセストークンから、認証済みのユーザー・オーナー・椅子を引くためのキャッシュ
+// 3 種類で 1 つを共有し、cookie 名で区別する
+type authTokenKey struct {
+	Cookie string
+	Token  string
+}
+
+var authTokenCache = NewCache[authTokenKey, any]()
+
+// cookie 名やクエリだけが違う認証ミドルウェアを 1 つにまとめたもの
+type tokenAuthenticator[T any] struct {
+	Cookie string
+	// 認証したエンティティを context に載せるキー
+	ContextKey string
+	// access_token で 1 件引く。無ければ sql.ErrNoRows
+	Get       func(ctx context.Context, dest *T, accessToken string) error
+	ID        func(*T) string
+	RateLimit rateLimitClass
+}
+
+var (
+	appAuthMiddleware = newTokenAuthMiddleware(tokenAuthenticator[User]{
+		Cookie:     "app_session",
+		ContextKey: "user",
+		Get: func(ctx context.Context, u *User, accessToken string) error {
+			return db.GetContext(ctx, u, "SELECT "+userColumns+" FROM users WHERE access_token = ?", accessToken)
+		},
+		ID:        func(u *User) string { return u.ID },
+		RateLimit: rateLimitApp,
+	})
+	ownerAuthMiddleware = newTokenAuthMiddleware(tokenAuthenticator[Owner]{
+		Cookie:     "owner_session",
+		ContextKey: "owner",
+		Get: func(ctx context.Context, o *Owner, accessToken string) error {
+			return db.GetContext(ctx, o, "SELECT "+ownerColumns+" FROM owners WHERE access_token = ?", accessToken)
+		},
+		ID:        func(o *Owner) string { return o.ID },
+		RateLimit: rateLimitOwner,
+	})
+	chairAuthMiddleware = newTokenAuthMiddleware(tokenAuthenticator[Chair]{
+		Cookie:     "chair_session",
+		ContextKey: "chair",
+		Get: func(ctx context.Context, c *Chair, accessToken string) error {
+			return getChairContext(ctx, db, c, "SELECT "+chairColumns+" FROM chairs WHERE access_token = ?", accessToken)
+		},
+		ID:        func(c *Chair) string { return c.ID },
+		RateLimit: rateLimitChair,
+	})
+)
+
+func cacheAuthToken[T any](s *cacheSet, cookie, token string, v *T) {
+	authTokenCache.in(s).Set(authTokenKey{Cookie: cookie, Token: token}, v)
+}
+
+func newTokenAuthMiddleware[T any](a tokenAuthenticator[T]) func(http.Handler) http.Handler {
+	cacheName := a.Cookie + "_tokens"
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			c, err := r.Cookie(a.Cookie)
+			if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
+				writeError(w, http.StatusUnauthorized, errors.New(a.Cookie+" cookie is required"))
+				return
+			}
+			accessToken := c.Value
+			key := authTokenKey{Cookie: a.Cookie, Token: accessToken}
+
+			cached, ok := authTokenCache.Get(key)
+			recordCacheLookup(ctx, cacheName, ok)
+			var entity *T
+			if ok {
+				entity = cached.(*T)
+				verifyCacheRead(ctx, cacheName, a.ID(entity), a.ID(entity), func() (string, error) {
+					fresh := new(T)
+					err := a.Get(ctx, fresh, accessToken)
+					return a.ID(fresh), err
+				})
+			} else {
+				entity = new(T)
+				if err := a.Get(ctx, entity, accessToken); err != nil {
+					if errors.Is(err, sql.ErrNoRows) {
+						writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+						return
+					}
+					writeError(w, http.StatusInternalServerError, err)
+					return
+				}
+				authTokenCache.Set(key, entity)
+			}
+			if !allowRequest(w, r, a.RateLimit, accessToken) {
+				return
+			}
+
+			ctx = context.WithValue(ctx, a.ContextKey, entity)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bench-warm: 本番のベンチマーク前にローカルのインスタンスへ合成トラフィックを流し、マッチング・キャッシュ・ワーカーを一通り動かす
+// 公式ベンチマーカー無しで競合を再現するためのもので、シナリオの正しさは検証しない
+var (
+	benchWarmTarget   = getEnvString("ISUCON_BENCH_WARM_TARGET", "http://127.0.0.1:8080")
+	benchWarmDuration = time.Duration(getEnvInt("ISUCON_BENCH_WARM_SECONDS", 30)) * time.Second
+	benchWarmUsers    = getEnvInt("ISUCON_BENCH_WARM_USERS", 20)
+	benchWarmChairs   = getEnvInt("ISUCON_BENCH_WARM_CHAIRS", 20)
+	// 2-master-data.sql に入っているモデル
+	benchWarmModels = strings.Split(getEnvString("ISUCON_BENCH_WARM_MODELS", "リラックスシート NEO,エアシェル ライト,チェアエース S,スピンフレーム 01"), ",")
+)
+
+type benchWarmClient struct {
+	http *http.Client
+	name string
+}
+
+func newBenchWarmClient(name string) *benchWarmClient {
+	jar, _ := cookiejar.New(nil)
+	return &benchWarmClient{http: &http.Client{Jar: jar, Timeout: 40 * time.Second}, name: name}
+}
+
+var benchWarmRequests, benchWarmFailures atomic.Int64
+
+// body が nil でなければ JSON で送り、out が nil でなければレスポンスを読み込む
+func (c *benchWarmClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, benchWarmTarget+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	benchWarmRequests.Add(1)
+	res, err := c.http.Do(req)
+	if err != nil {
+		benchWarmFailures.Add(1)
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 400 {
+		benchWarmFailures.Add(1)
+		b, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s %s: %d %s", method, path, res.StatusCode, bytes.TrimSpace(b))
+	}
+	if out == nil || res.StatusCode == http.StatusNoContent {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func randomBenchWarmCoordinate() Coordinate {
+	return Coordinate{Latitude: rand.IntN(100) - 50, Longitude: rand.IntN(100) - 50}
+}
+
+func runBenchWarm() error {
+	ctx, cancel := context.WithTimeout(context.Background(), benchWarmDuration)
+	defer cancel()
+
+	owner := newBenchWarmClient("owner")
+	ownerRes := &ownerPostOwnersResponse{}
+	if err := owner.do(ctx, http.MethodPost, "/api/owner/owners", ownerPostOwnersRequest{Name: fmt.Sprintf("bench-warm-%d", time.Now().UnixNano())}, ownerRes); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for i := range benchWarmChairs {
+		chair := newBenchWarmClient(fmt.Sprintf("chair-%d", i))
+		req := chairPostChairsRequest{
+			Name:               chair.name,
+			Model:              benchWarmModels[i%len(benchWarmModels)],
+			ChairRegisterToken: ownerRes.ChairRegisterToken,
+		}
+		if err := chair.do(ctx, http.MethodPost, "/api/chair/chairs", req, nil); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runBenchWarmChair(ctx, chair)
+		}()
+	}
+	for i := range benchWarmUsers {
+		user := newBenchWarmClient(fmt.Sprintf("user-%d", i))
+		req := appPostUsersRequest{
+			Username:    fmt.Sprintf("bench-warm-%d-%d", time.Now().UnixNano(), i),
+			FirstName:   "Bench",
+			LastName:    "Warm",
+			DateOfBirth: "2000-01-01",
+		}
+		if err := user.do(ctx, http.MethodPost, "/api/app/users", req, nil); err != nil {
+			return err
+		}
+		if err := user.do(ctx, http.MethodPost, "/api/app/payment-methods", appPostPaymentMethodsRequest{Token: "bench-warm"}, nil); err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runBenchWarmUser(ctx, user)
+		}()
+	}
+	// 本番ではインスタンス内から叩かれているマッチングも回す
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		matcher := newBenchWarmClient("matcher")
+		for ctx.Err() == nil {
+			matcher.do(ctx, http.MethodGet, "/api/internal/matching", nil, nil)
+			time.Sleep(200 * time.Millisecond)
+		}
+	}()
+	wg.Wait()
+
+	slog.Info("bench-warm done", "requests", benchWarmRequests.Load(), "failures", benchWarmFailures.Load())
+	return nil
+}
+
+// 通知を受けたら座標を瞬間移動させながらライドを進める
+func runBenchWarmChair(ctx context.Context, c *benchWarmClient) {
+	if err := c.do(ctx, http.MethodPost, "/api/chair/activity", postChairActivityRequest{IsActive: true}, nil); err != nil {
+		slog.Warn("bench-warm chair activity failed", "chair", c.name, "err", err)
+		return
+	}
+	c.do(ctx, http.MethodPost, "/api/chair/coordinate", randomBenchWarmCoordinate(), nil)
+	for ctx.Err() == nil {
+		res := &chairGetNotificationResponse{}
+		if err := c.do(ctx, http.MethodGet, "/api/chair/notification?wait=5", nil, res); err != nil {
+			time.Sleep(500 * time.Millisecond)
+			continue
+		}
+		if res.Data == nil {
+			continue
+		}
+		path := "/api/chair/rides/" + res.Data.RideID + "/status"
+		switch res.Data.Status {
+		case RideStateMatching:
+			c.do(ctx, http.MethodPost, path, postChairRidesRideIDStatusRequest{Status: RideStateEnroute}, nil)
+			c.do(ctx, http.MethodPost, "/api/chair/coordinate", res.Data.PickupCoordinate, nil)
+		case RideStatePickup:
+			c.do(ctx, http.MethodPost, path, postChairRidesRideIDStatusRequest{Status: RideStateCarrying}, nil)
+			c.do(ctx, http.MethodPost, "/api/chair/coordinate", res.Data.DestinationCoordinate, nil)
+		}
+	}
+}
+
+// ライドを作り、到着したら評価して次のライドを作る
+func runBenchWarmUser(ctx context.Context, c *benchWarmClient) {
+	for ctx.Err() == nil {
+		req := appPostRidesRequest{}
+		pickup, dest := randomBenchWarmCoordinate(), randomBenchWarmCoordinate()
+		req.PickupCoordinate, req.DestinationCoordinate = &pickup, &dest
+		c.do(ctx, http.MethodPost, "/api/app/rides/estimated-fare", req, nil)
+		ride := &appPostRidesResponse{}
+		if err := c.do(ctx, http.MethodPost, "/api/app/rides", req, ride); err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		for ctx.Err() == nil {
+			res := &appGetNotificationResponse{}
+			if err := c.do(ctx, http.MethodGet, "/api/app/notification", nil, res); err == nil && res.Data != nil && res.Data.RideID == ride.RideID && res.Data.Status == RideStateArrived {
+				c.do(ctx, http.MethodPost, "/api/app/rides/"+ride.RideID+"/evaluation", appPostRideEvaluationRequest{Evaluation: 1 + rand.IntN(5)}, nil)
+				break
+			}
+			time.Sleep(time.Duration(max(appNotificationRetryAfterMs, 100)) * time.Millisecond)
+		}
+		c.do(ctx, http.MethodGet, "/api/app/rides", nil, nil)
+	}
+}
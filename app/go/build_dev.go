@@ -0,0 +1,33 @@
+//go:build !competition
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"golang.org/x/net/websocket"
+)
+
+// 開発用のビルド。本番では `go build -tags competition` で以下を外す
+const competitionBuild = false
+
+// リクエストごとのアクセスログ
+func devMiddlewares() []func(http.Handler) http.Handler {
+	return []func(http.Handler) http.Handler{middleware.Logger}
+}
+
+// デバッグ・検証・シミュレーション用のエンドポイント
+func mountDevRoutes(mux chi.Router) {
+	mux.HandleFunc("POST /api/internal/matching/dry-run", internalPostMatchingDryRun)
+	mux.HandleFunc("GET /api/internal/rides/{ride_id}/trace", internalGetRideTrace)
+	mux.HandleFunc("GET /api/internal/sse/events", internalGetSSEEvents)
+	mux.HandleFunc("GET /api/internal/verify/chair-locations", internalGetChairLocationCheck)
+	mux.HandleFunc("GET /api/internal/report", internalGetReport)
+	mux.Handle("GET /api/internal/ws/events", websocket.Server{
+		Handler: internalWsEvents,
+		// デバッグ用なので Origin は見ない
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+	})
+}
@@ -1,35 +1,210 @@
 package main
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
-type cache[K comparable, V any] struct {
+// キャッシュの中身。initialize では全キャッシュの中身を新しく作ってから cacheSet ごと差し替える
+type cacheData[K comparable, V any] struct {
 	sync.RWMutex
 	items map[K]V
+	// 以下は予算を設定したキャッシュだけが持つ
+	// 最後に触った時刻 (UnixNano)。Get は読み込みロックのまま書き換えるので atomic にする
+	lastUsed map[K]*atomic.Int64
+	sizeOf   func(K, V) int
+	// sizeOf の合計。書き込みのたびに足し引きする
+	size atomic.Int64
+}
+
+// グローバルに置くキャッシュは今の cacheSet の中身を見る。in で作ったものは特定の cacheSet の中身に固定される
+type cache[K comparable, V any] struct {
+	slot int
+	// 予算を設定したキャッシュだけ持つ
+	sizeOf func(K, V) int
+	data   *cacheData[K, V]
+}
+
+// 全キャッシュの中身の組。liveCaches を差し替えると、全キャッシュが一度に新しい中身を見るようになる
+type cacheSet struct {
+	caches []any
 }
 
+var (
+	// NewCache した順。cacheSet の中の位置になる
+	cacheSlots []func() any
+	// 起動時の cacheSet。パッケージの初期化中に NewCache のたびに伸びる
+	bootCaches = &cacheSet{}
+	liveCaches atomic.Pointer[cacheSet]
+)
+
+func init() {
+	liveCaches.Store(bootCaches)
+}
+
+func currentCaches() *cacheSet {
+	return liveCaches.Load()
+}
+
+// パッケージの初期化時 (グローバル変数) にだけ呼ぶ
 func NewCache[K comparable, V any]() *cache[K, V] {
-	m := make(map[K]V)
-	c := &cache[K, V]{
-		items: m,
-	}
+	c := &cache[K, V]{slot: len(cacheSlots)}
+	cacheSlots = append(cacheSlots, func() any { return c.bind() })
+	bootCaches.caches = append(bootCaches.caches, c.bind())
 	return c
 }
 
+func (c *cache[K, V]) bind() *cache[K, V] {
+	d := &cacheData[K, V]{items: make(map[K]V), sizeOf: c.sizeOf}
+	if c.sizeOf != nil {
+		d.lastUsed = make(map[K]*atomic.Int64)
+	}
+	return &cache[K, V]{slot: c.slot, sizeOf: c.sizeOf, data: d}
+}
+
+// 中身が空の cacheSet。作り終えてから liveCaches に入れる
+func newCacheSet() *cacheSet {
+	s := &cacheSet{caches: make([]any, len(cacheSlots))}
+	for i, f := range cacheSlots {
+		s.caches[i] = f()
+	}
+	return s
+}
+
+// s の中身を見るキャッシュ。s が今の cacheSet でなくてもよい
+func (c *cache[K, V]) in(s *cacheSet) *cache[K, V] {
+	return s.caches[c.slot].(*cache[K, V])
+}
+
+func (c *cache[K, V]) d() *cacheData[K, V] {
+	if c.data != nil {
+		return c.data
+	}
+	return c.in(liveCaches.Load()).data
+}
+
 func (c *cache[K, V]) Set(key K, value V) {
-	c.Lock()
-	c.items[key] = value
-	c.Unlock()
+	d := c.d()
+	d.Lock()
+	d.put(key, value)
+	d.Unlock()
 }
 
 func (c *cache[K, V]) Get(key K) (V, bool) {
-	c.RLock()
-	v, found := c.items[key]
-	c.RUnlock()
+	d := c.d()
+	d.RLock()
+	v, found := d.items[key]
+	if found && d.lastUsed != nil {
+		d.lastUsed[key].Store(time.Now().UnixNano())
+	}
+	d.RUnlock()
 	return v, found
 }
 
-func (c *cache[K, V]) Init() {
-	c.Lock()
-	c.items = make(map[K]V)
-	c.Unlock()
+// 以下は書き込みロックを持って呼ぶ
+func (d *cacheData[K, V]) put(key K, value V) {
+	if d.sizeOf == nil {
+		d.items[key] = value
+		return
+	}
+	if old, found := d.items[key]; found {
+		d.size.Add(-int64(d.sizeOf(key, old)))
+	}
+	d.size.Add(int64(d.sizeOf(key, value)))
+	d.items[key] = value
+	t, ok := d.lastUsed[key]
+	if !ok {
+		t = new(atomic.Int64)
+		d.lastUsed[key] = t
+	}
+	t.Store(time.Now().UnixNano())
+}
+
+func (d *cacheData[K, V]) remove(key K) {
+	old, found := d.items[key]
+	if !found {
+		return
+	}
+	delete(d.items, key)
+	if d.sizeOf != nil {
+		d.size.Add(-int64(d.sizeOf(key, old)))
+		delete(d.lastUsed, key)
+	}
+}
+
+// ロックを取ったまま読み込みと書き込みを行う
+func (c *cache[K, V]) Update(key K, f func(v V, found bool) V) V {
+	d := c.d()
+	d.Lock()
+	v, found := d.items[key]
+	v = f(v, found)
+	d.put(key, v)
+	d.Unlock()
+	return v
+}
+
+// キーがあるときだけ更新する。更新したかを返す
+func (c *cache[K, V]) UpdateIfPresent(key K, f func(v V) V) bool {
+	d := c.d()
+	d.Lock()
+	defer d.Unlock()
+	v, found := d.items[key]
+	if !found {
+		return false
+	}
+	d.put(key, f(v))
+	return true
+}
+
+// キーがあり f が true を返したときだけ消す
+func (c *cache[K, V]) DeleteIf(key K, f func(v V) bool) {
+	d := c.d()
+	d.Lock()
+	defer d.Unlock()
+	if v, found := d.items[key]; found && f(v) {
+		d.remove(key)
+	}
+}
+
+func (c *cache[K, V]) Delete(key K) {
+	d := c.d()
+	d.Lock()
+	d.remove(key)
+	d.Unlock()
+}
+
+// 中身のコピーを返す
+func (c *cache[K, V]) Snapshot() map[K]V {
+	d := c.d()
+	d.RLock()
+	m := make(map[K]V, len(d.items))
+	for k, v := range d.items {
+		m[k] = v
+	}
+	d.RUnlock()
+	return m
+}
+
+// 中身を m で置き換える。m はそのまま使うので呼び出し後に触らないこと
+func (c *cache[K, V]) Restore(m map[K]V) {
+	if m == nil {
+		m = make(map[K]V)
+	}
+	d := c.d()
+	d.Lock()
+	d.items = m
+	if d.sizeOf != nil {
+		now := time.Now().UnixNano()
+		var size int64
+		d.lastUsed = make(map[K]*atomic.Int64, len(m))
+		for k, v := range m {
+			t := new(atomic.Int64)
+			t.Store(now)
+			d.lastUsed[k] = t
+			size += int64(d.sizeOf(k, v))
+		}
+		d.size.Store(size)
+	}
+	d.Unlock()
 }
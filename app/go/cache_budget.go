@@ -0,0 +1,107 @@
+package main
+
+import (
+	"log/slog"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MySQL から引き直せるキャッシュにだけ予算を付け、超えたら最近触っていないものから捨てる
+// 大きさは要素ごとのおおよそのバイト数を足し合わせたもので、Go のヒープ使用量とは一致しない
+type budgetedCache interface {
+	bytes() int64
+	evictTo(target int64) int
+}
+
+type cacheBudget struct {
+	name     string
+	maxBytes int64
+	cache    budgetedCache
+}
+
+var cacheBudgets []cacheBudget
+
+var cacheBudgetSweepInterval = newReloadable(time.Duration(getEnvInt("ISUCON_CACHE_BUDGET_SWEEP_SECONDS", 5)) * time.Second)
+
+// maxMB が 0 なら予算を付けない。起動時 (キャッシュを使い始める前) に呼ぶ
+func (c *cache[K, V]) withBudget(name string, maxMB int, sizeOf func(K, V) int) *cache[K, V] {
+	if maxMB <= 0 {
+		return c
+	}
+	c.sizeOf = sizeOf
+	boot := c.in(bootCaches)
+	boot.sizeOf = sizeOf
+	boot.data.sizeOf = sizeOf
+	boot.data.lastUsed = make(map[K]*atomic.Int64)
+	cacheBudgets = append(cacheBudgets, cacheBudget{
+		name:     name,
+		maxBytes: int64(maxMB) << 20,
+		cache:    &sizedCache[K, V]{cache: c},
+	})
+	return c
+}
+
+func cacheBudgetMB(name string, def int) int {
+	return getEnvInt("ISUCON_CACHE_BUDGET_"+strings.ToUpper(name)+"_MB", def)
+}
+
+type sizedCache[K comparable, V any] struct {
+	cache *cache[K, V]
+}
+
+func (s *sizedCache[K, V]) bytes() int64 {
+	return s.cache.d().size.Load()
+}
+
+// 最後に触った時刻の古い順に捨て、target 以下にする。捨てた件数を返す
+func (s *sizedCache[K, V]) evictTo(target int64) int {
+	c := s.cache.d()
+	c.Lock()
+	defer c.Unlock()
+	type entry struct {
+		key      K
+		lastUsed int64
+	}
+	entries := make([]entry, 0, len(c.items))
+	for k := range c.items {
+		entries = append(entries, entry{key: k, lastUsed: c.lastUsed[k].Load()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].lastUsed < entries[j].lastUsed
+	})
+	evicted := 0
+	for _, e := range entries {
+		if c.size.Load() <= target {
+			break
+		}
+		c.remove(e.key)
+		evicted++
+	}
+	return evicted
+}
+
+func runCacheBudgetSweeper() {
+	if len(cacheBudgets) == 0 {
+		return
+	}
+	for {
+		time.Sleep(cacheBudgetSweepInterval.Load())
+		sweepCacheBudgets()
+	}
+}
+
+func sweepCacheBudgets() {
+	for _, b := range cacheBudgets {
+		used := b.cache.bytes()
+		if used > b.maxBytes {
+			// 毎回境界で捨て続けないよう、予算の 8 割まで減らす
+			evicted := b.cache.evictTo(b.maxBytes * 8 / 10)
+			metricCounter(metricName("cache_evictions_total", "cache", b.name)).Add(int64(evicted))
+			slog.Info("cache over budget; evicted least recently used entries", "cache", b.name, "bytes", used, "budget", b.maxBytes, "evicted", evicted)
+			used = b.cache.bytes()
+		}
+		metricGauge(metricName("cache_bytes", "cache", b.name)).Set(used)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+var testSwapCache = NewCache[string, int]()
+
+func TestCacheSetSwap(t *testing.T) {
+	prev := currentCaches()
+	t.Cleanup(func() { liveCaches.Store(prev) })
+
+	testSwapCache.Set("a", 1)
+	next := newCacheSet()
+	testSwapCache.in(next).Set("b", 2)
+
+	// 作っている間は前の中身が見え続ける
+	if _, ok := testSwapCache.Get("b"); ok {
+		t.Fatal("entry built into the next cache set is visible before swap")
+	}
+	if v, ok := testSwapCache.Get("a"); !ok || v != 1 {
+		t.Fatalf("live entry lost before swap: %v, %v", v, ok)
+	}
+
+	liveCaches.Store(next)
+	if _, ok := testSwapCache.Get("a"); ok {
+		t.Fatal("entry from the previous cache set survived swap")
+	}
+	if v, ok := testSwapCache.Get("b"); !ok || v != 2 {
+		t.Fatalf("entry built into the next cache set is missing after swap: %v, %v", v, ok)
+	}
+	// 差し替え前に取ったものは前の中身に書き込み、新しい中身には混ざらない
+	testSwapCache.in(prev).Set("c", 3)
+	if _, ok := testSwapCache.Get("c"); ok {
+		t.Fatal("write to the previous cache set leaked into the live one")
+	}
+}
+
+func TestCacheSetKeepsBudget(t *testing.T) {
+	next := newCacheSet()
+	if (rideStatusCache.sizeOf != nil) != (rideStatusCache.in(next).data.lastUsed != nil) {
+		t.Fatal("budgeted cache lost last-used tracking in a new cache set")
+	}
+}
+
+var testBudgetCache = NewCache[string, string]().withBudget("test", 1, func(k, v string) int {
+	return len(k) + len(v)
+})
+
+func TestCacheBudgetSize(t *testing.T) {
+	c := testBudgetCache.in(newCacheSet())
+	sized := &sizedCache[string, string]{cache: c}
+
+	c.Set("a", "xx")
+	c.Set("b", "yyyy")
+	c.Update("a", func(string, bool) string { return "x" })
+	c.UpdateIfPresent("b", func(v string) string { return v + "z" })
+	c.Delete("missing")
+	if got, want := sized.bytes(), int64(len("a")+len("x")+len("b")+len("yyyyz")); got != want {
+		t.Fatalf("bytes() = %d, want %d", got, want)
+	}
+	c.DeleteIf("a", func(string) bool { return true })
+	if got, want := sized.bytes(), int64(len("b")+len("yyyyz")); got != want {
+		t.Fatalf("bytes() after delete = %d, want %d", got, want)
+	}
+	c.Restore(map[string]string{"c": "1", "d": "22"})
+	if got, want := sized.bytes(), int64(5); got != want {
+		t.Fatalf("bytes() after restore = %d, want %d", got, want)
+	}
+}
+
+func TestCacheBudgetEvictsLeastRecentlyUsed(t *testing.T) {
+	c := testBudgetCache.in(newCacheSet())
+	sized := &sizedCache[string, string]{cache: c}
+
+	c.Set("a", "1")
+	c.Set("b", "1")
+	c.Set("c", "1")
+	// Get でも最後に触った時刻が進む
+	c.data.lastUsed["a"].Store(0)
+	c.data.lastUsed["b"].Store(0)
+	c.Get("a")
+
+	if evicted := sized.evictTo(4); evicted != 1 {
+		t.Fatalf("evicted %d entries, want 1", evicted)
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("least recently used entry survived eviction")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("entry touched by Get was evicted")
+	}
+	if got := sized.bytes(); got != 4 {
+		t.Fatalf("bytes() after eviction = %d, want 4", got)
+	}
+}
+
+func TestCacheBudgetConcurrentGet(t *testing.T) {
+	c := testBudgetCache.in(newCacheSet())
+	c.Set("a", "1")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				c.Get("a")
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range 1000 {
+			c.Set("b", "2")
+			c.Delete("b")
+		}
+	}()
+	wg.Wait()
+	if got := (&sizedCache[string, string]{cache: c}).bytes(); got != 2 {
+		t.Fatalf("bytes() = %d, want 2", got)
+	}
+}
+
+// テストの間だけ空の cacheSet に差し替える
+func useFreshCaches(t testing.TB) *cacheSet {
+	t.Helper()
+	prev := currentCaches()
+	t.Cleanup(func() { liveCaches.Store(prev) })
+	s := newCacheSet()
+	liveCaches.Store(s)
+	return s
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// 椅子の時計はサーバーとずれていることがあるので、位置情報やステータスの時刻は全てサーバー側で決める
+// (位置情報は nextChairLocationTime、ステータスは insertRideStatus と seq)
+// 椅子がリクエストに Date ヘッダーを付けてきたら、ずれを測って記録だけする。並び順には使わない
+// ずれがこれ (ms) を超えた椅子はログに出す。0 なら測らない
+var chairClockSkewLogThreshold = time.Duration(getEnvInt("ISUCON_CHAIR_CLOCK_SKEW_LOG_MS", 2000)) * time.Millisecond
+
+// Date ヘッダーは秒単位なので、1 秒未満のずれは測れない
+var chairClockSkewBucketsMs = []int64{1000, 2000, 5000, 10000, 60000, 300000}
+
+// ログに出した椅子。同じ椅子のずれを毎リクエスト出さないよう initialize まで覚えておく
+var chairClockSkewLogged = NewCache[string, struct{}]()
+
+func observeChairClockSkew(r *http.Request, chairID string, serverTime time.Time) {
+	if chairClockSkewLogThreshold <= 0 {
+		return
+	}
+	v := r.Header.Get("Date")
+	if v == "" {
+		return
+	}
+	clientTime, err := http.ParseTime(v)
+	if err != nil {
+		metricCounter(metricName("chair_clock_skew_total", "result", "unparsable")).Inc()
+		return
+	}
+	skew := clientTime.Sub(serverTime.Truncate(time.Second))
+	metricHistogram("chair_clock_skew_ms", chairClockSkewBucketsMs).Observe(skew.Abs().Milliseconds())
+	if skew.Abs() <= chairClockSkewLogThreshold {
+		metricCounter(metricName("chair_clock_skew_total", "result", "ok")).Inc()
+		return
+	}
+	metricCounter(metricName("chair_clock_skew_total", "result", "exceeded")).Inc()
+	if _, ok := chairClockSkewLogged.Get(chairID); ok {
+		return
+	}
+	chairClockSkewLogged.Set(chairID, struct{}{})
+	slog.Warn("chair clock skew exceeded threshold",
+		"chair_id", chairID,
+		"skew", skew.Round(time.Millisecond),
+		"client_time", clientTime,
+		"route", routeFromContext(r.Context()),
+	)
+}
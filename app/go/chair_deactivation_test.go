@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const setChairActiveQuery = "UPDATE chairs SET is_active"
+
+// chair-1 の最新のライドが status の状態にある DB。status が空ならライドが無い
+func fakeChairRideDB(status RideState) *fakeDB {
+	f := &fakeDB{}
+	columns := strings.Split(rideColumns, ", ")
+	if status == "" {
+		f.on("FROM rides WHERE chair_id = ?", columns)
+		return f
+	}
+	now := time.Now()
+	f.on("FROM rides WHERE chair_id = ?", columns,
+		[]driver.Value{"ride-1", "user-1", "chair-1", int64(0), int64(0), int64(10), int64(10), nil, now, now})
+	f.on("SELECT status FROM ride_statuses", []string{"status"}, []driver.Value{string(status)})
+	return f
+}
+
+func postChairActivity(t *testing.T, isActive bool) {
+	t.Helper()
+	body := `{"is_active":false}`
+	if isActive {
+		body = `{"is_active":true}`
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/chair/activity", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(context.WithValue(req.Context(), "chair", &Chair{ID: "chair-1", AccessToken: "token", IsActive: true}))
+	rec := httptest.NewRecorder()
+	chairPostActivity(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusNoContent, rec.Body)
+	}
+}
+
+func TestChairDeactivationDuringCarrying(t *testing.T) {
+	useFreshCaches(t)
+	f := fakeChairRideDB(RideStateCarrying)
+	useFakeDB(t, f)
+	chairActiveCache.Set("chair-1", true)
+
+	postChairActivity(t, false)
+
+	// 走行中のライドは最後まで担当させる
+	if n := f.count(setChairActiveQuery); n != 0 {
+		t.Fatalf("chair was deactivated in the DB during CARRYING (%d updates)", n)
+	}
+	if active, _ := chairActiveCache.Get("chair-1"); !active {
+		t.Fatal("chair was marked inactive in the cache during CARRYING")
+	}
+	if _, ok := chairDeactivationPending.Get("chair-1"); !ok {
+		t.Fatal("deactivation was not deferred")
+	}
+
+	// 次のマッチングには出さない
+	before := f.count("")
+	fastMatchChair(context.Background(), "chair-1")
+	if n := f.count(""); n != before {
+		t.Fatalf("fast matching looked at a chair pending deactivation (%d queries)", n-before)
+	}
+
+	// ライドが完了したら落とす
+	if err := applyPendingDeactivation(context.Background(), "chair-1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(setChairActiveQuery); n != 1 {
+		t.Fatalf("chair was deactivated %d times on completion, want 1", n)
+	}
+	if active, ok := chairActiveCache.Get("chair-1"); !ok || active {
+		t.Fatal("chair is still active in the cache after completion")
+	}
+	if _, ok := chairDeactivationPending.Get("chair-1"); ok {
+		t.Fatal("pending deactivation was left after completion")
+	}
+
+	// 次の完了では何もしない
+	if err := applyPendingDeactivation(context.Background(), "chair-1"); err != nil {
+		t.Fatal(err)
+	}
+	if n := f.count(setChairActiveQuery); n != 1 {
+		t.Fatalf("chair was deactivated %d times, want 1", n)
+	}
+}
+
+func TestChairDeactivationWithoutRide(t *testing.T) {
+	for _, status := range []RideState{"", RideStateCompleted} {
+		name := string(status)
+		if name == "" {
+			name = "NO_RIDE"
+		}
+		t.Run(name, func(t *testing.T) {
+			useFreshCaches(t)
+			f := fakeChairRideDB(status)
+			useFakeDB(t, f)
+
+			postChairActivity(t, false)
+
+			if n := f.count(setChairActiveQuery); n != 1 {
+				t.Fatalf("chair was deactivated %d times, want 1", n)
+			}
+			if active, ok := chairActiveCache.Get("chair-1"); !ok || active {
+				t.Fatal("chair is still active in the cache")
+			}
+			if _, ok := chairDeactivationPending.Get("chair-1"); ok {
+				t.Fatal("deactivation was deferred although no ride is in flight")
+			}
+		})
+	}
+}
+
+// 完了前にアクティブに戻したら、保留していた非アクティブ化は取り消す
+func TestChairReactivationCancelsPendingDeactivation(t *testing.T) {
+	useFreshCaches(t)
+	f := fakeChairRideDB(RideStateCarrying)
+	useFakeDB(t, f)
+
+	postChairActivity(t, false)
+	postChairActivity(t, true)
+	if _, ok := chairDeactivationPending.Get("chair-1"); ok {
+		t.Fatal("pending deactivation survived reactivation")
+	}
+
+	if err := applyPendingDeactivation(context.Background(), "chair-1"); err != nil {
+		t.Fatal(err)
+	}
+	if active, ok := chairActiveCache.Get("chair-1"); !ok || !active {
+		t.Fatal("reactivated chair was deactivated on completion")
+	}
+}
+
+// 評価のコミット後に椅子を落とせなくても評価は成功として返し、次の通知のポーリングでやり直す
+func TestRideEvaluationDeactivationFailure(t *testing.T) {
+	useFreshCaches(t)
+	now := time.Now()
+	f := fakeEvaluationDB(nil, RideStateArrived).
+		on("IFNULL(MAX(seq), 0)", []string{"seq"}, []driver.Value{int64(6)}).
+		on("FROM payment_tokens", []string{"user_id", "token", "created_at"}, []driver.Value{"user-1", "payment-token", now}).
+		on("FROM coupons WHERE used_by = ?", []string{"user_id", "code", "discount", "created_at", "used_by"}).
+		on("FROM settings", []string{"value"}, []driver.Value{"http://payment.invalid"}).
+		fail(setChairActiveQuery)
+	useFakeDB(t, f)
+	chairOwnerIndex.Set("chair-1", "owner-1")
+	chairDeactivationPending.Set("chair-1", struct{}{})
+	chairActiveCache.Set("chair-1", true)
+
+	// 決済はキューに積むだけにする
+	prevAsync, prevQueues, prevPending := asyncPayments.Enabled(), paymentQueues, paymentPending.Load()
+	asyncPayments.on.Store(true)
+	paymentQueues = []chan paymentJob{make(chan paymentJob, 1)}
+	t.Cleanup(func() {
+		asyncPayments.on.Store(prevAsync)
+		paymentQueues = prevQueues
+		paymentPending.Store(prevPending)
+	})
+
+	rec := postRideEvaluation(`{"evaluation":5}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusOK, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "completed_at") {
+		t.Fatalf("body = %s, want completed_at", rec.Body)
+	}
+	if n := f.count(setChairActiveQuery); n != 1 {
+		t.Fatalf("deactivation was tried %d times, want 1", n)
+	}
+	if _, ok := chairDeactivationRetry.Get("chair-1"); !ok {
+		t.Fatal("failed deactivation was not scheduled for retry")
+	}
+	if active, _ := chairActiveCache.Get("chair-1"); !active {
+		t.Fatal("chair was marked inactive although the update failed")
+	}
+
+	// 失敗が続く間は残しておく
+	retryPendingDeactivation(context.Background(), "chair-1")
+	if _, ok := chairDeactivationRetry.Get("chair-1"); !ok {
+		t.Fatal("retry was dropped although the update failed again")
+	}
+
+	f.clearFailures()
+	retryPendingDeactivation(context.Background(), "chair-1")
+	if n := f.count(setChairActiveQuery); n != 3 {
+		t.Fatalf("deactivation was tried %d times, want 3", n)
+	}
+	if active, ok := chairActiveCache.Get("chair-1"); !ok || active {
+		t.Fatal("chair is still active after the retry")
+	}
+	for name, c := range map[string]*cache[string, struct{}]{"pending": chairDeactivationPending, "retry": chairDeactivationRetry} {
+		if _, ok := c.Get("chair-1"); ok {
+			t.Fatalf("%s deactivation was left after the retry", name)
+		}
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/oklog/ulid/v2"
 )
 
@@ -21,11 +24,48 @@ type chairPostChairsResponse struct {
 	OwnerID string `json:"owner_id"`
 }
 
+type chairRegistrationKey struct {
+	OwnerID string
+	Name    string
+	Model   string
+}
+
+// オーナーごとの登録済み椅子 (名前とモデルの組) → 椅子ID
+var chairRegistrationIndex = NewCache[chairRegistrationKey, string]()
+
+type duplicateChairError struct {
+	Key     chairRegistrationKey
+	ChairID string
+}
+
+func (e *duplicateChairError) Error() string {
+	if e.ChairID == "" {
+		return fmt.Sprintf("chair %q (%s) is already registered", e.Key.Name, e.Key.Model)
+	}
+	return fmt.Sprintf("chair %q (%s) is already registered as %s", e.Key.Name, e.Key.Model, e.ChairID)
+}
+
+// 同じ組がまだ無ければ chairID で押さえる。DB への登録に失敗したら Delete で戻す
+func reserveChairRegistration(key chairRegistrationKey, chairID string) error {
+	var existing string
+	chairRegistrationIndex.Update(key, func(v string, found bool) string {
+		if found {
+			existing = v
+			return v
+		}
+		return chairID
+	})
+	if existing != "" {
+		return &duplicateChairError{Key: key, ChairID: existing}
+	}
+	return nil
+}
+
 func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &chairPostChairsRequest{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBindError(w, err)
 		return
 	}
 	if req.Name == "" || req.Model == "" || req.ChairRegisterToken == "" {
@@ -34,7 +74,7 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	owner := &Owner{}
-	if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
+	if err := db.GetContext(ctx, owner, "SELECT "+ownerColumns+" FROM owners WHERE chair_register_token = ?", req.ChairRegisterToken); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusUnauthorized, errors.New("invalid chair_register_token"))
 			return
@@ -46,16 +86,31 @@ func chairPostChairs(w http.ResponseWriter, r *http.Request) {
 	chairID := ulid.Make().String()
 	accessToken := secureRandomStr(32)
 
+	key := chairRegistrationKey{OwnerID: owner.ID, Name: req.Name, Model: req.Model}
+	if err := reserveChairRegistration(key, chairID); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
 	_, err := db.ExecContext(
 		ctx,
 		"INSERT INTO chairs (id, owner_id, name, model, is_active, access_token) VALUES (?, ?, ?, ?, ?, ?)",
 		chairID, owner.ID, req.Name, req.Model, false, accessToken,
 	)
 	if err != nil {
+		chairRegistrationIndex.Delete(key)
+		var mysqlErr *mysql.MySQLError
+		// 1062: Duplicate entry。キャッシュに載る前の椅子とぶつかった
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			writeError(w, http.StatusConflict, &duplicateChairError{Key: key})
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	cacheOwnerChair(currentCaches(), &Chair{ID: chairID, OwnerID: owner.ID, IsActive: false})
+
 	http.SetCookie(w, &http.Cookie{
 		Path:  "/",
 		Name:  "chair_session",
@@ -78,19 +133,92 @@ func chairPostActivity(w http.ResponseWriter, r *http.Request) {
 
 	req := &postChairActivityRequest{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBindError(w, err)
 		return
 	}
 
+	if req.IsActive {
+		chairDeactivationPending.Delete(chair.ID)
+		chairDeactivationRetry.Delete(chair.ID)
+	} else {
+		inFlight, err := chairHasInFlightRide(ctx, chair.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if inFlight {
+			// 走行中のライドは最後まで担当させ、次のマッチングからだけ外す
+			chairDeactivationPending.Set(chair.ID, struct{}{})
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
 	_, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = ? WHERE id = ?", req.IsActive, chair.ID)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	// is_active が古いまま残らないよう、次の認証で引き直させる
+	authTokenCache.Delete(authTokenKey{Cookie: "chair_session", Token: chair.AccessToken})
+	chairActiveCache.Set(chair.ID, req.IsActive)
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// 走行中に非アクティブにされた椅子。ライドが完了した時点で is_active を落とす
+var chairDeactivationPending = NewCache[string, struct{}]()
+
+func chairHasInFlightRide(ctx context.Context, chairID string) (bool, error) {
+	ride := &Ride{}
+	if err := getRideContext(ctx, db, ride, `SELECT `+rideColumns+` FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	status, err := getLatestRideStatus(ctx, db, ride.ID)
+	if err != nil {
+		return false, err
+	}
+	return status != RideStateCompleted, nil
+}
+
+func applyPendingDeactivation(ctx context.Context, chairID string) error {
+	if _, ok := chairDeactivationPending.Get(chairID); !ok {
+		return nil
+	}
+	if _, err := db.ExecContext(ctx, "UPDATE chairs SET is_active = FALSE WHERE id = ?", chairID); err != nil {
+		return err
+	}
+	chairActiveCache.Set(chairID, false)
+	chairDeactivationPending.Delete(chairID)
+	return nil
+}
+
+// ライドの完了後に is_active を落とせなかった椅子。次の通知のポーリングでやり直す
+var chairDeactivationRetry = NewCache[string, struct{}]()
+
+// ライドの完了 (コミット済み) の後に呼ぶ。評価はもう終わっているので、失敗してもエラーは返さずに後でやり直す
+func completePendingDeactivation(ctx context.Context, chairID string) {
+	if err := applyPendingDeactivation(ctx, chairID); err != nil {
+		metricCounter("chair_deactivation_retries_total").Inc()
+		slog.Warn("failed to deactivate chair after ride completion; retrying on next poll", "chair_id", chairID, "err", err)
+		chairDeactivationRetry.Set(chairID, struct{}{})
+	}
+}
+
+func retryPendingDeactivation(ctx context.Context, chairID string) {
+	if _, ok := chairDeactivationRetry.Get(chairID); !ok {
+		return
+	}
+	if err := applyPendingDeactivation(ctx, chairID); err != nil {
+		slog.Warn("failed to retry chair deactivation", "chair_id", chairID, "err", err)
+		return
+	}
+	chairDeactivationRetry.Delete(chairID)
+}
+
 type chairPostCoordinateResponse struct {
 	RecordedAt int64 `json:"recorded_at"`
 }
@@ -99,7 +227,7 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &Coordinate{}
 	if err := bindJSON(r, req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeBindError(w, err)
 		return
 	}
 
@@ -112,43 +240,58 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	chairLocationID := ulid.Make().String()
-	now := time.Now()
-	if _, err := tx.ExecContext(
-		ctx,
-		`INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES (?, ?, ?, ?, ?)`,
-		chairLocationID, chair.ID, req.Latitude, req.Longitude, now,
-	); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	// 記録時刻はアプリ側で決め、DB にも同じ時刻で書き込む
+	now := nextChairLocationTime(chair.ID)
+	observeChairClockSkew(r, chair.ID, now)
+	touchChair(currentCaches(), chair.ID, now)
+	if isDuplicateChairLocation(chair.ID, *req) {
+		metricCounter("chair_location_duplicates_total").Inc()
+	} else {
+		if err := enqueueChairLocation(ctx, ChairLocation{
+			ID:        ulid.Make().String(),
+			ChairID:   chair.ID,
+			Latitude:  req.Latitude,
+			Longitude: req.Longitude,
+			CreatedAt: now,
+		}); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
 	}
-	updateOrInsertChairLocation(chair.ID, req.Latitude, req.Longitude, now)
+	updateOrInsertChairLocation(currentCaches(), chair.ID, *req, now)
 
+	newStatuses := []RideStatus{}
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+	if err := getRideContext(ctx, tx, ride, `SELECT `+rideColumns+` FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 	} else {
+		// 読んだステータスを元に PICKUP / ARRIVED を足すので、判断からキャッシュの反映までライドを押さえる
+		defer locks.ForRide(ride.ID)()
 		status, err := getLatestRideStatus(ctx, tx, ride.ID)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "COMPLETED" && status != "CANCELED" {
-			if req.Latitude == ride.PickupLatitude && req.Longitude == ride.PickupLongitude && status == "ENROUTE" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "PICKUP"); err != nil {
+		if status != RideStateCompleted {
+			if *req == ride.Pickup() && status == RideStateEnroute {
+				rs, err := insertRideStatus(ctx, tx, ride.ID, RideStatePickup)
+				if err != nil {
 					writeError(w, http.StatusInternalServerError, err)
 					return
 				}
+				newStatuses = append(newStatuses, rs)
 			}
 
-			if req.Latitude == ride.DestinationLatitude && req.Longitude == ride.DestinationLongitude && status == "CARRYING" {
-				if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ARRIVED"); err != nil {
+			if *req == ride.Destination() && status == RideStateCarrying {
+				rs, err := insertRideStatus(ctx, tx, ride.ID, RideStateArrived)
+				if err != nil {
 					writeError(w, http.StatusInternalServerError, err)
 					return
 				}
+				newStatuses = append(newStatuses, rs)
 			}
 		}
 	}
@@ -158,8 +301,14 @@ func chairPostCoordinate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(newStatuses) > 0 {
+		cacheRideStatuses(currentCaches(), newStatuses...)
+		publishStatusEvents(chair.ID, newStatuses...)
+		chairNotifier.Notify(chair.ID)
+	}
+
 	writeJSON(w, http.StatusOK, &chairPostCoordinateResponse{
-		RecordedAt: now.UnixMilli(),
+		RecordedAt: epochMilli(now),
 	})
 }
 
@@ -178,92 +327,178 @@ type chairGetNotificationResponseData struct {
 	User                  simpleUser `json:"user"`
 	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
 	DestinationCoordinate Coordinate `json:"destination_coordinate"`
-	Status                string     `json:"status"`
+	Status                RideState  `json:"status"`
 }
 
+const (
+	chairNotificationRetryAfterMs = 200
+	chairNotificationMaxWait      = 30 * time.Second
+)
+
+// wait クエリ (秒) を指定すると、新しいイベントが来るかタイムアウトするまでレスポンスを保留する
 func chairGetNotification(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	chair := ctx.Value("chair").(*Chair)
+	touchChair(currentCaches(), chair.ID, time.Now())
+	retryPendingDeactivation(ctx, chair.ID)
 
-	tx, err := db.Beginx()
+	wait, err := parseNotificationWait(r, chairNotificationMaxWait)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	seen := chairNotifier.Version(chair.ID)
+	res, fresh, err := buildChairNotification(ctx, chair)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if fresh || wait == 0 {
+		writeChairNotification(w, res)
+		return
+	}
+
+	// 以降の組み立てはワーカーに任せ、結果が来るのを待つ
+	res, ok, err := chairNotifier.longPoll(ctx, chair.ID, chair, seen, res, wait)
+	if !ok {
+		return
+	}
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	writeChairNotification(w, res)
+}
+
+// res が nil ならまだライドが割り当てられていない
+func writeChairNotification(w http.ResponseWriter, res *chairGetNotificationResponse) {
+	if res == nil {
+		writeRawJSON(w, http.StatusOK, chairEmptyNotification)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 未送信のステータスがあれば fresh = true を返し、そのステータスを送信済みにする
+// 一度もライドが割り当てられていなければ、DB を見ずに nil を返す
+func buildChairNotification(ctx context.Context, chair *Chair) (*chairGetNotificationResponse, bool, error) {
+	if _, ok := chairsWithRide.Get(chair.ID); !ok {
+		return nil, false, nil
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, false, err
+	}
 	defer tx.Rollback()
 	ride := &Ride{}
-	yetSentRideStatus := RideStatus{}
-	status := ""
+	var status RideState
 
-	if err := tx.GetContext(ctx, ride, `SELECT * FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+	if err := getRideContext(ctx, tx, ride, `SELECT `+rideColumns+` FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
-				RetryAfterMs: 200,
-			})
-			return
+			return nil, false, nil
 		}
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
-	if err := tx.GetContext(ctx, &yetSentRideStatus, `SELECT * FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY created_at ASC LIMIT 1`, ride.ID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			status, err = getLatestRideStatus(ctx, tx, ride.ID)
-			if err != nil {
-				writeError(w, http.StatusInternalServerError, err)
-				return
-			}
-		} else {
-			writeError(w, http.StatusInternalServerError, err)
-			return
+	unsentRideStatuses, err := getUnsentRideStatuses(ctx, tx, sentAtChair, ride.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	yetSentRideStatus := firstUnsentStatus(sentAtChair, unsentRideStatuses)
+	if yetSentRideStatus == nil {
+		status, err = getLatestRideStatus(ctx, tx, ride.ID)
+		if err != nil {
+			return nil, false, err
 		}
 	} else {
 		status = yetSentRideStatus.Status
 	}
 
 	user := &User{}
-	err = tx.GetContext(ctx, user, "SELECT * FROM users WHERE id = ? FOR SHARE", ride.UserID)
+	err = tx.GetContext(ctx, user, "SELECT "+userColumns+" FROM users WHERE id = ? FOR SHARE", ride.UserID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+		return nil, false, err
 	}
 
-	if yetSentRideStatus.ID != "" {
-		_, err := tx.ExecContext(ctx, `UPDATE ride_statuses SET chair_sent_at = CURRENT_TIMESTAMP(6) WHERE id = ?`, yetSentRideStatus.ID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
+	if err := tx.Commit(); err != nil {
+		return nil, false, err
 	}
 
-	if err := tx.Commit(); err != nil {
-		writeError(w, http.StatusInternalServerError, err)
-		return
+	if yetSentRideStatus != nil {
+		enqueueStamp(sentAtChair, yetSentRideStatus)
+		if yetSentRideStatus.Status == RideStateMatching {
+			recordChairNotified(ride.ID)
+		}
+		if yetSentRideStatus.Status == RideStateCompleted {
+			go fastMatchChair(context.Background(), chair.ID)
+		}
 	}
 
-	writeJSON(w, http.StatusOK, &chairGetNotificationResponse{
+	return &chairGetNotificationResponse{
 		Data: &chairGetNotificationResponseData{
 			RideID: ride.ID,
 			User: simpleUser{
 				ID:   user.ID,
 				Name: fmt.Sprintf("%s %s", user.Firstname, user.Lastname),
 			},
-			PickupCoordinate: Coordinate{
-				Latitude:  ride.PickupLatitude,
-				Longitude: ride.PickupLongitude,
-			},
-			DestinationCoordinate: Coordinate{
-				Latitude:  ride.DestinationLatitude,
-				Longitude: ride.DestinationLongitude,
-			},
-			Status: status,
+			PickupCoordinate:      ride.Pickup(),
+			DestinationCoordinate: ride.Destination(),
+			Status:                status,
 		},
-		RetryAfterMs: 200,
+		RetryAfterMs: chairNotificationRetryAfterMs,
+	}, yetSentRideStatus != nil, nil
+}
+
+type chairGetCurrentRideResponse struct {
+	RideID                string     `json:"ride_id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Status                RideState  `json:"status"`
+	CreatedAt             int64      `json:"created_at"`
+	UpdatedAt             int64      `json:"updated_at"`
+}
+
+// 椅子が今受け持っているライドを返す。完了済みか一度も割り当てられていなければ 404
+func chairGetCurrentRide(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	chair := ctx.Value("chair").(*Chair)
+
+	if _, ok := chairsWithRide.Get(chair.ID); !ok {
+		writeError(w, http.StatusNotFound, errors.New("no active ride"))
+		return
+	}
+	ride := &Ride{}
+	if err := getRideContext(ctx, db, ride, `SELECT `+rideColumns+` FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chair.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("no active ride"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := getLatestRideStatus(ctx, db, ride.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if status == RideStateCompleted {
+		writeError(w, http.StatusNotFound, errors.New("no active ride"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &chairGetCurrentRideResponse{
+		RideID:                ride.ID,
+		PickupCoordinate:      ride.Pickup(),
+		DestinationCoordinate: ride.Destination(),
+		Status:                status,
+		CreatedAt:             epochMilli(ride.CreatedAt),
+		UpdatedAt:             epochMilli(ride.UpdatedAt),
 	})
 }
 
 type postChairRidesRideIDStatusRequest struct {
-	Status string `json:"status"`
+	Status RideState `json:"status"`
 }
 
 func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
@@ -274,10 +509,12 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 
 	req := &postChairRidesRideIDStatusRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
+	observeChairClockSkew(r, chair.ID, time.Now())
 
+	defer locks.ForRide(rideID)()
 	tx, err := db.Beginx()
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -286,7 +523,7 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 	defer tx.Rollback()
 
 	ride := &Ride{}
-	if err := tx.GetContext(ctx, ride, "SELECT * FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
+	if err := getRideContext(ctx, tx, ride, "SELECT "+rideColumns+" FROM rides WHERE id = ? FOR UPDATE", rideID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			writeError(w, http.StatusNotFound, errors.New("ride not found"))
 			return
@@ -300,25 +537,28 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var newStatus RideStatus
 	switch req.Status {
 	// Acknowledge the ride
-	case "ENROUTE":
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "ENROUTE"); err != nil {
+	case RideStateEnroute:
+		newStatus, err = insertRideStatus(ctx, tx, ride.ID, RideStateEnroute)
+		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
 	// After Picking up user
-	case "CARRYING":
+	case RideStateCarrying:
 		status, err := getLatestRideStatus(ctx, tx, ride.ID)
 		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
-		if status != "PICKUP" {
+		if status != RideStatePickup {
 			writeError(w, http.StatusBadRequest, errors.New("chair has not arrived yet"))
 			return
 		}
-		if _, err := tx.ExecContext(ctx, "INSERT INTO ride_statuses (id, ride_id, status) VALUES (?, ?, ?)", ulid.Make().String(), ride.ID, "CARRYING"); err != nil {
+		newStatus, err = insertRideStatus(ctx, tx, ride.ID, RideStateCarrying)
+		if err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
@@ -331,5 +571,17 @@ func chairPostRideStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if newStatus.ID != "" {
+		cacheRideStatuses(currentCaches(), newStatus)
+		publishStatusEvents(chair.ID, newStatus)
+		if newStatus.Status == RideStateEnroute {
+			awaitingAckCache.Delete(ride.ID)
+		}
+		if newStatus.Status == RideStateCarrying {
+			chairDestinationCache.Set(chair.ID, ride.Destination())
+		}
+	}
+	chairNotifier.Notify(chair.ID)
+
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -0,0 +1,29 @@
+package main
+
+import "time"
+
+// これ以上連絡の無い椅子は is_active でもマッチングから外す。0 なら無効
+// 通知の long polling は最大 chairNotificationMaxWait 待つので、それより長くしておくこと
+var chairSilenceThreshold = newReloadable(time.Duration(getEnvInt("ISUCON_CHAIR_SILENCE_SECONDS", 60)) * time.Second)
+
+// 椅子から最後に位置情報か通知の取得があった時刻
+var chairLastSeen = NewCache[string, time.Time]()
+
+func touchChair(s *cacheSet, chairID string, t time.Time) {
+	chairLastSeen.in(s).Update(chairID, func(last time.Time, _ bool) time.Time {
+		if t.After(last) {
+			return t
+		}
+		return last
+	})
+}
+
+// 一度も連絡の無い椅子はまだ分からないので生きているとみなす
+func isChairSilent(chairID string, now time.Time) bool {
+	threshold := chairSilenceThreshold.Load()
+	if threshold <= 0 {
+		return false
+	}
+	last, ok := chairLastSeen.Get(chairID)
+	return ok && now.Sub(last) > threshold
+}
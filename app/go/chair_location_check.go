@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// 有効にすると、次の /api/initialize でデータを消す前に、メモリ上の椅子の位置と chair_locations を突き合わせてログに出す
+// 位置情報の書き込みを後回しにしても取りこぼしが無いことを、走行ごとに確かめるためのもの
+var chairLocationCheck = getEnvBool("ISUCON_CHAIR_LOCATION_CHECK", false)
+
+const chairLocationFlushTimeout = 10 * time.Second
+
+// 書き込み待ちを流しきってから突き合わせる。食い違いは椅子 ID 順に並べて返す
+func checkChairLocations(ctx context.Context) ([]cacheMismatch, error) {
+	if !flushChairLocations(chairLocationFlushTimeout) {
+		return nil, errors.New("timed out waiting for pending chair locations to be written")
+	}
+	mismatches, err := verifyChairPositionCache(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(mismatches, func(i, j int) bool {
+		return mismatches[i].Key < mismatches[j].Key
+	})
+	return mismatches, nil
+}
+
+func logChairLocationCheck(ctx context.Context) {
+	mismatches, err := checkChairLocations(ctx)
+	if err != nil {
+		slog.Error("chair location check failed", "err", err)
+		return
+	}
+	for _, m := range mismatches {
+		slog.Warn("chair location mismatch", "chair_id", m.Key, "field", m.Field, "cache", m.InMem, "db", m.InDB)
+	}
+	metricGauge("chair_location_mismatches").Set(int64(len(mismatches)))
+	slog.Info("chair location check done", "mismatches", len(mismatches), "chairs", len(chairPositionCache.Snapshot()))
+}
+
+type internalGetChairLocationCheckResponse struct {
+	Mismatches []string `json:"mismatches"`
+}
+
+func internalGetChairLocationCheck(w http.ResponseWriter, r *http.Request) {
+	mismatches, err := checkChairLocations(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	lines := make([]string, 0, len(mismatches))
+	for _, m := range mismatches {
+		lines = append(lines, m.String())
+	}
+	writeJSON(w, http.StatusOK, &internalGetChairLocationCheckResponse{Mismatches: lines})
+}
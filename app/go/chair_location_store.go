@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chair_locations の書き込み先。採点に位置の履歴の永続化が要らないと判断したら、MySQL をやめてローカルのファイルに追記する
+// ハンドラはキューに積むだけなので、切り替えても触らなくてよい
+type ChairLocationStore interface {
+	// まとめて書き込む。同じ椅子の位置は created_at 順に渡される
+	Append(ctx context.Context, locs []ChairLocation) error
+	// キャッシュを作り直すときに読む。created_at が since より後のもの (ゼロなら全て) を created_at 順に返す
+	LoadSince(ctx context.Context, since time.Time) ([]ChairLocation, error)
+	// 椅子ごとの走行距離と最後の位置。キャッシュとの突き合わせに使う
+	Summarize(ctx context.Context) ([]chairLocationSummary, error)
+	// init.sh の後に呼び、前のベンチマークの分を消して初期データだけにする。MySQL は init.sh がやるので何もしない
+	Reset(ctx context.Context) error
+}
+
+type chairLocationSummary struct {
+	ChairID       string `db:"chair_id"`
+	TotalDistance int    `db:"total_distance"`
+	Latitude      int    `db:"latitude"`
+	Longitude     int    `db:"longitude"`
+}
+
+var chairLocationStores = map[string]ChairLocationStore{
+	"mysql": mysqlChairLocationStore{},
+	"file":  &fileChairLocationStore{path: getEnvString("ISUCON_CHAIR_LOCATION_FILE", "/tmp/isuride-chair-locations.jsonl")},
+}
+
+// 使う書き込み先の名前
+var chairLocationStoreName = getEnvString("ISUCON_CHAIR_LOCATION_STORE", "mysql")
+
+var chairLocations ChairLocationStore
+
+func init() {
+	store, ok := chairLocationStores[chairLocationStoreName]
+	if !ok {
+		names := make([]string, 0, len(chairLocationStores))
+		for n := range chairLocationStores {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		panic(fmt.Sprintf("unknown chair location store %q (available: %s)", chairLocationStoreName, strings.Join(names, ", ")))
+	}
+	chairLocations = store
+}
+
+type mysqlChairLocationStore struct{}
+
+func (mysqlChairLocationStore) Append(ctx context.Context, locs []ChairLocation) error {
+	placeholders := make([]string, 0, len(locs))
+	args := make([]any, 0, len(locs)*5)
+	for _, loc := range locs {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+		args = append(args, loc.ID, loc.ChairID, loc.Latitude, loc.Longitude, loc.CreatedAt)
+	}
+	query := `INSERT INTO chair_locations (id, chair_id, latitude, longitude, created_at) VALUES ` + strings.Join(placeholders, ", ")
+	_, err := db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (mysqlChairLocationStore) LoadSince(ctx context.Context, since time.Time) ([]ChairLocation, error) {
+	if since.IsZero() {
+		return selectChairLocationsContext(ctx, db, `SELECT `+chairLocationColumns+` FROM chair_locations ORDER BY created_at`)
+	}
+	return selectChairLocationsContext(ctx, db, `SELECT `+chairLocationColumns+` FROM chair_locations WHERE created_at > ? ORDER BY created_at`, since)
+}
+
+func (mysqlChairLocationStore) Summarize(ctx context.Context) ([]chairLocationSummary, error) {
+	rows := []chairLocationSummary{}
+	if err := db.SelectContext(ctx, &rows, `
+SELECT d.chair_id,
+       d.total_distance,
+       l.latitude,
+       l.longitude
+FROM (SELECT chair_id,
+             SUM(IFNULL(distance, 0)) AS total_distance
+      FROM (SELECT chair_id,
+                   ABS(latitude - LAG(latitude) OVER (PARTITION BY chair_id ORDER BY created_at)) +
+                   ABS(longitude - LAG(longitude) OVER (PARTITION BY chair_id ORDER BY created_at)) AS distance
+            FROM chair_locations) tmp
+      GROUP BY chair_id) d
+JOIN (SELECT chair_id,
+             latitude,
+             longitude,
+             ROW_NUMBER() OVER (PARTITION BY chair_id ORDER BY created_at DESC) AS rn
+      FROM chair_locations) l ON l.chair_id = d.chair_id AND l.rn = 1
+`); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+func (mysqlChairLocationStore) Reset(context.Context) error {
+	return nil
+}
+
+// 1 行 1 件の JSON で追記する。fsync はしないので、落ちたときに最後の方が消えてもよい場合だけ使う
+type fileChairLocationStore struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File
+}
+
+func (s *fileChairLocationStore) Append(_ context.Context, locs []ChairLocation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		s.f = f
+	}
+	w := bufio.NewWriter(s.f)
+	enc := json.NewEncoder(w)
+	for _, loc := range locs {
+		if err := enc.Encode(loc); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func (s *fileChairLocationStore) LoadSince(_ context.Context, since time.Time) ([]ChairLocation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.Open(s.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []ChairLocation{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	locations := []ChairLocation{}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var loc ChairLocation
+		if err := dec.Decode(&loc); err != nil {
+			return nil, err
+		}
+		if loc.CreatedAt.After(since) {
+			locations = append(locations, loc)
+		}
+	}
+	// バッチごとに追記しているので、椅子をまたぐと前後していることがある
+	sort.SliceStable(locations, func(i, j int) bool {
+		return locations[i].CreatedAt.Before(locations[j].CreatedAt)
+	})
+	return locations, nil
+}
+
+func (s *fileChairLocationStore) Summarize(ctx context.Context) ([]chairLocationSummary, error) {
+	locations, err := s.LoadSince(ctx, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	byChair := map[string]*chairLocationSummary{}
+	order := []string{}
+	for _, loc := range locations {
+		sum, ok := byChair[loc.ChairID]
+		if !ok {
+			sum = &chairLocationSummary{ChairID: loc.ChairID}
+			byChair[loc.ChairID] = sum
+			order = append(order, loc.ChairID)
+		} else {
+			sum.TotalDistance += absDiffInt(sum.Latitude, loc.Latitude) + absDiffInt(sum.Longitude, loc.Longitude)
+		}
+		sum.Latitude, sum.Longitude = loc.Latitude, loc.Longitude
+	}
+	rows := make([]chairLocationSummary, 0, len(order))
+	for _, chairID := range order {
+		rows = append(rows, *byChair[chairID])
+	}
+	return rows, nil
+}
+
+// init.sh が MySQL に入れた初期データの位置をファイルに写す。消すだけだと初期データの走行距離が無くなる
+func (s *fileChairLocationStore) Reset(ctx context.Context) error {
+	seed, err := mysqlChairLocationStore{}.LoadSince(ctx, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.mu.Unlock()
+		return err
+	}
+	s.mu.Unlock()
+
+	if len(seed) == 0 {
+		return nil
+	}
+	return s.Append(ctx, seed)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+var chairLocationBatchSize = newReloadable(getEnvInt("ISUCON_CHAIR_LOCATION_BATCH_SIZE", 256))
+
+var chairLocationQueue = make(chan ChairLocation, 4096)
+
+// キューに積まれてまだ INSERT が終わっていない件数
+var chairLocationPending atomic.Int64
+
+// 椅子ごとに最後に記録した時刻。同じ椅子の位置情報の時刻が前後しないようにする
+var chairLocationClock = NewCache[string, time.Time]()
+
+// DB の DATETIME(6) に合わせてマイクロ秒に丸め、椅子ごとに単調増加させる
+func nextChairLocationTime(chairID string) time.Time {
+	return chairLocationClock.Update(chairID, func(last time.Time, _ bool) time.Time {
+		now := time.Now().Truncate(time.Microsecond)
+		if !now.After(last) {
+			now = last.Add(time.Microsecond)
+		}
+		return now
+	})
+}
+
+// 止まっている椅子は同じ座標を送り続けるので、直前と同じ座標なら chair_locations に行を足さない
+// 走行距離は変わらないが、DB から作り直したときの total_distance_updated_at は最後に動いた時刻になり、
+// 走行中と違う値を返してしまう。再起動しないと分かっているときだけ有効にする
+var dedupeChairLocations = newFeatureFlag("dedupe_chair_locations", "ISUCON_DEDUPE_CHAIR_LOCATIONS", false)
+
+// 直前に記録した座標と同じか。最初の 1 件は必ず書く
+func isDuplicateChairLocation(chairID string, pos Coordinate) bool {
+	if !dedupeChairLocations.Enabled() {
+		return false
+	}
+	last, ok := chairPositionCache.Get(chairID)
+	return ok && last.Position() == pos
+}
+
+// 無効にすると位置情報をリクエストの中で書き込む。キューに残っている分は writer がそのまま書く
+var chairLocationWriteBehind = newFeatureFlag("chair_location_write_behind", "ISUCON_CHAIR_LOCATION_WRITE_BEHIND", true)
+
+// 位置情報の INSERT はレスポンスを返した後にまとめて行う
+func enqueueChairLocation(ctx context.Context, loc ChairLocation) error {
+	if !chairLocationWriteBehind.Enabled() {
+		return chairLocations.Append(ctx, []ChairLocation{loc})
+	}
+	chairLocationPending.Add(1)
+	chairLocationQueue <- loc
+	return nil
+}
+
+// キューに積まれた位置情報が全て書き込まれるまで待つ。timeout までに終わらなければ false
+func flushChairLocations(timeout time.Duration) bool {
+	return waitForPending(&chairLocationPending, time.Now().Add(timeout))
+}
+
+// 非同期に書き込むキューの残りが 0 になるまで待つ。deadline までに終わらなければ false
+func waitForPending(pending *atomic.Int64, deadline time.Time) bool {
+	for pending.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+func runChairLocationWriter() {
+	batch := make([]ChairLocation, 0, chairLocationBatchSize.Load())
+	for loc := range chairLocationQueue {
+		batch = append(batch[:0], loc)
+		size := chairLocationBatchSize.Load()
+	drain:
+		for len(batch) < size {
+			select {
+			case loc := <-chairLocationQueue:
+				batch = append(batch, loc)
+			default:
+				break drain
+			}
+		}
+
+		if err := chairLocations.Append(context.Background(), batch); err != nil {
+			slog.Error("failed to insert chair locations", "count", len(batch), "err", err)
+		}
+		chairLocationPending.Add(-int64(len(batch)))
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// 椅子が完了させたライド 1 件分。売上の集計 (chairRideStats) と同じタイミングで積む
+type chairRideHistoryEntry struct {
+	RideID      string
+	Pickup      Coordinate
+	Destination Coordinate
+	Sale        int
+	Charged     int
+	Evaluation  int
+	CompletedAt time.Time
+}
+
+// 椅子ID → 完了したライド (完了順)
+var chairRideHistoryCache = NewCache[string, []chairRideHistoryEntry]()
+
+func addChairRideHistory(s *cacheSet, chairID string, ride *Ride, fare rideFare, evaluation int) {
+	entry := chairRideHistoryEntry{
+		RideID:      ride.ID,
+		Pickup:      ride.Pickup(),
+		Destination: ride.Destination(),
+		Sale:        fare.Sale,
+		Charged:     fare.Charged,
+		Evaluation:  evaluation,
+		CompletedAt: ride.UpdatedAt,
+	}
+	chairRideHistoryCache.in(s).Update(chairID, func(v []chairRideHistoryEntry, _ bool) []chairRideHistoryEntry {
+		// 読み手とスライスを共有しているので、末尾に書き足さずにコピーを伸ばす
+		return append(v[:len(v):len(v)], entry)
+	})
+}
+
+type chairGetRidesResponse struct {
+	Rides             []chairGetRidesResponseItem `json:"rides"`
+	CompletedRides    int                         `json:"completed_rides"`
+	TotalSales        int                         `json:"total_sales"`
+	AverageEvaluation float64                     `json:"average_evaluation"`
+}
+
+type chairGetRidesResponseItem struct {
+	ID                    string     `json:"id"`
+	PickupCoordinate      Coordinate `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate `json:"destination_coordinate"`
+	Distance              int        `json:"distance"`
+	Sale                  int        `json:"sale"`
+	Fare                  int        `json:"fare"`
+	Evaluation            int        `json:"evaluation"`
+	CompletedAt           int64      `json:"completed_at"`
+}
+
+// 椅子が完了させたライドを新しい順に返す。集計はオーナーの売上と同じキャッシュから出す
+func chairGetRides(w http.ResponseWriter, r *http.Request) {
+	chair := r.Context().Value("chair").(*Chair)
+
+	history, _ := chairRideHistoryCache.Get(chair.ID)
+	stats, _ := chairRideStatsCache.Get(chair.ID)
+	res := chairGetRidesResponse{
+		Rides:          make([]chairGetRidesResponseItem, 0, len(history)),
+		CompletedRides: stats.CompletedRides,
+		TotalSales:     stats.TotalSales,
+	}
+	if stats.CompletedRides > 0 {
+		res.AverageEvaluation = float64(stats.EvaluationSum) / float64(stats.CompletedRides)
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		e := history[i]
+		res.Rides = append(res.Rides, chairGetRidesResponseItem{
+			ID:                    e.RideID,
+			PickupCoordinate:      e.Pickup,
+			DestinationCoordinate: e.Destination,
+			Distance:              e.Pickup.DistanceTo(e.Destination),
+			Sale:                  e.Sale,
+			Fare:                  e.Charged,
+			Evaluation:            e.Evaluation,
+			CompletedAt:           epochMilli(e.CompletedAt),
+		})
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// これより小さいレスポンスは圧縮しない。小さい JSON は圧縮にかかる時間の方が大きい
+var gzipMinBytes = getEnvInt("ISUCON_GZIP_MIN_BYTES", 1024)
+
+var gzipWriterPool = sync.Pool{
+	New: func() any {
+		gz, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+		return gz
+	},
+}
+
+// レスポンスが大きくなりうるエンドポイントにだけ付ける
+// gzipMinBytes までは溜めておき、超えたら圧縮に切り替えて以降は流しながら圧縮する
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	// しきい値に届く前に Flush されたら圧縮せずにそのまま流す
+	plain bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	switch {
+	case w.gz != nil:
+		return w.gz.Write(p)
+	case w.plain:
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= gzipMinBytes {
+		if err := w.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (w *gzipResponseWriter) startGzip() error {
+	h := w.Header()
+	h.Set("Content-Encoding", "gzip")
+	h.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.gz = gzipWriterPool.Get().(*gzip.Writer)
+	w.gz.Reset(w.ResponseWriter)
+	_, err := w.gz.Write(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *gzipResponseWriter) writePlain() {
+	w.plain = true
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(w.buf)
+	w.buf = nil
+}
+
+func (w *gzipResponseWriter) Flush() {
+	switch {
+	case w.gz != nil:
+		w.gz.Flush()
+	case !w.plain:
+		w.writePlain()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) finish() {
+	switch {
+	case w.gz != nil:
+		w.gz.Close()
+		gzipWriterPool.Put(w.gz)
+		w.gz = nil
+	case !w.plain:
+		w.writePlain()
+	}
+}
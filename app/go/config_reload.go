@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// KEY=VALUE 形式の設定ファイル。リロード時に起動時の設定へ重ねて反映する
+var configFilePath = os.Getenv("ISUCON_CONFIG_FILE")
+
+// 再起動せずに変えられる設定。設定ファイルに無いものは起動時 (環境変数か既定値) の値に戻す
+type reloadableConfig struct {
+	LogLevel                  string          `json:"log_level"`
+	MatchingAlgorithm         string          `json:"matching_algorithm"`
+	MatchingUtilizationWeight float64         `json:"matching_utilization_weight"`
+	MatchingFareWeight        float64         `json:"matching_fare_weight"`
+	MatchingSpeedWeight       float64         `json:"matching_speed_weight"`
+	MatchingSpeedPivot        int             `json:"matching_speed_pivot"`
+	MatchingStarvationSeconds int             `json:"matching_starvation_seconds"`
+	MatchingTieBreakSeed      int             `json:"matching_tie_break_seed"`
+	FastMatchRadius           int             `json:"fast_match_radius"`
+	ChairSilenceSeconds       int             `json:"chair_silence_seconds"`
+	SnapshotIntervalSeconds   int             `json:"snapshot_interval_seconds"`
+	CacheBudgetSweepSeconds   int             `json:"cache_budget_sweep_seconds"`
+	StampBatchSize            int             `json:"stamp_batch_size"`
+	ChairLocationBatchSize    int             `json:"chair_location_batch_size"`
+	SettlementBatchSize       int             `json:"settlement_batch_size"`
+	FeatureFlags              map[string]bool `json:"feature_flags"`
+}
+
+// 走行中に書き換える設定。読む側はロックを取らずに Load する
+type reloadable[T ~int | ~int64] struct {
+	v atomic.Int64
+}
+
+func newReloadable[T ~int | ~int64](v T) *reloadable[T] {
+	r := &reloadable[T]{}
+	r.Store(v)
+	return r
+}
+
+func (r *reloadable[T]) Load() T {
+	return T(r.v.Load())
+}
+
+func (r *reloadable[T]) Store(v T) {
+	r.v.Store(int64(v))
+}
+
+// ロガーの設定が終わった後に取る
+var startupConfig reloadableConfig
+
+func recordStartupConfig() {
+	startupConfig = currentConfig()
+}
+
+// 全て読んでから返す。途中で間違いがあれば何も反映しないよう、環境変数には書き込まない
+func loadConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func lookupConfig[T any](values map[string]string, key string, base T, parse func(string) (T, error)) (T, error) {
+	v := values[key]
+	if v == "" {
+		return base, nil
+	}
+	parsed, err := parse(v)
+	if err != nil {
+		return base, fmt.Errorf("failed to parse %s: %w", key, err)
+	}
+	return parsed, nil
+}
+
+func parseFloat(v string) (float64, error) {
+	return strconv.ParseFloat(v, 64)
+}
+
+func currentConfig() reloadableConfig {
+	return reloadableConfig{
+		LogLevel:                  strings.ToLower(logLevel.Level().String()),
+		MatchingAlgorithm:         matchingAlgorithm,
+		MatchingUtilizationWeight: matchingUtilizationWeight,
+		MatchingFareWeight:        matchingFareWeight,
+		MatchingSpeedWeight:       matchingSpeedWeight,
+		MatchingSpeedPivot:        matchingSpeedPivot,
+		MatchingStarvationSeconds: int(matchingStarvationThreshold / time.Second),
+		MatchingTieBreakSeed:      matchingTieBreakSeed,
+		FastMatchRadius:           fastMatchRadius,
+		ChairSilenceSeconds:       int(chairSilenceThreshold.Load() / time.Second),
+		SnapshotIntervalSeconds:   int(snapshotInterval.Load() / time.Second),
+		CacheBudgetSweepSeconds:   int(cacheBudgetSweepInterval.Load() / time.Second),
+		StampBatchSize:            stampBatchSize.Load(),
+		ChairLocationBatchSize:    chairLocationBatchSize.Load(),
+		SettlementBatchSize:       settlementBatchSize.Load(),
+		FeatureFlags:              currentFeatureFlags(),
+	}
+}
+
+// base に values (設定ファイルの中身) を重ねる。全ての値を確かめてから返す
+func readReloadableConfig(base reloadableConfig, values map[string]string) (reloadableConfig, error) {
+	c := base
+	var err error
+	if v := values["ISUCON_LOG_LEVEL"]; v != "" {
+		if _, err := parseLogLevel(v); err != nil {
+			return base, err
+		}
+		c.LogLevel = strings.ToLower(v)
+	}
+	if v := values["ISUCON_MATCHING_ALGORITHM"]; v != "" {
+		if _, err := lookupMatcher(v); err != nil {
+			return base, err
+		}
+		c.MatchingAlgorithm = v
+	}
+	if c.MatchingUtilizationWeight, err = lookupConfig(values, "ISUCON_MATCHING_UTILIZATION_WEIGHT", c.MatchingUtilizationWeight, parseFloat); err != nil {
+		return base, err
+	}
+	if c.MatchingFareWeight, err = lookupConfig(values, "ISUCON_MATCHING_FARE_WEIGHT", c.MatchingFareWeight, parseFloat); err != nil {
+		return base, err
+	}
+	if c.MatchingSpeedWeight, err = lookupConfig(values, "ISUCON_MATCHING_SPEED_WEIGHT", c.MatchingSpeedWeight, parseFloat); err != nil {
+		return base, err
+	}
+	if c.MatchingSpeedPivot, err = lookupConfig(values, "ISUCON_MATCHING_SPEED_PIVOT", c.MatchingSpeedPivot, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.MatchingStarvationSeconds, err = lookupConfig(values, "ISUCON_MATCHING_STARVATION_SECONDS", c.MatchingStarvationSeconds, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.MatchingTieBreakSeed, err = lookupConfig(values, "ISUCON_MATCHING_TIE_BREAK_SEED", c.MatchingTieBreakSeed, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.FastMatchRadius, err = lookupConfig(values, "ISUCON_FAST_MATCH_RADIUS", c.FastMatchRadius, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.ChairSilenceSeconds, err = lookupConfig(values, "ISUCON_CHAIR_SILENCE_SECONDS", c.ChairSilenceSeconds, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.SnapshotIntervalSeconds, err = lookupConfig(values, "ISUCON_SNAPSHOT_INTERVAL_SECONDS", c.SnapshotIntervalSeconds, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.CacheBudgetSweepSeconds, err = lookupConfig(values, "ISUCON_CACHE_BUDGET_SWEEP_SECONDS", c.CacheBudgetSweepSeconds, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.StampBatchSize, err = lookupConfig(values, "ISUCON_STAMP_BATCH_SIZE", c.StampBatchSize, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.ChairLocationBatchSize, err = lookupConfig(values, "ISUCON_CHAIR_LOCATION_BATCH_SIZE", c.ChairLocationBatchSize, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.SettlementBatchSize, err = lookupConfig(values, "ISUCON_SETTLEMENT_BATCH_SIZE", c.SettlementBatchSize, strconv.Atoi); err != nil {
+		return base, err
+	}
+	if c.FeatureFlags, err = readFeatureFlags(values, c.FeatureFlags); err != nil {
+		return base, err
+	}
+	if err := c.validate(); err != nil {
+		return base, err
+	}
+	return c, nil
+}
+
+func (c reloadableConfig) validate() error {
+	positive := []struct {
+		key string
+		v   int
+	}{
+		{"ISUCON_MATCHING_SPEED_PIVOT", c.MatchingSpeedPivot},
+		{"ISUCON_SNAPSHOT_INTERVAL_SECONDS", c.SnapshotIntervalSeconds},
+		{"ISUCON_CACHE_BUDGET_SWEEP_SECONDS", c.CacheBudgetSweepSeconds},
+		{"ISUCON_STAMP_BATCH_SIZE", c.StampBatchSize},
+		{"ISUCON_CHAIR_LOCATION_BATCH_SIZE", c.ChairLocationBatchSize},
+		{"ISUCON_SETTLEMENT_BATCH_SIZE", c.SettlementBatchSize},
+	}
+	for _, p := range positive {
+		if p.v <= 0 {
+			return fmt.Errorf("%s must be positive: %d", p.key, p.v)
+		}
+	}
+	nonNegative := []struct {
+		key string
+		v   int
+	}{
+		{"ISUCON_MATCHING_STARVATION_SECONDS", c.MatchingStarvationSeconds},
+		{"ISUCON_FAST_MATCH_RADIUS", c.FastMatchRadius},
+		{"ISUCON_CHAIR_SILENCE_SECONDS", c.ChairSilenceSeconds},
+	}
+	for _, p := range nonNegative {
+		if p.v < 0 {
+			return fmt.Errorf("%s must not be negative: %d", p.key, p.v)
+		}
+	}
+	return nil
+}
+
+// マッチングの設定はマッチング中に書き換えないよう matchingMu を取ったまま反映する
+// それ以外はマッチングの外から読まれるので atomic に書き換える
+func (c reloadableConfig) apply() {
+	level, _ := parseLogLevel(c.LogLevel)
+	logLevel.Set(level)
+	matchingAlgorithm = c.MatchingAlgorithm
+	matchingUtilizationWeight = c.MatchingUtilizationWeight
+	matchingFareWeight = c.MatchingFareWeight
+	matchingSpeedWeight = c.MatchingSpeedWeight
+	matchingSpeedPivot = c.MatchingSpeedPivot
+	matchingStarvationThreshold = time.Duration(c.MatchingStarvationSeconds) * time.Second
+	matchingTieBreakSeed = c.MatchingTieBreakSeed
+	fastMatchRadius = c.FastMatchRadius
+	chairSilenceThreshold.Store(time.Duration(c.ChairSilenceSeconds) * time.Second)
+	snapshotInterval.Store(time.Duration(c.SnapshotIntervalSeconds) * time.Second)
+	cacheBudgetSweepInterval.Store(time.Duration(c.CacheBudgetSweepSeconds) * time.Second)
+	stampBatchSize.Store(c.StampBatchSize)
+	chairLocationBatchSize.Store(c.ChairLocationBatchSize)
+	settlementBatchSize.Store(c.SettlementBatchSize)
+	applyFeatureFlags(c.FeatureFlags)
+}
+
+func internalPostConfigReload(w http.ResponseWriter, r *http.Request) {
+	values := map[string]string{}
+	if configFilePath != "" {
+		var err error
+		if values, err = loadConfigFile(configFilePath); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	c, err := readReloadableConfig(startupConfig, values)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	matchingMu.Lock()
+	defer matchingMu.Unlock()
+	c.apply()
+
+	writeJSON(w, http.StatusOK, c)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, lines ...string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "isuride.env")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	values, err := loadConfigFile(writeConfigFile(t,
+		"# comment",
+		"",
+		"ISUCON_FAST_MATCH_RADIUS = 20",
+		"ISUCON_STAMP_BATCH_SIZE=64",
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values["ISUCON_FAST_MATCH_RADIUS"] != "20" || values["ISUCON_STAMP_BATCH_SIZE"] != "64" || len(values) != 2 {
+		t.Fatalf("values = %v", values)
+	}
+	if _, err := loadConfigFile(writeConfigFile(t, "ISUCON_FAST_MATCH_RADIUS=20", "oops")); err == nil {
+		t.Fatal("malformed line was accepted")
+	}
+}
+
+func TestReadReloadableConfig(t *testing.T) {
+	base := currentConfig()
+
+	c, err := readReloadableConfig(base, map[string]string{
+		"ISUCON_FAST_MATCH_RADIUS":          "7",
+		"ISUCON_SNAPSHOT_INTERVAL_SECONDS":  "3",
+		"ISUCON_CHAIR_LOCATION_BATCH_SIZE":  "32",
+		"ISUCON_CACHE_BUDGET_SWEEP_SECONDS": "1",
+		"ISUCON_FAST_MATCH":                 "false",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FastMatchRadius != 7 || c.SnapshotIntervalSeconds != 3 || c.ChairLocationBatchSize != 32 || c.CacheBudgetSweepSeconds != 1 || c.FeatureFlags["fast_match"] {
+		t.Fatalf("file values were not applied: %+v", c)
+	}
+	if c.StampBatchSize != base.StampBatchSize || c.MatchingAlgorithm != base.MatchingAlgorithm {
+		t.Fatalf("values missing from the file changed: %+v", c)
+	}
+
+	// ファイルから消した設定は base に戻る
+	c, err = readReloadableConfig(base, map[string]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.FastMatchRadius != base.FastMatchRadius || c.FeatureFlags["fast_match"] != base.FeatureFlags["fast_match"] {
+		t.Fatalf("removed keys did not revert: %+v", c)
+	}
+}
+
+func TestReadReloadableConfigRejectsInvalid(t *testing.T) {
+	base := currentConfig()
+	for _, values := range []map[string]string{
+		{"ISUCON_FAST_MATCH_RADIUS": "ten"},
+		{"ISUCON_FAST_MATCH_RADIUS": "-1"},
+		{"ISUCON_MATCHING_ALGORITHM": "nope"},
+		{"ISUCON_STAMP_BATCH_SIZE": "0"},
+		{"ISUCON_SNAPSHOT_INTERVAL_SECONDS": "0"},
+		{"ISUCON_FAST_MATCH": "maybe"},
+		// 正しい値と一緒でも全体を断る
+		{"ISUCON_FAST_MATCH_RADIUS": "3", "ISUCON_SETTLEMENT_BATCH_SIZE": "-5"},
+	} {
+		c, err := readReloadableConfig(base, values)
+		if err == nil {
+			t.Errorf("%v was accepted", values)
+			continue
+		}
+		if c.FastMatchRadius != base.FastMatchRadius {
+			t.Errorf("%v: partially applied config returned: %+v", values, c)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "fmt"
+
+// 地図上の整数格子の点。緯度と経度を別々の int で持ち回ると取り違えるので、座標はこの型で受け渡す
+type Coordinate struct {
+	Latitude  int `json:"latitude"`
+	Longitude int `json:"longitude"`
+}
+
+// マンハッタン距離
+func (c Coordinate) DistanceTo(o Coordinate) int {
+	return abs(c.Latitude-o.Latitude) + abs(c.Longitude-o.Longitude)
+}
+
+// min と max を対角とする長方形 (境界を含む) に入っているか
+func (c Coordinate) InRegion(min, max Coordinate) bool {
+	return min.Latitude <= c.Latitude && c.Latitude <= max.Latitude &&
+		min.Longitude <= c.Longitude && c.Longitude <= max.Longitude
+}
+
+func (c Coordinate) String() string {
+	return fmt.Sprintf("(%d, %d)", c.Latitude, c.Longitude)
+}
+
+// 緯度を先に、次に経度を詰めて最大 steps だけ to へ近づける。to を通り越すことはない
+func (c Coordinate) MoveToward(to Coordinate, steps int) Coordinate {
+	move := func(from, to int) int {
+		d := min(absDiffInt(from, to), steps)
+		steps -= d
+		if from < to {
+			return from + d
+		}
+		return from - d
+	}
+	c.Latitude = move(c.Latitude, to.Latitude)
+	c.Longitude = move(c.Longitude, to.Longitude)
+	return c
+}
+
+func (r *Ride) Pickup() Coordinate {
+	return Coordinate{Latitude: r.PickupLatitude, Longitude: r.PickupLongitude}
+}
+
+func (r *Ride) Destination() Coordinate {
+	return Coordinate{Latitude: r.DestinationLatitude, Longitude: r.DestinationLongitude}
+}
+
+func (e chairPositionCacheEntry) Position() Coordinate {
+	return Coordinate{Latitude: e.LastLat, Longitude: e.LastLong}
+}
@@ -0,0 +1,139 @@
+package main
+
+import "log/slog"
+
+type ledgerCoupon struct {
+	Coupon
+	// ライド作成のトランザクション中に押さえているライドID。コミットかリリースで空に戻る
+	ReservedBy string
+}
+
+// ユーザーごとのクーポンを付与された順に持つ。DB の coupons と同じ内容を保つ
+// nil はキャッシュに載っていないユーザーを表す
+var couponLedger = NewCache[string, []ledgerCoupon]()
+
+func grantLedgerCoupon(s *cacheSet, c Coupon) {
+	couponLedger.in(s).Update(c.UserID, func(v []ledgerCoupon, _ bool) []ledgerCoupon {
+		return append(v[:len(v):len(v)], ledgerCoupon{Coupon: c})
+	})
+}
+
+// 読み手とスライスを共有しているので、書き換えるときはコピーしてから f に渡す
+func updateLedger(userID string, f func(coupons []ledgerCoupon)) {
+	couponLedger.Update(userID, func(v []ledgerCoupon, _ bool) []ledgerCoupon {
+		if v == nil {
+			return nil
+		}
+		coupons := append([]ledgerCoupon(nil), v...)
+		f(coupons)
+		return coupons
+	})
+}
+
+func usable(c *ledgerCoupon) bool {
+	return c.UsedBy == nil && c.ReservedBy == ""
+}
+
+// 次に使われるクーポンの位置を返す。初回利用クーポンが優先されるのは preferNew のときだけ
+func pickLedgerCoupon(coupons []ledgerCoupon, preferNew bool) int {
+	if preferNew {
+		for i := range coupons {
+			if usable(&coupons[i]) && coupons[i].Code == "CP_NEW2024" {
+				return i
+			}
+		}
+	}
+	for i := range coupons {
+		if usable(&coupons[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ユーザーID → 初回ライドとして作成中のライドID
+// 同じユーザーが同時にライドを作ると、どちらのトランザクションからも自分のライドしか見えず両方が初回になってしまうので、ここで 1 つに絞る
+var firstRideClaims = NewCache[string, string]()
+
+// rideID をユーザーの初回ライドとして押さえられたら true。既にライドがあるか、他のライドが押さえていれば false
+// 作成が終わったら成否に関わらず releaseFirstRide を呼ぶ
+func claimFirstRide(userID, rideID string) bool {
+	if _, ok := usersWithRide.Get(userID); ok {
+		return false
+	}
+	claimed := false
+	firstRideClaims.Update(userID, func(v string, found bool) string {
+		if found && v != rideID {
+			return v
+		}
+		claimed = true
+		return rideID
+	})
+	return claimed
+}
+
+// コミット後は usersWithRide に載っているので、押さえを外しても次のライドが初回になることはない
+func releaseFirstRide(userID, rideID string) {
+	firstRideClaims.DeleteIf(userID, func(v string) bool { return v == rideID })
+}
+
+// 見積もり用。他のリクエストが押さえているクーポンは使えないものとして扱う
+// known が false ならキャッシュにいないユーザーなので DB を見ること
+func nextLedgerCoupon(userID string) (coupon Coupon, ok bool, known bool) {
+	coupons, _ := couponLedger.Get(userID)
+	if coupons == nil {
+		return Coupon{}, false, false
+	}
+	if i := pickLedgerCoupon(coupons, true); i >= 0 {
+		return coupons[i].Coupon, true, true
+	}
+	return Coupon{}, false, true
+}
+
+// ライド作成用にクーポンを 1 枚押さえる。同じクーポンを同時に 2 つのライドが使うことはない
+func reserveLedgerCoupon(userID, rideID string, firstRide bool) (coupon Coupon, ok bool, known bool) {
+	updateLedger(userID, func(coupons []ledgerCoupon) {
+		known = true
+		if i := pickLedgerCoupon(coupons, firstRide); i >= 0 {
+			coupons[i].ReservedBy = rideID
+			coupon, ok = coupons[i].Coupon, true
+		}
+	})
+	return coupon, ok, known
+}
+
+// DB のコミット後に呼ぶ。1 つのライドに紐づくクーポンは 1 枚まで
+func commitLedgerCoupon(userID, code, rideID string) {
+	updateLedger(userID, func(coupons []ledgerCoupon) {
+		for i := range coupons {
+			if coupons[i].UsedBy != nil && *coupons[i].UsedBy == rideID {
+				slog.Warn("ride already has a coupon in ledger", "ride_id", rideID, "code", coupons[i].Code)
+				return
+			}
+		}
+		for i := range coupons {
+			c := &coupons[i]
+			if c.Code != code || c.UsedBy != nil {
+				continue
+			}
+			if c.ReservedBy != "" && c.ReservedBy != rideID {
+				continue
+			}
+			c.UsedBy = &rideID
+			c.ReservedBy = ""
+			return
+		}
+		slog.Warn("coupon not usable in ledger", "user_id", userID, "code", code, "ride_id", rideID)
+	})
+}
+
+// ライド作成が失敗したときに押さえていたクーポンを戻す。コミット済みなら何もしない
+func releaseLedgerCoupon(userID, code, rideID string) {
+	updateLedger(userID, func(coupons []ledgerCoupon) {
+		for i := range coupons {
+			if coupons[i].Code == code && coupons[i].ReservedBy == rideID {
+				coupons[i].ReservedBy = ""
+			}
+		}
+	})
+}
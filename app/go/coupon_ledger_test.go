@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// 同じユーザーの初回ライドが同時に作られても、初回として押さえられるのは 1 つだけ
+func TestClaimFirstRideConcurrent(t *testing.T) {
+	useFreshCaches(t)
+
+	const n = 32
+	var (
+		wg      sync.WaitGroup
+		claimed atomic.Int64
+		winner  atomic.Value
+		start   = make(chan struct{})
+	)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			rideID := fmt.Sprintf("ride-%d", i)
+			if claimFirstRide("user-1", rideID) {
+				claimed.Add(1)
+				winner.Store(rideID)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if got := claimed.Load(); got != 1 {
+		t.Fatalf("%d rides claimed the first ride, want 1", got)
+	}
+	rideID := winner.Load().(string)
+	// 押さえたライド自身はやり直しても初回のまま
+	if !claimFirstRide("user-1", rideID) {
+		t.Fatal("the claiming ride lost its own claim")
+	}
+	// 他のライドの release では外れない
+	releaseFirstRide("user-1", "other-ride")
+	if claimFirstRide("user-1", "other-ride") {
+		t.Fatal("another ride claimed the first ride while it was held")
+	}
+
+	// 作成に失敗して外したら、次のライドが初回になれる
+	releaseFirstRide("user-1", rideID)
+	if !claimFirstRide("user-1", "ride-retry") {
+		t.Fatal("first ride could not be claimed after release")
+	}
+	releaseFirstRide("user-1", "ride-retry")
+
+	// コミット済みならもう初回にはならない
+	usersWithRide.Set("user-1", struct{}{})
+	if claimFirstRide("user-1", "ride-next") {
+		t.Fatal("first ride was claimed by a user who already has a ride")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// テスト用の DB。クエリに match を含む最初の fakeResult の行を返し、Exec は記録だけする
+// MySQL 無しでハンドラや Scan の経路を動かすためのもので、SQL の意味は解釈しない
+type fakeDB struct {
+	mu      sync.Mutex
+	results []fakeResult
+	// 実行された文。Query も Exec も記録する
+	statements []string
+	// Exec がこれを含む文ならエラーにする
+	failExec []string
+}
+
+type fakeResult struct {
+	match   string
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (f *fakeDB) on(match string, columns []string, rows ...[]driver.Value) *fakeDB {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.results = append(f.results, fakeResult{match: match, columns: columns, rows: rows})
+	return f
+}
+
+// match を含む文の Exec を失敗させる
+func (f *fakeDB) fail(match string) *fakeDB {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failExec = append(f.failExec, match)
+	return f
+}
+
+// 失敗させていた Exec を通すようにする
+func (f *fakeDB) clearFailures() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failExec = nil
+}
+
+// match を含む文が何回実行されたか
+func (f *fakeDB) count(match string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, q := range f.statements {
+		if strings.Contains(q, match) {
+			n++
+		}
+	}
+	return n
+}
+
+var (
+	fakeDBs   sync.Map // DSN → *fakeDB
+	fakeDBSeq atomic.Int64
+)
+
+func init() {
+	sql.Register("isucon_fake", fakeDriver{})
+}
+
+// f を読む sqlx.DB を開く
+func openFakeDB(tb testing.TB, f *fakeDB) *sqlx.DB {
+	tb.Helper()
+	dsn := fmt.Sprintf("fake-%d", fakeDBSeq.Add(1))
+	fakeDBs.Store(dsn, f)
+	conn, err := sqlx.Open("isucon_fake", dsn)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		fakeDBs.Delete(dsn)
+	})
+	return conn
+}
+
+// テストの間だけグローバルの db を f に差し替える
+func useFakeDB(tb testing.TB, f *fakeDB) {
+	tb.Helper()
+	prev := db
+	db = openFakeDB(tb, f)
+	tb.Cleanup(func() { db = prev })
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	f, ok := fakeDBs.Load(dsn)
+	if !ok {
+		return nil, fmt.Errorf("unknown fake db %q", dsn)
+	}
+	return &fakeConn{db: f.(*fakeDB)}, nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return fakeTx{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec([]driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.statements = append(s.db.statements, s.query)
+	for _, match := range s.db.failExec {
+		if strings.Contains(s.query, match) {
+			return nil, fmt.Errorf("fake exec failure: %s", s.query)
+		}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query([]driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.statements = append(s.db.statements, s.query)
+	for _, r := range s.db.results {
+		if strings.Contains(s.query, r.match) {
+			return &fakeRows{columns: r.columns, rows: r.rows}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected query: %s", s.query)
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
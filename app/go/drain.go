@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// デプロイでバイナリを差し替える前に叩き、積まれた決済や sent_at の反映を失わないようにする
+// drain 中も読み取りはそのまま返し、決済を積む書き込みは断る。次の initialize で解除する
+var (
+	draining     atomic.Bool
+	drainTimeout = time.Duration(getEnvInt("ISUCON_DRAIN_TIMEOUT_SECONDS", 10)) * time.Second
+)
+
+// 決済を積む書き込み (評価) と drain を排他にする
+// 書き込みは RLock したまま決済を積み、drain は Lock で走っている書き込みが積み終わるのを待つ
+var paymentWritesMu sync.RWMutex
+
+var errDraining = errors.New("server is draining")
+
+// 決済を積む書き込みを始める。drain 中なら false を返すので、書き込まずに断る
+// true のときは書き込みが終わったら release を呼ぶ
+func beginPaymentWrite() (release func(), ok bool) {
+	paymentWritesMu.RLock()
+	if draining.Load() {
+		paymentWritesMu.RUnlock()
+		return nil, false
+	}
+	return paymentWritesMu.RUnlock, true
+}
+
+type internalPostDrainResponse struct {
+	Drained bool             `json:"drained"`
+	Pending map[string]int64 `json:"pending"`
+}
+
+func internalPostDrain(w http.ResponseWriter, r *http.Request) {
+	draining.Store(true)
+	// 走っているマッチングが終わるのを待つ。以降のマッチングは draining を見て何もしない
+	matchingMu.Lock()
+	matchingMu.Unlock()
+	// 評価も同じく、走っているものが決済を積み終えるのを待つ。以降の評価は 503 で断る
+	paymentWritesMu.Lock()
+	paymentWritesMu.Unlock()
+
+	// 決済が終わると精算が積まれるので、積む側から順に待つ
+	deadline := time.Now().Add(drainTimeout)
+	queues := []struct {
+		name    string
+		pending *atomic.Int64
+	}{
+		{"payments", &paymentPending},
+		{"settlements", &settlementPending},
+		{"stamps", &stampPending},
+		{"chair_locations", &chairLocationPending},
+	}
+	res := internalPostDrainResponse{Drained: true, Pending: map[string]int64{}}
+	for _, q := range queues {
+		if !waitForPending(q.pending, deadline) {
+			res.Drained = false
+		}
+		res.Pending[q.name] = q.pending.Load()
+	}
+	if !res.Drained {
+		slog.Warn("drain timed out", "pending", res.Pending)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postDrain() *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	internalPostDrain(rec, httptest.NewRequest(http.MethodPost, "/api/internal/drain", nil))
+	return rec
+}
+
+// drain 後の評価は決済を積まずに断る
+func TestRideEvaluationRejectedWhileDraining(t *testing.T) {
+	useFreshCaches(t)
+	f := fakeEvaluationDB(nil, RideStateArrived)
+	useFakeDB(t, f)
+	t.Cleanup(func() { draining.Store(false) })
+
+	if rec := postDrain(); rec.Code != http.StatusOK {
+		t.Fatalf("drain status = %d (body %s)", rec.Code, rec.Body)
+	}
+	rec := postRideEvaluation(`{"evaluation":5}`)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusServiceUnavailable, rec.Body)
+	}
+	if n := f.count(""); n != 0 {
+		t.Fatalf("evaluation reached the DB while draining (%d statements)", n)
+	}
+	if paymentPending.Load() != 0 {
+		t.Fatal("payment was queued while draining")
+	}
+}
+
+// drain は走っている評価が決済を積み終えるまで返らない
+func TestDrainWaitsForPaymentWrites(t *testing.T) {
+	t.Cleanup(func() { draining.Store(false) })
+
+	release, ok := beginPaymentWrite()
+	if !ok {
+		t.Fatal("payment write was rejected before draining")
+	}
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postDrain() }()
+
+	select {
+	case <-done:
+		t.Fatal("drain returned while a payment write was in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	select {
+	case rec := <-done:
+		if rec.Code != http.StatusOK {
+			t.Fatalf("drain status = %d (body %s)", rec.Code, rec.Body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("drain did not return after the payment write finished")
+	}
+
+	if _, ok := beginPaymentWrite(); ok {
+		t.Fatal("payment write was accepted after drain")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// 実験的: 運賃の見積もりの時点で一番近い空き椅子を少しの間押さえておき、そのユーザーがライドを作ったらすぐ割り当てる
+// 押さえている間は他のマッチングに使わない。メモリ上にだけ持ち、期限が過ぎたら自然に外れる。0 なら無効
+var (
+	estimateHoldTTL    = time.Duration(getEnvInt("ISUCON_ESTIMATE_HOLD_MS", 0)) * time.Millisecond
+	estimateHoldRadius = getEnvInt("ISUCON_ESTIMATE_HOLD_RADIUS", 50)
+)
+
+type estimateHold struct {
+	UserID  string
+	ChairID string
+	Until   time.Time
+}
+
+// 椅子 ID → 押さえているユーザー、ユーザー ID → 押さえている椅子。ユーザーごとに 1 台まで
+var (
+	chairEstimateHolds = NewCache[string, estimateHold]()
+	userEstimateHolds  = NewCache[string, estimateHold]()
+)
+
+func isChairHeld(chairID string, now time.Time) bool {
+	h, ok := chairEstimateHolds.Get(chairID)
+	return ok && now.Before(h.Until)
+}
+
+func releaseEstimateHold(userID string) {
+	h, ok := userEstimateHolds.Get(userID)
+	if !ok {
+		return
+	}
+	userEstimateHolds.Delete(userID)
+	chairEstimateHolds.DeleteIf(h.ChairID, func(v estimateHold) bool { return v.UserID == userID })
+}
+
+// 見積もりのたびに呼ぶ。前に押さえていた椅子は放し、pickup から estimateHoldRadius 以内で一番近い空き椅子を押さえ直す
+func holdChairForEstimate(userID string, pickup Coordinate) {
+	if estimateHoldTTL <= 0 {
+		return
+	}
+	releaseEstimateHold(userID)
+
+	type candidate struct {
+		chairID  string
+		distance int
+	}
+	now := time.Now()
+	candidates := []candidate{}
+	for chairID, active := range chairActiveCache.Snapshot() {
+		if !active || isChairHeld(chairID, now) || isChairOnRide(chairID) || isChairSilent(chairID, now) || isChairPenalized(chairID, now) {
+			continue
+		}
+		if _, ok := chairDeactivationPending.Get(chairID); ok {
+			continue
+		}
+		pos, ok := chairPositionCache.Get(chairID)
+		if !ok {
+			continue
+		}
+		if d := pos.Position().DistanceTo(pickup); d <= estimateHoldRadius {
+			candidates = append(candidates, candidate{chairID: chairID, distance: d})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].distance < candidates[j].distance
+	})
+
+	hold := estimateHold{UserID: userID, Until: now.Add(estimateHoldTTL)}
+	for _, c := range candidates {
+		hold.ChairID = c.chairID
+		// 同時に見積もった別のユーザーと取り合ったら次に近い椅子にする
+		won := false
+		chairEstimateHolds.Update(c.chairID, func(v estimateHold, found bool) estimateHold {
+			if found && v.UserID != userID && now.Before(v.Until) {
+				return v
+			}
+			won = true
+			return hold
+		})
+		if won {
+			userEstimateHolds.Set(userID, hold)
+			metricCounter(metricName("estimate_holds_total", "result", "held")).Inc()
+			return
+		}
+	}
+}
+
+// ライドを作った直後に呼ぶ。押さえた椅子がまだ空いていればそのライドに割り当てる
+func claimEstimateHold(ctx context.Context, userID string, ride *Ride) {
+	h, ok := userEstimateHolds.Get(userID)
+	if !ok {
+		return
+	}
+	// 割り当て終わるまでは他のマッチングに取られないよう押さえたままにする
+	defer releaseEstimateHold(userID)
+	result := "claimed"
+	defer func() {
+		metricCounter(metricName("estimate_holds_total", "result", result)).Inc()
+	}()
+	if time.Now().After(h.Until) {
+		result = "expired"
+		return
+	}
+
+	matchingMu.Lock()
+	defer matchingMu.Unlock()
+	if draining.Load() {
+		result = "lost"
+		return
+	}
+	chair := &Chair{}
+	if err := getChairContext(ctx, db, chair, `SELECT `+chairColumns+` FROM chairs WHERE id = ? AND is_active = TRUE`, h.ChairID); err != nil {
+		result = "lost"
+		if !errors.Is(err, sql.ErrNoRows) {
+			slog.Error("failed to claim estimate hold", "ride_id", ride.ID, "chair_id", h.ChairID, "err", err)
+		}
+		return
+	}
+	free, err := isChairFree(ctx, h.ChairID)
+	if err != nil || !free {
+		result = "lost"
+		return
+	}
+	pos, _ := chairPositionCache.Get(h.ChairID)
+	pair := matchingPair{RideID: ride.ID, ChairID: h.ChairID, Distance: pos.Position().DistanceTo(ride.Pickup())}
+	assigned, err := assignSingleMatch(ctx, pair, chair, assignmentByHold)
+	if err != nil {
+		slog.Error("failed to claim estimate hold", "ride_id", ride.ID, "chair_id", h.ChairID, "err", err)
+	}
+	if !assigned {
+		result = "lost"
+	}
+}
+
+// 期限の切れた押さえを消す。判定は期限を見ているので、これは掃除だけ
+func runEstimateHoldSweeper() {
+	if estimateHoldTTL <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expired := func(v estimateHold) bool { return now.After(v.Until) }
+		for userID := range userEstimateHolds.Snapshot() {
+			userEstimateHolds.DeleteIf(userID, expired)
+		}
+		for chairID := range chairEstimateHolds.Snapshot() {
+			chairEstimateHolds.DeleteIf(chairID, expired)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"maps"
+	"strconv"
+	"sync/atomic"
+)
+
+// 危ない最適化のオン・オフ。起動時は環境変数から読み、設定のリロードで走行中でも切り替えられる
+// 設定ファイルから消すと起動時の値に戻る
+// 検証モードで食い違いが出たら、設定ファイルで該当するものを false にしてリロードすれば元の経路に戻る
+type featureFlag struct {
+	name string
+	env  string
+	on   atomic.Bool
+}
+
+// フラグ名 → フラグ。newFeatureFlag で登録する
+var featureFlags = map[string]*featureFlag{}
+
+func newFeatureFlag(name, env string, defaultValue bool) *featureFlag {
+	if _, ok := featureFlags[name]; ok {
+		panic("duplicate feature flag: " + name)
+	}
+	f := &featureFlag{name: name, env: env}
+	f.on.Store(getEnvBool(env, defaultValue))
+	featureFlags[name] = f
+	return f
+}
+
+func (f *featureFlag) Enabled() bool {
+	return f.on.Load()
+}
+
+func currentFeatureFlags() map[string]bool {
+	flags := make(map[string]bool, len(featureFlags))
+	for name, f := range featureFlags {
+		flags[name] = f.Enabled()
+	}
+	return flags
+}
+
+// values (設定ファイルの中身) に無いフラグは base の値のまま
+func readFeatureFlags(values map[string]string, base map[string]bool) (map[string]bool, error) {
+	flags := maps.Clone(base)
+	for name, f := range featureFlags {
+		v, err := lookupConfig(values, f.env, flags[name], strconv.ParseBool)
+		if err != nil {
+			return base, err
+		}
+		flags[name] = v
+	}
+	return flags, nil
+}
+
+func applyFeatureFlags(flags map[string]bool) {
+	for name, on := range flags {
+		f, ok := featureFlags[name]
+		if !ok {
+			continue
+		}
+		if f.on.Swap(on) != on {
+			metricCounter(metricName("feature_flag_changes_total", "flag", name)).Inc()
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// ホットなクエリが頼っているインデックス。init.sh がスキーマを作り直しても落ちていないことを、マイグレーションの最後に確かめる
+// 先頭から同じ列を持つインデックスが既にあればそれで足りるとみなし、無ければ作る
+type requiredIndex struct {
+	Table   string
+	Name    string
+	Columns []string
+	// EXPLAIN で実際にインデックスが選ばれるかを見るクエリ。? には適当な値を入れる
+	Probe string
+}
+
+var requiredIndexes = []requiredIndex{
+	{Table: "rides", Name: "idx_rides_chair_id", Columns: []string{"chair_id"}, Probe: `SELECT id FROM rides WHERE chair_id = ?`},
+	{Table: "rides", Name: "idx_rides_user_id_created_at", Columns: []string{"user_id", "created_at"}, Probe: `SELECT id FROM rides WHERE user_id = ? ORDER BY created_at`},
+	// ステータスの並びは seq で決めるようになったので、created_at ではなく seq と組にする
+	{Table: "ride_statuses", Name: "idx_ride_statuses_ride_id_seq", Columns: []string{"ride_id", "seq"}, Probe: `SELECT id FROM ride_statuses WHERE ride_id = ? ORDER BY seq`},
+	{Table: "chair_locations", Name: "idx_chair_locations_chair_id_created_at", Columns: []string{"chair_id", "created_at"}, Probe: `SELECT id FROM chair_locations WHERE chair_id = ? ORDER BY created_at`},
+	{Table: "chairs", Name: "idx_chairs_access_token", Columns: []string{"access_token"}, Probe: `SELECT id FROM chairs WHERE access_token = ?`},
+	{Table: "users", Name: "idx_users_access_token", Columns: []string{"access_token"}, Probe: `SELECT id FROM users WHERE access_token = ?`},
+}
+
+// テーブルのインデックス名 → 列 (インデックス内の順)
+func tableIndexes(ctx context.Context, table string) (map[string][]string, error) {
+	rows := []struct {
+		IndexName  string `db:"INDEX_NAME"`
+		ColumnName string `db:"COLUMN_NAME"`
+	}{}
+	if err := db.SelectContext(ctx, &rows, `SELECT INDEX_NAME, COLUMN_NAME FROM information_schema.STATISTICS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? ORDER BY INDEX_NAME, SEQ_IN_INDEX`, table); err != nil {
+		return nil, err
+	}
+	indexes := map[string][]string{}
+	for _, r := range rows {
+		indexes[r.IndexName] = append(indexes[r.IndexName], r.ColumnName)
+	}
+	return indexes, nil
+}
+
+// 先頭の列が idx.Columns と一致するインデックスの名前
+func coveringIndexes(indexes map[string][]string, idx requiredIndex) []string {
+	names := []string{}
+	for name, cols := range indexes {
+		if len(cols) >= len(idx.Columns) && slices.Equal(cols[:len(idx.Columns)], idx.Columns) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func ensureIndexes(ctx context.Context) error {
+	created := []string{}
+	for _, idx := range requiredIndexes {
+		indexes, err := tableIndexes(ctx, idx.Table)
+		if err != nil {
+			return err
+		}
+		names := coveringIndexes(indexes, idx)
+		if len(names) == 0 {
+			stmt := fmt.Sprintf("CREATE INDEX %s ON %s (%s)", idx.Name, idx.Table, strings.Join(idx.Columns, ", "))
+			if _, err := db.ExecContext(ctx, stmt); err != nil && !isAlreadyMigrated(err) {
+				return fmt.Errorf("ensure index %s: %w", idx.Name, err)
+			}
+			created = append(created, idx.Table+"."+idx.Name)
+			names = []string{idx.Name}
+		}
+		explainIndexUsage(ctx, idx, names)
+	}
+	if len(created) > 0 {
+		slog.Warn("created missing indexes", "indexes", created)
+	}
+	return nil
+}
+
+// 行が少ないとオプティマイザがインデックスを使わないことがあるので、使われていなくても警告に留める
+func explainIndexUsage(ctx context.Context, idx requiredIndex, names []string) {
+	rows, err := db.QueryxContext(ctx, "EXPLAIN "+idx.Probe, "")
+	if err != nil {
+		slog.Warn("failed to explain index probe", "index", idx.Name, "err", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		row := map[string]any{}
+		if err := rows.MapScan(row); err != nil {
+			slog.Warn("failed to explain index probe", "index", idx.Name, "err", err)
+			return
+		}
+		key, _ := row["key"].([]byte)
+		if slices.Contains(names, string(key)) {
+			return
+		}
+		slog.Warn("index not chosen by optimizer", "table", idx.Table, "columns", idx.Columns, "key", string(key), "query", idx.Probe)
+	}
+}
@@ -1,55 +1,289 @@
 package main
 
 import (
-	"database/sql"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/net/websocket"
 )
 
 // このAPIをインスタンス内から一定間隔で叩かせることで、椅子とライドをマッチングさせる
 func internalGetMatching(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	// MEMO: 一旦最も待たせているリクエストに適当な空いている椅子マッチさせる実装とする。おそらくもっといい方法があるはず…
-	rides := []Ride{}
-	if err := db.SelectContext(ctx, &rides, `SELECT * FROM rides WHERE chair_id IS NULL ORDER BY created_at`); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
+	matchingMu.Lock()
+	defer matchingMu.Unlock()
+	if draining.Load() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	defer observeMatchingRound(time.Now())
+
+	rides, chairs, err := loadMatchingInput(ctx)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
+	// 空き椅子が 1 台も無いときは単なる供給不足なので、マッチングを回さずに待っている数だけ記録する
+	if len(chairs) == 0 {
+		metricGauge("matching_rides_waiting_without_free_chairs").Set(int64(len(rides)))
+		updateMatchingQueue(rides, nil, time.Now())
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	metricGauge("matching_rides_waiting_without_free_chairs").Set(0)
 
-	for _, ride := range rides {
-		matched := &Chair{}
-		empty := false
-		for i := 0; i < 10; i++ {
-			if err := db.GetContext(ctx, matched, "SELECT * FROM chairs INNER JOIN (SELECT id FROM chairs WHERE is_active = TRUE ORDER BY RAND() LIMIT 1) AS tmp ON chairs.id = tmp.id LIMIT 1"); err != nil {
-				if errors.Is(err, sql.ErrNoRows) {
-					w.WriteHeader(http.StatusNoContent)
-					return
-				}
-				writeError(w, http.StatusInternalServerError, err)
+	report := matchRides(rides, chairs)
+	chairByID := make(map[string]*Chair, len(chairs))
+	for i := range chairs {
+		chairByID[chairs[i].Chair.ID] = &chairs[i].Chair
+	}
+	rideIDs := make([]string, 0, len(report.Pairs))
+	for _, pair := range report.Pairs {
+		rideIDs = append(rideIDs, pair.RideID)
+	}
+	defer locks.ForRides(rideIDs)()
+	finishJournal, err := journalMatchingPairs(report.Pairs)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	err = withTx(ctx, func(tx *sqlx.Tx) error {
+		for _, pair := range report.Pairs {
+			if _, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", pair.ChairID, pair.RideID); err != nil {
+				return err
 			}
+		}
+		return nil
+	})
+	finishJournal(err)
+	if err != nil {
+		writeTxError(w, err)
+		return
+	}
+	for _, pair := range report.Pairs {
+		cacheRideChair(currentCaches(), pair.RideID, chairByID[pair.ChairID])
+		chairCurrentRideCache.Set(pair.ChairID, pair.RideID)
+		recordRideAssignment(pair, assignmentByRound)
+		chairNotifier.Notify(pair.ChairID)
+		publishRideEvent(rideEvent{Type: rideEventAssigned, RideID: pair.RideID, ChairID: pair.ChairID})
+	}
+	lastMatchingReport.Store(report)
+	updateMatchingQueue(rides, report.Pairs, time.Now())
+	// 戦略ごとに実際に割り当てたライドの運賃を積み上げ、重みの効果を比べられるようにする
+	metricCounter(metricName("matching_matched_fare_total", "strategy", report.Strategy)).Add(int64(report.MatchedFare))
+	metricCounter(metricName("matching_pairs_total", "strategy", report.Strategy)).Add(int64(len(report.Pairs)))
+	logMatchingSummary(rides, report)
+	recordMatchingQuality(rides, report)
+	checkMatchingStarvation(rides, report)
+
+	w.WriteHeader(http.StatusNoContent)
+}
 
-			if err := db.GetContext(ctx, &empty, "SELECT COUNT(*) = 0 FROM (SELECT COUNT(chair_sent_at) = 6 AS completed FROM ride_statuses WHERE ride_id IN (SELECT id FROM rides WHERE chair_id = ?) GROUP BY ride_id) is_completed WHERE completed = FALSE", matched.ID); err != nil {
-				writeError(w, http.StatusInternalServerError, err)
+// 割り当ては行わず、今の状態でマッチングした場合の結果だけを返す
+func internalPostMatchingDryRun(w http.ResponseWriter, r *http.Request) {
+	matchingMu.Lock()
+	defer matchingMu.Unlock()
+
+	rides, chairs, err := loadMatchingInput(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, matchRides(rides, chairs))
+}
+
+func loadMatchingInput(ctx context.Context) ([]Ride, []matchingChair, error) {
+	rides, err := selectPendingRides(ctx, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rides) == 0 {
+		return rides, nil, nil
+	}
+
+	activeChairs, err := selectChairsContext(ctx, db, `SELECT `+chairColumns+` FROM chairs WHERE is_active = TRUE`)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(activeChairs) == 0 {
+		return rides, nil, nil
+	}
+
+	now := time.Now()
+	silent, unlocated := 0, 0
+	chairs := []matchingChair{}
+	for _, chair := range activeChairs {
+		if _, ok := chairDeactivationPending.Get(chair.ID); ok {
+			continue
+		}
+		// クライアントが落ちた椅子に割り当て続けないよう、連絡が途絶えている間は外す
+		if isChairSilent(chair.ID, now) {
+			silent++
+			continue
+		}
+		if isChairPenalized(chair.ID, now) || isChairHeld(chair.ID, now) {
+			continue
+		}
+
+		free, err := isChairFree(ctx, chair.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !free {
+			continue
+		}
+
+		pos, ok := chairPositionCache.Get(chair.ID)
+		recordCacheLookup(ctx, "chair_positions", ok)
+		// 位置をまだ報告していない椅子は (0,0) にいることにせず、候補から外す
+		if !ok {
+			unlocated++
+			continue
+		}
+		age := now.Sub(pos.ReportedAt)
+		// 報告が古い椅子は、その間に進んだはずの位置で距離を測る
+		speed, _ := chairModelSpeedCache.Get(chair.Model)
+		position := estimateChairPosition(chair.ID, pos, speed, age)
+		chairs = append(chairs, matchingChair{
+			Chair:          chair,
+			Position:       position,
+			CompletedRides: completedRides(chair.ID),
+			PositionAge:    age,
+			Speed:          speed,
+		})
+	}
+
+	metricGauge("matching_silent_chairs").Set(int64(silent))
+	metricGauge("matching_unlocated_chairs").Set(int64(unlocated))
+
+	return rides, chairs, nil
+}
+
+func internalGetMatchingReport(w http.ResponseWriter, r *http.Request) {
+	report := lastMatchingReport.Load()
+	if report == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// ライドのイベントを WebSocket で流し続ける。ride_id / chair_id クエリで絞り込める
+func internalWsEvents(conn *websocket.Conn) {
+	defer conn.Close()
+	q := conn.Request().URL.Query()
+	rideID := q.Get("ride_id")
+	chairID := q.Get("chair_id")
+
+	events, unsubscribe := subscribeRideEvents()
+	defer unsubscribe()
+	defer trackSubscriber("websocket")()
+
+	// クライアントからは何も送られてこないので、読み込みが失敗したら切断とみなす
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard []byte
+		for websocket.Message.Receive(conn, &discard) == nil {
+		}
+	}()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
 				return
 			}
-			if empty {
-				break
+			if rideID != "" && ev.RideID != rideID {
+				continue
+			}
+			if chairID != "" && ev.ChairID != chairID {
+				continue
+			}
+			if err := websocket.JSON.Send(conn, ev); err != nil {
+				return
 			}
+		case <-closed:
+			recordClientAbort("websocket")
+			return
 		}
-		if !empty {
-			w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// WebSocket と同じイベントを SSE で流す。Last-Event-ID を付けて再接続すると続きから受け取れる
+func internalGetSSEEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+	q := r.URL.Query()
+	rideID := q.Get("ride_id")
+	chairID := q.Get("chair_id")
+
+	afterID := int64(-1)
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || id < 0 {
+			writeError(w, http.StatusBadRequest, errors.New("Last-Event-ID is invalid"))
 			return
 		}
+		afterID = id
+	}
+
+	backlog, events, unsubscribe, ok := subscribeRideEventsAfter(afterID)
+	defer unsubscribe()
+	defer trackSubscriber("sse")()
 
-		if _, err := db.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ?", matched.ID, ride.ID); err != nil {
-			writeError(w, http.StatusInternalServerError, err)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if !ok {
+		// 続きがログから消えているので、クライアントに状態を取り直してもらう
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+
+	send := func(ev rideEvent) error {
+		if rideID != "" && ev.RideID != rideID {
+			return nil
+		}
+		if chairID != "" && ev.ChairID != chairID {
+			return nil
+		}
+		b, err := json.Marshal(ev)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, b)
+		return err
+	}
+	for _, ev := range backlog {
+		if err := send(ev); err != nil {
 			return
 		}
 	}
+	flusher.Flush()
 
-	w.WriteHeader(http.StatusNoContent)
+	for {
+		select {
+		case ev, ok := <-events:
+			// 詰まって購読を切られたら接続を閉じ、Last-Event-ID で再開してもらう
+			if !ok {
+				return
+			}
+			if err := send(ev); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			recordClientAbort("sse")
+			return
+		}
+	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// 招待コード → 招待した側のユーザーID
+// 初期化時に全ユーザー分を載せるので、ここに無いコードは存在しないものとして扱う
+var invitationCodeIndex = NewCache[string, string]()
+
+// 衝突したときに作り直す回数の上限
+const invitationCodeAttempts = 5
+
+var errInvitationCodeExhausted = errors.New("failed to generate a unique invitation code")
+
+// 他のユーザーと被らない招待コードを作り、userID の分として押さえておく
+// 登録に失敗したら releaseInvitationCode で手放す
+func reserveInvitationCode(userID string) (string, error) {
+	for range invitationCodeAttempts {
+		code := secureRandomStr(15)
+		reserved := false
+		invitationCodeIndex.Update(code, func(owner string, found bool) string {
+			if found {
+				return owner
+			}
+			reserved = true
+			return userID
+		})
+		if reserved {
+			return code, nil
+		}
+		metricCounter(metricName("invitation_code_collisions_total", "source", "memory")).Inc()
+	}
+	return "", errInvitationCodeExhausted
+}
+
+func releaseInvitationCode(code string) {
+	invitationCodeIndex.Delete(code)
+}
+
+// ユーザーを INSERT する。キャッシュに載っていないコードと DB の UNIQUE 制約でぶつかったら、コードを作り直してやり直す
+// 実際に使った招待コードを返す
+func insertUserWithInvitationCode(ctx context.Context, tx *sqlx.Tx, user *User) (string, error) {
+	code, err := reserveInvitationCode(user.ID)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		_, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO users (id, username, firstname, lastname, date_of_birth, access_token, invitation_code) VALUES (?, ?, ?, ?, ?, ?, ?)",
+			user.ID, user.Username, user.Firstname, user.Lastname, user.DateOfBirth, user.AccessToken, code,
+		)
+		if err == nil {
+			return code, nil
+		}
+		releaseInvitationCode(code)
+		var mysqlErr *mysql.MySQLError
+		if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 || !strings.Contains(mysqlErr.Message, "invitation_code") || attempt >= invitationCodeAttempts {
+			return "", err
+		}
+		metricCounter(metricName("invitation_code_collisions_total", "source", "db")).Inc()
+		if code, err = reserveInvitationCode(user.ID); err != nil {
+			return "", err
+		}
+	}
+}
+
+// 招待コードから招待した側のユーザーを引く
+// 登録中のユーザーのコードも載っているが、コードはコミット後にしか本人へ返さないので使われることはない
+func lookupInviter(ctx context.Context, code string) (string, bool) {
+	inviterID, ok := invitationCodeIndex.Get(code)
+	recordCacheLookup(ctx, "invitation_codes", ok)
+	return inviterID, ok
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 処理中のリクエストがこれを超えたら、優先度の低いエンドポイントは 429 で断る。0 なら見ない
+var shedMaxInFlight = int64(getEnvInt("ISUCON_SHED_MAX_INFLIGHT", 256))
+
+// 直近のレイテンシの p99 がこれを超えたら、優先度の低いエンドポイントは 429 で断る。0 なら見ない
+var shedLatencyThreshold = time.Duration(getEnvInt("ISUCON_SHED_P99_MS", 500)) * time.Millisecond
+
+const latencyWindowSize = 1024
+
+var (
+	inFlightRequests atomic.Int64
+	latencyP99       atomic.Int64
+
+	// 直近 latencyWindowSize 件のレイテンシ
+	latencyWindow = struct {
+		sync.Mutex
+		samples []time.Duration
+		next    int
+	}{samples: make([]time.Duration, 0, latencyWindowSize)}
+)
+
+// 全リクエストの処理中の数とレイテンシを記録する
+// 繋ぎっぱなしのリクエストは負荷と関係なく長くかかるので数えない
+func loadTrackingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isLongLivedRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		inFlightRequests.Add(1)
+		start := time.Now()
+		defer func() {
+			inFlightRequests.Add(-1)
+			recordLatency(time.Since(start))
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// 椅子の通知のロングポーリングと、イベントの SSE・WebSocket
+func isLongLivedRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/internal/sse/events", "/api/internal/ws/events":
+		return true
+	case "/api/chair/notification":
+		v := r.URL.Query().Get("wait")
+		return v != "" && v != "0"
+	}
+	return false
+}
+
+func recordLatency(d time.Duration) {
+	latencyWindow.Lock()
+	defer latencyWindow.Unlock()
+	if len(latencyWindow.samples) < latencyWindowSize {
+		latencyWindow.samples = append(latencyWindow.samples, d)
+		return
+	}
+	latencyWindow.samples[latencyWindow.next] = d
+	latencyWindow.next = (latencyWindow.next + 1) % latencyWindowSize
+}
+
+// リクエストのたびにソートしないよう、p99 は 1 秒ごとに計算し直す
+func runLoadMonitor() {
+	for range time.Tick(time.Second) {
+		latencyWindow.Lock()
+		samples := slices.Clone(latencyWindow.samples)
+		latencyWindow.Unlock()
+		if len(samples) == 0 {
+			continue
+		}
+		slices.Sort(samples)
+		p99 := samples[len(samples)*99/100]
+		latencyP99.Store(int64(p99))
+		metricGauge("http_latency_p99_ms").Set(p99.Milliseconds())
+		metricGauge("http_in_flight_requests").Set(inFlightRequests.Load())
+	}
+}
+
+func overloaded() (bool, string) {
+	if shedMaxInFlight > 0 && inFlightRequests.Load() > shedMaxInFlight {
+		return true, "in_flight"
+	}
+	if shedLatencyThreshold > 0 && time.Duration(latencyP99.Load()) > shedLatencyThreshold {
+		return true, "latency"
+	}
+	return false, ""
+}
+
+// 捌けるまでの目安。p99 を処理中の数が上限を超えている割合で伸ばす
+func overloadRetryAfter() time.Duration {
+	d := time.Duration(latencyP99.Load())
+	if shedMaxInFlight > 0 {
+		if n := inFlightRequests.Load(); n > shedMaxInFlight {
+			d = d * time.Duration(n) / time.Duration(shedMaxInFlight)
+		}
+	}
+	return d
+}
+
+// オーナー向けの集計や履歴など、スコアに直結しないエンドポイントにだけ付ける
+// 過負荷のときはすぐに 429 を返し、ライドや椅子のエンドポイントに余力を回す
+func shedLoadMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if shed, reason := overloaded(); shed {
+			rejectOverloaded(w, r, "shed", reason, overloadRetryAfter())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// スコアに直結するエンドポイント。ここが断られていたら制限か shedLoadMiddleware の付け方が間違っている
+// GET /api/app/rides (履歴) のように同じパスで後回しにしてよいものがあるので、メソッドも含めて見る
+var scoreCriticalRoutes = map[string]struct{}{
+	"POST /api/app/rides":                      {},
+	"GET /api/app/notification":                {},
+	"POST /api/app/rides/{ride_id}/evaluation": {},
+	"POST /api/chair/coordinate":               {},
+	"GET /api/chair/notification":              {},
+	"POST /api/chair/rides/{ride_id}/status":   {},
+	"GET /api/internal/matching":               {},
+}
+
+// "METHOD /path" の形にする。ルートのパターンにメソッドが付いていなければリクエストのものを使う
+func scoreCriticalRouteKey(r *http.Request, route string) string {
+	if _, path, ok := strings.Cut(route, " "); ok {
+		route = path
+	}
+	return r.Method + " " + route
+}
+
+const maxRetryAfter = 30 * time.Second
+
+// レート制限と負荷による遮断の共通の断り方。Retry-After は秒単位に切り上げ、1 秒から maxRetryAfter に収める
+// source は "rate_limit" か "shed"、reason はその中の理由 (クラス名や過負荷の種類)
+func rejectOverloaded(w http.ResponseWriter, r *http.Request, source, reason string, retryAfter time.Duration) {
+	route := routeFromContext(r.Context())
+	metricCounter(metricName("requests_rejected_total", "route", route, "source", source, "reason", reason)).Inc()
+	route = scoreCriticalRouteKey(r, route)
+	if _, ok := scoreCriticalRoutes[route]; ok {
+		metricCounter(metricName("requests_rejected_critical_total", "route", route)).Inc()
+		slog.Warn("score-critical request rejected", "route", route, "source", source, "reason", reason)
+	} else {
+		slog.Debug("request rejected", "route", route, "source", source, "reason", reason)
+	}
+	secs := int(math.Ceil(min(max(retryAfter, time.Second), maxRetryAfter).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeError(w, http.StatusTooManyRequests, errors.New("too many requests"))
+}
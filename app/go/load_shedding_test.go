@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoadTrackingSkipsLongLivedRequests(t *testing.T) {
+	tests := []struct {
+		target  string
+		tracked bool
+	}{
+		{"/api/chair/notification", true},
+		{"/api/chair/notification?wait=0", true},
+		{"/api/chair/notification?wait=5", false},
+		{"/api/internal/sse/events", false},
+		{"/api/internal/ws/events", false},
+		{"/api/app/notification", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var inFlight int64
+			h := loadTrackingMiddleware(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+				inFlight = inFlightRequests.Load()
+			}))
+			before := inFlightRequests.Load()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if got := inFlight > before; got != tt.tracked {
+				t.Fatalf("tracked = %v, want %v", got, tt.tracked)
+			}
+		})
+	}
+}
+
+func TestScoreCriticalRouteKey(t *testing.T) {
+	tests := []struct {
+		method, route string
+		critical      bool
+	}{
+		{http.MethodPost, "POST /api/app/rides", true},
+		{http.MethodGet, "GET /api/app/rides", false},
+		{http.MethodPost, "/api/app/rides", true},
+		{http.MethodGet, "/api/app/rides", false},
+		{http.MethodGet, "GET /api/chair/notification", true},
+		{http.MethodGet, "GET /api/owner/sales", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/", nil)
+		_, got := scoreCriticalRoutes[scoreCriticalRouteKey(r, tt.route)]
+		if got != tt.critical {
+			t.Errorf("%s %q: critical = %v, want %v", tt.method, tt.route, got, tt.critical)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"sync"
+)
+
+// 同じライドを別々の主体 (椅子のステータス更新・評価・マッチング・割り当ての回収) が同時に書き換えないようにする
+// DB の行ロックに頼らずキャッシュだけを見て判断する処理でも、コミットとキャッシュの反映までを一続きにできる
+// 使う側は defer locks.ForRide(rideID)() のように解放関数をすぐ defer する
+type lockRegistry struct {
+	mu    sync.Mutex
+	locks map[string]*refLock
+}
+
+// 待っている分も含めて誰も使わなくなったら map から消す
+type refLock struct {
+	sync.Mutex
+	refs int
+}
+
+var locks = &lockRegistry{locks: map[string]*refLock{}}
+
+func (r *lockRegistry) acquire(key string) func() {
+	r.mu.Lock()
+	l, ok := r.locks[key]
+	if !ok {
+		l = &refLock{}
+		r.locks[key] = l
+	}
+	l.refs++
+	r.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		r.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(r.locks, key)
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *lockRegistry) ForRide(rideID string) func() {
+	return r.acquire(rideID)
+}
+
+// 複数のライドをまとめて取る。取り合いでデッドロックしないよう ID 順に取る
+// 他の処理はライドを 1 つしか取らないので、待ちの輪ができるのは複数を取るここだけになる
+func (r *lockRegistry) ForRides(rideIDs []string) func() {
+	ids := slices.Clone(rideIDs)
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+	releases := make([]func(), 0, len(ids))
+	for _, id := range ids {
+		releases = append(releases, r.acquire(id))
+	}
+	return func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// 書き込みを別 goroutine に任せる io.Writer。キューが埋まっていたら待たずに捨てる
+// slog のハンドラは 1 レコードを 1 回の Write で書くので、レコード単位で捨てられる
+type asyncWriter struct {
+	out     io.Writer
+	queue   chan []byte
+	dropped *counter
+	pending sync.WaitGroup
+}
+
+func newAsyncWriter(out io.Writer, size int) *asyncWriter {
+	w := &asyncWriter{
+		out:     out,
+		queue:   make(chan []byte, size),
+		dropped: metricCounter("log_records_dropped_total"),
+	}
+	go w.run()
+	return w
+}
+
+func (w *asyncWriter) Write(p []byte) (int, error) {
+	// ハンドラはバッファを使い回すのでコピーしてから渡す
+	b := append([]byte(nil), p...)
+	w.pending.Add(1)
+	select {
+	case w.queue <- b:
+	default:
+		w.pending.Done()
+		w.dropped.Inc()
+	}
+	return len(p), nil
+}
+
+func (w *asyncWriter) run() {
+	for b := range w.queue {
+		w.out.Write(b)
+		w.pending.Done()
+	}
+}
+
+// キューに残っているレコードを書き終わるまで待つ。os.Exit の前に呼ぶ
+func (w *asyncWriter) Flush() {
+	w.pending.Wait()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+var logLevel = new(slog.LevelVar)
+
+// ログを書き出すキューの長さ。0 なら stderr に直接書く
+var logQueueSize = getEnvInt("ISUCON_LOG_QUEUE_SIZE", 1024)
+
+var logWriter *asyncWriter
+
+// ISUCON_LOG_LEVEL (debug/info/warn/error) と ISUCON_LOG_FORMAT (text/json) からロガーを設定する
+func setupLogger() {
+	level, err := parseLogLevel(os.Getenv("ISUCON_LOG_LEVEL"))
+	if err != nil {
+		panic(err)
+	}
+	// 本番ビルドでは指定が無ければ info のログを出さない
+	if competitionBuild && os.Getenv("ISUCON_LOG_LEVEL") == "" {
+		level = slog.LevelWarn
+	}
+	logLevel.Set(level)
+
+	var out io.Writer = os.Stderr
+	if logQueueSize > 0 {
+		logWriter = newAsyncWriter(os.Stderr, logQueueSize)
+		out = logWriter
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch format := strings.ToLower(os.Getenv("ISUCON_LOG_FORMAT")); format {
+	case "", "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		panic(fmt.Sprintf("unknown ISUCON_LOG_FORMAT: %s", format))
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func flushLogs() {
+	if logWriter != nil {
+		logWriter.Flush()
+	}
+}
+
+func parseLogLevel(v string) (slog.Level, error) {
+	switch strings.ToLower(v) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level: %s", v)
+}
@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestLRUCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newLRUCache[string, int](2)
+	c.Set("a", 1)
+	c.Set("b", 2)
+	// a を使ったので、溢れたときに捨てられるのは b
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Fatalf("Get(a) = %d, %v", v, ok)
+	}
+	c.Set("c", 3)
+
+	if c.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", c.Len())
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("b was not evicted")
+	}
+	for k, want := range map[string]int{"a": 1, "c": 3} {
+		if v, ok := c.Get(k); !ok || v != want {
+			t.Fatalf("Get(%s) = %d, %v, want %d", k, v, ok, want)
+		}
+	}
+}
+
+func useRouteDistanceCache(t *testing.T, size int) {
+	t.Helper()
+	prevSize, prevCache := routeDistanceCacheSize, routeDistanceCache
+	routeDistanceCacheSize, routeDistanceCache = size, newLRUCache[routeKey, int](max(size, 0))
+	t.Cleanup(func() { routeDistanceCacheSize, routeDistanceCache = prevSize, prevCache })
+}
+
+// 同じ乗車地と目的地の組は 2 回目からキャッシュで返す
+func TestCalculateRouteDistanceCachesRepeatedPairs(t *testing.T) {
+	useRouteDistanceCache(t, 2)
+	pickup, destination := Coordinate{Latitude: 0, Longitude: 0}, Coordinate{Latitude: 3, Longitude: -4}
+
+	if d := calculateRouteDistance(pickup, destination); d != 7 {
+		t.Fatalf("calculateRouteDistance() = %d, want 7", d)
+	}
+	if d, ok := routeDistanceCache.Get(routeKey{pickup, destination}); !ok || d != 7 {
+		t.Fatalf("pair was not cached: %d, %v", d, ok)
+	}
+	// キャッシュに載っている値を返していることを、計算結果と違う値を置いて確かめる
+	routeDistanceCache.Set(routeKey{pickup, destination}, 100)
+	if d := calculateRouteDistance(pickup, destination); d != 100 {
+		t.Fatalf("repeated pair was recomputed: %d", d)
+	}
+	// 向きが逆の組は別のキー
+	if d := calculateRouteDistance(destination, pickup); d != 7 {
+		t.Fatalf("reversed pair = %d, want 7", d)
+	}
+
+	// 上限を超えたら古い組から捨てる
+	calculateRouteDistance(Coordinate{Latitude: 1}, Coordinate{Latitude: 2})
+	if n := routeDistanceCache.Len(); n != 2 {
+		t.Fatalf("cache has %d pairs, want 2", n)
+	}
+	if _, ok := routeDistanceCache.Get(routeKey{pickup, destination}); ok {
+		t.Fatal("least recently used pair was not evicted")
+	}
+}
+
+func TestCalculateRouteDistanceCacheDisabled(t *testing.T) {
+	useRouteDistanceCache(t, 0)
+	calculateRouteDistance(Coordinate{}, Coordinate{Latitude: 5})
+	if n := routeDistanceCache.Len(); n != 0 {
+		t.Fatalf("cache has %d pairs although it is disabled", n)
+	}
+}
@@ -3,9 +3,9 @@ package main
 import (
 	"context"
 	crand "crypto/rand"
+	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
 	"log/slog"
 	"net"
 	"net/http"
@@ -15,7 +15,6 @@ import (
 	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/kaz/pprotein/integration/standalone"
@@ -24,12 +23,66 @@ import (
 var db *sqlx.DB
 
 func main() {
-	mux := setup()
-	slog.Info("Listening on :8080")
-	http.ListenAndServe(":8080", mux)
+	setupLogger()
+	defer flushLogs()
+	recordStartupConfig()
+	tuneRuntime()
+
+	cmd := "serve"
+	if len(os.Args) > 1 {
+		cmd = os.Args[1]
+	}
+
+	switch cmd {
+	case "serve":
+		mux := setup()
+		slog.Info("Listening on :8080")
+		http.ListenAndServe(":8080", mux)
+	case "warmup":
+		// キャッシュを作り直せることだけ確認して終了する
+		connectDB()
+		cacheInit()
+		slog.Info("warmup done")
+	case "migrate":
+		connectDB()
+		if err := runMigrations(context.Background()); err != nil {
+			slog.Error("migrate failed", "err", err)
+			exit(1)
+		}
+		slog.Info("migrate done")
+	case "verify":
+		// 起動中のインスタンスのキャッシュを DB と突き合わせる
+		mismatches, err := runVerify()
+		if err != nil {
+			slog.Error("verify failed", "err", err)
+			exit(1)
+		}
+		for _, m := range mismatches {
+			fmt.Println(m)
+		}
+		if len(mismatches) > 0 {
+			exit(1)
+		}
+		slog.Info("verify done: no mismatches")
+	case "bench-warm":
+		// 起動中のインスタンスに合成トラフィックを流す
+		if err := runBenchWarm(); err != nil {
+			slog.Error("bench-warm failed", "err", err)
+			exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "usage: %s [serve|warmup|migrate|verify|bench-warm]\n", os.Args[0])
+		os.Exit(2)
+	}
 }
 
-func setup() http.Handler {
+// os.Exit は defer を走らせないので、非同期のログを書き切ってから終了する
+func exit(code int) {
+	flushLogs()
+	os.Exit(code)
+}
+
+func connectDB() {
 	host := os.Getenv("ISUCON_DB_HOST")
 	if host == "" {
 		host = "127.0.0.1"
@@ -64,21 +117,60 @@ func setup() http.Handler {
 	dbConfig.ParseTime = true
 	dbConfig.InterpolateParams = true
 
-	_db, err := sqlx.Connect("mysql", dbConfig.FormatDSN())
+	connector, err := mysql.NewConnector(dbConfig)
 	if err != nil {
 		panic(err)
 	}
-	db = _db
+	if sqlRouteComments || sqlQueryStats || sqlHotRouteAudit {
+		connector = taggingConnector{connector}
+	}
+	db = sqlx.NewDb(sql.OpenDB(connector), "mysql")
+	if err := db.Ping(); err != nil {
+		panic(err)
+	}
 	db.SetMaxOpenConns(64)
 	db.SetMaxIdleConns(64)
+}
+
+func setup() http.Handler {
+	connectDB()
+	if autoMigrate {
+		if err := runMigrations(context.Background()); err != nil {
+			panic(err)
+		}
+	}
+	detectSettledAtColumn(context.Background())
+	// 前のプロセスが書きかけたマッチング結果を、キャッシュを作る前に DB へ反映しておく
+	if err := reconcileMatchingJournal(context.Background()); err != nil {
+		panic(err)
+	}
 
 	go func() {
 		standalone.Integrate(":6458")
 	}()
 
+	if snapshotPath != "" {
+		if err := warmStartCaches(context.Background()); err != nil {
+			panic(err)
+		}
+		go runSnapshotter()
+	}
+
+	go runStamper()
+	go runChairLocationWriter()
+	go runAssignmentReaper()
+	go runEstimateHoldSweeper()
+	startPaymentWorkers()
+	startNotificationWorkers()
+	startRideEventWebhook()
+	go runLoadMonitor()
+	go runCacheBudgetSweeper()
+	go runReportSignalHandler()
+
 	mux := chi.NewRouter()
-	mux.Use(middleware.Logger)
-	mux.Use(middleware.Recoverer)
+	mux.Use(devMiddlewares()...)
+	mux.Use(recoverMiddleware)
+	mux.Use(loadTrackingMiddleware)
 	mux.HandleFunc("POST /api/initialize", postInitialize)
 
 	// app handlers
@@ -87,21 +179,32 @@ func setup() http.Handler {
 
 		authedMux := mux.With(appAuthMiddleware)
 		authedMux.HandleFunc("POST /api/app/payment-methods", appPostPaymentMethods)
-		authedMux.HandleFunc("GET /api/app/rides", appGetRides)
 		authedMux.HandleFunc("POST /api/app/rides", appPostRides)
 		authedMux.HandleFunc("POST /api/app/rides/estimated-fare", appPostRidesEstimatedFare)
 		authedMux.HandleFunc("POST /api/app/rides/{ride_id}/evaluation", appPostRideEvaluatation)
 		authedMux.HandleFunc("GET /api/app/notification", appGetNotification)
 		authedMux.HandleFunc("GET /api/app/nearby-chairs", appGetNearbyChairs)
+		authedMux.HandleFunc("GET /api/app/chair-models", appGetChairModels)
+
+		// 過負荷のときは後回しにする
+		sheddableMux := mux.With(shedLoadMiddleware, appAuthMiddleware)
+		sheddableMux.With(gzipMiddleware).HandleFunc("GET /api/app/rides", appGetRides)
+		sheddableMux.HandleFunc("GET /api/app/stats", appGetStats)
 	}
 
 	// owner handlers
 	{
 		mux.HandleFunc("POST /api/owner/owners", ownerPostOwners)
 
-		authedMux := mux.With(ownerAuthMiddleware)
-		authedMux.HandleFunc("GET /api/owner/sales", ownerGetSales)
+		// オーナー向けの集計は過負荷のときは後回しにする
+		authedMux := mux.With(shedLoadMiddleware, ownerAuthMiddleware)
+		authedMux.With(gzipMiddleware).HandleFunc("GET /api/owner/sales", ownerGetSales)
+		authedMux.With(gzipMiddleware).HandleFunc("GET /api/owner/sales.csv", ownerGetSalesCSV)
 		authedMux.HandleFunc("GET /api/owner/chairs", ownerGetChairs)
+		authedMux.HandleFunc("GET /api/owner/chairs/{chair_id}", ownerGetChairDetail)
+		authedMux.HandleFunc("GET /api/owner/stats", ownerGetStats)
+		authedMux.HandleFunc("GET /api/owner/summary", ownerGetSummary)
+		authedMux.HandleFunc("GET /api/owner/models", ownerGetModels)
 	}
 
 	// chair handlers
@@ -112,12 +215,21 @@ func setup() http.Handler {
 		authedMux.HandleFunc("POST /api/chair/activity", chairPostActivity)
 		authedMux.HandleFunc("POST /api/chair/coordinate", chairPostCoordinate)
 		authedMux.HandleFunc("GET /api/chair/notification", chairGetNotification)
+		authedMux.HandleFunc("GET /api/chair/rides", chairGetRides)
+		authedMux.HandleFunc("GET /api/chair/rides/current", chairGetCurrentRide)
 		authedMux.HandleFunc("POST /api/chair/rides/{ride_id}/status", chairPostRideStatus)
 	}
 
 	// internal handlers
 	{
 		mux.HandleFunc("GET /api/internal/matching", internalGetMatching)
+		mux.HandleFunc("GET /api/internal/matching/report", internalGetMatchingReport)
+		mux.HandleFunc("GET /api/internal/metrics", internalGetMetrics)
+		mux.HandleFunc("GET /api/internal/payments/failed", internalGetFailedPayments)
+		mux.HandleFunc("POST /api/internal/config/reload", internalPostConfigReload)
+		mux.HandleFunc("POST /api/internal/drain", internalPostDrain)
+		mux.HandleFunc("GET /api/internal/verify/caches", internalGetCacheCheck)
+		mountDevRoutes(mux)
 	}
 
 	return mux
@@ -131,6 +243,49 @@ type postInitializeResponse struct {
 	Language string `json:"language"`
 }
 
+func getEnvString(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func getEnvBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s environment variable as bool: %v", key, err))
+	}
+	return b
+}
+
+func getEnvInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s environment variable as int: %v", key, err))
+	}
+	return i
+}
+
+func getEnvFloat(key string, def float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		panic(fmt.Sprintf("failed to parse %s environment variable as float: %v", key, err))
+	}
+	return f
+}
+
 func absDiffInt(x, y int) int {
 	if x < y {
 		return y - x
@@ -139,38 +294,187 @@ func absDiffInt(x, y int) int {
 }
 
 func cacheInit() {
-	rideEvalCache.Init()
-	chairPositionCache.Init()
+	cacheInitFrom(nil)
+}
 
-	locations := []ChairLocation{}
-	if err := db.SelectContext(context.Background(), &locations, `select * from chair_locations order by created_at`); err != nil {
-		panic("cache init fail")
+// 新しい cacheSet を作り終えてから一度に差し替える。作っている間のリクエストやバックグラウンド処理は前の中身を見る
+func cacheInitFrom(snap *cacheSnapshot) {
+	s := newCacheSet()
+	buildCaches(s, snap)
+	liveCaches.Store(s)
+	metricGauge("payment_failed_rides").Set(int64(len(failedPaymentCache.Snapshot())))
+}
+
+// snap があれば、そこに含まれるキャッシュは MySQL から作り直さずにそれを使う
+func buildCaches(s *cacheSet, snap *cacheSnapshot) {
+	// スナップショットを使うときは、それより後に MySQL に書かれた分だけを読んで足す
+	var since time.Time
+	if snap != nil {
+		restoreCacheSnapshot(s, snap)
+		since = snap.TakenAt.Add(-snapshotReplayMargin)
 	}
 
+	locations, err := chairLocations.LoadSince(context.Background(), since)
+	if err != nil {
+		panic("cache init fail")
+	}
 	for _, pos := range locations {
-		updateOrInsertChairLocation(pos.ChairID, pos.Latitude, pos.Longitude, pos.CreatedAt)
+		// 余裕を持って読んだ分のうち、スナップショットに入っている位置は飛ばす
+		if cur, ok := chairPositionCache.in(s).Get(pos.ChairID); snap != nil && ok && !pos.CreatedAt.After(cur.ReportedAt) {
+			continue
+		}
+		updateOrInsertChairLocation(s, pos.ChairID, Coordinate{Latitude: pos.Latitude, Longitude: pos.Longitude}, pos.CreatedAt)
+		touchChair(s, pos.ChairID, pos.CreatedAt)
+	}
+
+	statuses := []RideStatus{}
+	if err := db.SelectContext(context.Background(), &statuses, `SELECT `+rideStatusColumns+` FROM ride_statuses ORDER BY ride_id, seq`); err != nil {
+		panic("cache init fail")
+	}
+	for _, rs := range statuses {
+		if !rs.Status.Valid() {
+			panic(fmt.Sprintf("ride_statuses %s has unknown status %q", rs.ID, rs.Status))
+		}
+		cacheRideStatuses(s, rs)
+		// スナップショットの後に通知した分もあるので、DB の送信済みと合わせる
+		if rs.AppSentAt != nil {
+			appSentStatusCache.in(s).Set(rs.ID, struct{}{})
+		}
+		if rs.ChairSentAt != nil {
+			chairSentStatusCache.in(s).Set(rs.ID, struct{}{})
+		}
+	}
+
+	models := []ChairModel{}
+	if err := db.SelectContext(context.Background(), &models, `SELECT name, speed FROM chair_models`); err != nil {
+		panic("cache init fail")
+	}
+	for _, m := range models {
+		chairModelSpeedCache.in(s).Set(m.Name, m.Speed)
+	}
+
+	registeredChairs, err := selectChairsContext(context.Background(), db, `SELECT `+chairColumns+` FROM chairs`)
+	if err != nil {
+		panic("cache init fail")
+	}
+	for i, c := range registeredChairs {
+		cacheOwnerChair(s, &registeredChairs[i])
+		chairRegistrationIndex.in(s).Set(chairRegistrationKey{OwnerID: c.OwnerID, Name: c.Name, Model: c.Model}, c.ID)
+	}
+
+	users := []User{}
+	if err := db.SelectContext(context.Background(), &users, `SELECT `+userColumns+` FROM users`); err != nil {
+		panic("cache init fail")
+	}
+	for i := range users {
+		cacheUser(s, &users[i])
+	}
+
+	riders := []string{}
+	if err := db.SelectContext(context.Background(), &riders, `SELECT DISTINCT user_id FROM rides`); err != nil {
+		panic("cache init fail")
+	}
+	for _, id := range riders {
+		usersWithRide.in(s).Set(id, struct{}{})
+	}
+
+	coupons := []Coupon{}
+	if err := db.SelectContext(context.Background(), &coupons, `SELECT `+couponColumns+` FROM coupons ORDER BY created_at`); err != nil {
+		panic("cache init fail")
+	}
+	for _, c := range coupons {
+		grantLedgerCoupon(s, c)
+	}
+
+	assignedChairs := []struct {
+		RideID string `db:"ride_id"`
+		chairRow
+	}{}
+	if err := db.SelectContext(context.Background(), &assignedChairs, `SELECT rides.id AS ride_id, chairs.id, chairs.owner_id, chairs.name, chairs.model FROM rides JOIN chairs ON rides.chair_id = chairs.id ORDER BY rides.updated_at`); err != nil {
+		panic("cache init fail")
+	}
+	for _, a := range assignedChairs {
+		chair := a.chairRow.model()
+		cacheRideChair(s, a.RideID, &chair)
+		chairCurrentRideCache.in(s).Set(chair.ID, a.RideID)
+	}
+
+	if snap == nil {
+		evaluations := []struct {
+			OwnerID string `db:"owner_id"`
+			Count   int    `db:"count"`
+			Sum     int    `db:"sum"`
+		}{}
+		if err := db.SelectContext(context.Background(), &evaluations, `SELECT chairs.owner_id, COUNT(*) AS count, SUM(rides.evaluation) AS sum FROM rides JOIN chairs ON rides.chair_id = chairs.id WHERE rides.evaluation IS NOT NULL GROUP BY chairs.owner_id`); err != nil {
+			panic("cache init fail")
+		}
+		for _, e := range evaluations {
+			ownerEvaluationCache.in(s).Set(e.OwnerID, ownerEvaluationStats{Count: e.Count, Sum: e.Sum})
+		}
+	}
+
+	completedRides := []struct {
+		rideRow
+		OwnerID     string    `db:"owner_id"`
+		Discount    int       `db:"discount"`
+		CompletedAt time.Time `db:"completed_at"`
+	}{}
+	query := `SELECT rides.id, rides.user_id, rides.chair_id, rides.pickup_latitude, rides.pickup_longitude, rides.destination_latitude, rides.destination_longitude, rides.evaluation, rides.updated_at, chairs.owner_id, IFNULL(coupons.discount, 0) AS discount, completed.created_at AS completed_at FROM rides JOIN chairs ON chairs.id = rides.chair_id JOIN ride_statuses completed ON completed.ride_id = rides.id AND completed.status = 'COMPLETED' LEFT JOIN coupons ON coupons.used_by = rides.id WHERE rides.evaluation IS NOT NULL`
+	args := []any{}
+	// 評価の後は書き換わらないので、スナップショットの後に評価されたライドだけを積み上げ直す
+	replayed := map[string]struct{}{}
+	if snap != nil {
+		query += ` AND rides.updated_at > ?`
+		args = append(args, since)
+		for _, entries := range snap.ChairRideHistory {
+			for _, e := range entries {
+				replayed[e.RideID] = struct{}{}
+			}
+		}
+	}
+	if err := db.SelectContext(context.Background(), &completedRides, query, args...); err != nil {
+		panic("cache init fail")
+	}
+	for _, c := range completedRides {
+		if _, ok := replayed[c.ID]; ok {
+			continue
+		}
+		ride := c.rideRow.model()
+		if snap != nil {
+			addOwnerEvaluation(s, c.OwnerID, *ride.Evaluation)
+		}
+		meteredFare := farePerDistance * ride.Pickup().DistanceTo(ride.Destination())
+		fare := rideFare{
+			Sale:    initialFare + meteredFare,
+			Charged: initialFare + max(meteredFare-c.Discount, 0),
+		}
+		completedRideFareCache.in(s).Set(ride.ID, fare)
+		addUserCompletedRide(s, ride.UserID, fare)
+		addChairCompletedRide(s, ride.ChairID.String, initialFare+meteredFare, *ride.Evaluation)
+		addChairRideHistory(s, ride.ChairID.String, &ride, fare, *ride.Evaluation)
+		addOwnerSale(s, c.OwnerID, initialFare+meteredFare, c.CompletedAt)
 	}
 }
 
-func updateOrInsertChairLocation(chairID string, lat, long int, t time.Time) {
-	cache, ok := chairPositionCache.Get(chairID)
+func updateOrInsertChairLocation(s *cacheSet, chairID string, pos Coordinate, t time.Time) {
+	cache, ok := chairPositionCache.in(s).Get(chairID)
 	if !ok {
-		chairPositionCache.Set(chairID, chairPositionCacheEntry{
-			LastLat:                lat,
-			LastLong:               long,
+		chairPositionCache.in(s).Set(chairID, chairPositionCacheEntry{
+			LastLat:                pos.Latitude,
+			LastLong:               pos.Longitude,
 			TotalDistance:          0,
 			TotalDistanceUpdatedAt: nil,
+			ReportedAt:             t,
 		})
 		return
 	}
 
-	latDiff := absDiffInt(cache.LastLat, lat)
-	longDiff := absDiffInt(cache.LastLong, long)
-	chairPositionCache.Set(chairID, chairPositionCacheEntry{
-		LastLat:                lat,
-		LastLong:               long,
-		TotalDistance:          cache.TotalDistance + latDiff + longDiff,
+	chairPositionCache.in(s).Set(chairID, chairPositionCacheEntry{
+		LastLat:                pos.Latitude,
+		LastLong:               pos.Longitude,
+		TotalDistance:          cache.TotalDistance + cache.Position().DistanceTo(pos),
 		TotalDistanceUpdatedAt: addrof(t),
+		ReportedAt:             t,
 	})
 }
 
@@ -179,11 +483,20 @@ func addrof[T any](v T) *T {
 }
 
 func postInitialize(w http.ResponseWriter, r *http.Request) {
-	cacheInit()
 	ctx := r.Context()
+	// キャッシュは作り終えてから差し替えるので、リクエストやバックグラウンド処理は止めない。マッチングだけは止めておく
+	matchingMu.Lock()
+	defer matchingMu.Unlock()
+	// 前のベンチマークの位置情報が新しい DB に書き込まれないよう、キューを先に空にする
+	if !flushChairLocations(5 * time.Second) {
+		slog.Warn("chair locations are still pending at initialize", "pending", chairLocationPending.Load())
+	}
+	if chairLocationCheck {
+		logChairLocationCheck(ctx)
+	}
 	req := &postInitializeRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
 
@@ -191,6 +504,23 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusInternalServerError, fmt.Errorf("failed to initialize: %s: %w", string(out), err))
 		return
 	}
+	if err := chairLocations.Reset(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if autoMigrate {
+		if err := runMigrations(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	detectSettledAtColumn(ctx)
+
+	if err := renewCacheGeneration(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
 
 	if _, err := db.ExecContext(ctx, "UPDATE settings SET value = ? WHERE name = 'payment_gateway_url'", req.PaymentServer); err != nil {
 		writeError(w, http.StatusInternalServerError, err)
@@ -199,24 +529,23 @@ func postInitialize(w http.ResponseWriter, r *http.Request) {
 
 	go func() {
 		if _, err := http.Get("http://192.168.0.13:9000/api/group/collect"); err != nil {
-			log.Printf("failed to communicate with pprotein: %v", err)
+			slog.Warn("failed to communicate with pprotein", "err", err)
 		}
 	}()
 
 	cacheInit()
+	resetMatchingQuality()
+	resetMatchingQueue()
+	resetRideLatency()
+	resetSQLAudit()
+	draining.Store(false)
+	if err := resetMatchingJournal(); err != nil {
+		slog.Warn("failed to reset matching journal", "err", err)
+	}
 
 	writeJSON(w, http.StatusOK, postInitializeResponse{Language: "go"})
 }
 
-type Coordinate struct {
-	Latitude  int `json:"latitude"`
-	Longitude int `json:"longitude"`
-}
-
-func bindJSON(r *http.Request, v interface{}) error {
-	return json.NewDecoder(r.Body).Decode(v)
-}
-
 func writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	buf, err := json.Marshal(v)
@@ -239,7 +568,7 @@ func writeError(w http.ResponseWriter, statusCode int, err error) {
 	}
 	w.Write(buf)
 
-	slog.Error("error response wrote", err)
+	slog.Error("error response wrote", "status", statusCode, "err", err)
 }
 
 func secureRandomStr(b int) string {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ライドと空き椅子の組を作るアルゴリズム。DB やキャッシュには触らず、渡されたものだけで決める
+// rides は優先したい順に並んでいる
+type Matcher interface {
+	Match(rides []Ride, chairs []matchingChair) []matchingPair
+}
+
+var matchers = map[string]Matcher{
+	"greedy":    greedyMatcher{},
+	"grid":      gridMatcher{},
+	"hungarian": hungarianMatcher{},
+}
+
+// 使うマッチングアルゴリズムの名前。設定のリロードで切り替えられる
+var matchingAlgorithm = getEnvString("ISUCON_MATCHING_ALGORITHM", "grid")
+
+func init() {
+	if _, err := lookupMatcher(matchingAlgorithm); err != nil {
+		panic(err)
+	}
+}
+
+func lookupMatcher(name string) (Matcher, error) {
+	m, ok := matchers[name]
+	if !ok {
+		names := make([]string, 0, len(matchers))
+		for n := range matchers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown matching algorithm %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return m, nil
+}
+
+func newMatchingPair(ride *Ride, chair *matchingChair) matchingPair {
+	distance := chair.Position.DistanceTo(ride.Pickup())
+	return matchingPair{
+		RideID:     ride.ID,
+		ChairID:    chair.Chair.ID,
+		Distance:   distance,
+		Score:      matchingScore(ride, distance, chair),
+		SpeedBonus: matchingSpeedBonus(ride, chair),
+	}
+}
+
+// 順にライドを見て、残っている全ての椅子の中からスコアが最小のものを割り当てる
+type greedyMatcher struct{}
+
+func (greedyMatcher) Match(rides []Ride, chairs []matchingChair) []matchingPair {
+	remaining := make([]int, len(chairs))
+	for i := range remaining {
+		remaining[i] = i
+	}
+	pairs := []matchingPair{}
+	for i := range rides {
+		best, _, _ := selectBestChair(&rides[i], chairs, remaining)
+		if best == -1 {
+			break
+		}
+		for j, c := range remaining {
+			if c == best {
+				remaining = append(remaining[:j], remaining[j+1:]...)
+				break
+			}
+		}
+		pairs = append(pairs, newMatchingPair(&rides[i], &chairs[best]))
+	}
+	return pairs
+}
+
+// greedy と同じ順で割り当てるが、グリッドで近くの候補だけに絞ってから正確な距離でスコアを出す
+type gridMatcher struct{}
+
+func (gridMatcher) Match(rides []Ride, chairs []matchingChair) []matchingPair {
+	grid := newChairGrid(chairs)
+	pairs := []matchingPair{}
+	for i := range rides {
+		best, _, _ := selectBestChair(&rides[i], chairs, grid.candidates(rides[i].Pickup()))
+		if best == -1 {
+			break
+		}
+		grid.remove(chairs, best)
+		pairs = append(pairs, newMatchingPair(&rides[i], &chairs[best]))
+	}
+	return pairs
+}
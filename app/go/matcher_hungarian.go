@@ -0,0 +1,126 @@
+package main
+
+import (
+	"math"
+	"slices"
+)
+
+// これより多い組み合わせは計算量が大きすぎるので grid に任せる
+const hungarianMaxCells = 250_000
+
+// スコアの合計が最小になる組を作る。ライドの優先順は考慮しない
+type hungarianMatcher struct{}
+
+func (hungarianMatcher) Match(rides []Ride, chairs []matchingChair) []matchingPair {
+	if len(rides) == 0 || len(chairs) == 0 {
+		return []matchingPair{}
+	}
+	if len(rides)*len(chairs) > hungarianMaxCells {
+		return gridMatcher{}.Match(rides, chairs)
+	}
+
+	// 費用が同じ組の選び方が入力の並び順で変わらないよう、椅子を chairBeforeOnTie の順に並べ直す
+	chairs = slices.Clone(chairs)
+	slices.SortFunc(chairs, func(a, b matchingChair) int {
+		switch {
+		case chairBeforeOnTie(a.Chair.ID, b.Chair.ID):
+			return -1
+		case chairBeforeOnTie(b.Chair.ID, a.Chair.ID):
+			return 1
+		}
+		return 0
+	})
+
+	// 行の数が列の数以下になるよう、少ない方を行にする
+	ridesAreRows := len(rides) <= len(chairs)
+	rows, cols := len(rides), len(chairs)
+	if !ridesAreRows {
+		rows, cols = cols, rows
+	}
+	cost := make([][]float64, rows)
+	for i := range cost {
+		cost[i] = make([]float64, cols)
+		for j := range cost[i] {
+			r, c := i, j
+			if !ridesAreRows {
+				r, c = j, i
+			}
+			cost[i][j] = newMatchingPair(&rides[r], &chairs[c]).Score
+		}
+	}
+
+	pairs := make([]matchingPair, 0, rows)
+	for i, j := range hungarian(cost) {
+		r, c := i, j
+		if !ridesAreRows {
+			r, c = j, i
+		}
+		pairs = append(pairs, newMatchingPair(&rides[r], &chairs[c]))
+	}
+	return pairs
+}
+
+// rows <= cols の費用行列について、各行に割り当てる列を返す (O(rows^2 * cols))
+func hungarian(cost [][]float64) []int {
+	n, m := len(cost), len(cost[0])
+	u := make([]float64, n+1)
+	v := make([]float64, m+1)
+	p := make([]int, m+1)
+	way := make([]int, m+1)
+	minv := make([]float64, m+1)
+	used := make([]bool, m+1)
+
+	for i := 1; i <= n; i++ {
+		p[0] = i
+		j0 := 0
+		for j := range minv {
+			minv[j] = math.Inf(1)
+			used[j] = false
+		}
+		for {
+			used[j0] = true
+			i0 := p[j0]
+			delta := math.Inf(1)
+			j1 := 0
+			for j := 1; j <= m; j++ {
+				if used[j] {
+					continue
+				}
+				cur := cost[i0-1][j-1] - u[i0] - v[j]
+				if cur < minv[j] {
+					minv[j] = cur
+					way[j] = j0
+				}
+				if minv[j] < delta {
+					delta = minv[j]
+					j1 = j
+				}
+			}
+			for j := 0; j <= m; j++ {
+				if used[j] {
+					u[p[j]] += delta
+					v[j] -= delta
+				} else {
+					minv[j] -= delta
+				}
+			}
+			j0 = j1
+			if p[j0] == 0 {
+				break
+			}
+		}
+		for j0 != 0 {
+			j1 := way[j0]
+			p[j0] = p[j1]
+			j0 = j1
+		}
+	}
+
+	assignment := make([]int, n)
+	for j := 1; j <= m; j++ {
+		if p[j] != 0 {
+			assignment[p[j]-1] = j - 1
+		}
+	}
+	return assignment
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRide(id string, pickup Coordinate) Ride {
+	return Ride{
+		ID:                   id,
+		PickupLatitude:       pickup.Latitude,
+		PickupLongitude:      pickup.Longitude,
+		DestinationLatitude:  pickup.Latitude + 10,
+		DestinationLongitude: pickup.Longitude,
+	}
+}
+
+func testChair(id string, pos Coordinate, completed int) matchingChair {
+	return matchingChair{Chair: Chair{ID: id}, Position: pos, CompletedRides: completed, Speed: 1}
+}
+
+// テストの間だけタイブレークの seed を差し替える
+func useTieBreakSeed(t *testing.T, seed int) {
+	t.Helper()
+	prev := matchingTieBreakSeed
+	matchingTieBreakSeed = seed
+	t.Cleanup(func() { matchingTieBreakSeed = prev })
+}
+
+// テストの間だけ利用回数の重みを差し替える
+func useUtilizationWeight(t *testing.T, weight float64) {
+	t.Helper()
+	prev := matchingUtilizationWeight
+	matchingUtilizationWeight = weight
+	t.Cleanup(func() { matchingUtilizationWeight = prev })
+}
+
+func TestSelectBestChair(t *testing.T) {
+	useTieBreakSeed(t, 0)
+	useUtilizationWeight(t, 10)
+	ride := testRide("ride", Coordinate{Latitude: 0, Longitude: 0})
+	tests := []struct {
+		name   string
+		chairs []matchingChair
+		want   string
+	}{
+		{
+			name: "nearest",
+			chairs: []matchingChair{
+				testChair("far", Coordinate{Latitude: 100, Longitude: 0}, 0),
+				testChair("near", Coordinate{Latitude: 3, Longitude: 4}, 0),
+				testChair("middle", Coordinate{Latitude: 20, Longitude: 20}, 0),
+			},
+			want: "near",
+		},
+		{
+			name: "busy chair loses to a slightly farther idle one",
+			chairs: []matchingChair{
+				testChair("busy", Coordinate{Latitude: 1, Longitude: 0}, 5),
+				testChair("idle", Coordinate{Latitude: 10, Longitude: 0}, 0),
+			},
+			want: "idle",
+		},
+		{
+			name: "tie goes to the smaller id",
+			chairs: []matchingChair{
+				testChair("b", Coordinate{Latitude: 5, Longitude: 0}, 0),
+				testChair("a", Coordinate{Latitude: 0, Longitude: 5}, 0),
+				testChair("c", Coordinate{Latitude: -5, Longitude: 0}, 0),
+			},
+			want: "a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			candidates := make([]int, len(tt.chairs))
+			for i := range candidates {
+				candidates[i] = i
+			}
+			// 候補の並び順で結果が変わらない
+			for range 2 {
+				best, _, _ := selectBestChair(&ride, tt.chairs, candidates)
+				if got := tt.chairs[best].Chair.ID; got != tt.want {
+					t.Fatalf("selectBestChair() = %s, want %s (candidates %v)", got, tt.want, candidates)
+				}
+				slices.Reverse(candidates)
+			}
+		})
+	}
+
+	t.Run("no candidates", func(t *testing.T) {
+		if best, _, _ := selectBestChair(&ride, nil, nil); best != -1 {
+			t.Fatalf("selectBestChair() = %d, want -1", best)
+		}
+	})
+}
+
+// 既定では利用回数を見ずに近い椅子を選ぶ
+func TestSelectBestChairUtilizationDisabledByDefault(t *testing.T) {
+	if matchingUtilizationWeight != 0 {
+		t.Skipf("ISUCON_MATCHING_UTILIZATION_WEIGHT is set to %v", matchingUtilizationWeight)
+	}
+	ride := testRide("ride", Coordinate{})
+	chairs := []matchingChair{
+		testChair("busy", Coordinate{Latitude: 1, Longitude: 0}, 5),
+		testChair("idle", Coordinate{Latitude: 10, Longitude: 0}, 0),
+	}
+	if best, _, _ := selectBestChair(&ride, chairs, []int{0, 1}); chairs[best].Chair.ID != "busy" {
+		t.Fatalf("selectBestChair() = %s, want busy", chairs[best].Chair.ID)
+	}
+}
+
+// 位置の分からない椅子は候補に入れず、完了数はキャッシュから読む
+func TestLoadMatchingInput(t *testing.T) {
+	useFreshCaches(t)
+	now := time.Now()
+	chair := func(id string) []driver.Value {
+		return []driver.Value{id, "owner-1", "QC-" + id, "クエストチェア Lite", true, "token-" + id, now, now}
+	}
+	f := (&fakeDB{}).
+		on("FROM rides WHERE chair_id IS NULL", strings.Split(pendingRideColumns, ", "),
+			[]driver.Value{"ride-1", int64(0), int64(0), int64(10), int64(10), now}).
+		on("FROM chairs WHERE is_active", strings.Split(chairColumns, ", "), chair("located"), chair("unlocated")).
+		on("FROM ride_statuses JOIN rides", []string{"ride_id", "id"})
+	useFakeDB(t, f)
+	chairPositionCache.Set("located", chairPositionCacheEntry{LastLat: 3, LastLong: 4, ReportedAt: now})
+	chairRideStatsCache.Set("located", chairRideStats{CompletedRides: 7})
+
+	rides, chairs, err := loadMatchingInput(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rides) != 1 {
+		t.Fatalf("rides = %+v, want ride-1", rides)
+	}
+	if len(chairs) != 1 || chairs[0].Chair.ID != "located" {
+		t.Fatalf("chairs = %+v, want only located", chairs)
+	}
+	if got := chairs[0].Position; got != (Coordinate{Latitude: 3, Longitude: 4}) {
+		t.Fatalf("position = %+v, want (3,4)", got)
+	}
+	if got := chairs[0].CompletedRides; got != 7 {
+		t.Fatalf("completed rides = %d, want 7", got)
+	}
+	if n := f.count("GROUP BY"); n != 0 {
+		t.Fatalf("counted rides in the DB %d times", n)
+	}
+}
+
+func TestSelectBestChairTieBreakSeed(t *testing.T) {
+	ride := testRide("ride", Coordinate{})
+	chairs := make([]matchingChair, 8)
+	candidates := make([]int, len(chairs))
+	for i := range chairs {
+		chairs[i] = testChair(fmt.Sprintf("chair-%d", i), Coordinate{Latitude: 5}, 0)
+		candidates[i] = i
+	}
+	pick := func(seed int) string {
+		useTieBreakSeed(t, seed)
+		best, _, _ := selectBestChair(&ride, chairs, candidates)
+		return chairs[best].Chair.ID
+	}
+
+	if got := pick(0); got != "chair-0" {
+		t.Fatalf("seed 0 picked %s, want chair-0", got)
+	}
+	picked := map[string]bool{}
+	for seed := 1; seed <= 16; seed++ {
+		first := pick(seed)
+		slices.Reverse(candidates)
+		if again := pick(seed); again != first {
+			t.Fatalf("seed %d picked %s then %s", seed, first, again)
+		}
+		picked[first] = true
+	}
+	// seed を変えれば同点の中で選ばれる椅子も変わる
+	if len(picked) < 2 {
+		t.Fatalf("all seeds picked the same chair: %v", picked)
+	}
+}
+
+func randomMatchingInput(rng *rand.Rand, rideCount, chairCount int) ([]Ride, []matchingChair) {
+	coord := func() Coordinate {
+		return Coordinate{Latitude: rng.IntN(201) - 100, Longitude: rng.IntN(201) - 100}
+	}
+	rides := make([]Ride, rideCount)
+	for i := range rides {
+		rides[i] = testRide(fmt.Sprintf("ride-%02d", i), coord())
+	}
+	chairs := make([]matchingChair, chairCount)
+	for i := range chairs {
+		chairs[i] = testChair(fmt.Sprintf("chair-%02d", i), coord(), rng.IntN(3))
+	}
+	return rides, chairs
+}
+
+func totalScore(pairs []matchingPair) float64 {
+	total := 0.0
+	for _, p := range pairs {
+		total += p.Score
+	}
+	return total
+}
+
+func TestMatchers(t *testing.T) {
+	for _, name := range []string{"greedy", "grid", "hungarian"} {
+		m, err := lookupMatcher(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name, func(t *testing.T) {
+			useTieBreakSeed(t, 0)
+			t.Run("empty", func(t *testing.T) {
+				rides, chairs := randomMatchingInput(rand.New(rand.NewPCG(1, 1)), 3, 3)
+				if pairs := m.Match(nil, chairs); len(pairs) != 0 {
+					t.Fatalf("matched %d pairs without rides", len(pairs))
+				}
+				if pairs := m.Match(rides, nil); len(pairs) != 0 {
+					t.Fatalf("matched %d pairs without chairs", len(pairs))
+				}
+			})
+			t.Run("nearest", func(t *testing.T) {
+				rides := []Ride{testRide("ride", Coordinate{Latitude: 50, Longitude: 50})}
+				chairs := []matchingChair{
+					testChair("far", Coordinate{Latitude: -50, Longitude: -50}, 0),
+					testChair("near", Coordinate{Latitude: 48, Longitude: 51}, 0),
+				}
+				pairs := m.Match(rides, chairs)
+				if len(pairs) != 1 || pairs[0].ChairID != "near" || pairs[0].Distance != 3 {
+					t.Fatalf("Match() = %+v, want ride paired with near at distance 3", pairs)
+				}
+			})
+			for seed := range uint64(20) {
+				t.Run(fmt.Sprintf("random/%d", seed), func(t *testing.T) {
+					rng := rand.New(rand.NewPCG(seed, 7))
+					rides, chairs := randomMatchingInput(rng, 1+rng.IntN(30), 1+rng.IntN(30))
+					pairs := m.Match(rides, chairs)
+
+					if want := min(len(rides), len(chairs)); len(pairs) != want {
+						t.Fatalf("matched %d pairs, want %d", len(pairs), want)
+					}
+					usedRides, usedChairs := map[string]bool{}, map[string]bool{}
+					for _, p := range pairs {
+						if usedRides[p.RideID] || usedChairs[p.ChairID] {
+							t.Fatalf("ride or chair used twice: %+v", p)
+						}
+						usedRides[p.RideID], usedChairs[p.ChairID] = true, true
+					}
+
+					// 椅子の並び順を変えても同じ組になる
+					shuffled := slices.Clone(chairs)
+					rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+					again := m.Match(rides, shuffled)
+					sortPairs := func(p []matchingPair) {
+						slices.SortFunc(p, func(a, b matchingPair) int { return strings.Compare(a.RideID, b.RideID) })
+					}
+					sortPairs(pairs)
+					sortPairs(again)
+					if !slices.Equal(pairs, again) {
+						t.Fatalf("result depends on chair order\nfirst: %+v\nagain: %+v", pairs, again)
+					}
+				})
+			}
+		})
+	}
+}
+
+// 椅子が十分あれば grid は greedy と同じ組を作る
+func TestGridMatcherAgreesWithGreedy(t *testing.T) {
+	useTieBreakSeed(t, 0)
+	rides := []Ride{
+		testRide("ride-0", Coordinate{Latitude: 0, Longitude: 0}),
+		testRide("ride-1", Coordinate{Latitude: 40, Longitude: 40}),
+		testRide("ride-2", Coordinate{Latitude: -40, Longitude: 40}),
+	}
+	chairs := []matchingChair{
+		testChair("chair-0", Coordinate{Latitude: 2, Longitude: 1}, 0),
+		testChair("chair-1", Coordinate{Latitude: 41, Longitude: 38}, 0),
+		testChair("chair-2", Coordinate{Latitude: -39, Longitude: 42}, 0),
+		testChair("chair-3", Coordinate{Latitude: 90, Longitude: -90}, 0),
+	}
+	if greedy, grid := (greedyMatcher{}).Match(rides, chairs), (gridMatcher{}).Match(rides, chairs); !slices.Equal(greedy, grid) {
+		t.Fatalf("grid = %+v, greedy = %+v", grid, greedy)
+	}
+}
+
+func TestHungarianMatcherBeatsGreedy(t *testing.T) {
+	useTieBreakSeed(t, 0)
+	// greedy は ride-0 に近い chair-a を取ってしまい、ride-1 が遠い chair-b を回される
+	rides := []Ride{
+		testRide("ride-0", Coordinate{Latitude: 0}),
+		testRide("ride-1", Coordinate{Latitude: 10}),
+	}
+	chairs := []matchingChair{
+		testChair("chair-a", Coordinate{Latitude: 9}, 0),
+		testChair("chair-b", Coordinate{Latitude: -12}, 0),
+	}
+	greedy := (greedyMatcher{}).Match(rides, chairs)
+	hungarian := (hungarianMatcher{}).Match(rides, chairs)
+	if got, want := totalScore(greedy), 31.0; got != want {
+		t.Fatalf("greedy total = %v, want %v", got, want)
+	}
+	if got, want := totalScore(hungarian), 13.0; got != want {
+		t.Fatalf("hungarian total = %v, want %v (%+v)", got, want, hungarian)
+	}
+
+	for seed := range uint64(20) {
+		rng := rand.New(rand.NewPCG(seed, 11))
+		rides, chairs := randomMatchingInput(rng, 1+rng.IntN(15), 1+rng.IntN(15))
+		if h, g := totalScore((hungarianMatcher{}).Match(rides, chairs)), totalScore((greedyMatcher{}).Match(rides, chairs)); h > g+1e-9 {
+			t.Fatalf("seed %d: hungarian total %v is worse than greedy %v", seed, h, g)
+		}
+	}
+}
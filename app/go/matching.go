@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// 完了済みライド数 1 件あたりに加算するペナルティ。大きいほど仕事を椅子全体に散らす。0 なら考慮しない
+var matchingUtilizationWeight = getEnvFloat("ISUCON_MATCHING_UTILIZATION_WEIGHT", 0)
+
+// 椅子の完了済みライド数。評価時に積んでいる chairRideStatsCache から読み、ラウンドごとに数え直さない
+func completedRides(chairID string) int {
+	stats, _ := chairRideStatsCache.Get(chairID)
+	return stats.CompletedRides
+}
+
+// 椅子が足りないときに運賃の高いライドを優先する重み。運賃 1000 円を何秒分の待ち時間とみなすか。0 なら待たせている順
+var matchingFareWeight = getEnvFloat("ISUCON_MATCHING_FARE_WEIGHT", 0)
+
+// 椅子の速さとライドの長さが合っているほど加える優遇の重み。0 なら考慮しない
+// pivot より長いライドには速い椅子を、短いライドには遅い椅子を優先する
+var (
+	matchingSpeedWeight = getEnvFloat("ISUCON_MATCHING_SPEED_WEIGHT", 0)
+	matchingSpeedPivot  = getEnvInt("ISUCON_MATCHING_SPEED_PIVOT", 100)
+)
+
+const (
+	matchingStrategyOldestFirst  = "oldest_first"
+	matchingStrategyFarePriority = "fare_priority"
+)
+
+type matchingChair struct {
+	Chair          Chair
+	Position       Coordinate
+	CompletedRides int
+	// 位置の報告からの経過時間
+	PositionAge time.Duration
+	Speed       int
+}
+
+type matchingPair struct {
+	RideID   string  `json:"ride_id"`
+	ChairID  string  `json:"chair_id"`
+	Distance int     `json:"distance"`
+	Score    float64 `json:"score"`
+	Fare     int     `json:"fare"`
+	// スコアから差し引いた速さの優遇。遅い椅子を長いライドに当てると負になる
+	SpeedBonus float64 `json:"speed_bonus"`
+}
+
+type matchingReport struct {
+	RoundAt           int64          `json:"round_at"`
+	PendingRides      int            `json:"pending_rides"`
+	FreeChairs        int            `json:"free_chairs"`
+	Algorithm         string         `json:"algorithm"`
+	UtilizationWeight float64        `json:"utilization_weight"`
+	Strategy          string         `json:"strategy"`
+	FareWeight        float64        `json:"fare_weight"`
+	SpeedWeight       float64        `json:"speed_weight"`
+	MatchedFare       int            `json:"matched_fare"`
+	SpeedBonus        float64        `json:"speed_bonus"`
+	Pairs             []matchingPair `json:"pairs"`
+	ChairRideCounts   map[string]int `json:"chair_ride_counts"`
+}
+
+var lastMatchingReport atomic.Pointer[matchingReport]
+
+// これ以上マッチしないまま待たされているライドがあれば警告する
+var matchingStarvationThreshold = time.Duration(getEnvInt("ISUCON_MATCHING_STARVATION_SECONDS", 30)) * time.Second
+
+func matchingScore(ride *Ride, distance int, chair *matchingChair) float64 {
+	return float64(distance) +
+		matchingUtilizationWeight*float64(chair.CompletedRides) +
+		matchingStalenessWeight*chair.PositionAge.Seconds() -
+		matchingSpeedBonus(ride, chair)
+}
+
+func matchingSpeedBonus(ride *Ride, chair *matchingChair) float64 {
+	if matchingSpeedWeight == 0 {
+		return 0
+	}
+	rideDistance := ride.Pickup().DistanceTo(ride.Destination())
+	return matchingSpeedWeight * float64(chair.Speed) * float64(rideDistance-matchingSpeedPivot) / float64(matchingSpeedPivot)
+}
+
+func estimatedRideFare(ride *Ride) int {
+	return calculateFare(ride.Pickup(), ride.Destination())
+}
+
+// 椅子が足りず重みが設定されているときだけ、待ち時間と運賃を合わせた優先度の高い順に並べ替える
+func orderMatchingRides(rides []Ride, chairs int, now time.Time) ([]Ride, string) {
+	if matchingFareWeight <= 0 || chairs >= len(rides) {
+		return rides, matchingStrategyOldestFirst
+	}
+	priority := func(ride *Ride) float64 {
+		return now.Sub(ride.CreatedAt).Seconds() + matchingFareWeight*float64(estimatedRideFare(ride))/1000
+	}
+	ordered := append([]Ride(nil), rides...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return priority(&ordered[i]) > priority(&ordered[j])
+	})
+	return ordered, matchingStrategyFarePriority
+}
+
+// 優先度の高い順 (既定では待たせている順) に並べたライドを、設定されたアルゴリズムで空き椅子と組にする
+func matchRides(rides []Ride, chairs []matchingChair) *matchingReport {
+	now := time.Now()
+	rides, strategy := orderMatchingRides(rides, len(chairs), now)
+	report := &matchingReport{
+		RoundAt:           epochMilli(now),
+		PendingRides:      len(rides),
+		FreeChairs:        len(chairs),
+		Algorithm:         matchingAlgorithm,
+		UtilizationWeight: matchingUtilizationWeight,
+		Strategy:          strategy,
+		FareWeight:        matchingFareWeight,
+		SpeedWeight:       matchingSpeedWeight,
+		Pairs:             []matchingPair{},
+		ChairRideCounts:   map[string]int{},
+	}
+	for _, c := range chairs {
+		report.ChairRideCounts[c.Chair.ID] = c.CompletedRides
+	}
+
+	m, _ := lookupMatcher(matchingAlgorithm)
+	fares := make(map[string]int, len(rides))
+	for i := range rides {
+		fares[rides[i].ID] = estimatedRideFare(&rides[i])
+	}
+	for _, pair := range m.Match(rides, chairs) {
+		pair.Fare = fares[pair.RideID]
+		report.MatchedFare += pair.Fare
+		report.SpeedBonus += pair.SpeedBonus
+		report.Pairs = append(report.Pairs, pair)
+	}
+
+	return report
+}
+
+// 候補の中からスコアが最も小さい (近くて仕事の少ない) 椅子を選ぶ。候補が無ければ -1
+// スコアが同じなら chairBeforeOnTie で選び、候補の並び順によらず結果が決まるようにする
+func selectBestChair(ride *Ride, chairs []matchingChair, candidates []int) (best int, distance int, score float64) {
+	best = -1
+	for _, i := range candidates {
+		c := &chairs[i]
+		d := c.Position.DistanceTo(ride.Pickup())
+		s := matchingScore(ride, d, c)
+		if best == -1 || s < score || (s == score && chairBeforeOnTie(c.Chair.ID, chairs[best].Chair.ID)) {
+			best, distance, score = i, d, s
+		}
+	}
+	return best, distance, score
+}
+
+// スコアが同じ椅子の選び方。0 なら椅子 ID の小さい方、それ以外ならこの値と椅子 ID のハッシュが小さい方
+// 同じ値なら何度やっても同じ組になるので、テストやリプレイで再現できる。ID の若い椅子に偏るのが嫌なら変える
+// 設定のリロードで切り替えられる
+var matchingTieBreakSeed = getEnvInt("ISUCON_MATCHING_TIE_BREAK_SEED", 0)
+
+func chairBeforeOnTie(a, b string) bool {
+	if matchingTieBreakSeed == 0 {
+		return a < b
+	}
+	ka, kb := matchingTieBreakKey(a), matchingTieBreakKey(b)
+	if ka != kb {
+		return ka < kb
+	}
+	return a < b
+}
+
+func matchingTieBreakKey(chairID string) uint64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, uint64(matchingTieBreakSeed))
+	h.Write([]byte(chairID))
+	return h.Sum64()
+}
+
+// 割り当てた距離を数える区間の上限。最後の区間はそれより遠いもの全て
+var matchingDistanceBuckets = []int{10, 50, 100, 200}
+
+// ラウンドごとの結果を 1 行にまとめて出す
+func logMatchingSummary(rides []Ride, report *matchingReport) {
+	if len(report.Pairs) == 0 {
+		return
+	}
+	createdAt := make(map[string]time.Time, len(rides))
+	for _, ride := range rides {
+		createdAt[ride.ID] = ride.CreatedAt
+	}
+	now := time.Now()
+	histogram := make([]int, len(matchingDistanceBuckets)+1)
+	var totalWait time.Duration
+	for _, pair := range report.Pairs {
+		histogram[sort.SearchInts(matchingDistanceBuckets, pair.Distance)]++
+		totalWait += now.Sub(createdAt[pair.RideID])
+	}
+	buckets := make([]any, 0, len(histogram))
+	for i, n := range histogram {
+		label := "inf"
+		if i < len(matchingDistanceBuckets) {
+			label = strconv.Itoa(matchingDistanceBuckets[i])
+		}
+		buckets = append(buckets, slog.Int("le_"+label, n))
+	}
+	slog.Info("matching round",
+		"algorithm", report.Algorithm,
+		"strategy", report.Strategy,
+		"pairs", len(report.Pairs),
+		"pending_rides", report.PendingRides-len(report.Pairs),
+		"free_chairs", report.FreeChairs-len(report.Pairs),
+		"mean_wait", (totalWait / time.Duration(len(report.Pairs))).Round(time.Millisecond),
+		slog.Group("distance", buckets...),
+	)
+}
+
+// マッチングが詰まっている兆候を拾う。空き椅子があるのに 1 組も作れないのはマッチャーのバグを疑う
+func checkMatchingStarvation(rides []Ride, report *matchingReport) {
+	if report.FreeChairs > 0 && report.PendingRides > 0 && len(report.Pairs) == 0 {
+		metricCounter(metricName("matching_starvation_total", "reason", "no_pairs")).Inc()
+		slog.Warn("matching produced no pairs despite free chairs",
+			"pending_rides", report.PendingRides,
+			"free_chairs", report.FreeChairs,
+		)
+	}
+
+	matched := make(map[string]struct{}, len(report.Pairs))
+	for _, pair := range report.Pairs {
+		matched[pair.RideID] = struct{}{}
+	}
+	now := time.Now()
+	starving := 0
+	var oldest time.Duration
+	for _, ride := range rides {
+		if _, ok := matched[ride.ID]; ok {
+			continue
+		}
+		if wait := now.Sub(ride.CreatedAt); wait > matchingStarvationThreshold {
+			starving++
+			oldest = max(oldest, wait)
+		}
+	}
+	if starving > 0 {
+		metricCounter(metricName("matching_starvation_total", "reason", "ride_wait")).Inc()
+		slog.Warn("rides have been waiting for matching too long",
+			"rides", starving,
+			"oldest_wait", oldest,
+			"threshold", matchingStarvationThreshold,
+		)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 空いた椅子をこの距離以内で待っている最も古いライドに即座に割り当てる。0 なら無効
+var fastMatchRadius = getEnvInt("ISUCON_FAST_MATCH_RADIUS", 50)
+
+// 無効にすると空いた椅子は次の定期マッチングまで待つ
+var fastMatchEnabled = newFeatureFlag("fast_match", "ISUCON_FAST_MATCH", true)
+
+// 定期マッチングと即時マッチングが同じ椅子やライドを取り合わないようにする
+// 設定のリロードもこれを取ってマッチングの設定を書き換える
+var matchingMu sync.Mutex
+
+// 椅子が空いたとき (COMPLETED を椅子に通知したとき) に、次の定期マッチングを待たずに 1 台だけマッチさせる
+func fastMatchChair(ctx context.Context, chairID string) {
+	if _, ok := chairDeactivationPending.Get(chairID); ok {
+		return
+	}
+	if now := time.Now(); isChairPenalized(chairID, now) || isChairHeld(chairID, now) {
+		return
+	}
+
+	matchingMu.Lock()
+	defer matchingMu.Unlock()
+	if fastMatchRadius <= 0 || !fastMatchEnabled.Enabled() || draining.Load() {
+		return
+	}
+
+	pair, chair, err := findFastMatch(ctx, chairID)
+	if err != nil {
+		slog.Error("fast match failed", "chair_id", chairID, "err", err)
+		return
+	}
+	if pair == nil {
+		return
+	}
+
+	assigned, err := assignSingleMatch(ctx, *pair, chair, assignmentByFast)
+	if err != nil {
+		slog.Error("fast match failed", "chair_id", chairID, "err", err)
+		return
+	}
+	if assigned {
+		metricCounter("matching_fast_total").Inc()
+	}
+}
+
+// 定期マッチングを待たずに 1 組だけ割り当てる。matchingMu を取ったまま呼ぶこと
+// 他で先に割り当てられていたら何もせず false
+func assignSingleMatch(ctx context.Context, pair matchingPair, chair *Chair, by string) (bool, error) {
+	defer locks.ForRide(pair.RideID)()
+	finishJournal, err := journalMatchingPairs([]matchingPair{pair})
+	if err != nil {
+		return false, err
+	}
+	assigned := false
+	err = withTx(ctx, func(tx *sqlx.Tx) error {
+		result, err := tx.ExecContext(ctx, "UPDATE rides SET chair_id = ? WHERE id = ? AND chair_id IS NULL", pair.ChairID, pair.RideID)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		assigned = n > 0
+		return err
+	})
+	finishJournal(err)
+	if err != nil || !assigned {
+		return false, err
+	}
+	cacheRideChair(currentCaches(), pair.RideID, chair)
+	chairCurrentRideCache.Set(pair.ChairID, pair.RideID)
+	recordRideAssignment(pair, by)
+	chairNotifier.Notify(pair.ChairID)
+	publishRideEvent(rideEvent{Type: rideEventAssigned, RideID: pair.RideID, ChairID: pair.ChairID})
+	return true, nil
+}
+
+func findFastMatch(ctx context.Context, chairID string) (*matchingPair, *Chair, error) {
+	chair := &Chair{}
+	if err := getChairContext(ctx, db, chair, `SELECT `+chairColumns+` FROM chairs WHERE id = ? AND is_active = TRUE`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	free, err := isChairFree(ctx, chairID)
+	if err != nil || !free {
+		return nil, nil, err
+	}
+	pos, ok := chairPositionCache.Get(chairID)
+	recordCacheLookup(ctx, "chair_positions", ok)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	rides, err := selectPendingRides(ctx, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ride := range rides {
+		distance := pos.Position().DistanceTo(ride.Pickup())
+		if distance > fastMatchRadius {
+			continue
+		}
+		return &matchingPair{
+			RideID:   ride.ID,
+			ChairID:  chairID,
+			Distance: distance,
+		}, chair, nil
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import "math"
+
+const matchingGridCellSize = 16
+
+type gridCell struct {
+	X, Y int
+}
+
+// マッチング 1 回分の空き椅子をグリッドに並べたもの。ライドごとに全椅子を舐めずに済ませる
+type chairGrid struct {
+	cells                  map[gridCell][]int
+	minX, maxX, minY, maxY int
+	size                   int
+}
+
+func floorDiv(a, b int) int {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+func cellOf(c Coordinate) gridCell {
+	return gridCell{X: floorDiv(c.Latitude, matchingGridCellSize), Y: floorDiv(c.Longitude, matchingGridCellSize)}
+}
+
+func newChairGrid(chairs []matchingChair) *chairGrid {
+	g := &chairGrid{
+		cells: map[gridCell][]int{},
+		minX:  math.MaxInt,
+		maxX:  math.MinInt,
+		minY:  math.MaxInt,
+		maxY:  math.MinInt,
+	}
+	for i, c := range chairs {
+		cell := cellOf(c.Position)
+		g.cells[cell] = append(g.cells[cell], i)
+		g.minX, g.maxX = min(g.minX, cell.X), max(g.maxX, cell.X)
+		g.minY, g.maxY = min(g.minY, cell.Y), max(g.maxY, cell.Y)
+	}
+	g.size = len(chairs)
+	return g
+}
+
+func (g *chairGrid) remove(chairs []matchingChair, idx int) {
+	cell := cellOf(chairs[idx].Position)
+	indexes := g.cells[cell]
+	for i, v := range indexes {
+		if v == idx {
+			g.cells[cell] = append(indexes[:i], indexes[i+1:]...)
+			g.size--
+			return
+		}
+	}
+}
+
+// 椅子が密なほど少ないリングで集まるので、候補数は全体の数から決める
+func (g *chairGrid) candidateCount() int {
+	return min(max(int(math.Sqrt(float64(g.size))), 4), 16)
+}
+
+// 地点を中心にリング状にセルを広げ、k 個以上集まったらもう 1 リングだけ見て返す
+// セル単位の距離とマンハッタン距離はずれるので、最後の 1 リングはその補正
+func (g *chairGrid) candidates(point Coordinate) []int {
+	if g.size == 0 {
+		return nil
+	}
+	k := g.candidateCount()
+	center := cellOf(point)
+	maxRing := max(
+		absDiffInt(center.X, g.minX), absDiffInt(center.X, g.maxX),
+		absDiffInt(center.Y, g.minY), absDiffInt(center.Y, g.maxY),
+	)
+
+	found := []int{}
+	extraRingDone := false
+	for ring := 0; ring <= maxRing; ring++ {
+		found = g.appendRing(found, center, ring)
+		if len(found) >= k {
+			if extraRingDone {
+				break
+			}
+			extraRingDone = true
+		}
+	}
+	return found
+}
+
+func (g *chairGrid) appendRing(dst []int, center gridCell, ring int) []int {
+	if ring == 0 {
+		return append(dst, g.cells[center]...)
+	}
+	for dx := -ring; dx <= ring; dx++ {
+		dst = append(dst, g.cells[gridCell{X: center.X + dx, Y: center.Y - ring}]...)
+		dst = append(dst, g.cells[gridCell{X: center.X + dx, Y: center.Y + ring}]...)
+	}
+	for dy := -ring + 1; dy <= ring-1; dy++ {
+		dst = append(dst, g.cells[gridCell{X: center.X - ring, Y: center.Y + dy}]...)
+		dst = append(dst, g.cells[gridCell{X: center.X + ring, Y: center.Y + dy}]...)
+	}
+	return dst
+}
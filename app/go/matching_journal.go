@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// マッチング結果を DB に書く前に追記しておくファイル。空なら無効
+// 書き込みの途中でプロセスが落ちても、再起動時に書きかけの割り当てを DB に反映し直せる
+var (
+	matchingJournalPath = os.Getenv("ISUCON_MATCHING_JOURNAL_PATH")
+	matchingJournalSync = getEnvBool("ISUCON_MATCHING_JOURNAL_SYNC", true)
+)
+
+type matchingJournalOp string
+
+const (
+	matchingJournalAssign matchingJournalOp = "assign"
+	matchingJournalCommit matchingJournalOp = "commit"
+	matchingJournalAbort  matchingJournalOp = "abort"
+)
+
+type matchingJournalPair struct {
+	RideID  string `json:"ride_id"`
+	ChairID string `json:"chair_id"`
+}
+
+// 1 行 1 エントリの JSON。assign の後に commit か abort が無いバッチが書きかけ
+type matchingJournalEntry struct {
+	Batch string                `json:"batch"`
+	Op    matchingJournalOp     `json:"op"`
+	Pairs []matchingJournalPair `json:"pairs,omitempty"`
+	At    time.Time             `json:"at"`
+}
+
+var matchingJournal struct {
+	sync.Mutex
+	f *os.File
+}
+
+func appendMatchingJournal(entry matchingJournalEntry) error {
+	matchingJournal.Lock()
+	defer matchingJournal.Unlock()
+	if matchingJournal.f == nil {
+		f, err := os.OpenFile(matchingJournalPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		matchingJournal.f = f
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := matchingJournal.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if matchingJournalSync {
+		return matchingJournal.f.Sync()
+	}
+	return nil
+}
+
+// DB に書く前に呼ぶ。返した関数にトランザクションの結果を渡すと commit / abort を書く
+// ジャーナルに書けなければ、落ちたときに取り戻せないのでマッチングを諦めさせる
+func journalMatchingPairs(pairs []matchingPair) (func(error), error) {
+	if matchingJournalPath == "" || len(pairs) == 0 {
+		return func(error) {}, nil
+	}
+	entry := matchingJournalEntry{
+		Batch: ulid.Make().String(),
+		Op:    matchingJournalAssign,
+		Pairs: make([]matchingJournalPair, 0, len(pairs)),
+		At:    time.Now(),
+	}
+	for _, pair := range pairs {
+		entry.Pairs = append(entry.Pairs, matchingJournalPair{RideID: pair.RideID, ChairID: pair.ChairID})
+	}
+	if err := appendMatchingJournal(entry); err != nil {
+		return nil, err
+	}
+	return func(txErr error) {
+		op := matchingJournalCommit
+		if txErr != nil {
+			op = matchingJournalAbort
+		}
+		if err := appendMatchingJournal(matchingJournalEntry{Batch: entry.Batch, Op: op, At: time.Now()}); err != nil {
+			slog.Error("failed to append matching journal", "batch", entry.Batch, "op", op, "err", err)
+		}
+	}, nil
+}
+
+// 書きかけのバッチ。commit / abort が書かれたものは DB と食い違わないので無視する
+func readPendingMatchingJournal(path string) ([]matchingJournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	pending := map[string]matchingJournalEntry{}
+	order := []string{}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var entry matchingJournalEntry
+		// 書いている途中で落ちた最後の行は読めないので飛ばす
+		if err := json.Unmarshal(sc.Bytes(), &entry); err != nil {
+			continue
+		}
+		if entry.Op == matchingJournalAssign {
+			pending[entry.Batch] = entry
+			order = append(order, entry.Batch)
+		} else {
+			delete(pending, entry.Batch)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	entries := make([]matchingJournalEntry, 0, len(pending))
+	for _, batch := range order {
+		if entry, ok := pending[batch]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// 起動時、キャッシュを作る前に呼ぶ。書きかけの割り当てのうち、ライドがまだ待っていて椅子も空いているものを DB に書き直す
+// 反映できなかったライドは待ちのまま残るので、次のマッチングで拾われる
+func reconcileMatchingJournal(ctx context.Context) error {
+	if matchingJournalPath == "" {
+		return nil
+	}
+	entries, err := readPendingMatchingJournal(matchingJournalPath)
+	if err != nil {
+		return err
+	}
+	applied, skipped := 0, 0
+	for _, entry := range entries {
+		for _, pair := range entry.Pairs {
+			// 評価されていないライドを持つ椅子は走行中
+			busy := false
+			if err := db.GetContext(ctx, &busy, `SELECT COUNT(*) > 0 FROM rides WHERE chair_id = ? AND evaluation IS NULL`, pair.ChairID); err != nil {
+				return err
+			}
+			if busy {
+				skipped++
+				continue
+			}
+			result, err := db.ExecContext(ctx, `UPDATE rides SET chair_id = ? WHERE id = ? AND chair_id IS NULL`, pair.ChairID, pair.RideID)
+			if err != nil {
+				return err
+			}
+			if n, _ := result.RowsAffected(); n > 0 {
+				applied++
+			} else {
+				skipped++
+			}
+		}
+	}
+	if len(entries) > 0 {
+		slog.Warn("reconciled matching journal", "batches", len(entries), "applied", applied, "skipped", skipped)
+	}
+	return resetMatchingJournal()
+}
+
+// initialize と起動時の突き合わせの後に呼び、前の分を捨てる
+func resetMatchingJournal() error {
+	if matchingJournalPath == "" {
+		return nil
+	}
+	matchingJournal.Lock()
+	defer matchingJournal.Unlock()
+	if matchingJournal.f != nil {
+		matchingJournal.f.Close()
+		matchingJournal.f = nil
+	}
+	if err := os.Remove(matchingJournalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 直近のマッチングで割り当てられずに残ったライドの並び。通知で待ち順と待ち時間の目安を返すのに使う
+type matchingQueueSnapshot struct {
+	positions map[string]int
+	length    int
+	// 1 秒あたりに割り当てられたライド数の移動平均
+	throughput float64
+}
+
+var matchingQueue atomic.Pointer[matchingQueueSnapshot]
+
+// 割り当て数の移動平均の重み。大きいほど直近のラウンドに引っ張られる
+const matchingThroughputAlpha = 0.3
+
+var matchingThroughput struct {
+	sync.Mutex
+	lastRoundAt time.Time
+	rate        float64
+}
+
+// マッチングのラウンドごとに呼ぶ。rides は古い順に並んでいること
+func updateMatchingQueue(rides []Ride, pairs []matchingPair, now time.Time) {
+	matched := make(map[string]struct{}, len(pairs))
+	for _, pair := range pairs {
+		matched[pair.RideID] = struct{}{}
+	}
+	snap := &matchingQueueSnapshot{positions: make(map[string]int, len(rides)-len(pairs))}
+	for _, ride := range rides {
+		if _, ok := matched[ride.ID]; ok {
+			continue
+		}
+		snap.length++
+		snap.positions[ride.ID] = snap.length
+	}
+
+	matchingThroughput.Lock()
+	if !matchingThroughput.lastRoundAt.IsZero() {
+		if elapsed := now.Sub(matchingThroughput.lastRoundAt).Seconds(); elapsed > 0 {
+			rate := float64(len(pairs)) / elapsed
+			matchingThroughput.rate = matchingThroughputAlpha*rate + (1-matchingThroughputAlpha)*matchingThroughput.rate
+		}
+	}
+	matchingThroughput.lastRoundAt = now
+	snap.throughput = matchingThroughput.rate
+	matchingThroughput.Unlock()
+
+	matchingQueue.Store(snap)
+	metricGauge("matching_queue_length").Set(int64(snap.length))
+	// 最後尾のライドが捌けるまでの目安。伸び続けていれば椅子が足りず取り残されている
+	if wait, ok := snap.estimatedWait(snap.length); ok {
+		metricGauge("matching_queue_estimated_wait_seconds").Set(int64(wait))
+	}
+}
+
+func (s *matchingQueueSnapshot) estimatedWait(position int) (int, bool) {
+	if s.throughput <= 0 {
+		return 0, false
+	}
+	return int(math.Ceil(float64(position) / s.throughput)), true
+}
+
+// 待ち順 (1 始まり) と待ち時間の目安 (秒)。直近のラウンドより後に作られたライドは列の最後尾にいるとみなす
+// マッチングがまだ一度も回っていなければ何も返さない
+func matchingQueuePosition(rideID string) (*int, *int) {
+	snap := matchingQueue.Load()
+	if snap == nil {
+		return nil, nil
+	}
+	position, ok := snap.positions[rideID]
+	if !ok {
+		position = snap.length + 1
+	}
+	wait, ok := snap.estimatedWait(position)
+	if !ok {
+		return &position, nil
+	}
+	return &position, &wait
+}
+
+func resetMatchingQueue() {
+	matchingQueue.Store(nil)
+	matchingThroughput.Lock()
+	matchingThroughput.lastRoundAt = time.Time{}
+	matchingThroughput.rate = 0
+	matchingThroughput.Unlock()
+}
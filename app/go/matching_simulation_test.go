@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// マッチング結果どおりに椅子を動かしたとき、迎車と到着に何秒かかるかを 1 秒刻みで再現する
+// 椅子は Coordinate.MoveToward と同じく整数格子の上を 1 秒あたりモデルの速度ぶん進む
+type simulatedRide struct {
+	RideID         string
+	ChairID        string
+	PickupSeconds  int
+	ArrivalSeconds int
+	// 迎車と送迎をそれぞれ速度で割って切り上げた見積もり (ETA と同じ計算)
+	// 迎車地点で余った移動量は次の秒に持ち越さないので、区間ごとに切り上げる
+	ExpectedSeconds int
+	Completed       bool
+}
+
+// これを超えて到着しないライドは打ち切って未完了とする
+const simulationMaxSeconds = 3600
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+func simulateChairRide(from Coordinate, speed int, pickup, destination Coordinate) simulatedRide {
+	sim := simulatedRide{}
+	if speed <= 0 {
+		return sim
+	}
+	sim.ExpectedSeconds = ceilDiv(from.DistanceTo(pickup), speed) + ceilDiv(pickup.DistanceTo(destination), speed)
+
+	pos := from
+	target, picked := pickup, false
+	for t := 0; t <= simulationMaxSeconds; t++ {
+		if pos == target {
+			if picked {
+				sim.ArrivalSeconds, sim.Completed = t, true
+				return sim
+			}
+			sim.PickupSeconds = t
+			target, picked = destination, true
+			// 迎車地点で同じ秒のうちに折り返す
+			t--
+			continue
+		}
+		pos = pos.MoveToward(target, speed)
+	}
+	return sim
+}
+
+// matchRides の結果を全て動かしてみる
+func simulateMatching(t *testing.T, rides []Ride, chairs []matchingChair) []simulatedRide {
+	t.Helper()
+	rideByID := make(map[string]*Ride, len(rides))
+	for i := range rides {
+		rideByID[rides[i].ID] = &rides[i]
+	}
+	chairByID := make(map[string]*matchingChair, len(chairs))
+	for i := range chairs {
+		chairByID[chairs[i].Chair.ID] = &chairs[i]
+	}
+
+	sims := []simulatedRide{}
+	for _, pair := range matchRides(rides, chairs).Pairs {
+		ride, chair := rideByID[pair.RideID], chairByID[pair.ChairID]
+		if ride == nil || chair == nil {
+			t.Fatalf("matcher returned an unknown pair: %+v", pair)
+		}
+		r := simulateChairRide(chair.Position, chair.Speed, ride.Pickup(), ride.Destination())
+		r.RideID, r.ChairID = pair.RideID, pair.ChairID
+		sims = append(sims, r)
+	}
+	return sims
+}
+
+func TestSimulateChairRide(t *testing.T) {
+	tests := []struct {
+		name                 string
+		from, pickup, dest   Coordinate
+		speed                int
+		pickupSecs, arrivals int
+	}{
+		// 合計 8 を速度 3 で割ると 3 秒だが、迎車地点で余りが捨てられるので 4 秒かかる
+		{"legs rounded separately", Coordinate{0, 0}, Coordinate{0, 4}, Coordinate{0, 8}, 3, 2, 4},
+		{"already at pickup", Coordinate{5, 5}, Coordinate{5, 5}, Coordinate{5, 9}, 2, 0, 2},
+		{"lat then long", Coordinate{0, 0}, Coordinate{2, 2}, Coordinate{-1, 3}, 3, 2, 4},
+		{"destination equals pickup", Coordinate{0, 0}, Coordinate{0, 6}, Coordinate{0, 6}, 3, 2, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := simulateChairRide(tt.from, tt.speed, tt.pickup, tt.dest)
+			if !got.Completed || got.PickupSeconds != tt.pickupSecs || got.ArrivalSeconds != tt.arrivals {
+				t.Fatalf("got pickup=%d arrival=%d completed=%v, want pickup=%d arrival=%d",
+					got.PickupSeconds, got.ArrivalSeconds, got.Completed, tt.pickupSecs, tt.arrivals)
+			}
+			if got.ExpectedSeconds != tt.arrivals {
+				t.Fatalf("expected seconds = %d, want %d", got.ExpectedSeconds, tt.arrivals)
+			}
+		})
+	}
+}
+
+func TestSimulateChairRideStopped(t *testing.T) {
+	if got := simulateChairRide(Coordinate{0, 0}, 0, Coordinate{1, 1}, Coordinate{2, 2}); got.Completed {
+		t.Fatalf("chair with no speed completed a ride: %+v", got)
+	}
+}
+
+// 見積もりは 1 秒刻みで動かしたときと必ず一致する
+func TestSimulateChairRideMatchesEstimate(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	coord := func() Coordinate {
+		return Coordinate{Latitude: rng.IntN(201) - 100, Longitude: rng.IntN(201) - 100}
+	}
+	for range 1000 {
+		from, pickup, dest, speed := coord(), coord(), coord(), 1+rng.IntN(7)
+		got := simulateChairRide(from, speed, pickup, dest)
+		if !got.Completed || got.ArrivalSeconds != got.ExpectedSeconds {
+			t.Fatalf("from=%v pickup=%v dest=%v speed=%d: arrival=%d expected=%d completed=%v",
+				from, pickup, dest, speed, got.ArrivalSeconds, got.ExpectedSeconds, got.Completed)
+		}
+		if want := ceilDiv(from.DistanceTo(pickup), speed); got.PickupSeconds != want {
+			t.Fatalf("from=%v pickup=%v speed=%d: pickup=%d, want %d", from, pickup, speed, got.PickupSeconds, want)
+		}
+	}
+}
+
+func TestSimulateMatching(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	coord := func() Coordinate {
+		return Coordinate{Latitude: rng.IntN(101) - 50, Longitude: rng.IntN(101) - 50}
+	}
+	rides := make([]Ride, 20)
+	for i := range rides {
+		pickup, dest := coord(), coord()
+		rides[i] = Ride{
+			ID:                   fmt.Sprintf("ride-%02d", i),
+			PickupLatitude:       pickup.Latitude,
+			PickupLongitude:      pickup.Longitude,
+			DestinationLatitude:  dest.Latitude,
+			DestinationLongitude: dest.Longitude,
+		}
+	}
+	chairs := make([]matchingChair, 10)
+	for i := range chairs {
+		chairs[i] = matchingChair{
+			Chair:    Chair{ID: fmt.Sprintf("chair-%02d", i)},
+			Position: coord(),
+			Speed:    1 + rng.IntN(7),
+		}
+	}
+
+	sims := simulateMatching(t, rides, chairs)
+	if len(sims) == 0 {
+		t.Fatal("no rides were matched")
+	}
+	seen := map[string]bool{}
+	for _, r := range sims {
+		if seen[r.ChairID] {
+			t.Fatalf("chair %s was matched twice", r.ChairID)
+		}
+		seen[r.ChairID] = true
+		if !r.Completed || r.ArrivalSeconds > r.ExpectedSeconds {
+			t.Errorf("%s by %s: arrival=%d expected=%d completed=%v", r.RideID, r.ChairID, r.ArrivalSeconds, r.ExpectedSeconds, r.Completed)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type counter struct {
+	v atomic.Int64
+}
+
+func (c *counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *counter) Add(n int64) {
+	c.v.Add(n)
+}
+
+func (c *counter) Value() int64 {
+	return c.v.Load()
+}
+
+type gauge struct {
+	v atomic.Int64
+}
+
+func (g *gauge) Set(n int64) {
+	g.v.Store(n)
+}
+
+func (g *gauge) Add(n int64) {
+	g.v.Add(n)
+}
+
+func (g *gauge) Value() int64 {
+	return g.v.Load()
+}
+
+// 値は区間ごとに数える。bounds は各区間の上限 (昇順) で、最後の区間はそれより大きいもの全て
+type histogram struct {
+	bounds []int64
+	counts []atomic.Int64
+	sum    atomic.Int64
+	count  atomic.Int64
+}
+
+func (h *histogram) Observe(v int64) {
+	h.counts[sort.Search(len(h.bounds), func(i int) bool { return v <= h.bounds[i] })].Add(1)
+	h.sum.Add(v)
+	h.count.Add(1)
+}
+
+// q 番目の値が入っている区間の上限。最後の区間に入っていれば最大の上限を返す
+func (h *histogram) Quantile(q float64) int64 {
+	total := h.count.Load()
+	if total == 0 {
+		return 0
+	}
+	rank := int64(q * float64(total))
+	var seen int64
+	for i := range h.bounds {
+		if seen += h.counts[i].Load(); seen > rank {
+			return h.bounds[i]
+		}
+	}
+	return h.bounds[len(h.bounds)-1]
+}
+
+var metricsRegistry = struct {
+	sync.Mutex
+	counters   map[string]*counter
+	gauges     map[string]*gauge
+	histograms map[string]*histogram
+}{counters: map[string]*counter{}, gauges: map[string]*gauge{}, histograms: map[string]*histogram{}}
+
+// name はラベル込みで一意なキーにする (e.g. `panics_total{route="GET /api/app/rides"}`)
+func metricCounter(name string) *counter {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	c, ok := metricsRegistry.counters[name]
+	if !ok {
+		c = &counter{}
+		metricsRegistry.counters[name] = c
+	}
+	return c
+}
+
+func metricGauge(name string) *gauge {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	g, ok := metricsRegistry.gauges[name]
+	if !ok {
+		g = &gauge{}
+		metricsRegistry.gauges[name] = g
+	}
+	return g
+}
+
+// 同じ名前で最初に登録した bounds を使い続ける
+func metricHistogram(name string, bounds []int64) *histogram {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	h, ok := metricsRegistry.histograms[name]
+	if !ok {
+		h = &histogram{bounds: bounds, counts: make([]atomic.Int64, len(bounds)+1)}
+		metricsRegistry.histograms[name] = h
+	}
+	return h
+}
+
+// name にラベルが付いていれば、その後ろに le を足す
+func histogramBucketName(name, le string) string {
+	base, labels, ok := strings.Cut(name, "{")
+	if !ok {
+		return fmt.Sprintf("%s_bucket{le=%q}", name, le)
+	}
+	return fmt.Sprintf("%s_bucket{%s,le=%q}", base, strings.TrimSuffix(labels, "}"), le)
+}
+
+func histogramSeriesName(name, suffix string) string {
+	base, labels, ok := strings.Cut(name, "{")
+	if !ok {
+		return name + suffix
+	}
+	return base + suffix + "{" + labels
+}
+
+func metricName(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+type cacheLookupKey struct {
+	cache string
+	route string
+}
+
+// (キャッシュ, エンドポイント) → [miss, hit] のカウンター
+// キャッシュを引くたびに名前を組み立ててレジストリのロックを取らないよう、最初に引いたときに解決しておく
+var cacheLookupCounters sync.Map
+
+// キャッシュを引いた結果を呼び出し元のエンドポイントごとに数える
+// miss が多いエンドポイントはまだ MySQL を見に行っている
+func recordCacheLookup(ctx context.Context, cache string, hit bool) {
+	key := cacheLookupKey{cache: cache, route: routeFromContext(ctx)}
+	v, ok := cacheLookupCounters.Load(key)
+	if !ok {
+		v, _ = cacheLookupCounters.LoadOrStore(key, &[2]*counter{
+			metricCounter(metricName("cache_lookups_total", "cache", key.cache, "route", key.route, "result", "miss")),
+			metricCounter(metricName("cache_lookups_total", "cache", key.cache, "route", key.route, "result", "hit")),
+		})
+	}
+	counters := v.(*[2]*counter)
+	if hit {
+		counters[1].Inc()
+	} else {
+		counters[0].Inc()
+	}
+}
+
+func routeFromContext(ctx context.Context) string {
+	rctx := chi.RouteContext(ctx)
+	if rctx == nil {
+		return "background"
+	}
+	if pattern := rctx.RoutePattern(); pattern != "" {
+		return pattern
+	}
+	return "unknown"
+}
+
+func metricsSnapshot() map[string]int64 {
+	metricsRegistry.Lock()
+	defer metricsRegistry.Unlock()
+	values := make(map[string]int64, len(metricsRegistry.counters)+len(metricsRegistry.gauges))
+	for name, c := range metricsRegistry.counters {
+		values[name] = c.Value()
+	}
+	for name, g := range metricsRegistry.gauges {
+		values[name] = g.Value()
+	}
+	// バケットは累積で出す
+	for name, h := range metricsRegistry.histograms {
+		var cumulative int64
+		for i := range h.counts {
+			cumulative += h.counts[i].Load()
+			le := "+Inf"
+			if i < len(h.bounds) {
+				le = strconv.FormatInt(h.bounds[i], 10)
+			}
+			values[histogramBucketName(name, le)] = cumulative
+		}
+		values[histogramSeriesName(name, "_sum")] = h.sum.Load()
+		values[histogramSeriesName(name, "_count")] = h.count.Load()
+	}
+	return values
+}
+
+func internalGetMetrics(w http.ResponseWriter, r *http.Request) {
+	values := metricsSnapshot()
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s %d\n", name, values[name])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(b.String()))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRecordCacheLookup(t *testing.T) {
+	ctx := context.Background()
+	hit := metricCounter(metricName("cache_lookups_total", "cache", "test_lookup", "route", "background", "result", "hit"))
+	miss := metricCounter(metricName("cache_lookups_total", "cache", "test_lookup", "route", "background", "result", "miss"))
+	hits, misses := hit.Value(), miss.Value()
+
+	recordCacheLookup(ctx, "test_lookup", true)
+	recordCacheLookup(ctx, "test_lookup", true)
+	recordCacheLookup(ctx, "test_lookup", false)
+
+	if got := hit.Value() - hits; got != 2 {
+		t.Errorf("hits = %d, want 2", got)
+	}
+	if got := miss.Value() - misses; got != 1 {
+		t.Errorf("misses = %d, want 1", got)
+	}
+}
+
+func BenchmarkRecordCacheLookup(b *testing.B) {
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			recordCacheLookup(ctx, "bench_lookup", true)
+		}
+	})
+}
@@ -1,82 +1,40 @@
 package main
 
 import (
-	"context"
-	"database/sql"
 	"errors"
+	"log/slog"
 	"net/http"
+	"runtime/debug"
+
+	"github.com/go-chi/chi/v5"
 )
 
-func appAuthMiddleware(next http.Handler) http.Handler {
+func recoverMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		c, err := r.Cookie("app_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("app_session cookie is required"))
-			return
-		}
-		accessToken := c.Value
-		user := &User{}
-		err = db.GetContext(ctx, user, "SELECT * FROM users WHERE access_token = ?", accessToken)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
+		defer func() {
+			rec := recover()
+			if rec == nil {
 				return
 			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		ctx = context.WithValue(ctx, "user", user)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
-
-func ownerAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		c, err := r.Cookie("owner_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("owner_session cookie is required"))
-			return
-		}
-		accessToken := c.Value
-		owner := &Owner{}
-		if err := db.GetContext(ctx, owner, "SELECT * FROM owners WHERE access_token = ?", accessToken); err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-				return
+			if rec == http.ErrAbortHandler {
+				panic(rec)
 			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
-
-		ctx = context.WithValue(ctx, "owner", owner)
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
-}
 
-func chairAuthMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
-		c, err := r.Cookie("chair_session")
-		if errors.Is(err, http.ErrNoCookie) || c.Value == "" {
-			writeError(w, http.StatusUnauthorized, errors.New("chair_session cookie is required"))
-			return
-		}
-		accessToken := c.Value
-		chair := &Chair{}
-		err = db.GetContext(ctx, chair, "SELECT * FROM chairs WHERE access_token = ?", accessToken)
-		if err != nil {
-			if errors.Is(err, sql.ErrNoRows) {
-				writeError(w, http.StatusUnauthorized, errors.New("invalid access token"))
-				return
+			route := r.URL.Path
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
 			}
-			writeError(w, http.StatusInternalServerError, err)
-			return
-		}
+			metricCounter(metricName("panics_total", "route", route)).Inc()
+			slog.Error("panic recovered",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"route", route,
+				"panic", rec,
+				"stack", string(debug.Stack()),
+			)
+			writeError(w, http.StatusInternalServerError, errors.New("internal server error"))
+		}()
 
-		ctx = context.WithValue(ctx, "chair", chair)
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// 起動時と initialize 後にマイグレーションを流すかどうか
+var autoMigrate = getEnvBool("ISUCON_AUTO_MIGRATE", true)
+
+// 追加のみのスキーマ変更を順に流す
+// init.sh でテーブルごと作り直されるので適用済みかは記録せず、既にあるカラムやインデックスのエラーは無視する
+func runMigrations(ctx context.Context) error {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		b, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		applied := 0
+		for _, stmt := range splitSQLStatements(string(b)) {
+			if _, err := db.ExecContext(ctx, stmt); err != nil {
+				if isAlreadyMigrated(err) {
+					continue
+				}
+				return fmt.Errorf("migration %s: %w", name, err)
+			}
+			applied++
+		}
+		if applied > 0 {
+			slog.Info("migration applied", "name", name)
+		}
+	}
+	return ensureIndexes(ctx)
+}
+
+// ; で文に分ける。文字列リテラル・クォートした識別子・コメントの中の ; では区切らない
+// 空の文とコメントだけの文は返さない
+func splitSQLStatements(src string) []string {
+	var (
+		stmts []string
+		start int
+		// 文の中にコメント以外の文字があるか
+		hasCode bool
+	)
+	flush := func(end int) {
+		if stmt := strings.TrimSpace(src[start:end]); hasCode && stmt != "" {
+			stmts = append(stmts, stmt)
+		}
+		hasCode = false
+	}
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; {
+		case c == '\'' || c == '"' || c == '`':
+			hasCode = true
+			// 閉じるクォートまで飛ばす。'' のような重ねたクォートと \ によるエスケープを考慮する
+			for i++; i < len(src); i++ {
+				if src[i] == '\\' && c != '`' {
+					i++
+					continue
+				}
+				if src[i] == c {
+					if i+1 < len(src) && src[i+1] == c {
+						i++
+						continue
+					}
+					break
+				}
+			}
+		// MySQL の -- コメントは後ろに空白か改行が要る
+		case c == '#' || (strings.HasPrefix(src[i:], "--") && (i+2 == len(src) || src[i+2] <= ' ')):
+			if j := strings.IndexByte(src[i:], '\n'); j >= 0 {
+				i += j
+			} else {
+				i = len(src)
+			}
+		case c == '/' && strings.HasPrefix(src[i:], "/*"):
+			if j := strings.Index(src[i+2:], "*/"); j >= 0 {
+				i += j + 3
+			} else {
+				i = len(src)
+			}
+		case c == ';':
+			flush(i)
+			start = i + 1
+		case c != ' ' && c != '\t' && c != '\n' && c != '\r':
+			hasCode = true
+		}
+	}
+	flush(len(src))
+	return stmts
+}
+
+func isAlreadyMigrated(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	// 1060: Duplicate column name, 1061: Duplicate key name
+	return mysqlErr.Number == 1060 || mysqlErr.Number == 1061
+}
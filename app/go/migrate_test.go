@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []string
+	}{
+		{name: "single", src: "ALTER TABLE rides ADD COLUMN a INT;", want: []string{"ALTER TABLE rides ADD COLUMN a INT"}},
+		{name: "no trailing semicolon", src: "SELECT 1;\nSELECT 2", want: []string{"SELECT 1", "SELECT 2"}},
+		{name: "empty statements", src: ";\n ; SELECT 1;;", want: []string{"SELECT 1"}},
+		{name: "semicolon in string", src: "UPDATE t SET v = 'a;b'; SELECT 1;", want: []string{"UPDATE t SET v = 'a;b'", "SELECT 1"}},
+		{name: "semicolon in comment literal", src: "ALTER TABLE t ADD COLUMN c INT COMMENT '区切り; ここまで';", want: []string{"ALTER TABLE t ADD COLUMN c INT COMMENT '区切り; ここまで'"}},
+		{name: "doubled quote", src: "SELECT 'it''s;here'; SELECT 2;", want: []string{"SELECT 'it''s;here'", "SELECT 2"}},
+		{name: "escaped quote", src: `SELECT 'a\';b'; SELECT 2;`, want: []string{`SELECT 'a\';b'`, "SELECT 2"}},
+		{name: "double quoted", src: `SELECT "x;y";`, want: []string{`SELECT "x;y"`}},
+		{name: "backquoted identifier", src: "SELECT `a;b` FROM t;", want: []string{"SELECT `a;b` FROM t"}},
+		{name: "line comment", src: "-- drop; this\nSELECT 1;", want: []string{"-- drop; this\nSELECT 1"}},
+		{name: "hash comment", src: "SELECT 1; # trailing; comment\n", want: []string{"SELECT 1"}},
+		{name: "block comment", src: "/* a; b */ SELECT 1;", want: []string{"/* a; b */ SELECT 1"}},
+		{name: "comment only", src: "-- nothing here;\n/* or; here */", want: nil},
+		{name: "double minus without space", src: "SELECT 1--1;", want: []string{"SELECT 1--1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := splitSQLStatements(tt.src); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("splitSQLStatements(%q) = %q, want %q", tt.src, got, tt.want)
+			}
+		})
+	}
+}
+
+// 埋め込んだマイグレーションが想定どおりの文数に分かれる
+func TestMigrationFilesSplit(t *testing.T) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"migrations/0003_rides_pending_index.sql":        1,
+		"migrations/0004_chairs_unique_registration.sql": 1,
+		"migrations/0005_rides_settled_at.sql":           1,
+		"migrations/0006_ride_statuses_seq.sql":          3,
+	}
+	if len(names) != len(want) {
+		t.Fatalf("migrations = %v, want %d files", names, len(want))
+	}
+	for _, name := range names {
+		b, err := migrationFiles.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(splitSQLStatements(string(b))); got != want[name] {
+			t.Errorf("%s: %d statements, want %d", name, got, want[name])
+		}
+	}
+}
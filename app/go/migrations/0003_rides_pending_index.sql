@@ -0,0 +1 @@
+ALTER TABLE rides ADD INDEX idx_chair_id_created_at (chair_id, created_at);
@@ -0,0 +1 @@
+ALTER TABLE chairs ADD UNIQUE INDEX uniq_owner_id_name_model (owner_id, name, model(255));
@@ -0,0 +1 @@
+ALTER TABLE rides ADD COLUMN settled_at DATETIME(6) NULL COMMENT '決済が完了した日時';
@@ -0,0 +1,7 @@
+ALTER TABLE ride_statuses ADD COLUMN seq INT NOT NULL DEFAULT 0 COMMENT 'ライドごとの通し番号。created_at が同じステータスの順序もこれで決める';
+UPDATE ride_statuses
+    JOIN (SELECT id, ROW_NUMBER() OVER (PARTITION BY ride_id ORDER BY created_at, FIELD(status, 'MATCHING', 'ENROUTE', 'PICKUP', 'CARRYING', 'ARRIVED', 'COMPLETED')) AS seq FROM ride_statuses) numbered
+    ON numbered.id = ride_statuses.id
+SET ride_statuses.seq = numbered.seq
+WHERE ride_statuses.seq = 0;
+ALTER TABLE ride_statuses ADD UNIQUE INDEX ride_statuses_ride_id_seq (ride_id, seq);
@@ -2,10 +2,36 @@ package main
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 )
 
-type Chair struct {
+// 各テーブルから読む列。SELECT * は使わず、ここに並べた列だけを明示して取得する
+const (
+	chairColumns         = "id, owner_id, name, model, is_active, access_token, created_at, updated_at"
+	chairLocationColumns = "id, chair_id, latitude, longitude, created_at"
+	rideColumns          = "id, user_id, chair_id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, evaluation, created_at, updated_at"
+	rideStatusColumns    = "id, ride_id, status, seq, created_at, app_sent_at, chair_sent_at"
+	userColumns          = "id, username, firstname, lastname, date_of_birth, access_token, invitation_code, created_at, updated_at"
+	ownerColumns         = "id, name, access_token, chair_register_token, created_at, updated_at"
+	couponColumns        = "user_id, code, discount, created_at, used_by"
+	paymentTokenColumns  = "user_id, token, created_at"
+)
+
+// "id, name" → "t.id, t.name"。JOIN や派生テーブルから *Columns の列を引くときに使う
+func qualifyColumns(table, columns string) string {
+	cols := strings.Split(columns, ", ")
+	for i, c := range cols {
+		cols[i] = table + "." + c
+	}
+	return strings.Join(cols, ", ")
+}
+
+// 椅子・椅子の位置・ライドは、DB の行 (chairRow など) とアプリ内で持ち回す型 (Chair など) を分ける
+// 読み取りは行の型に Scan し、model() で変換してから渡す。アプリ側の型は列に縛られないので、
+// キャッシュやハンドラ向けに表現を変えても、変換を直すだけでスキャンは壊れない
+
+type chairRow struct {
 	ID          string    `db:"id"`
 	OwnerID     string    `db:"owner_id"`
 	Name        string    `db:"name"`
@@ -16,12 +42,36 @@ type Chair struct {
 	UpdatedAt   time.Time `db:"updated_at"`
 }
 
+func (r *chairRow) model() Chair {
+	return Chair{
+		ID:          r.ID,
+		OwnerID:     r.OwnerID,
+		Name:        r.Name,
+		Model:       r.Model,
+		IsActive:    r.IsActive,
+		AccessToken: r.AccessToken,
+		CreatedAt:   r.CreatedAt,
+		UpdatedAt:   r.UpdatedAt,
+	}
+}
+
+type Chair struct {
+	ID          string
+	OwnerID     string
+	Name        string
+	Model       string
+	IsActive    bool
+	AccessToken string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
 type ChairModel struct {
 	Name  string `db:"name"`
 	Speed int    `db:"speed"`
 }
 
-type ChairLocation struct {
+type chairLocationRow struct {
 	ID        string    `db:"id"`
 	ChairID   string    `db:"chair_id"`
 	Latitude  int       `db:"latitude"`
@@ -29,6 +79,25 @@ type ChairLocation struct {
 	CreatedAt time.Time `db:"created_at"`
 }
 
+func (r *chairLocationRow) model() ChairLocation {
+	return ChairLocation{
+		ID:        r.ID,
+		ChairID:   r.ChairID,
+		Latitude:  r.Latitude,
+		Longitude: r.Longitude,
+		CreatedAt: r.CreatedAt,
+	}
+}
+
+// ファイルのストアではこの形のまま JSON で書き出す
+type ChairLocation struct {
+	ID        string
+	ChairID   string
+	Latitude  int
+	Longitude int
+	CreatedAt time.Time
+}
+
 type User struct {
 	ID             string    `db:"id"`
 	Username       string    `db:"username"`
@@ -47,7 +116,7 @@ type PaymentToken struct {
 	CreatedAt time.Time `db:"created_at"`
 }
 
-type Ride struct {
+type rideRow struct {
 	ID                   string         `db:"id"`
 	UserID               string         `db:"user_id"`
 	ChairID              sql.NullString `db:"chair_id"`
@@ -60,10 +129,55 @@ type Ride struct {
 	UpdatedAt            time.Time      `db:"updated_at"`
 }
 
+// rideColumns の順
+func (r *rideRow) dest() []any {
+	return []any{
+		&r.ID,
+		&r.UserID,
+		&r.ChairID,
+		&r.PickupLatitude,
+		&r.PickupLongitude,
+		&r.DestinationLatitude,
+		&r.DestinationLongitude,
+		&r.Evaluation,
+		&r.CreatedAt,
+		&r.UpdatedAt,
+	}
+}
+
+func (r *rideRow) model() Ride {
+	return Ride{
+		ID:                   r.ID,
+		UserID:               r.UserID,
+		ChairID:              r.ChairID,
+		PickupLatitude:       r.PickupLatitude,
+		PickupLongitude:      r.PickupLongitude,
+		DestinationLatitude:  r.DestinationLatitude,
+		DestinationLongitude: r.DestinationLongitude,
+		Evaluation:           r.Evaluation,
+		CreatedAt:            r.CreatedAt,
+		UpdatedAt:            r.UpdatedAt,
+	}
+}
+
+type Ride struct {
+	ID                   string
+	UserID               string
+	ChairID              sql.NullString
+	PickupLatitude       int
+	PickupLongitude      int
+	DestinationLatitude  int
+	DestinationLongitude int
+	Evaluation           *int
+	CreatedAt            time.Time
+	UpdatedAt            time.Time
+}
+
 type RideStatus struct {
 	ID          string     `db:"id"`
 	RideID      string     `db:"ride_id"`
-	Status      string     `db:"status"`
+	Status      RideState  `db:"status"`
+	Seq         int        `db:"seq"`
 	CreatedAt   time.Time  `db:"created_at"`
 	AppSentAt   *time.Time `db:"app_sent_at"`
 	ChairSentAt *time.Time `db:"chair_sent_at"`
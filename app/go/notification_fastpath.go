@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// ライドをまだ持っていないユーザー・椅子の集合。これに無ければ DB も JSON エンコードも経ずに固定の応答を返す
+var (
+	usersWithRide  = NewCache[string, struct{}]()
+	chairsWithRide = NewCache[string, struct{}]()
+)
+
+// ライド → 利用者。ハブのイベントをアプリの通知待ちに振り分けるのに使う
+// 作成時と通知を組み立てたときに載せるので、再起動前のライドも次の通知で載る
+var rideUsers = NewCache[string, string]()
+
+// 通知が無いときの応答は常に同じなので、起動時に一度だけ組み立てておく
+var (
+	appEmptyNotification   = []byte(`{"data":null,"retry_after_ms":` + strconv.Itoa(appNotificationRetryAfterMs) + `}`)
+	chairEmptyNotification = []byte(`{"data":null,"retry_after_ms":` + strconv.Itoa(chairNotificationRetryAfterMs) + `}`)
+)
+
+func writeRawJSON(w http.ResponseWriter, statusCode int, body []byte) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
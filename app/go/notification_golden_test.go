@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// go test -run Golden -update で testdata/*.golden を書き直す
+// ベンチマーカーが検証する形なので、差分が出たら意図した変更かを必ず確かめる
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func goldenAppNotification(status RideState, withChair bool) *appGetNotificationResponse {
+	res := &appGetNotificationResponse{
+		Data: &appGetNotificationResponseData{
+			RideID:                "01JDFEF7MGXXCJKW1MNJXPA77A",
+			PickupCoordinate:      Coordinate{Latitude: 12, Longitude: -34},
+			DestinationCoordinate: Coordinate{Latitude: 56, Longitude: 78},
+			Fare:                  1500,
+			Status:                status,
+			CreatedAt:             1733000000000,
+			UpdateAt:              1733000012345,
+		},
+		RetryAfterMs: appNotificationRetryAfterMs,
+	}
+	if !withChair {
+		res.Data.QueuePosition, res.Data.EstimatedWaitSecs = intPtr(3), intPtr(7)
+		return res
+	}
+	res.Data.Chair = &appGetNotificationResponseChair{
+		ID:    "01JDFEDF00B09BNMV8MP0RB34G",
+		Name:  "QC-L13-8361",
+		Model: "クエストチェア Lite",
+		Stats: appGetNotificationResponseChairStats{TotalRidesCount: 4, TotalEvaluationAvg: 4.25},
+	}
+	switch status {
+	case RideStateMatching, RideStateEnroute:
+		res.Data.EstimatedPickupSecs, res.Data.EstimatedArrivalSecs = intPtr(10), intPtr(42)
+	case RideStatePickup, RideStateCarrying:
+		res.Data.EstimatedArrivalSecs = intPtr(32)
+	}
+	return res
+}
+
+func goldenChairNotification(status RideState) *chairGetNotificationResponse {
+	return &chairGetNotificationResponse{
+		Data: &chairGetNotificationResponseData{
+			RideID:                "01JDFEF7MGXXCJKW1MNJXPA77A",
+			User:                  simpleUser{ID: "01JDFEDF008NB6X3MN3RK5A6T6", Name: "山田 太郎"},
+			PickupCoordinate:      Coordinate{Latitude: 12, Longitude: -34},
+			DestinationCoordinate: Coordinate{Latitude: 56, Longitude: 78},
+			Status:                status,
+		},
+		RetryAfterMs: chairNotificationRetryAfterMs,
+	}
+}
+
+// writeJSON を通して、実際にハンドラが返すのと同じバイト列にする
+func encodeNotification(v any) []byte {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, http.StatusOK, v)
+	return rec.Body.Bytes()
+}
+
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name+".golden")
+	if *updateGolden {
+		if err := os.MkdirAll("testdata", 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read golden file (run with -update to create it): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s mismatch\ngot:  %s\nwant: %s", path, got, want)
+	}
+}
+
+func TestAppNotificationGolden(t *testing.T) {
+	for _, status := range rideStateOrder {
+		t.Run(string(status), func(t *testing.T) {
+			assertGolden(t, "app_notification_"+strings.ToLower(string(status)), encodeNotification(goldenAppNotification(status, true)))
+		})
+	}
+	t.Run("no_chair", func(t *testing.T) {
+		assertGolden(t, "app_notification_no_chair", encodeNotification(goldenAppNotification(RideStateMatching, false)))
+	})
+	t.Run("empty", func(t *testing.T) {
+		assertGolden(t, "app_notification_empty", appEmptyNotification)
+		if got := encodeNotification(&appGetNotificationResponse{RetryAfterMs: appNotificationRetryAfterMs}); !bytes.Equal(got, appEmptyNotification) {
+			t.Errorf("prebuilt empty notification differs from encoded one\ngot:  %s\nwant: %s", appEmptyNotification, got)
+		}
+	})
+}
+
+func TestChairNotificationGolden(t *testing.T) {
+	for _, status := range rideStateOrder {
+		t.Run(string(status), func(t *testing.T) {
+			assertGolden(t, "chair_notification_"+strings.ToLower(string(status)), encodeNotification(goldenChairNotification(status)))
+		})
+	}
+	t.Run("empty", func(t *testing.T) {
+		assertGolden(t, "chair_notification_empty", chairEmptyNotification)
+		if got := encodeNotification(&chairGetNotificationResponse{RetryAfterMs: chairNotificationRetryAfterMs}); !bytes.Equal(got, chairEmptyNotification) {
+			t.Errorf("prebuilt empty notification differs from encoded one\ngot:  %s\nwant: %s", chairEmptyNotification, got)
+		}
+	})
+}
+
+func BenchmarkAppNotificationEncode(b *testing.B) {
+	res := goldenAppNotification(RideStateEnroute, true)
+	b.ReportAllocs()
+	for range b.N {
+		encodeNotification(res)
+	}
+}
+
+func BenchmarkAppNotificationEncodeNoChair(b *testing.B) {
+	res := goldenAppNotification(RideStateMatching, false)
+	b.ReportAllocs()
+	for range b.N {
+		encodeNotification(res)
+	}
+}
+
+func BenchmarkChairNotificationEncode(b *testing.B) {
+	res := goldenChairNotification(RideStateEnroute)
+	b.ReportAllocs()
+	for range b.N {
+		encodeNotification(res)
+	}
+}
+
+func BenchmarkEmptyNotificationWrite(b *testing.B) {
+	b.ReportAllocs()
+	for range b.N {
+		rec := httptest.NewRecorder()
+		writeRawJSON(rec, http.StatusOK, appEmptyNotification)
+	}
+}
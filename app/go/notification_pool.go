@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 通知を組み立てるワーカーの数 (種類ごと)。待っている接続がいくつあっても、同時に DB を見に行くのはこの数まで
+var notificationWorkers = getEnvInt("ISUCON_NOTIFICATION_WORKERS", 8)
+
+type notificationResult[R any] struct {
+	res   R
+	fresh bool
+	err   error
+	// 組み立てる直前の通知の版
+	version uint64
+}
+
+type notificationWaiter[S any, R any] struct {
+	key     string
+	subject S
+	ch      chan notificationResult[R]
+}
+
+// 組み立てを待っているキーと、それを拾うワーカーを起こすチャネル
+// pending はプールのロックで守る。wake は 1 つだけ溜まればよいので、enqueue は詰まらない
+type notificationWorker struct {
+	pending []string
+	wake    chan struct{}
+}
+
+// 椅子・ユーザーごとに通知を待っている接続を束ね、状態が変わったらワーカーが 1 回だけ組み立てて全員に配る
+// 同じキーの通知は同じワーカーが順に処理する
+type notificationPool[S any, R any] struct {
+	sync.Mutex
+	kind    string
+	build   func(context.Context, S) (R, bool, error)
+	workers []*notificationWorker
+	waiters map[string][]*notificationWaiter[S, R]
+	// 組み立て待ちのキー。積まれている間に来た Notify は 1 回の組み立てにまとめる
+	queued map[string]struct{}
+	// Notify のたびに増える。待ち始める前の変化を取りこぼさないために使う
+	version map[string]uint64
+}
+
+func newNotificationPool[S any, R any](kind string) *notificationPool[S, R] {
+	return &notificationPool[S, R]{
+		kind:    kind,
+		waiters: map[string][]*notificationWaiter[S, R]{},
+		queued:  map[string]struct{}{},
+		version: map[string]uint64{},
+	}
+}
+
+// 組み立て関数は通知を送る側から参照されて初期化が循環するので、start で渡す
+var (
+	chairNotifier = newNotificationPool[*Chair, *chairGetNotificationResponse]("chair")
+	appNotifier   = newNotificationPool[*User, *appGetNotificationResponse]("app")
+)
+
+func startNotificationWorkers() {
+	chairNotifier.start(notificationWorkers, buildChairNotification)
+	appNotifier.start(notificationWorkers, buildAppNotification)
+	go runRideEventFanout()
+}
+
+func (p *notificationPool[S, R]) start(n int, build func(context.Context, S) (R, bool, error)) {
+	p.Lock()
+	p.build = build
+	p.workers = make([]*notificationWorker, max(n, 1))
+	for i := range p.workers {
+		p.workers[i] = &notificationWorker{wake: make(chan struct{}, 1)}
+	}
+	p.Unlock()
+	for _, w := range p.workers {
+		go p.run(w)
+	}
+}
+
+func (p *notificationPool[S, R]) Version(key string) uint64 {
+	p.Lock()
+	defer p.Unlock()
+	return p.version[key]
+}
+
+// seen 以降に変化があれば、すぐに組み立てを予約する
+func (p *notificationPool[S, R]) Wait(key string, subject S, seen uint64) *notificationWaiter[S, R] {
+	w := &notificationWaiter[S, R]{key: key, subject: subject, ch: make(chan notificationResult[R], 1)}
+	p.Lock()
+	p.waiters[key] = append(p.waiters[key], w)
+	var worker *notificationWorker
+	if p.version[key] != seen {
+		worker = p.enqueueLocked(key)
+	}
+	p.Unlock()
+	worker.signal()
+	return w
+}
+
+// ワーカーが拾う前に取り消せたら true。false ならワーカーが組み立て中なので結果を受け取る必要がある
+func (p *notificationPool[S, R]) Cancel(w *notificationWaiter[S, R]) bool {
+	p.Lock()
+	defer p.Unlock()
+	waiters := p.waiters[w.key]
+	for i, v := range waiters {
+		if v == w {
+			p.waiters[w.key] = append(waiters[:i], waiters[i+1:]...)
+			if len(p.waiters[w.key]) == 0 {
+				delete(p.waiters, w.key)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (p *notificationPool[S, R]) Notify(key string) {
+	p.Lock()
+	p.version[key]++
+	var worker *notificationWorker
+	if len(p.waiters[key]) > 0 {
+		worker = p.enqueueLocked(key)
+	}
+	p.Unlock()
+	worker.signal()
+}
+
+// ロックを持って呼ぶ。すでに積まれていれば何もせず nil を返す。積んだら起こすワーカーを返す
+func (p *notificationPool[S, R]) enqueueLocked(key string) *notificationWorker {
+	if _, ok := p.queued[key]; ok {
+		metricCounter(metricName("notification_coalesced_total", "type", p.kind)).Inc()
+		return nil
+	}
+	p.queued[key] = struct{}{}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	w := p.workers[h.Sum32()%uint32(len(p.workers))]
+	w.pending = append(w.pending, key)
+	return w
+}
+
+// 既に起こしてあれば何もしない。ワーカーが組み立て中でも呼び出し側は待たされない
+func (w *notificationWorker) signal() {
+	if w == nil {
+		return
+	}
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *notificationPool[S, R]) run(worker *notificationWorker) {
+	for range worker.wake {
+		p.Lock()
+		keys := worker.pending
+		worker.pending = nil
+		p.Unlock()
+		for _, key := range keys {
+			p.dispatch(key)
+		}
+	}
+}
+
+func (p *notificationPool[S, R]) dispatch(key string) {
+	p.Lock()
+	delete(p.queued, key)
+	waiters := p.waiters[key]
+	delete(p.waiters, key)
+	version := p.version[key]
+	p.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+
+	res, fresh, err := p.build(context.Background(), waiters[0].subject)
+	metricCounter(metricName("notification_builds_total", "type", p.kind)).Inc()
+	result := notificationResult[R]{res: res, fresh: fresh, err: err, version: version}
+	for _, w := range waiters {
+		w.ch <- result
+	}
+}
+
+// 最初に組み立てた res (版は seen) を持って、新しい通知ができるか wait が切れるまで待つ
+// 以降の組み立てはワーカーに任せる。切断されたら ok = false で、呼び出し側は何も書かずに返る
+func (p *notificationPool[S, R]) longPoll(ctx context.Context, key string, subject S, seen uint64, res R, wait time.Duration) (_ R, ok bool, _ error) {
+	kind := p.kind + "_long_poll"
+	defer trackSubscriber(kind)()
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	expired := false
+	for {
+		waiter := p.Wait(key, subject, seen)
+		var result notificationResult[R]
+		select {
+		case result = <-waiter.ch:
+		case <-deadline.C:
+			if p.Cancel(waiter) {
+				return res, true, nil
+			}
+			// 組み立て中のものは送信済みになるので、捨てずに返す
+			expired = true
+			result = <-waiter.ch
+		case <-ctx.Done():
+			// 切断されたらすぐに待ち行列から外し、組み立て中の結果を持ち続けないようにする
+			recordClientAbort(kind)
+			if !p.Cancel(waiter) {
+				<-waiter.ch
+			}
+			return res, false, nil
+		}
+		if result.err != nil {
+			return res, true, result.err
+		}
+		seen, res = result.version, result.res
+		if result.fresh || expired {
+			return res, true, nil
+		}
+	}
+}
+
+// wait クエリ (秒)。無ければ 0 で、長すぎれば maxWait に切り詰める
+func parseNotificationWait(r *http.Request, maxWait time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get("wait")
+	if v == "" {
+		return 0, nil
+	}
+	sec, err := strconv.Atoi(v)
+	if err != nil || sec < 0 {
+		return 0, errors.New("wait is invalid")
+	}
+	return min(time.Duration(sec)*time.Second, maxWait), nil
+}
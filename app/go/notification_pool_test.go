@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// build が release を閉じるまで止まり、呼ばれた回数を数えるプール
+func newTestNotificationPool(t *testing.T, workers int) (p *notificationPool[string, string], builds *atomic.Int64, release chan struct{}) {
+	t.Helper()
+	p = newNotificationPool[string, string]("test")
+	builds = new(atomic.Int64)
+	release = make(chan struct{})
+	p.start(workers, func(_ context.Context, key string) (string, bool, error) {
+		builds.Add(1)
+		<-release
+		return key, true, nil
+	})
+	return p, builds, release
+}
+
+func TestNotificationPoolNotifyDoesNotBlock(t *testing.T) {
+	p, builds, release := newTestNotificationPool(t, 1)
+	defer close(release)
+
+	// ワーカーを組み立て中で止めておく
+	p.Wait("a", "a", 1)
+	for builds.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 10000 {
+			key := string(rune('b' + i%100))
+			p.Wait(key, key, 1)
+			p.Notify(key)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify blocked while the worker was busy")
+	}
+
+	p.Lock()
+	pending := len(p.workers[0].pending)
+	p.Unlock()
+	// 同じキーは 1 つにまとまる
+	if pending != 100 {
+		t.Fatalf("pending = %d, want 100", pending)
+	}
+}
+
+func TestNotificationPoolCoalescesDuplicates(t *testing.T) {
+	p, builds, release := newTestNotificationPool(t, 1)
+
+	waiters := make([]*notificationWaiter[string, string], 5)
+	for i := range waiters {
+		waiters[i] = p.Wait("a", "a", 0)
+	}
+	for range 10 {
+		p.Notify("a")
+	}
+	close(release)
+	for _, w := range waiters {
+		select {
+		case res := <-w.ch:
+			if res.res != "a" || res.version != 10 {
+				t.Fatalf("got %+v, want res a at version 10", res)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiter was not notified")
+		}
+	}
+	if got := builds.Load(); got != 1 {
+		t.Fatalf("built %d times, want 1", got)
+	}
+}
+
+func TestNotificationPoolLongPoll(t *testing.T) {
+	p, _, release := newTestNotificationPool(t, 2)
+	close(release)
+
+	t.Run("notified", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			p.Notify("a")
+		}()
+		res, ok, err := p.longPoll(context.Background(), "a", "a", p.Version("a"), "stale", 5*time.Second)
+		if !ok || err != nil || res != "a" {
+			t.Fatalf("longPoll() = %q, %v, %v", res, ok, err)
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		res, ok, err := p.longPoll(context.Background(), "b", "b", p.Version("b"), "stale", 10*time.Millisecond)
+		if !ok || err != nil || res != "stale" {
+			t.Fatalf("longPoll() = %q, %v, %v", res, ok, err)
+		}
+	})
+	t.Run("aborted", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, ok, _ := p.longPoll(ctx, "c", "c", p.Version("c"), "stale", 5*time.Second); ok {
+			t.Fatal("longPoll() returned ok after the client went away")
+		}
+		p.Lock()
+		defer p.Unlock()
+		if len(p.waiters["c"]) != 0 {
+			t.Fatal("aborted waiter was left in the pool")
+		}
+	})
+}
+
+func TestRideEventFanout(t *testing.T) {
+	useFreshCaches(t)
+	// 他のテストが積んだまま配っていないイベントを先に流しておく
+	flushRideEvents()
+	rideUsers.Set("ride-1", "user-1")
+
+	publishRideEvent(rideEvent{Type: rideEventCreated, RideID: "ride-1"})
+	// 配る前に購読を始めても、backlog と重ならずに以降のものだけが届く
+	backlog, events, unsubscribe, ok := subscribeRideEventsAfter(rideEventHub.lastID - 1)
+	defer unsubscribe()
+	if !ok || len(backlog) != 1 {
+		t.Fatalf("backlog = %v, ok = %v", backlog, ok)
+	}
+	publishRideEvent(rideEvent{Type: rideEventStatus, RideID: "ride-1", Status: RideStateEnroute})
+
+	before := appNotifier.Version("user-1")
+	flushRideEvents()
+	select {
+	case ev := <-events:
+		if ev.ID != backlog[0].ID+1 || ev.Status != RideStateEnroute {
+			t.Fatalf("got %+v, want the status event after the backlog", ev)
+		}
+	default:
+		t.Fatal("event was not fanned out")
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("event %+v was delivered twice", ev)
+	default:
+	}
+	if got := appNotifier.Version("user-1"); got != before+2 {
+		t.Fatalf("app notification version = %d, want %d", got, before+2)
+	}
+}
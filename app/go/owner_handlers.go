@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
-	"strconv"
+	"sort"
 	"time"
 
 	"github.com/oklog/ulid/v2"
@@ -28,7 +33,7 @@ func ownerPostOwners(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	req := &ownerPostOwnersRequest{}
 	if err := bindJSON(r, req); err != nil {
-		writeError(w, http.StatusBadRequest, err)
+		writeBindError(w, err)
 		return
 	}
 	if req.Name == "" {
@@ -73,6 +78,7 @@ type modelSales struct {
 	Sales int    `json:"sales"`
 }
 
+// レスポンスの形。ownerGetSales はこれを組み立てずに同じ形で書き出す
 type ownerGetSalesResponse struct {
 	TotalSales int          `json:"total_sales"`
 	Chairs     []chairSales `json:"chairs"`
@@ -81,23 +87,10 @@ type ownerGetSalesResponse struct {
 
 func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	since := time.Unix(0, 0)
-	until := time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
-	if r.URL.Query().Get("since") != "" {
-		parsed, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
-		}
-		since = time.UnixMilli(parsed)
-	}
-	if r.URL.Query().Get("until") != "" {
-		parsed, err := strconv.ParseInt(r.URL.Query().Get("until"), 10, 64)
-		if err != nil {
-			writeError(w, http.StatusBadRequest, err)
-			return
-		}
-		until = time.UnixMilli(parsed)
+	tr, err := parseTimeRange(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
 	}
 
 	owner := r.Context().Value("owner").(*Owner)
@@ -109,34 +102,63 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	chairs := []Chair{}
-	if err := tx.SelectContext(ctx, &chairs, "SELECT * FROM chairs WHERE owner_id = ?", owner.ID); err != nil {
+	chairs, err := selectChairsContext(ctx, tx, "SELECT "+chairColumns+" FROM chairs WHERE owner_id = ?", owner.ID)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
 
-	res := ownerGetSalesResponse{
-		TotalSales: 0,
+	chairSalesOf := func(chair Chair) (int, error) {
+		rides, err := selectRidesContext(ctx, tx, "SELECT rides.id, rides.pickup_latitude, rides.pickup_longitude, rides.destination_latitude, rides.destination_longitude FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at >= ? AND updated_at < ?", chair.ID, tr.Since, tr.Until)
+		if err != nil {
+			return 0, err
+		}
+		return sumSales(rides), nil
 	}
 
-	modelSalesByModel := map[string]int{}
-	for _, chair := range chairs {
-		rides := []Ride{}
-		if err := tx.SelectContext(ctx, &rides, "SELECT rides.* FROM rides JOIN ride_statuses ON rides.id = ride_statuses.ride_id WHERE chair_id = ? AND status = 'COMPLETED' AND updated_at BETWEEN ? AND ? + INTERVAL 999 MICROSECOND", chair.ID, since, until); err != nil {
+	// 期間が長いとレスポンスが大きくなるので、椅子ごとに計算した端から書き出す
+	// 合計は最後まで分からないので末尾に置く。キーの順番は JSON としては意味を持たない
+	// DB が落ちているときに 200 で壊れた JSON を返さないよう、最初の椅子を計算できてからヘッダーを送る
+	firstSales := 0
+	if len(chairs) > 0 {
+		if firstSales, err = chairSalesOf(chairs[0]); err != nil {
 			writeError(w, http.StatusInternalServerError, err)
 			return
 		}
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if len(chairs) == 0 {
+		io.WriteString(w, `{"chairs":null,"models":[],"total_sales":0}`)
+		return
+	}
 
-		sales := sumSales(rides)
-		res.TotalSales += sales
+	// ヘッダーを送った後なので、途中のエラーはログに残して打ち切るしかない
+	totalSales := 0
+	modelSalesByModel := map[string]int{}
+	io.WriteString(w, `{"chairs":[`)
+	for i, chair := range chairs {
+		sales := firstSales
+		if i > 0 {
+			if sales, err = chairSalesOf(chair); err != nil {
+				slog.Error("failed to aggregate sales", "owner_id", owner.ID, "chair_id", chair.ID, "err", err)
+				return
+			}
+		}
+		totalSales += sales
+		modelSalesByModel[chair.Model] += sales
 
-		res.Chairs = append(res.Chairs, chairSales{
+		b, _ := json.Marshal(chairSales{
 			ID:    chair.ID,
 			Name:  chair.Name,
 			Sales: sales,
 		})
-
-		modelSalesByModel[chair.Model] += sales
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		if _, err := w.Write(b); err != nil {
+			return
+		}
 	}
 
 	models := []modelSales{}
@@ -146,21 +168,28 @@ func ownerGetSales(w http.ResponseWriter, r *http.Request) {
 			Sales: sales,
 		})
 	}
-	res.Models = models
-
-	writeJSON(w, http.StatusOK, res)
+	b, _ := json.Marshal(models)
+	io.WriteString(w, `],"models":`)
+	w.Write(b)
+	fmt.Fprintf(w, `,"total_sales":%d}`, totalSales)
 }
 
 func sumSales(rides []Ride) int {
 	sale := 0
 	for _, ride := range rides {
+		if isPaymentFailed(ride.ID) {
+			continue
+		}
 		sale += calculateSale(ride)
 	}
 	return sale
 }
 
 func calculateSale(ride Ride) int {
-	return calculateFare(ride.PickupLatitude, ride.PickupLongitude, ride.DestinationLatitude, ride.DestinationLongitude)
+	if fare, ok := completedRideFareCache.Get(ride.ID); ok {
+		return fare.Sale
+	}
+	return calculateFare(ride.Pickup(), ride.Destination())
 }
 
 type chairWithDetail struct {
@@ -195,6 +224,7 @@ type chairPositionCacheEntry struct {
 	LastLong               int
 	TotalDistance          int
 	TotalDistanceUpdatedAt *time.Time
+	ReportedAt             time.Time
 }
 
 var chairPositionCache = NewCache[string, chairPositionCacheEntry]()
@@ -203,8 +233,7 @@ func ownerGetChairs(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	owner := ctx.Value("owner").(*Owner)
 
-	chairs := []Chair{}
-	if err := db.SelectContext(ctx, &chairs, `
+	chairs, err := selectChairsContext(ctx, db, `
 SELECT id,
        owner_id,
        name,
@@ -215,7 +244,8 @@ SELECT id,
        updated_at
 FROM chairs
 WHERE owner_id = ?
-`, owner.ID); err != nil {
+`, owner.ID)
+	if err != nil {
 		writeError(w, http.StatusInternalServerError, err)
 		return
 	}
@@ -223,22 +253,208 @@ WHERE owner_id = ?
 	res := ownerGetChairResponse{}
 	for _, chair := range chairs {
 		poscache, ok := chairPositionCache.Get(chair.ID)
+		recordCacheLookup(ctx, "chair_positions", ok)
 		if !ok {
 			// use 0 value
 		}
 		c := ownerGetChairResponseChair{
-			ID:            chair.ID,
-			Name:          chair.Name,
-			Model:         chair.Model,
-			Active:        chair.IsActive,
-			RegisteredAt:  chair.CreatedAt.UnixMilli(),
-			TotalDistance: poscache.TotalDistance,
-		}
-		if poscache.TotalDistanceUpdatedAt != nil {
-			t := poscache.TotalDistanceUpdatedAt.UnixMilli()
-			c.TotalDistanceUpdatedAt = &t
+			ID:                     chair.ID,
+			Name:                   chair.Name,
+			Model:                  chair.Model,
+			Active:                 chair.IsActive,
+			RegisteredAt:           epochMilli(chair.CreatedAt),
+			TotalDistance:          poscache.TotalDistance,
+			TotalDistanceUpdatedAt: epochMilliPtr(poscache.TotalDistanceUpdatedAt),
 		}
 		res.Chairs = append(res.Chairs, c)
 	}
 	writeJSON(w, http.StatusOK, res)
 }
+
+type ownerEvaluationStats struct {
+	Count int
+	Sum   int
+}
+
+var ownerEvaluationCache = NewCache[string, ownerEvaluationStats]()
+
+func addOwnerEvaluation(s *cacheSet, ownerID string, evaluation int) {
+	ownerEvaluationCache.in(s).Update(ownerID, func(stats ownerEvaluationStats, _ bool) ownerEvaluationStats {
+		stats.Count++
+		stats.Sum += evaluation
+		return stats
+	})
+}
+
+type ownerGetStatsResponse struct {
+	TotalEvaluations  int     `json:"total_evaluations"`
+	AverageEvaluation float64 `json:"average_evaluation"`
+}
+
+func ownerGetStats(w http.ResponseWriter, r *http.Request) {
+	owner := r.Context().Value("owner").(*Owner)
+
+	stats, _ := ownerEvaluationCache.Get(owner.ID)
+	res := ownerGetStatsResponse{
+		TotalEvaluations: stats.Count,
+	}
+	if stats.Count > 0 {
+		res.AverageEvaluation = float64(stats.Sum) / float64(stats.Count)
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+type chairRideStats struct {
+	CompletedRides int
+	TotalSales     int
+	EvaluationSum  int
+}
+
+var chairRideStatsCache = NewCache[string, chairRideStats]()
+
+func addChairCompletedRide(s *cacheSet, chairID string, sale, evaluation int) {
+	chairRideStatsCache.in(s).Update(chairID, func(stats chairRideStats, _ bool) chairRideStats {
+		stats.CompletedRides++
+		stats.TotalSales += sale
+		stats.EvaluationSum += evaluation
+		return stats
+	})
+}
+
+type ownerGetChairDetailResponse struct {
+	ID                     string      `json:"id"`
+	Name                   string      `json:"name"`
+	Model                  string      `json:"model"`
+	Active                 bool        `json:"active"`
+	RegisteredAt           int64       `json:"registered_at"`
+	TotalDistance          int         `json:"total_distance"`
+	TotalDistanceUpdatedAt *int64      `json:"total_distance_updated_at,omitempty"`
+	CompletedRides         int         `json:"completed_rides"`
+	TotalSales             int         `json:"total_sales"`
+	CurrentStatus          *RideState  `json:"current_status"`
+	CurrentCoordinate      *Coordinate `json:"current_coordinate"`
+}
+
+func ownerGetChairDetail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+	chairID := r.PathValue("chair_id")
+
+	// 他人の椅子は DB を見ずに弾く
+	if ownerID, ok := chairOwnerIndex.Get(chairID); ok && ownerID != owner.ID {
+		writeError(w, http.StatusNotFound, errors.New("chair not found"))
+		return
+	}
+	chair := &Chair{}
+	if err := getChairContext(ctx, db, chair, `SELECT `+chairColumns+` FROM chairs WHERE id = ? AND owner_id = ?`, chairID, owner.ID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("chair not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	stats, _ := chairRideStatsCache.Get(chair.ID)
+	res := ownerGetChairDetailResponse{
+		ID:             chair.ID,
+		Name:           chair.Name,
+		Model:          chair.Model,
+		Active:         chair.IsActive,
+		RegisteredAt:   epochMilli(chair.CreatedAt),
+		CompletedRides: stats.CompletedRides,
+		TotalSales:     stats.TotalSales,
+	}
+	pos, ok := chairPositionCache.Get(chair.ID)
+	recordCacheLookup(ctx, "chair_positions", ok)
+	if ok {
+		res.TotalDistance = pos.TotalDistance
+		res.TotalDistanceUpdatedAt = epochMilliPtr(pos.TotalDistanceUpdatedAt)
+		current := pos.Position()
+		res.CurrentCoordinate = &current
+	}
+
+	status, err := getChairCurrentStatus(ctx, chair.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	res.CurrentStatus = status
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// 椅子に最後に割り当てられたライドのステータス。一度も割り当てられていなければ nil
+func getChairCurrentStatus(ctx context.Context, chairID string) (*RideState, error) {
+	var rideID string
+	if err := db.GetContext(ctx, &rideID, `SELECT id FROM rides WHERE chair_id = ? ORDER BY updated_at DESC LIMIT 1`, chairID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	status, err := getLatestRideStatus(ctx, db, rideID)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+type ownerGetModelsResponse struct {
+	Models []ownerGetModelsResponseModel `json:"models"`
+}
+
+type ownerGetModelsResponseModel struct {
+	Model             string  `json:"model"`
+	Chairs            int     `json:"chairs"`
+	CompletedRides    int     `json:"completed_rides"`
+	TotalSales        int     `json:"total_sales"`
+	AverageEvaluation float64 `json:"average_evaluation"`
+}
+
+// オーナーの椅子をモデルごとにまとめ、売上の多い順 (同じなら評価の高い順) に並べる
+func ownerGetModels(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	owner := ctx.Value("owner").(*Owner)
+
+	chairs, err := selectChairsContext(ctx, db, `SELECT `+chairColumns+` FROM chairs WHERE owner_id = ?`, owner.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	byModel := map[string]*ownerGetModelsResponseModel{}
+	evaluationSums := map[string]int{}
+	for _, chair := range chairs {
+		m, ok := byModel[chair.Model]
+		if !ok {
+			m = &ownerGetModelsResponseModel{Model: chair.Model}
+			byModel[chair.Model] = m
+		}
+		stats, _ := chairRideStatsCache.Get(chair.ID)
+		m.Chairs++
+		m.CompletedRides += stats.CompletedRides
+		m.TotalSales += stats.TotalSales
+		evaluationSums[chair.Model] += stats.EvaluationSum
+	}
+
+	res := ownerGetModelsResponse{Models: make([]ownerGetModelsResponseModel, 0, len(byModel))}
+	for model, m := range byModel {
+		if m.CompletedRides > 0 {
+			m.AverageEvaluation = float64(evaluationSums[model]) / float64(m.CompletedRides)
+		}
+		res.Models = append(res.Models, *m)
+	}
+	sort.Slice(res.Models, func(i, j int) bool {
+		a, b := res.Models[i], res.Models[j]
+		if a.TotalSales != b.TotalSales {
+			return a.TotalSales > b.TotalSales
+		}
+		if a.AverageEvaluation != b.AverageEvaluation {
+			return a.AverageEvaluation > b.AverageEvaluation
+		}
+		return a.Model < b.Model
+	})
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/csv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// 何行ごとにクライアントへ送り出すか
+const salesCSVFlushRows = 256
+
+// 完了したライドごとの売上を CSV で返す。行を読みながら書き出すので件数によらずメモリは一定
+func ownerGetSalesCSV(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	tr, err := parseTimeRange(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	owner := ctx.Value("owner").(*Owner)
+
+	rows, err := db.QueryxContext(ctx, `SELECT rides.id, rides.chair_id, chairs.name, chairs.model, rides.updated_at, rides.pickup_latitude, rides.pickup_longitude, rides.destination_latitude, rides.destination_longitude
+		FROM rides JOIN chairs ON rides.chair_id = chairs.id
+		WHERE chairs.owner_id = ? AND rides.evaluation IS NOT NULL AND rides.updated_at >= ? AND rides.updated_at < ?
+		ORDER BY rides.updated_at`, owner.ID, tr.Since, tr.Until)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="sales.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ride_id", "chair_id", "chair_name", "model", "completed_at", "sales"})
+
+	// ヘッダーを送った後なので、途中のエラーはログに残して打ち切るしかない
+	n := 0
+	for rows.Next() {
+		var (
+			row         rideRow
+			name, model string
+			completedAt time.Time
+		)
+		if err := rows.Scan(&row.ID, &row.ChairID, &name, &model, &completedAt, &row.PickupLatitude, &row.PickupLongitude, &row.DestinationLatitude, &row.DestinationLongitude); err != nil {
+			slog.Error("failed to scan sales row", "owner_id", owner.ID, "err", err)
+			break
+		}
+		ride := row.model()
+		if isPaymentFailed(ride.ID) {
+			continue
+		}
+		cw.Write([]string{
+			ride.ID,
+			ride.ChairID.String,
+			name,
+			model,
+			strconv.FormatInt(epochMilli(completedAt), 10),
+			strconv.Itoa(calculateSale(ride)),
+		})
+		if n++; n%salesCSVFlushRows == 0 {
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		slog.Error("failed to read sales rows", "owner_id", owner.ID, "err", err)
+	}
+	cw.Flush()
+}
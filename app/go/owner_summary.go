@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// オーナー → 所有する椅子の ID
+var ownerChairsIndex = NewCache[string, []string]()
+
+// 椅子 ID → オーナー ID。椅子の持ち主は変わらないので、登録時に入れたら消さない
+var chairOwnerIndex = NewCache[string, string]()
+
+// 椅子 ID → is_active
+var chairActiveCache = NewCache[string, bool]()
+
+// 椅子 ID → 最後に割り当てられたライドの ID
+var chairCurrentRideCache = NewCache[string, string]()
+
+type ownerSalesDay struct {
+	OwnerID string
+	Day     string
+}
+
+// オーナーごと・日ごと (ライドが完了した日) の売上
+// 完了した時刻は COMPLETED のステータスの created_at (アプリ側で決めた時刻) を使う
+var ownerDailySalesCache = NewCache[ownerSalesDay, int]()
+
+// DB から読んだ時刻と time.Now() でタイムゾーンが違っても同じ日になるよう、UTC で区切る
+func salesDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+func cacheOwnerChair(s *cacheSet, chair *Chair) {
+	ownerChairsIndex.in(s).Update(chair.OwnerID, func(ids []string, _ bool) []string {
+		return append(ids, chair.ID)
+	})
+	chairOwnerIndex.in(s).Set(chair.ID, chair.OwnerID)
+	chairActiveCache.in(s).Set(chair.ID, chair.IsActive)
+}
+
+// 椅子のオーナー ID。キャッシュに無ければ DB を見る
+func getChairOwnerID(ctx context.Context, tx executableGet, chairID string) (string, error) {
+	ownerID, ok := chairOwnerIndex.Get(chairID)
+	recordCacheLookup(ctx, "chair_owners", ok)
+	if ok {
+		return ownerID, nil
+	}
+	if err := tx.GetContext(ctx, &ownerID, `SELECT owner_id FROM chairs WHERE id = ?`, chairID); err != nil {
+		return "", err
+	}
+	chairOwnerIndex.Set(chairID, ownerID)
+	return ownerID, nil
+}
+
+func addOwnerSale(s *cacheSet, ownerID string, sale int, completedAt time.Time) {
+	ownerDailySalesCache.in(s).Update(ownerSalesDay{OwnerID: ownerID, Day: salesDay(completedAt)}, func(v int, _ bool) int {
+		return v + sale
+	})
+}
+
+// 割り当てられたライドがまだ完了していなければ走行中
+func isChairOnRide(chairID string) bool {
+	rideID, ok := chairCurrentRideCache.Get(chairID)
+	if !ok {
+		return false
+	}
+	statuses, ok := rideStatusCache.Get(rideID)
+	if !ok {
+		// 走行中のライドは頻繁に触られるので、履歴が捨てられているなら終わって久しいとみなす
+		return false
+	}
+	return len(statuses) == 0 || statuses[len(statuses)-1].Status != RideStateCompleted
+}
+
+type ownerGetSummaryResponse struct {
+	TotalSalesToday   int     `json:"total_sales_today"`
+	TotalChairs       int     `json:"total_chairs"`
+	ActiveChairs      int     `json:"active_chairs"`
+	ChairsOnRide      int     `json:"chairs_on_ride"`
+	TotalEvaluations  int     `json:"total_evaluations"`
+	AverageEvaluation float64 `json:"average_evaluation"`
+}
+
+// オーナー画面の概要。メモリ上の集計だけで返す
+func ownerGetSummary(w http.ResponseWriter, r *http.Request) {
+	owner := r.Context().Value("owner").(*Owner)
+
+	sales, _ := ownerDailySalesCache.Get(ownerSalesDay{OwnerID: owner.ID, Day: salesDay(time.Now())})
+	res := ownerGetSummaryResponse{TotalSalesToday: sales}
+
+	chairIDs, _ := ownerChairsIndex.Get(owner.ID)
+	res.TotalChairs = len(chairIDs)
+	for _, id := range chairIDs {
+		if active, _ := chairActiveCache.Get(id); active {
+			res.ActiveChairs++
+		}
+		if isChairOnRide(id) {
+			res.ChairsOnRide++
+		}
+	}
+
+	evaluations, _ := ownerEvaluationCache.Get(owner.ID)
+	res.TotalEvaluations = evaluations.Count
+	if evaluations.Count > 0 {
+		res.AverageEvaluation = float64(evaluations.Sum) / float64(evaluations.Count)
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
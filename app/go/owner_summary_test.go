@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSalesDayUsesUTC(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	// JST では 12/9 だが UTC ではまだ 12/8
+	at := time.Date(2024, 12, 9, 8, 0, 0, 0, jst)
+	if got := salesDay(at); got != "2024-12-08" {
+		t.Errorf("salesDay(%v) = %q, want 2024-12-08", at, got)
+	}
+	if salesDay(at) != salesDay(at.UTC()) {
+		t.Error("the same instant falls on different days depending on its zone")
+	}
+}
+
+func TestOwnerDailySales(t *testing.T) {
+	s := useFreshCaches(t)
+	jst := time.FixedZone("JST", 9*60*60)
+	addOwnerSale(s, "owner", 1000, time.Date(2024, 12, 8, 23, 0, 0, 0, time.UTC))
+	addOwnerSale(s, "owner", 500, time.Date(2024, 12, 9, 7, 0, 0, 0, jst))
+	addOwnerSale(s, "owner", 300, time.Date(2024, 12, 9, 0, 0, 0, 0, time.UTC))
+
+	if got, _ := ownerDailySalesCache.Get(ownerSalesDay{OwnerID: "owner", Day: "2024-12-08"}); got != 1500 {
+		t.Errorf("sales on 2024-12-08 = %d, want 1500", got)
+	}
+	if got, _ := ownerDailySalesCache.Get(ownerSalesDay{OwnerID: "owner", Day: "2024-12-09"}); got != 300 {
+		t.Errorf("sales on 2024-12-09 = %d, want 300", got)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// リトライしても決済できなかったライド。売上に数えず、走行終了までに再送するかを人が判断するために残す
+type failedPayment struct {
+	RideID   string    `json:"ride_id"`
+	UserID   string    `json:"user_id"`
+	OwnerID  string    `json:"owner_id"`
+	Amount   int       `json:"amount"`
+	Sale     int       `json:"sale"`
+	Error    string    `json:"error"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+var failedPaymentCache = NewCache[string, failedPayment]()
+
+// 決済失敗を記録し、その分の売上と支払額を各集計から取り消す。同じライドで二度呼ばれても二重には引かない
+// 完了ライド数と評価は取り消さない
+func compensateFailedPayment(job paymentJob, err error) {
+	fp := failedPayment{
+		RideID:   job.RideID,
+		UserID:   job.UserID,
+		OwnerID:  job.OwnerID,
+		Amount:   job.Amount,
+		Sale:     job.Sale,
+		Error:    err.Error(),
+		FailedAt: time.Now(),
+	}
+	var seen bool
+	failedPaymentCache.Update(job.RideID, func(_ failedPayment, found bool) failedPayment {
+		seen = found
+		return fp
+	})
+	if seen {
+		return
+	}
+	s := currentCaches()
+	addOwnerSale(s, job.OwnerID, -job.Sale, job.CompletedAt)
+	chairRideStatsCache.in(s).UpdateIfPresent(job.ChairID, func(stats chairRideStats) chairRideStats {
+		stats.TotalSales -= job.Sale
+		return stats
+	})
+	userRideStatsCache.in(s).UpdateIfPresent(job.UserID, func(stats userRideStats) userRideStats {
+		stats.TotalSpend -= job.Amount
+		return stats
+	})
+	chairRideHistoryCache.in(s).UpdateIfPresent(job.ChairID, func(v []chairRideHistoryEntry) []chairRideHistoryEntry {
+		i := slices.IndexFunc(v, func(e chairRideHistoryEntry) bool { return e.RideID == job.RideID })
+		if i < 0 {
+			return v
+		}
+		// 読み手とスライスを共有しているので、書き換えずにコピーする
+		v = slices.Clone(v)
+		v[i].Sale, v[i].Charged = 0, 0
+		return v
+	})
+	metricCounter("payment_compensations_total").Inc()
+	metricGauge("payment_failed_rides").Add(1)
+}
+
+func isPaymentFailed(rideID string) bool {
+	_, ok := failedPaymentCache.Get(rideID)
+	return ok
+}
+
+type internalGetFailedPaymentsResponse struct {
+	Payments    []failedPayment `json:"payments"`
+	TotalAmount int             `json:"total_amount"`
+}
+
+func internalGetFailedPayments(w http.ResponseWriter, r *http.Request) {
+	res := internalGetFailedPaymentsResponse{Payments: []failedPayment{}}
+	for _, fp := range failedPaymentCache.Snapshot() {
+		res.Payments = append(res.Payments, fp)
+		res.TotalAmount += fp.Amount
+	}
+	sort.Slice(res.Payments, func(i, j int) bool {
+		return res.Payments[i].FailedAt.Before(res.Payments[j].FailedAt)
+	})
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCompensateFailedPayment(t *testing.T) {
+	s := useFreshCaches(t)
+	completedAt := time.Date(2024, 12, 8, 10, 0, 0, 0, time.UTC)
+	for _, r := range []struct {
+		id   string
+		fare rideFare
+	}{
+		{"ride-ok", rideFare{Sale: 1000, Charged: 900}},
+		{"ride-failed", rideFare{Sale: 2000, Charged: 1500}},
+	} {
+		ride := &Ride{ID: r.id, UpdatedAt: completedAt}
+		addUserCompletedRide(s, "user", r.fare)
+		addChairCompletedRide(s, "chair", r.fare.Sale, 5)
+		addChairRideHistory(s, "chair", ride, r.fare, 5)
+	}
+	history, _ := chairRideHistoryCache.Get("chair")
+
+	job := paymentJob{RideID: "ride-failed", UserID: "user", OwnerID: "owner", ChairID: "chair", Amount: 1500, Sale: 2000, CompletedAt: completedAt}
+	compensateFailedPayment(job, errors.New("gateway down"))
+	// 二度目は何も引かない
+	compensateFailedPayment(job, errors.New("gateway down"))
+
+	if !isPaymentFailed("ride-failed") || isPaymentFailed("ride-ok") {
+		t.Fatal("failed payment was not recorded for the right ride")
+	}
+	if got, _ := chairRideStatsCache.Get("chair"); got != (chairRideStats{CompletedRides: 2, TotalSales: 1000, EvaluationSum: 10}) {
+		t.Errorf("chair stats = %+v", got)
+	}
+	if got, _ := userRideStatsCache.Get("user"); got != (userRideStats{TotalRides: 2, TotalSpend: 900, TotalDiscount: 600}) {
+		t.Errorf("user stats = %+v", got)
+	}
+	got, _ := chairRideHistoryCache.Get("chair")
+	if got[0].Sale != 1000 || got[0].Charged != 900 {
+		t.Errorf("paid ride was compensated: %+v", got[0])
+	}
+	if got[1].Sale != 0 || got[1].Charged != 0 {
+		t.Errorf("failed ride still has its sale: %+v", got[1])
+	}
+	if history[1].Sale != 2000 {
+		t.Error("history slice handed out before compensation was modified in place")
+	}
+}
@@ -32,6 +32,9 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 	retry := 0
 	for {
 		err := func() error {
+			ctx, cancel := context.WithTimeout(ctx, paymentRequestTimeout)
+			defer cancel()
+
 			req, err := http.NewRequestWithContext(ctx, http.MethodPost, paymentGatewayURL+"/payments", bytes.NewBuffer(b))
 			if err != nil {
 				return err
@@ -45,6 +48,10 @@ func requestPaymentGatewayPostPayment(ctx context.Context, paymentGatewayURL str
 			}
 			defer res.Body.Close()
 
+			if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500 {
+				markPaymentGatewayDegraded()
+			}
+
 			if res.StatusCode != http.StatusNoContent {
 				// エラーが返ってきても成功している場合があるので、社内決済マイクロサービスに問い合わせ
 				getReq, err := http.NewRequestWithContext(ctx, http.MethodGet, paymentGatewayURL+"/payments", bytes.NewBuffer([]byte{}))
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+type paymentJob struct {
+	RideID        string
+	UserID        string
+	RideCreatedAt time.Time
+	Token         string
+	GatewayURL    string
+	Amount        int
+	// 決済に失敗したときに売上を取り消すため
+	OwnerID     string
+	ChairID     string
+	Sale        int
+	CompletedAt time.Time
+}
+
+// 有効にすると評価のレスポンスを決済の完了を待たずに返し、決済はワーカーで行う
+// その場合、決済サービスのエラーは 502 にならず、売上の取り消し (compensateFailedPayment) で後から帳尻を合わせる
+// 無効 (既定) なら評価のトランザクションの中で決済し、失敗したら 502 を返して評価も取り消す
+var asyncPayments = newFeatureFlag("async_payments", "ISUCON_ASYNC_PAYMENTS", false)
+
+var (
+	paymentConcurrency    = getEnvInt("ISUCON_PAYMENT_CONCURRENCY", 4)
+	paymentRequestTimeout = time.Duration(getEnvInt("ISUCON_PAYMENT_TIMEOUT_MS", 5000)) * time.Millisecond
+)
+
+// 決済サービスが 429/5xx を返したら、しばらくの間は直列に処理する
+const paymentSerialCooldown = 3 * time.Second
+
+// ワーカーごとのキュー。同じユーザーの決済は同じワーカーに積み、順番を保ったまま別のユーザーとは並行に流す
+var (
+	paymentQueues      []chan paymentJob
+	paymentSerialUntil atomic.Int64
+	paymentSerialMutex sync.Mutex
+	// キューに積まれてまだ処理が終わっていない件数。drain で空になるのを待つ
+	paymentPending    atomic.Int64
+	settlementPending atomic.Int64
+)
+
+func enqueuePayment(job paymentJob) {
+	h := fnv.New32a()
+	h.Write([]byte(job.UserID))
+	paymentPending.Add(1)
+	paymentQueues[h.Sum32()%uint32(len(paymentQueues))] <- job
+}
+
+func markPaymentGatewayDegraded() {
+	paymentSerialUntil.Store(time.Now().Add(paymentSerialCooldown).UnixNano())
+}
+
+func startPaymentWorkers() {
+	paymentQueues = make([]chan paymentJob, max(paymentConcurrency, 1))
+	for i := range paymentQueues {
+		paymentQueues[i] = make(chan paymentJob, 1024)
+		go runPaymentWorker(paymentQueues[i])
+	}
+	go runSettlementWriter()
+}
+
+func runPaymentWorker(queue <-chan paymentJob) {
+	for job := range queue {
+		if time.Now().UnixNano() < paymentSerialUntil.Load() {
+			paymentSerialMutex.Lock()
+			processPayment(job)
+			paymentSerialMutex.Unlock()
+		} else {
+			processPayment(job)
+		}
+		paymentPending.Add(-1)
+	}
+}
+
+func processPayment(job paymentJob) {
+	ctx := context.Background()
+	err := requestPaymentGatewayPostPayment(ctx, job.GatewayURL, job.Token, &paymentGatewayPostPaymentRequest{
+		Amount: job.Amount,
+	}, func() ([]Ride, error) {
+		// 後から作られたライドは数えない
+		return selectRidesContext(ctx, db, `SELECT `+rideColumns+` FROM rides WHERE user_id = ? AND created_at <= ? ORDER BY created_at ASC`, job.UserID, job.RideCreatedAt)
+	})
+	result := ridePaymentResult{Amount: job.Amount, Succeeded: err == nil, CompletedAt: time.Now()}
+	if err != nil {
+		result.Error = err.Error()
+		ridePaymentResultCache.Set(job.RideID, result)
+		metricCounter("payment_failures_total").Inc()
+		slog.Error("payment failed", "ride_id", job.RideID, "amount", job.Amount, "err", err)
+		publishRideEvent(rideEvent{Type: rideEventPayment, RideID: job.RideID, Detail: "failed: " + err.Error()})
+		compensateFailedPayment(job, err)
+		return
+	}
+	settlePayment(job.RideID, result)
+}
+
+// 決済が済んだことを記録する。同期・非同期のどちらからも呼ぶ
+func settlePayment(rideID string, result ridePaymentResult) {
+	ridePaymentResultCache.Set(rideID, result)
+	settlementPending.Add(1)
+	settlementQueue <- rideID
+	publishRideEvent(rideEvent{Type: rideEventPayment, RideID: rideID, Detail: "succeeded"})
+}
+
+var settlementBatchSize = newReloadable(getEnvInt("ISUCON_SETTLEMENT_BATCH_SIZE", 256))
+
+// 決済が済んだライド ID。完了が重なったときに settled_at の UPDATE を 1 本にまとめる
+var settlementQueue = make(chan string, 4096)
+
+func runSettlementWriter() {
+	batch := make([]string, 0, settlementBatchSize.Load())
+	for rideID := range settlementQueue {
+		batch = append(batch[:0], rideID)
+		size := settlementBatchSize.Load()
+	drain:
+		for len(batch) < size {
+			select {
+			case rideID := <-settlementQueue:
+				batch = append(batch, rideID)
+			default:
+				break drain
+			}
+		}
+
+		writeSettlements(batch)
+		settlementPending.Add(-int64(len(batch)))
+	}
+}
+
+// rides.settled_at (マイグレーション 0005) があるか。無い間は精算の記録を飛ばし、バッチごとにエラーを出さない
+var settledAtColumn atomic.Bool
+
+// 起動時と initialize でマイグレーションの後に呼ぶ。調べられなければ、あるものとして書いてみる
+func detectSettledAtColumn(ctx context.Context) {
+	var n int
+	if err := db.GetContext(ctx, &n, `SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'rides' AND COLUMN_NAME = 'settled_at'`); err != nil {
+		slog.Warn("failed to check rides.settled_at", "err", err)
+		settledAtColumn.Store(true)
+		return
+	}
+	settledAtColumn.Store(n > 0)
+	if n == 0 {
+		slog.Warn("rides.settled_at is missing; settlements will not be recorded until migration 0005 is applied")
+	}
+}
+
+// updated_at は ON UPDATE CURRENT_TIMESTAMP(6) なので、そのままにすると精算のたびに完了したライドの並びが変わる
+// 椅子の現在のライドを updated_at 順で引いているのと、完了日時 (completed_at) に使っているので触らない
+func writeSettlements(batch []string) {
+	if !settledAtColumn.Load() {
+		metricCounter("payment_settlement_skipped_total").Add(int64(len(batch)))
+		return
+	}
+	query, args, err := sqlx.In(`UPDATE rides SET settled_at = ?, updated_at = updated_at WHERE id IN (?)`, time.Now().Truncate(time.Microsecond), batch)
+	if err != nil {
+		slog.Error("failed to build settlement query", "err", err)
+		return
+	}
+	if _, err := db.ExecContext(context.Background(), query, args...); err != nil {
+		var mysqlErr *mysql.MySQLError
+		// 1054: Unknown column。マイグレーション前の DB に切り替わったら以降は飛ばす
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1054 {
+			settledAtColumn.Store(false)
+			slog.Warn("rides.settled_at is missing; settlements will not be recorded until migration 0005 is applied")
+			return
+		}
+		slog.Error("failed to mark rides as settled", "count", len(batch), "err", err)
+		return
+	}
+	metricCounter("payment_settlement_batches_total").Inc()
+}
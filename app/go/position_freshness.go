@@ -0,0 +1,28 @@
+package main
+
+import "time"
+
+// 位置の報告がこれより古い椅子は、最後のライドの目的地へ向かって進んでいるものとして位置を見積もる
+var positionStaleAfter = time.Duration(getEnvInt("ISUCON_POSITION_STALE_SECONDS", 3)) * time.Second
+
+// 位置の報告の古さ 1 秒あたりにスコアへ加算するペナルティ。最近報告してきた椅子を優先する
+var matchingStalenessWeight = getEnvFloat("ISUCON_MATCHING_STALENESS_WEIGHT", 1)
+
+// 椅子が最後に乗せたライドの目的地。乗車 (CARRYING) 時に記録する
+var chairDestinationCache = NewCache[string, Coordinate]()
+
+// モデル名ごとの速度。chair_models はマスタデータなので初期化時に読み込めば変わらない
+var chairModelSpeedCache = NewCache[string, int]()
+
+// 報告から経過した時間ぶん、椅子が目的地へ向かって進んだとみなした位置を返す
+// 椅子は緯度を先に、次に経度を 1 秒あたり speed ずつ詰めていく想定で、目的地を通り越すことはない
+func estimateChairPosition(chairID string, pos chairPositionCacheEntry, speed int, age time.Duration) Coordinate {
+	if age <= positionStaleAfter || speed <= 0 {
+		return pos.Position()
+	}
+	dest, ok := chairDestinationCache.Get(chairID)
+	if !ok {
+		return pos.Position()
+	}
+	return pos.Position().MoveToward(dest, speed*int(age/time.Second))
+}
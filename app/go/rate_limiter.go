@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// アクセストークンごとのレート制限。おかしな挙動のクライアントが他の利用者を巻き込まないようにする
+// 秒あたりのリクエスト数が 0 のクラスは制限しない
+type rateLimitClass struct {
+	Name  string
+	Rate  float64
+	Burst float64
+}
+
+var (
+	rateLimitApp = rateLimitClass{
+		Name:  "app",
+		Rate:  getEnvFloat("ISUCON_RATE_LIMIT_APP_RPS", 0),
+		Burst: getEnvFloat("ISUCON_RATE_LIMIT_APP_BURST", 50),
+	}
+	rateLimitOwner = rateLimitClass{
+		Name:  "owner",
+		Rate:  getEnvFloat("ISUCON_RATE_LIMIT_OWNER_RPS", 0),
+		Burst: getEnvFloat("ISUCON_RATE_LIMIT_OWNER_BURST", 20),
+	}
+	rateLimitChair = rateLimitClass{
+		Name:  "chair",
+		Rate:  getEnvFloat("ISUCON_RATE_LIMIT_CHAIR_RPS", 0),
+		Burst: getEnvFloat("ISUCON_RATE_LIMIT_CHAIR_BURST", 50),
+	}
+)
+
+type tokenBucket struct {
+	mu       sync.Mutex
+	tokens   float64
+	updateAt time.Time
+}
+
+// 断るときは次のトークンが貯まるまでの時間も返す
+func (b *tokenBucket) allow(class rateLimitClass, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.updateAt.IsZero() {
+		b.tokens = class.Burst
+	} else {
+		b.tokens = min(class.Burst, b.tokens+now.Sub(b.updateAt).Seconds()*class.Rate)
+	}
+	b.updateAt = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / class.Rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// クラスとトークンの組ごとのバケツ。認証を通ったトークンだけが入るので、数は利用者の数で抑えられる
+var rateLimitBuckets = NewCache[string, *tokenBucket]()
+
+// 制限を超えていれば 429 を書いて false を返す。認証ミドルウェアの中で呼ぶ
+func allowRequest(w http.ResponseWriter, r *http.Request, class rateLimitClass, accessToken string) bool {
+	if class.Rate <= 0 {
+		return true
+	}
+	bucket := rateLimitBuckets.Update(class.Name+":"+accessToken, func(b *tokenBucket, ok bool) *tokenBucket {
+		if !ok {
+			b = &tokenBucket{}
+		}
+		return b
+	})
+	ok, wait := bucket.allow(class, time.Now())
+	if ok {
+		return true
+	}
+	rejectOverloaded(w, r, "rate_limit", class.Name, wait)
+	return false
+}
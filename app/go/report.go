@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// 走行後の診断情報を書き出すディレクトリ。プロセスが再起動するとメモリ上の集計は消えるので、その前に残す
+var reportDir = getEnvString("ISUCON_REPORT_DIR", "/tmp")
+
+const reportSlowQueries = 30
+
+type cacheHitRatio struct {
+	Hits   int64   `json:"hits"`
+	Misses int64   `json:"misses"`
+	Ratio  float64 `json:"ratio"`
+}
+
+// initialize からのマッチングの累計
+type matchingQualityStats struct {
+	Rounds        int64   `json:"rounds"`
+	Pairs         int64   `json:"pairs"`
+	MatchedFare   int64   `json:"matched_fare"`
+	MeanDistance  float64 `json:"mean_distance"`
+	MeanWaitMs    float64 `json:"mean_wait_ms"`
+	MaxWaitMs     int64   `json:"max_wait_ms"`
+	totalDistance int64
+	totalWaitMs   int64
+}
+
+var matchingQuality = struct {
+	sync.Mutex
+	stats matchingQualityStats
+}{}
+
+func recordMatchingQuality(rides []Ride, report *matchingReport) {
+	createdAt := make(map[string]time.Time, len(rides))
+	for _, ride := range rides {
+		createdAt[ride.ID] = ride.CreatedAt
+	}
+	now := time.Now()
+	matchingQuality.Lock()
+	defer matchingQuality.Unlock()
+	s := &matchingQuality.stats
+	s.Rounds++
+	for _, pair := range report.Pairs {
+		wait := now.Sub(createdAt[pair.RideID]).Milliseconds()
+		s.Pairs++
+		s.MatchedFare += int64(pair.Fare)
+		s.totalDistance += int64(pair.Distance)
+		s.totalWaitMs += wait
+		s.MaxWaitMs = max(s.MaxWaitMs, wait)
+	}
+}
+
+func resetMatchingQuality() {
+	matchingQuality.Lock()
+	matchingQuality.stats = matchingQualityStats{}
+	matchingQuality.Unlock()
+}
+
+func currentMatchingQuality() matchingQualityStats {
+	matchingQuality.Lock()
+	s := matchingQuality.stats
+	matchingQuality.Unlock()
+	if s.Pairs > 0 {
+		s.MeanDistance = float64(s.totalDistance) / float64(s.Pairs)
+		s.MeanWaitMs = float64(s.totalWaitMs) / float64(s.Pairs)
+	}
+	return s
+}
+
+type runReport struct {
+	GeneratedAt        time.Time                `json:"generated_at"`
+	Metrics            map[string]int64         `json:"metrics"`
+	CacheHitRatios     map[string]cacheHitRatio `json:"cache_hit_ratios"`
+	MatchingQuality    matchingQualityStats     `json:"matching_quality"`
+	LastMatchingReport *matchingReport          `json:"last_matching_report"`
+	SlowQueries        []queryStat              `json:"slow_queries"`
+	RejectionsByRoute  map[string]int64         `json:"rejections_by_route"`
+	// 割り当てと通知までの時間を、定期マッチングの所要時間・間隔と並べて見る
+	RideLatency map[string]latencySummary `json:"ride_latency"`
+}
+
+var cacheLookupLabels = regexp.MustCompile(`^cache_lookups_total\{cache="([^"]*)",.*result="(hit|miss)"\}$`)
+
+// cache_lookups_total をエンドポイントをまたいでキャッシュごとに足し合わせる
+func cacheHitRatios(metrics map[string]int64) map[string]cacheHitRatio {
+	ratios := map[string]cacheHitRatio{}
+	for name, v := range metrics {
+		m := cacheLookupLabels.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		r := ratios[m[1]]
+		if m[2] == "hit" {
+			r.Hits += v
+		} else {
+			r.Misses += v
+		}
+		ratios[m[1]] = r
+	}
+	for name, r := range ratios {
+		if total := r.Hits + r.Misses; total > 0 {
+			r.Ratio = float64(r.Hits) / float64(total)
+		}
+		ratios[name] = r
+	}
+	return ratios
+}
+
+var rejectionLabels = regexp.MustCompile(`^requests_rejected_total\{route="([^"]*)",`)
+
+// requests_rejected_total を理由をまたいでエンドポイントごとに足し合わせる
+func rejectionsByRoute(metrics map[string]int64) map[string]int64 {
+	rejections := map[string]int64{}
+	for name, v := range metrics {
+		if m := rejectionLabels.FindStringSubmatch(name); m != nil {
+			rejections[m[1]] += v
+		}
+	}
+	return rejections
+}
+
+func buildRunReport() *runReport {
+	metrics := metricsSnapshot()
+	return &runReport{
+		GeneratedAt:        time.Now(),
+		Metrics:            metrics,
+		CacheHitRatios:     cacheHitRatios(metrics),
+		MatchingQuality:    currentMatchingQuality(),
+		LastMatchingReport: lastMatchingReport.Load(),
+		SlowQueries:        slowQueryRanking(reportSlowQueries),
+		RejectionsByRoute:  rejectionsByRoute(metrics),
+		RideLatency:        rideLatencySummaries(),
+	}
+}
+
+// 一時ファイルに書いてから rename し、途中で落ちても壊れたレポートを残さない
+func writeRunReport(report *runReport) (string, error) {
+	path := filepath.Join(reportDir, fmt.Sprintf("isuride-report-%s.json", report.GeneratedAt.Format("20060102-150405")))
+	b, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// SIGUSR1 を受けるたびにレポートを書き出す
+func runReportSignalHandler() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	for range ch {
+		path, err := writeRunReport(buildRunReport())
+		if err != nil {
+			slog.Error("failed to write run report", "err", err)
+			continue
+		}
+		slog.Info("run report written", "path", path)
+	}
+}
+
+func internalGetReport(w http.ResponseWriter, r *http.Request) {
+	report := buildRunReport()
+	path, err := writeRunReport(report)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("X-Report-Path", path)
+	writeJSON(w, http.StatusOK, report)
+}
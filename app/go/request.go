@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const maxRequestBodyBytes = 64 * 1024
+
+// 未知のフィールドを含むリクエストを弾くかどうか。ベンチマーカーが余計なフィールドを送ってきても困らないよう既定では無効
+var strictJSONDecoding = getEnvBool("ISUCON_STRICT_JSON", false)
+
+type requestBodyErrorKind string
+
+const (
+	requestBodyEmpty        requestBodyErrorKind = "empty"
+	requestBodyTooLarge     requestBodyErrorKind = "too_large"
+	requestBodySyntax       requestBodyErrorKind = "syntax"
+	requestBodyType         requestBodyErrorKind = "type"
+	requestBodyUnknownField requestBodyErrorKind = "unknown_field"
+	requestBodyTrailingData requestBodyErrorKind = "trailing_data"
+)
+
+type requestBodyError struct {
+	Kind requestBodyErrorKind
+	Err  error
+}
+
+func (e *requestBodyError) Error() string {
+	return fmt.Sprintf("invalid request body (%s): %v", e.Kind, e.Err)
+}
+
+func (e *requestBodyError) Unwrap() error {
+	return e.Err
+}
+
+func bindJSON(r *http.Request, v interface{}) error {
+	body := io.LimitReader(r.Body, maxRequestBodyBytes+1)
+	counted := &countingReader{r: body}
+	dec := json.NewDecoder(counted)
+	if strictJSONDecoding {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(v); err != nil {
+		return classifyDecodeError(err, counted.n)
+	}
+	if dec.More() {
+		return &requestBodyError{Kind: requestBodyTrailingData, Err: errors.New("unexpected data after JSON value")}
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func classifyDecodeError(err error, read int64) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case read > maxRequestBodyBytes:
+		return &requestBodyError{Kind: requestBodyTooLarge, Err: fmt.Errorf("body must not exceed %d bytes", maxRequestBodyBytes)}
+	case errors.Is(err, io.EOF):
+		return &requestBodyError{Kind: requestBodyEmpty, Err: errors.New("body is empty")}
+	case errors.As(err, &syntaxErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return &requestBodyError{Kind: requestBodySyntax, Err: err}
+	case errors.As(err, &typeErr):
+		return &requestBodyError{Kind: requestBodyType, Err: fmt.Errorf("field %s must be %s", typeErr.Field, typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return &requestBodyError{Kind: requestBodyUnknownField, Err: err}
+	}
+	return &requestBodyError{Kind: requestBodySyntax, Err: err}
+}
+
+func writeBindError(w http.ResponseWriter, err error) {
+	var bodyErr *requestBodyError
+	if errors.As(err, &bodyErr) && bodyErr.Kind == requestBodyTooLarge {
+		writeError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
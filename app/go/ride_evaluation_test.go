@@ -0,0 +1,116 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ride-1 の評価が evaluation (nil なら未評価) で、最新のステータスが status の DB。status が空ならライドが無い
+func fakeEvaluationDB(evaluation any, status RideState) *fakeDB {
+	f := &fakeDB{}
+	columns := strings.Split(rideColumns, ", ")
+	if status == "" {
+		f.on("FROM rides WHERE id = ?", columns)
+		return f
+	}
+	now := time.Now()
+	f.on("FROM rides WHERE id = ?", columns,
+		[]driver.Value{"ride-1", "user-1", "chair-1", int64(0), int64(0), int64(10), int64(10), evaluation, now, now})
+	f.on("SELECT status FROM ride_statuses", []string{"status"}, []driver.Value{string(status)})
+	return f
+}
+
+func postRideEvaluation(body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/app/rides/ride-1/evaluation", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetPathValue("ride_id", "ride-1")
+	rec := httptest.NewRecorder()
+	appPostRideEvaluatation(rec, req)
+	return rec
+}
+
+func TestRideEvaluationValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "zero", body: `{"evaluation":0}`},
+		{name: "too large", body: `{"evaluation":6}`},
+		{name: "negative", body: `{"evaluation":-1}`},
+		{name: "fractional", body: `{"evaluation":4.5}`},
+		{name: "string", body: `{"evaluation":"5"}`},
+		{name: "missing", body: `{}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFreshCaches(t)
+			f := fakeEvaluationDB(nil, RideStateArrived)
+			useFakeDB(t, f)
+
+			if rec := postRideEvaluation(tt.body); rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusBadRequest, rec.Body)
+			}
+			// 範囲外の値は DB にも集計にも届かない
+			if n := f.count(""); n != 0 {
+				t.Fatalf("invalid evaluation reached the DB (%d statements)", n)
+			}
+			if _, ok := chairRideStatsCache.Get("chair-1"); ok {
+				t.Fatal("invalid evaluation changed the chair stats")
+			}
+		})
+	}
+}
+
+func TestRideEvaluationRejected(t *testing.T) {
+	tests := []struct {
+		name       string
+		evaluation any
+		status     RideState
+		want       int
+	}{
+		{name: "already evaluated", evaluation: int64(4), status: RideStateArrived, want: http.StatusConflict},
+		{name: "already completed", status: RideStateCompleted, want: http.StatusConflict},
+		{name: "not arrived", status: RideStateCarrying, want: http.StatusBadRequest},
+		{name: "not found", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFreshCaches(t)
+			f := fakeEvaluationDB(tt.evaluation, tt.status)
+			useFakeDB(t, f)
+
+			if rec := postRideEvaluation(`{"evaluation":5}`); rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, tt.want, rec.Body)
+			}
+			if n := f.count("UPDATE rides SET evaluation"); n != 0 {
+				t.Fatal("rejected evaluation was written")
+			}
+			if _, ok := chairRideStatsCache.Get("chair-1"); ok {
+				t.Fatal("rejected evaluation changed the chair stats")
+			}
+		})
+	}
+}
+
+// 完了済みのライドはキャッシュだけで二重送信と分かる
+func TestRideEvaluationDuplicateFromCache(t *testing.T) {
+	useFreshCaches(t)
+	f := fakeEvaluationDB(int64(5), RideStateCompleted)
+	useFakeDB(t, f)
+	completedRideFareCache.Set("ride-1", rideFare{Sale: 1000, Charged: 1000})
+
+	rec := postRideEvaluation(`{"evaluation":5}`)
+	if rec.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusConflict, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), errRideAlreadyEvaluated.Error()) {
+		t.Fatalf("body = %s, want %q", rec.Body, errRideAlreadyEvaluated)
+	}
+	if n := f.count(""); n != 0 {
+		t.Fatalf("duplicate evaluation reached the DB (%d statements)", n)
+	}
+}
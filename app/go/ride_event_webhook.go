@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ライドのイベントを外部のダッシュボードなどへ POST する先。空なら送らない
+// プロセスにつながずに練習中の様子を眺めるためのもので、送りきれない分は捨てる
+var (
+	rideEventWebhookURL     = os.Getenv("ISUCON_RIDE_EVENT_WEBHOOK_URL")
+	rideEventWebhookTimeout = time.Duration(getEnvInt("ISUCON_RIDE_EVENT_WEBHOOK_TIMEOUT_MS", 1000)) * time.Millisecond
+)
+
+// 1 回の POST にまとめるイベントの最大数
+const rideEventWebhookBatchSize = 100
+
+var rideEventWebhookQueue chan rideEvent
+
+func startRideEventWebhook() {
+	if rideEventWebhookURL == "" {
+		return
+	}
+	rideEventWebhookQueue = make(chan rideEvent, 4096)
+	go runRideEventWebhook()
+}
+
+// publishRideEvent から呼ぶ。ハンドラを待たせないよう、キューが詰まっていたら捨てる
+func enqueueRideEventWebhook(ev rideEvent) {
+	if rideEventWebhookQueue == nil {
+		return
+	}
+	select {
+	case rideEventWebhookQueue <- ev:
+	default:
+		metricCounter("ride_event_webhook_dropped_total").Inc()
+	}
+}
+
+func runRideEventWebhook() {
+	client := &http.Client{Timeout: rideEventWebhookTimeout}
+	batch := make([]rideEvent, 0, rideEventWebhookBatchSize)
+	for ev := range rideEventWebhookQueue {
+		batch = append(batch[:0], ev)
+	drain:
+		for len(batch) < rideEventWebhookBatchSize {
+			select {
+			case ev := <-rideEventWebhookQueue:
+				batch = append(batch, ev)
+			default:
+				break drain
+			}
+		}
+		if err := postRideEventWebhook(client, batch); err != nil {
+			metricCounter("ride_event_webhook_dropped_total").Add(int64(len(batch)))
+			slog.Debug("failed to deliver ride event webhook", "count", len(batch), "err", err)
+			continue
+		}
+		metricCounter("ride_event_webhook_delivered_total").Add(int64(len(batch)))
+	}
+}
+
+// JSON の配列で送る。リトライはしない
+func postRideEventWebhook(client *http.Client, events []rideEvent) error {
+	b, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, rideEventWebhookURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code (%d)", res.StatusCode)
+	}
+	return nil
+}
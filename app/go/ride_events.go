@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	rideEventCreated    = "created"
+	rideEventAssigned   = "assigned"
+	rideEventUnassigned = "unassigned"
+	rideEventStatus     = "status"
+	rideEventPayment    = "payment"
+)
+
+type rideEvent struct {
+	ID      int64     `json:"id"`
+	Type    string    `json:"type"`
+	RideID  string    `json:"ride_id"`
+	ChairID string    `json:"chair_id,omitempty"`
+	Status  RideState `json:"status,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+	At      int64     `json:"at"`
+}
+
+// 再接続したクライアントに送り直せるよう直近のイベントを残しておく数
+var rideEventLogSize = getEnvInt("ISUCON_RIDE_EVENT_LOG_SIZE", 1024)
+
+// デバッグ用にライドのライフサイクルイベントを配る
+// 配るのは runRideEventFanout の 1 本だけで、発行側は pending に積んで起こすだけ
+// 購読者が詰まったら取りこぼしを出さずにチャネルを閉じ、Last-Event-ID で再開してもらう
+var rideEventHub = struct {
+	sync.Mutex
+	// 購読者 → 購読を始めた時点の最後の ID。これ以前のものは backlog で渡しているので配らない
+	subs    map[chan rideEvent]int64
+	lastID  int64
+	log     []rideEvent // ID 昇順のリングバッファ
+	pending []rideEvent // まだ配っていないもの
+	wake    chan struct{}
+}{subs: map[chan rideEvent]int64{}, wake: make(chan struct{}, 1)}
+
+func subscribeRideEvents() (<-chan rideEvent, func()) {
+	_, ch, unsubscribe, _ := subscribeRideEventsAfter(-1)
+	return ch, unsubscribe
+}
+
+// afterID より後のイベントを、ログに残っている分と以降に届く分で重複も抜けもなく返す
+// afterID が負なら今から届く分だけ。ログから既に消えていたら ok は false で、呼び出し側で作り直してもらう
+func subscribeRideEventsAfter(afterID int64) (backlog []rideEvent, events <-chan rideEvent, unsubscribe func(), ok bool) {
+	ch := make(chan rideEvent, 256)
+	rideEventHub.Lock()
+	defer rideEventHub.Unlock()
+
+	ok = true
+	if afterID > rideEventHub.lastID {
+		// サーバーが再起動して ID が振り直されている
+		ok = false
+	} else if afterID >= 0 && afterID < rideEventHub.lastID {
+		if len(rideEventHub.log) == 0 || rideEventHub.log[0].ID > afterID+1 {
+			ok = false
+		}
+		for _, ev := range rideEventHub.log {
+			if ev.ID > afterID {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	rideEventHub.subs[ch] = rideEventHub.lastID
+	rideEventHubSubscribers.Set(int64(len(rideEventHub.subs)))
+
+	return backlog, ch, func() {
+		rideEventHub.Lock()
+		if _, ok := rideEventHub.subs[ch]; ok {
+			delete(rideEventHub.subs, ch)
+			close(ch)
+			rideEventHubSubscribers.Set(int64(len(rideEventHub.subs)))
+		}
+		rideEventHub.Unlock()
+	}, ok
+}
+
+// ハブに登録されている購読者の数。接続が無いのに減らなければ購読解除の漏れ
+var rideEventHubSubscribers = metricGauge("ride_event_hub_subscribers")
+
+// 通知を待っている接続を種類ごとに数える。戻り値は接続が終わったときに呼ぶ
+func trackSubscriber(kind string) func() {
+	g := metricGauge(metricName("notification_subscribers", "type", kind))
+	g.Add(1)
+	return func() { g.Add(-1) }
+}
+
+// クライアントが先に切断したのを検知した回数
+func recordClientAbort(kind string) {
+	metricCounter(metricName("notification_client_aborts_total", "type", kind)).Inc()
+}
+
+func publishRideEvent(ev rideEvent) {
+	ev.At = epochMilli(time.Now())
+	rideEventHub.Lock()
+	rideEventHub.lastID++
+	ev.ID = rideEventHub.lastID
+	if rideEventLogSize > 0 {
+		if len(rideEventHub.log) >= rideEventLogSize {
+			rideEventHub.log = rideEventHub.log[1:]
+		}
+		rideEventHub.log = append(rideEventHub.log, ev)
+	}
+	rideEventHub.pending = append(rideEventHub.pending, ev)
+	rideEventHub.Unlock()
+	select {
+	case rideEventHub.wake <- struct{}{}:
+	default:
+	}
+	enqueueRideEventWebhook(ev)
+}
+
+// 積まれたイベントを購読者に配り、そのライドの利用者が通知を待っていれば appNotifier で組み立て直させる
+func runRideEventFanout() {
+	for range rideEventHub.wake {
+		flushRideEvents()
+	}
+}
+
+func flushRideEvents() {
+	rideEventHub.Lock()
+	events := rideEventHub.pending
+	rideEventHub.pending = nil
+	for _, ev := range events {
+		fanOutRideEvent(ev)
+	}
+	rideEventHub.Unlock()
+	for _, ev := range events {
+		if userID, ok := rideUsers.Get(ev.RideID); ok {
+			appNotifier.Notify(userID)
+		}
+	}
+}
+
+// ロックを持って呼ぶ
+func fanOutRideEvent(ev rideEvent) {
+	for ch, after := range rideEventHub.subs {
+		if ev.ID <= after {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+			delete(rideEventHub.subs, ch)
+			close(ch)
+			rideEventHubSubscribers.Set(int64(len(rideEventHub.subs)))
+		}
+	}
+}
+
+func publishStatusEvents(chairID string, statuses ...RideStatus) {
+	for _, rs := range statuses {
+		publishRideEvent(rideEvent{Type: rideEventStatus, RideID: rs.RideID, ChairID: chairID, Status: rs.Status})
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ライドの作成から、割り当て・椅子への最初の通知・アプリへの最初の通知 (椅子付き) までの時間 (ms)
+// ユーザーから見えるマッチングの遅さは減点されるので、どこで時間がかかっているかを段階ごとに見る
+var rideLatencyBucketsMs = []int64{50, 100, 250, 500, 1000, 2000, 3000, 5000, 10000, 30000}
+
+const (
+	rideLatencyAssignment        = "ride_assignment_latency_ms"
+	rideLatencyChairNotification = "ride_chair_notification_latency_ms"
+	rideLatencyAppNotification   = "ride_app_notification_latency_ms"
+	rideLatencyUserVisible       = "ride_user_visible_match_latency_ms"
+	matchingRoundDuration        = "matching_round_duration_ms"
+	matchingRoundInterval        = "matching_round_interval_ms"
+)
+
+// レポートに載せるもの
+var rideLatencyMetrics = []string{
+	rideLatencyAssignment,
+	rideLatencyChairNotification,
+	rideLatencyAppNotification,
+	rideLatencyUserVisible,
+	matchingRoundDuration,
+	matchingRoundInterval,
+}
+
+func observeLatency(name string, d time.Duration) {
+	metricHistogram(name, rideLatencyBucketsMs).Observe(d.Milliseconds())
+}
+
+// 作成時刻はアプリの時計で取る。DB の created_at と比べると時計のずれが混ざる
+type rideLatency struct {
+	CreatedAt     time.Time
+	AssignedAt    time.Time
+	ChairNotified bool
+	AppNotified   bool
+}
+
+// 両方に通知し終えたら消す。再起動前に作られたライドは測らない
+var rideLatencyCache = NewCache[string, rideLatency]()
+
+// ライドのコミット後に呼ぶ
+func recordRideCreated(rideID string, at time.Time) {
+	rideLatencyCache.Set(rideID, rideLatency{CreatedAt: at})
+}
+
+// 割り当てが回収されて別の椅子に付け直されたら、そこから測り直す
+func recordRideAssigned(rideID string, at time.Time) {
+	rideLatencyCache.UpdateIfPresent(rideID, func(v rideLatency) rideLatency {
+		observeLatency(rideLatencyAssignment, at.Sub(v.CreatedAt))
+		return rideLatency{CreatedAt: v.CreatedAt, AssignedAt: at}
+	})
+}
+
+// 割り当てが回収されたら、前の椅子の分は捨てて作成時刻だけ残す
+func recordRideUnassigned(rideID string) {
+	rideLatencyCache.UpdateIfPresent(rideID, func(v rideLatency) rideLatency {
+		return rideLatency{CreatedAt: v.CreatedAt}
+	})
+}
+
+// 椅子に MATCHING を通知したときに呼ぶ
+func recordChairNotified(rideID string) {
+	recordRideNotified(rideID, func(v *rideLatency, now time.Time) {
+		if v.ChairNotified {
+			return
+		}
+		v.ChairNotified = true
+		observeLatency(rideLatencyChairNotification, now.Sub(v.AssignedAt))
+	})
+}
+
+// アプリに椅子の情報を付けて通知したときに呼ぶ
+func recordAppNotified(rideID string) {
+	recordRideNotified(rideID, func(v *rideLatency, now time.Time) {
+		if v.AppNotified {
+			return
+		}
+		v.AppNotified = true
+		observeLatency(rideLatencyAppNotification, now.Sub(v.AssignedAt))
+		observeLatency(rideLatencyUserVisible, now.Sub(v.CreatedAt))
+	})
+}
+
+func recordRideNotified(rideID string, f func(v *rideLatency, now time.Time)) {
+	now := time.Now()
+	done := false
+	rideLatencyCache.UpdateIfPresent(rideID, func(v rideLatency) rideLatency {
+		if v.AssignedAt.IsZero() {
+			return v
+		}
+		f(&v, now)
+		done = v.ChairNotified && v.AppNotified
+		return v
+	})
+	if done {
+		rideLatencyCache.Delete(rideID)
+	}
+}
+
+var lastMatchingRoundAt atomic.Pointer[time.Time]
+
+// 定期マッチングのラウンドの所要時間と間隔。割り当てまでの時間はおおむね間隔の半分 + 所要時間になるはず
+func observeMatchingRound(start time.Time) {
+	observeLatency(matchingRoundDuration, time.Since(start))
+	if last := lastMatchingRoundAt.Swap(&start); last != nil {
+		observeLatency(matchingRoundInterval, start.Sub(*last))
+	}
+}
+
+func resetRideLatency() {
+	lastMatchingRoundAt.Store(nil)
+}
+
+// レポート用に区間から荒く見積もった値。分位点は区間の上限なので実際より大きめに出る
+type latencySummary struct {
+	Count  int64   `json:"count"`
+	MeanMs float64 `json:"mean_ms"`
+	P50Ms  int64   `json:"p50_ms"`
+	P90Ms  int64   `json:"p90_ms"`
+	P99Ms  int64   `json:"p99_ms"`
+}
+
+func rideLatencySummaries() map[string]latencySummary {
+	summaries := make(map[string]latencySummary, len(rideLatencyMetrics))
+	for _, name := range rideLatencyMetrics {
+		h := metricHistogram(name, rideLatencyBucketsMs)
+		s := latencySummary{
+			Count: h.count.Load(),
+			P50Ms: h.Quantile(0.5),
+			P90Ms: h.Quantile(0.9),
+			P99Ms: h.Quantile(0.99),
+		}
+		if s.Count > 0 {
+			s.MeanMs = float64(h.sum.Load()) / float64(s.Count)
+		}
+		summaries[name] = s
+	}
+	return summaries
+}
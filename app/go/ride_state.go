@@ -0,0 +1,53 @@
+package main
+
+import "fmt"
+
+// ライドの状態。ride_statuses.status に入る値
+// 文字列のまま比べると綴りを間違えても気づけないので、必ずこの定数を使う
+type RideState string
+
+const (
+	RideStateMatching  RideState = "MATCHING"
+	RideStateEnroute   RideState = "ENROUTE"
+	RideStatePickup    RideState = "PICKUP"
+	RideStateCarrying  RideState = "CARRYING"
+	RideStateArrived   RideState = "ARRIVED"
+	RideStateCompleted RideState = "COMPLETED"
+)
+
+// 状態の遷移順
+var rideStateOrder = []RideState{
+	RideStateMatching,
+	RideStateEnroute,
+	RideStatePickup,
+	RideStateCarrying,
+	RideStateArrived,
+	RideStateCompleted,
+}
+
+func (s RideState) Valid() bool {
+	for _, v := range rideStateOrder {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// 次に遷移する状態。COMPLETED や不正な状態なら false
+func (s RideState) Next() (RideState, bool) {
+	for i, v := range rideStateOrder {
+		if s == v && i+1 < len(rideStateOrder) {
+			return rideStateOrder[i+1], true
+		}
+	}
+	return "", false
+}
+
+func RideStateFromString(s string) (RideState, error) {
+	state := RideState(s)
+	if !state.Valid() {
+		return "", fmt.Errorf("unknown ride status: %q", s)
+	}
+	return state, nil
+}
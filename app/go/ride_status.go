@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+)
+
+// 有効にすると ride_statuses の読み込みを全てメモリから返す。MySQL へは書き込みだけ行う
+var inMemoryRideStatuses = newFeatureFlag("inmemory_ride_statuses", "ISUCON_INMEMORY_RIDE_STATUSES", false)
+
+// ライド ID ごとのステータス履歴 (seq 昇順)。フラグに関係なく常に更新しておく
+// 予算を超えると古いライドから捨てられるので、無いときは DB を見る
+var rideStatusCache = NewCache[string, []RideStatus]().withBudget("ride_statuses", cacheBudgetMB("ride_statuses", 256), func(_ string, v []RideStatus) int {
+	return 64 + len(v)*160
+})
+
+// created_at はアプリ側で決めて、DB とキャッシュで同じ値を持つ
+func insertRideStatus(ctx context.Context, tx *sqlx.Tx, rideID string, status RideState) (RideStatus, error) {
+	if _, err := RideStateFromString(string(status)); err != nil {
+		return RideStatus{}, err
+	}
+	seq, err := nextRideStatusSeq(ctx, tx, rideID, status)
+	if err != nil {
+		return RideStatus{}, err
+	}
+	rs := RideStatus{
+		ID:        ulid.Make().String(),
+		RideID:    rideID,
+		Status:    status,
+		Seq:       seq,
+		CreatedAt: time.Now().Truncate(time.Microsecond),
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO ride_statuses (id, ride_id, status, seq, created_at) VALUES (?, ?, ?, ?, ?)`, rs.ID, rs.RideID, rs.Status, rs.Seq, rs.CreatedAt); err != nil {
+		return rs, err
+	}
+	return rs, nil
+}
+
+// 同じマイクロ秒に作られたステータスでも順序が決まるよう、ライドごとに 1 から振る
+// (ride_id, seq) は一意なので、同じライドに同時に書き込まれたら片方の INSERT が失敗する
+func nextRideStatusSeq(ctx context.Context, tx *sqlx.Tx, rideID string, status RideState) (int, error) {
+	if status == RideStateMatching {
+		// MATCHING はライドの作成時にだけ積まれる
+		return 1, nil
+	}
+	if statuses, ok := rideStatusCache.Get(rideID); ok && len(statuses) > 0 {
+		return statuses[len(statuses)-1].Seq + 1, nil
+	}
+	var seq int
+	if err := tx.GetContext(ctx, &seq, `SELECT IFNULL(MAX(seq), 0) + 1 FROM ride_statuses WHERE ride_id = ?`, rideID); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// トランザクションのコミット後に呼ぶ
+func cacheRideStatuses(s *cacheSet, statuses ...RideStatus) {
+	for _, rs := range statuses {
+		appendStatus := func(v []RideStatus) []RideStatus { return append(v, rs) }
+		if rs.Status == RideStateMatching {
+			rideStatusCache.in(s).Update(rs.RideID, func(v []RideStatus, _ bool) []RideStatus { return appendStatus(v) })
+			continue
+		}
+		// 捨てられた履歴の続きだけを載せると欠けた履歴を返してしまうので、無ければ DB から引き直させる
+		rideStatusCache.in(s).UpdateIfPresent(rs.RideID, appendStatus)
+	}
+}
+
+func getRideStatuses(ctx context.Context, tx executableGet, rideID string) ([]RideStatus, error) {
+	if inMemoryRideStatuses.Enabled() {
+		statuses, ok := rideStatusCache.Get(rideID)
+		recordCacheLookup(ctx, "ride_statuses", ok)
+		if ok {
+			verifyCacheRead(ctx, "ride_statuses", rideID, rideStatusIDs(statuses), func() (string, error) {
+				fromDB := []RideStatus{}
+				err := tx.SelectContext(ctx, &fromDB, `SELECT `+rideStatusColumns+` FROM ride_statuses WHERE ride_id = ? ORDER BY seq`, rideID)
+				return rideStatusIDs(fromDB), err
+			})
+			return statuses, nil
+		}
+	}
+	statuses := []RideStatus{}
+	if err := tx.SelectContext(ctx, &statuses, `SELECT `+rideStatusColumns+` FROM ride_statuses WHERE ride_id = ? ORDER BY seq`, rideID); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// 通知先にまだ送っていないステータスを古い順に返す
+func getUnsentRideStatuses(ctx context.Context, tx executableGet, target sentAtTarget, rideID string) ([]RideStatus, error) {
+	if inMemoryRideStatuses.Enabled() {
+		statuses, ok := rideStatusCache.Get(rideID)
+		recordCacheLookup(ctx, "ride_statuses", ok)
+		if ok {
+			sent := sentStatusCache(target)
+			unsent := []RideStatus{}
+			for _, rs := range statuses {
+				if _, ok := sent.Get(rs.ID); !ok {
+					unsent = append(unsent, rs)
+				}
+			}
+			return unsent, nil
+		}
+	}
+
+	query := `SELECT ` + rideStatusColumns + ` FROM ride_statuses WHERE ride_id = ? AND app_sent_at IS NULL ORDER BY seq ASC`
+	if target == sentAtChair {
+		query = `SELECT ` + rideStatusColumns + ` FROM ride_statuses WHERE ride_id = ? AND chair_sent_at IS NULL ORDER BY seq ASC`
+	}
+	statuses := []RideStatus{}
+	if err := tx.SelectContext(ctx, &statuses, query, rideID); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+func latestRideStatusFromCache(rideID string) (RideState, bool) {
+	if !inMemoryRideStatuses.Enabled() {
+		return "", false
+	}
+	statuses, ok := rideStatusCache.Get(rideID)
+	if !ok || len(statuses) == 0 {
+		return "", false
+	}
+	return statuses[len(statuses)-1].Status, true
+}
+
+// 椅子に割り当てられた全てのライドが完了し、椅子側に全ステータスを通知済みなら空いている
+// 通知済みかは chair_sent_at ではなく chairSentStatusCache で見る。chair_sent_at は stamper が後から書くので、
+// COMPLETED を通知した直後 (即時マッチングを呼ぶとき) にはまだ入っていない
+func isChairFree(ctx context.Context, chairID string) (bool, error) {
+	statusIDs, err := chairRideStatusIDs(ctx, chairID)
+	if err != nil {
+		return false, err
+	}
+	for _, ids := range statusIDs {
+		sent := 0
+		for _, id := range ids {
+			if _, ok := chairSentStatusCache.Get(id); ok {
+				sent++
+			}
+		}
+		if sent != 6 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// 椅子に割り当てられたライドごとのステータス ID
+func chairRideStatusIDs(ctx context.Context, chairID string) (map[string][]string, error) {
+	statusIDs := map[string][]string{}
+	if !inMemoryRideStatuses.Enabled() {
+		rows := []struct {
+			RideID string `db:"ride_id"`
+			ID     string `db:"id"`
+		}{}
+		if err := db.SelectContext(ctx, &rows, "SELECT ride_statuses.ride_id, ride_statuses.id FROM ride_statuses JOIN rides ON rides.id = ride_statuses.ride_id WHERE rides.chair_id = ?", chairID); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			statusIDs[row.RideID] = append(statusIDs[row.RideID], row.ID)
+		}
+		return statusIDs, nil
+	}
+
+	rideIDs := []string{}
+	if err := db.SelectContext(ctx, &rideIDs, `SELECT id FROM rides WHERE chair_id = ?`, chairID); err != nil {
+		return nil, err
+	}
+	for _, rideID := range rideIDs {
+		statuses, ok := rideStatusCache.Get(rideID)
+		if !ok {
+			// 予算超過で捨てられた古いライドは DB で引く
+			ids := []string{}
+			if err := db.SelectContext(ctx, &ids, "SELECT id FROM ride_statuses WHERE ride_id = ?", rideID); err != nil {
+				return nil, err
+			}
+			statusIDs[rideID] = ids
+			continue
+		}
+		for _, rs := range statuses {
+			statusIDs[rideID] = append(statusIDs[rideID], rs.ID)
+		}
+	}
+	return statusIDs, nil
+}
+
+// アプリの通知に使う、ユーザーの最新のライドとその未送信のうち最も古いステータス
+type appNotificationTarget struct {
+	Ride *Ride
+	// 未送信のステータスが無ければ nil
+	Unsent *RideStatus
+	Latest RideState
+}
+
+// ライドとステータスを 1 回で引く。ユーザーにライドが無ければ sql.ErrNoRows
+func getAppNotificationTarget(ctx context.Context, tx executableGet, userID string) (*appNotificationTarget, error) {
+	target := &appNotificationTarget{Ride: &Ride{}}
+	if inMemoryRideStatuses.Enabled() {
+		if err := getRideContext(ctx, tx, target.Ride, `SELECT `+rideColumns+` FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1`, userID); err != nil {
+			return nil, err
+		}
+		statuses, ok := rideStatusCache.Get(target.Ride.ID)
+		recordCacheLookup(ctx, "ride_statuses", ok)
+		if ok && len(statuses) > 0 {
+			// 履歴を 1 回なめて、最も古い未送信と最新を拾う
+			target.Unsent = firstUnsentStatus(sentAtApp, statuses)
+			target.Latest = statuses[len(statuses)-1].Status
+			return target, nil
+		}
+		return target, fillAppNotificationStatuses(ctx, tx, target)
+	}
+
+	var (
+		unsentID, unsentStatus sql.NullString
+		unsentSeq              sql.NullInt64
+		unsentCreatedAt        sql.NullTime
+		latest                 string
+	)
+	var ride rideRow
+	dest := append(ride.dest(), &unsentID, &unsentStatus, &unsentSeq, &unsentCreatedAt, &latest)
+	err := tx.QueryRowContext(ctx, `SELECT `+qualifyColumns("latest", rideColumns)+`, rs.id, rs.status, rs.seq, rs.created_at,
+       (SELECT status FROM ride_statuses WHERE ride_id = latest.id ORDER BY seq DESC LIMIT 1)
+FROM (SELECT `+rideColumns+` FROM rides WHERE user_id = ? ORDER BY created_at DESC LIMIT 1) latest
+LEFT JOIN ride_statuses rs ON rs.id = (SELECT id FROM ride_statuses WHERE ride_id = latest.id AND app_sent_at IS NULL ORDER BY seq ASC LIMIT 1)`, userID).Scan(dest...)
+	if err != nil {
+		return nil, err
+	}
+	*target.Ride = ride.model()
+	if target.Latest, err = RideStateFromString(latest); err != nil {
+		return nil, err
+	}
+	if !unsentID.Valid {
+		return target, nil
+	}
+	if _, stamping := appSentStatusCache.Get(unsentID.String); stamping {
+		// 送信済みにした印がまだ DB に反映されていないので、次の未送信を探すには全て引く必要がある
+		return target, fillAppNotificationStatuses(ctx, tx, target)
+	}
+	status, err := RideStateFromString(unsentStatus.String)
+	if err != nil {
+		return nil, err
+	}
+	target.Unsent = &RideStatus{ID: unsentID.String, RideID: target.Ride.ID, Status: status, Seq: int(unsentSeq.Int64), CreatedAt: unsentCreatedAt.Time}
+	return target, nil
+}
+
+// 1 回で引けなかったときは、未送信のステータスと最新のステータスを別々に引く
+func fillAppNotificationStatuses(ctx context.Context, tx executableGet, target *appNotificationTarget) error {
+	unsent, err := getUnsentRideStatuses(ctx, tx, sentAtApp, target.Ride.ID)
+	if err != nil {
+		return err
+	}
+	target.Unsent = firstUnsentStatus(sentAtApp, unsent)
+	target.Latest, err = getLatestRideStatus(ctx, tx, target.Ride.ID)
+	return err
+}
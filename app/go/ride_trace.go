@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	assignmentByRound = "round"
+	assignmentByFast  = "fast"
+	assignmentByHold  = "hold"
+)
+
+type rideAssignment struct {
+	ChairID    string
+	AssignedAt time.Time
+	Distance   int
+	By         string
+}
+
+// 割り当てた時刻と、そのときの椅子から乗車地点までの距離
+var rideAssignmentCache = NewCache[string, rideAssignment]()
+
+func recordRideAssignment(pair matchingPair, by string) {
+	a := rideAssignment{
+		ChairID:    pair.ChairID,
+		AssignedAt: time.Now(),
+		Distance:   pair.Distance,
+		By:         by,
+	}
+	rideAssignmentCache.Set(pair.RideID, a)
+	awaitingAckCache.Set(pair.RideID, a)
+	recordRideAssigned(pair.RideID, a.AssignedAt)
+}
+
+type ridePaymentResult struct {
+	Amount      int
+	Succeeded   bool
+	Error       string
+	CompletedAt time.Time
+}
+
+var ridePaymentResultCache = NewCache[string, ridePaymentResult]()
+
+type internalGetRideTraceResponse struct {
+	RideID                string               `json:"ride_id"`
+	UserID                string               `json:"user_id"`
+	ChairID               *string              `json:"chair_id"`
+	PickupCoordinate      Coordinate           `json:"pickup_coordinate"`
+	DestinationCoordinate Coordinate           `json:"destination_coordinate"`
+	Evaluation            *int                 `json:"evaluation"`
+	CreatedAt             int64                `json:"created_at"`
+	UpdatedAt             int64                `json:"updated_at"`
+	Assignment            *rideTraceAssignment `json:"assignment"`
+	Statuses              []rideTraceStatus    `json:"statuses"`
+	Payment               *rideTracePayment    `json:"payment"`
+}
+
+type rideTraceAssignment struct {
+	ChairID    string `json:"chair_id"`
+	AssignedAt int64  `json:"assigned_at"`
+	Distance   int    `json:"distance"`
+	By         string `json:"by"`
+}
+
+type rideTraceStatus struct {
+	ID          string    `json:"id"`
+	Status      RideState `json:"status"`
+	CreatedAt   int64     `json:"created_at"`
+	AppSentAt   *int64    `json:"app_sent_at"`
+	ChairSentAt *int64    `json:"chair_sent_at"`
+	// stamper が DB に反映する前でも、通知済みならこちらは true になる
+	AppSent   bool `json:"app_sent"`
+	ChairSent bool `json:"chair_sent"`
+}
+
+type rideTracePayment struct {
+	Amount      int    `json:"amount"`
+	Succeeded   bool   `json:"succeeded"`
+	Error       string `json:"error,omitempty"`
+	CompletedAt int64  `json:"completed_at"`
+}
+
+// ベンチマーカーのエラーに出てきたライドについて、作成から決済までの経過をまとめて返す
+func internalGetRideTrace(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	rideID := r.PathValue("ride_id")
+
+	ride := &Ride{}
+	if err := getRideContext(ctx, db, ride, `SELECT `+rideColumns+` FROM rides WHERE id = ?`, rideID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			writeError(w, http.StatusNotFound, errors.New("ride not found"))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// sent_at を見たいのでキャッシュではなく DB から読む
+	statuses := []RideStatus{}
+	if err := db.SelectContext(ctx, &statuses, `SELECT `+rideStatusColumns+` FROM ride_statuses WHERE ride_id = ? ORDER BY seq`, rideID); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	res := internalGetRideTraceResponse{
+		RideID:                ride.ID,
+		UserID:                ride.UserID,
+		PickupCoordinate:      ride.Pickup(),
+		DestinationCoordinate: ride.Destination(),
+		Evaluation:            ride.Evaluation,
+		CreatedAt:             epochMilli(ride.CreatedAt),
+		UpdatedAt:             epochMilli(ride.UpdatedAt),
+		Statuses:              make([]rideTraceStatus, 0, len(statuses)),
+	}
+	if ride.ChairID.Valid {
+		res.ChairID = &ride.ChairID.String
+	}
+	if a, ok := rideAssignmentCache.Get(ride.ID); ok {
+		res.Assignment = &rideTraceAssignment{
+			ChairID:    a.ChairID,
+			AssignedAt: epochMilli(a.AssignedAt),
+			Distance:   a.Distance,
+			By:         a.By,
+		}
+	}
+	for _, rs := range statuses {
+		_, appSent := appSentStatusCache.Get(rs.ID)
+		_, chairSent := chairSentStatusCache.Get(rs.ID)
+		res.Statuses = append(res.Statuses, rideTraceStatus{
+			ID:          rs.ID,
+			Status:      rs.Status,
+			CreatedAt:   epochMilli(rs.CreatedAt),
+			AppSentAt:   epochMilliPtr(rs.AppSentAt),
+			ChairSentAt: epochMilliPtr(rs.ChairSentAt),
+			AppSent:     appSent || rs.AppSentAt != nil,
+			ChairSent:   chairSent || rs.ChairSentAt != nil,
+		})
+	}
+	if p, ok := ridePaymentResultCache.Get(ride.ID); ok {
+		res.Payment = &rideTracePayment{
+			Amount:      p.Amount,
+			Succeeded:   p.Succeeded,
+			Error:       p.Error,
+			CompletedAt: epochMilli(p.CompletedAt),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,72 @@
+package main
+
+import "context"
+
+// アプリ向けのレスポンスを組み立てるためのライドの情報
+// 椅子がまだ割り当てられていなければ Chair は nil で、レスポンスからも椅子の情報を省く
+type rideView struct {
+	Ride  *Ride
+	Chair *rideChairSummary
+}
+
+func getRideView(ctx context.Context, tx executableGet, ride *Ride) (*rideView, error) {
+	view := &rideView{Ride: ride}
+	if !ride.ChairID.Valid {
+		return view, nil
+	}
+
+	summary, ok := rideChairCache.Get(ride.ID)
+	recordCacheLookup(ctx, "ride_chairs", ok)
+	if !ok {
+		chair := &Chair{}
+		if err := getChairContext(ctx, tx, chair, `SELECT `+chairColumns+` FROM chairs WHERE id = ?`, ride.ChairID); err != nil {
+			return nil, err
+		}
+		summary = cacheRideChair(currentCaches(), ride.ID, chair)
+	} else {
+		verifyCacheRead(ctx, "ride_chairs", ride.ID, summary.ID, func() (string, error) {
+			return ride.ChairID.String, nil
+		})
+	}
+	view.Chair = &summary
+	return view, nil
+}
+
+func (v *rideView) PickupCoordinate() Coordinate {
+	return v.Ride.Pickup()
+}
+
+func (v *rideView) DestinationCoordinate() Coordinate {
+	return v.Ride.Destination()
+}
+
+// 迎車と到着までのおおよその秒数。椅子の最後の位置からマンハッタン距離を速度で割って出す
+// 椅子が決まっていない、位置や速度が分からない、もう到着しているときは nil
+func (v *rideView) ETA(status RideState) (pickup *int, arrival *int) {
+	if v.Chair == nil {
+		return nil, nil
+	}
+	speed, ok := chairModelSpeedCache.Get(v.Chair.Model)
+	if !ok || speed <= 0 {
+		return nil, nil
+	}
+	pos, ok := chairPositionCache.Get(v.Chair.ID)
+	if !ok {
+		return nil, nil
+	}
+	seconds := func(distance int) *int {
+		s := (distance + speed - 1) / speed
+		return &s
+	}
+	pickupToDestination := v.Ride.Pickup().DistanceTo(v.Ride.Destination())
+	switch status {
+	case RideStateEnroute:
+		toPickup := pos.Position().DistanceTo(v.Ride.Pickup())
+		return seconds(toPickup), seconds(toPickup + pickupToDestination)
+	case RideStatePickup:
+		return seconds(0), seconds(pickupToDestination)
+	case RideStateCarrying:
+		return seconds(0), seconds(pos.Position().DistanceTo(v.Ride.Destination()))
+	}
+	return nil, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// (0,0) で乗せて (10,20) まで運ぶライド
+func testViewRide(chairID string) *Ride {
+	ride := &Ride{ID: "ride-1", UserID: "user-1", DestinationLatitude: 10, DestinationLongitude: 20}
+	if chairID != "" {
+		ride.ChairID = sql.NullString{String: chairID, Valid: true}
+	}
+	return ride
+}
+
+func TestGetRideViewWithoutChair(t *testing.T) {
+	useFreshCaches(t)
+	f := &fakeDB{}
+	conn := openFakeDB(t, f)
+
+	view, err := getRideView(context.Background(), conn, testViewRide(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.Chair != nil {
+		t.Fatalf("Chair = %+v, want nil", view.Chair)
+	}
+	if pickup, arrival := view.ETA(RideStateEnroute); pickup != nil || arrival != nil {
+		t.Fatal("ETA is set for a ride without a chair")
+	}
+	if n := f.count(""); n != 0 {
+		t.Fatalf("looked up the DB %d times for a ride without a chair", n)
+	}
+}
+
+func TestGetRideViewChairLookup(t *testing.T) {
+	useFreshCaches(t)
+	now := time.Now()
+	f := (&fakeDB{}).on("FROM chairs WHERE id = ?", strings.Split(chairColumns, ", "),
+		[]driver.Value{"chair-1", "owner-1", "QC-1", "クエストチェア Lite", true, "token", now, now})
+	conn := openFakeDB(t, f)
+
+	want := rideChairSummary{ID: "chair-1", OwnerID: "owner-1", Name: "QC-1", Model: "クエストチェア Lite"}
+	for i := range 2 {
+		view, err := getRideView(context.Background(), conn, testViewRide("chair-1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if view.Chair == nil || *view.Chair != want {
+			t.Fatalf("Chair = %+v, want %+v", view.Chair, want)
+		}
+		// 2 回目は割り当て時と同じくキャッシュから返す
+		if n := f.count("FROM chairs"); n != 1 {
+			t.Fatalf("call %d: looked up chairs %d times, want 1", i+1, n)
+		}
+	}
+	if _, ok := chairsWithRide.Get("chair-1"); !ok {
+		t.Fatal("chair was not marked as having a ride")
+	}
+}
+
+func TestRideViewETA(t *testing.T) {
+	useFreshCaches(t)
+	chairModelSpeedCache.Set("fast", 3)
+	chairModelSpeedCache.Set("stopped", 0)
+	// 乗車地点から (3,4) 離れた位置にいる
+	chairPositionCache.Set("chair-1", chairPositionCacheEntry{LastLat: 3, LastLong: 4})
+
+	view := func(chairID, model string) *rideView {
+		return &rideView{Ride: testViewRide(chairID), Chair: &rideChairSummary{ID: chairID, Model: model}}
+	}
+	tests := []struct {
+		name        string
+		view        *rideView
+		status      RideState
+		wantPickup  *int
+		wantArrival *int
+	}{
+		// 迎車 7 → ceil(7/3) = 3 秒、到着まで 7+30 → ceil(37/3) = 13 秒
+		{name: "enroute", view: view("chair-1", "fast"), status: RideStateEnroute, wantPickup: intPtr(3), wantArrival: intPtr(13)},
+		{name: "pickup", view: view("chair-1", "fast"), status: RideStatePickup, wantPickup: intPtr(0), wantArrival: intPtr(10)},
+		// 目的地まで |10-3|+|20-4| = 23 → ceil(23/3) = 8 秒
+		{name: "carrying", view: view("chair-1", "fast"), status: RideStateCarrying, wantPickup: intPtr(0), wantArrival: intPtr(8)},
+		{name: "matching", view: view("chair-1", "fast"), status: RideStateMatching},
+		{name: "arrived", view: view("chair-1", "fast"), status: RideStateArrived},
+		{name: "completed", view: view("chair-1", "fast"), status: RideStateCompleted},
+		{name: "unknown model", view: view("chair-1", "unknown"), status: RideStateEnroute},
+		{name: "stopped model", view: view("chair-1", "stopped"), status: RideStateEnroute},
+		{name: "no position", view: view("chair-2", "fast"), status: RideStateEnroute},
+		{name: "no chair", view: &rideView{Ride: testViewRide("")}, status: RideStateEnroute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pickup, arrival := tt.view.ETA(tt.status)
+			if !equalIntPtr(pickup, tt.wantPickup) || !equalIntPtr(arrival, tt.wantArrival) {
+				t.Fatalf("ETA(%s) = %s, %s, want %s, %s", tt.status, fmtIntPtr(pickup), fmtIntPtr(arrival), fmtIntPtr(tt.wantPickup), fmtIntPtr(tt.wantArrival))
+			}
+		})
+	}
+}
+
+func equalIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func fmtIntPtr(p *int) string {
+	if p == nil {
+		return "nil"
+	}
+	return strconv.Itoa(*p)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// 競技用インスタンスはメモリが少なく、GC の停止が p99 に出るので起動時にまとめて調整する
+// 0 または負の値はその項目を触らない (Go のデフォルトか GOGC / GOMEMLIMIT に任せる)
+var (
+	runtimeMaxProcs      = getEnvInt("ISUCON_GOMAXPROCS", 0)
+	runtimeGCPercent     = getEnvInt("ISUCON_GC_PERCENT", 0)
+	runtimeMemoryLimitMB = getEnvInt("ISUCON_MEMORY_LIMIT_MB", 0)
+	runtimeGCBallastMB   = getEnvInt("ISUCON_GC_BALLAST_MB", 0)
+)
+
+// ヒープを大きく見せて GC の頻度を下げるための領域。触らないので物理メモリはほぼ使わない
+var gcBallast []byte
+
+func tuneRuntime() {
+	procs, source := runtimeMaxProcs, "env"
+	if procs <= 0 {
+		procs, source = cgroupCPUQuota(), "cgroup"
+	}
+	if procs > 0 {
+		runtime.GOMAXPROCS(procs)
+	} else {
+		source = "default"
+	}
+
+	if runtimeGCPercent > 0 {
+		debug.SetGCPercent(runtimeGCPercent)
+	}
+	if runtimeMemoryLimitMB > 0 {
+		debug.SetMemoryLimit(int64(runtimeMemoryLimitMB) << 20)
+	}
+	if runtimeGCBallastMB > 0 {
+		gcBallast = make([]byte, runtimeGCBallastMB<<20)
+	}
+
+	// 今の値を読むだけの API が無いので、一度無効化して前の値を受け取り、すぐ戻す
+	gcPercent := debug.SetGCPercent(-1)
+	debug.SetGCPercent(gcPercent)
+	slog.Info("runtime tuned",
+		"gomaxprocs", runtime.GOMAXPROCS(0),
+		"gomaxprocs_source", source,
+		"num_cpu", runtime.NumCPU(),
+		"gc_percent", gcPercent,
+		"memory_limit_mb", debug.SetMemoryLimit(-1)>>20,
+		"ballast_mb", len(gcBallast)>>20,
+	)
+}
+
+// cgroup の CPU クォータを切り上げた整数。制限が無いか読めなければ 0
+func cgroupCPUQuota() int {
+	// cgroup v2: "<quota> <period>" または "max <period>"
+	if b, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(b))
+		if len(fields) == 2 && fields[0] != "max" {
+			return cpuQuotaToProcs(fields[0], fields[1])
+		}
+		return 0
+	}
+	// cgroup v1
+	quota, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	period, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return cpuQuotaToProcs(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func cpuQuotaToProcs(quota, period string) int {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return max(int(math.Ceil(q/p)), 1)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+)
+
+// ホットなクエリは sqlx のリフレクションを通さずに手で Scan する
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// rideColumns の順に並んでいること
+func scanRide(row rowScanner, ride *Ride) error {
+	var r rideRow
+	if err := row.Scan(r.dest()...); err != nil {
+		return err
+	}
+	*ride = r.model()
+	return nil
+}
+
+func getRideContext(ctx context.Context, q queryRower, ride *Ride, query string, args ...any) error {
+	return scanRide(q.QueryRowContext(ctx, query, args...), ride)
+}
+
+// 列は rideRow のタグで対応付けるので、rideColumns の一部だけを引いてもよい。引かなかったフィールドはゼロ値
+func selectRidesContext(ctx context.Context, q executableGet, query string, args ...any) ([]Ride, error) {
+	rows := []rideRow{}
+	if err := q.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	rides := make([]Ride, len(rows))
+	for i := range rows {
+		rides[i] = rows[i].model()
+	}
+	return rides, nil
+}
+
+func getChairContext(ctx context.Context, q executableGet, chair *Chair, query string, args ...any) error {
+	var r chairRow
+	if err := q.GetContext(ctx, &r, query, args...); err != nil {
+		return err
+	}
+	*chair = r.model()
+	return nil
+}
+
+func selectChairsContext(ctx context.Context, q executableGet, query string, args ...any) ([]Chair, error) {
+	rows := []chairRow{}
+	if err := q.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	chairs := make([]Chair, len(rows))
+	for i := range rows {
+		chairs[i] = rows[i].model()
+	}
+	return chairs, nil
+}
+
+func selectChairLocationsContext(ctx context.Context, q executableGet, query string, args ...any) ([]ChairLocation, error) {
+	rows := []chairLocationRow{}
+	if err := q.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, err
+	}
+	locations := make([]ChairLocation, len(rows))
+	for i := range rows {
+		locations[i] = rows[i].model()
+	}
+	return locations, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// マッチングが使う列だけ。行き先は運賃で重み付けするのに要る
+const pendingRideColumns = "id, pickup_latitude, pickup_longitude, destination_latitude, destination_longitude, created_at"
+
+// 椅子が決まっていないライドを古い順に返す。pendingRideColumns 以外のフィールドはゼロ値のまま
+func selectPendingRides(ctx context.Context, q queryer) ([]Ride, error) {
+	rows, err := q.QueryContext(ctx, `SELECT `+pendingRideColumns+` FROM rides WHERE chair_id IS NULL ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rides := []Ride{}
+	for rows.Next() {
+		var r rideRow
+		if err := rows.Scan(&r.ID, &r.PickupLatitude, &r.PickupLongitude, &r.DestinationLatitude, &r.DestinationLongitude, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		rides = append(rides, r.model())
+	}
+	return rides, rows.Err()
+}
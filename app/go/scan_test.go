@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var scanTestAt = time.Date(2024, 12, 8, 10, 0, 0, 0, time.UTC)
+
+// どのライドを引いても同じ 1 行を返す。DB 無しで Scan の経路だけを比べる
+func openScanTestDB(tb testing.TB) *sqlx.DB {
+	tb.Helper()
+	f := (&fakeDB{}).
+		on("SELECT status ", []string{"status"}, []driver.Value{"ENROUTE"}).
+		on("FROM rides", strings.Split(rideColumns, ", "),
+			[]driver.Value{"ride", "user", "chair", int64(1), int64(-2), int64(3), int64(-4), int64(5), scanTestAt, scanTestAt.Add(time.Second)})
+	return openFakeDB(tb, f)
+}
+
+const scanTestRideQuery = `SELECT ` + rideColumns + ` FROM rides WHERE id = ?`
+
+// 手書きの Scan が sqlx の db タグによる対応付けと同じ値を読む (rideColumns の並びがずれていない)
+func TestScanRideMatchesSqlx(t *testing.T) {
+	db := openScanTestDB(t)
+	ctx := context.Background()
+
+	row := rideRow{}
+	if err := db.GetContext(ctx, &row, scanTestRideQuery, "ride"); err != nil {
+		t.Fatal(err)
+	}
+	want := row.model()
+	got := Ride{}
+	if err := getRideContext(ctx, db, &got, scanTestRideQuery, "ride"); err != nil {
+		t.Fatal(err)
+	}
+	if got.Evaluation == nil || want.Evaluation == nil || *got.Evaluation != *want.Evaluation {
+		t.Fatalf("Evaluation = %v, want %v", got.Evaluation, want.Evaluation)
+	}
+	got.Evaluation, want.Evaluation = nil, nil
+	if got != want {
+		t.Fatalf("getRideContext() = %+v, sqlx = %+v", got, want)
+	}
+	if got.ID != "ride" || !got.ChairID.Valid || got.PickupLongitude != -2 || !got.UpdatedAt.Equal(scanTestAt.Add(time.Second)) {
+		t.Fatalf("unexpected ride: %+v", got)
+	}
+}
+
+// 一部の列だけを引いても rideRow のタグで対応付けられ、残りはゼロ値になる
+func TestSelectRidesContextPartialColumns(t *testing.T) {
+	f := (&fakeDB{}).on("FROM rides", []string{"id", "pickup_latitude", "destination_longitude"},
+		[]driver.Value{"ride-1", int64(3), int64(-4)},
+		[]driver.Value{"ride-2", int64(5), int64(6)})
+	conn := openFakeDB(t, f)
+
+	rides, err := selectRidesContext(context.Background(), conn, `SELECT id, pickup_latitude, destination_longitude FROM rides`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Ride{
+		{ID: "ride-1", PickupLatitude: 3, DestinationLongitude: -4},
+		{ID: "ride-2", PickupLatitude: 5, DestinationLongitude: 6},
+	}
+	if !reflect.DeepEqual(rides, want) {
+		t.Fatalf("selectRidesContext() = %+v, want %+v", rides, want)
+	}
+}
+
+func TestChairRowModel(t *testing.T) {
+	now := time.Now()
+	f := (&fakeDB{}).on("FROM chairs", strings.Split(chairColumns, ", "),
+		[]driver.Value{"chair-1", "owner-1", "QC-1", "クエストチェア Lite", true, "token", now, now.Add(time.Second)})
+	conn := openFakeDB(t, f)
+
+	want := Chair{ID: "chair-1", OwnerID: "owner-1", Name: "QC-1", Model: "クエストチェア Lite", IsActive: true, AccessToken: "token", CreatedAt: now, UpdatedAt: now.Add(time.Second)}
+	chair := Chair{}
+	if err := getChairContext(context.Background(), conn, &chair, `SELECT `+chairColumns+` FROM chairs WHERE id = ?`, "chair-1"); err != nil {
+		t.Fatal(err)
+	}
+	if chair != want {
+		t.Fatalf("getChairContext() = %+v, want %+v", chair, want)
+	}
+	chairs, err := selectChairsContext(context.Background(), conn, `SELECT `+chairColumns+` FROM chairs`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chairs) != 1 || chairs[0] != want {
+		t.Fatalf("selectChairsContext() = %+v, want [%+v]", chairs, want)
+	}
+}
+
+func TestLatestRideStatusScan(t *testing.T) {
+	db := openScanTestDB(t)
+	status, err := getLatestRideStatus(context.Background(), db, "ride")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != "ENROUTE" {
+		t.Fatalf("getLatestRideStatus() = %q", status)
+	}
+}
+
+func BenchmarkRideFetch(b *testing.B) {
+	db := openScanTestDB(b)
+	ctx := context.Background()
+	b.Run("sqlx", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			ride := rideRow{}
+			if err := db.GetContext(ctx, &ride, scanTestRideQuery, "ride"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			ride := Ride{}
+			if err := getRideContext(ctx, db, &ride, scanTestRideQuery, "ride"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkLatestRideStatus(b *testing.B) {
+	db := openScanTestDB(b)
+	ctx := context.Background()
+	const query = `SELECT status FROM ride_statuses WHERE ride_id = ? ORDER BY created_at DESC LIMIT 1`
+	b.Run("sqlx", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			status := ""
+			if err := db.GetContext(ctx, &status, query, "ride"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			if _, err := getLatestRideStatus(ctx, db, "ride"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
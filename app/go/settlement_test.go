@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"testing"
+)
+
+func useSettledAtColumn(t *testing.T, present bool) {
+	prev := settledAtColumn.Load()
+	settledAtColumn.Store(present)
+	t.Cleanup(func() { settledAtColumn.Store(prev) })
+}
+
+// 精算で updated_at が進むと、椅子の現在のライドと完了日時がずれる
+func TestWriteSettlementsKeepsUpdatedAt(t *testing.T) {
+	f := &fakeDB{}
+	useFakeDB(t, f)
+	useSettledAtColumn(t, true)
+
+	writeSettlements([]string{"ride-1", "ride-2"})
+
+	if n := f.count("UPDATE rides SET settled_at"); n != 1 {
+		t.Fatalf("settlement was written %d times, want 1", n)
+	}
+	if n := f.count("updated_at = updated_at"); n != 1 {
+		t.Fatalf("settlement does not keep updated_at: %v", f.statements)
+	}
+}
+
+func TestWriteSettlementsWithoutColumn(t *testing.T) {
+	f := &fakeDB{}
+	useFakeDB(t, f)
+	useSettledAtColumn(t, false)
+
+	writeSettlements([]string{"ride-1"})
+
+	if n := f.count(""); n != 0 {
+		t.Fatalf("settlement reached the DB without rides.settled_at (%d statements)", n)
+	}
+}
+
+func TestDetectSettledAtColumn(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		count int64
+		want  bool
+	}{
+		{name: "migrated", count: 1, want: true},
+		{name: "not migrated", count: 0, want: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeDB(t, (&fakeDB{}).on("information_schema.COLUMNS", []string{"COUNT(*)"}, []driver.Value{tt.count}))
+			useSettledAtColumn(t, !tt.want)
+
+			detectSettledAtColumn(context.Background())
+			if got := settledAtColumn.Load(); got != tt.want {
+				t.Fatalf("settledAtColumn = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// 列を調べられなければ書いてみる
+func TestDetectSettledAtColumnError(t *testing.T) {
+	useFakeDB(t, &fakeDB{})
+	useSettledAtColumn(t, false)
+
+	detectSettledAtColumn(context.Background())
+	if !settledAtColumn.Load() {
+		t.Fatal("settlements were disabled although the column could not be checked")
+	}
+}
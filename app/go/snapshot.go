@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/oklog/ulid/v2"
+)
+
+// キャッシュのスナップショットを書き出すファイル。空なら無効
+var (
+	snapshotPath     = os.Getenv("ISUCON_SNAPSHOT_PATH")
+	snapshotInterval = newReloadable(time.Duration(getEnvInt("ISUCON_SNAPSHOT_INTERVAL_SECONDS", 10)) * time.Second)
+)
+
+// initialize のたびに振り直す世代。これが違うスナップショットは initialize 前のものなので使わない
+var cacheGeneration atomic.Pointer[string]
+
+// スナップショットより少し前から MySQL を読み直し、取る直前の書き込みや DB との時計のずれで取りこぼさないようにする
+// 重なった分はライド ID と位置の報告時刻で飛ばす
+const snapshotReplayMargin = time.Minute
+
+// 位置・集計・通知済みステータスのように MySQL からの作り直しが重いものだけを持つ
+type cacheSnapshot struct {
+	Generation         string
+	TakenAt            time.Time
+	ChairPositions     map[string]chairPositionCacheEntry
+	OwnerEvaluations   map[string]ownerEvaluationStats
+	ChairRideStats     map[string]chairRideStats
+	ChairRideHistory   map[string][]chairRideHistoryEntry
+	CompletedRideFares map[string]rideFare
+	UserRideStats      map[string]userRideStats
+	OwnerDailySales    map[ownerSalesDay]int
+	FailedPayments     map[string]failedPayment
+	AppSentStatuses    []string
+	ChairSentStatuses  []string
+}
+
+func renewCacheGeneration(ctx context.Context) error {
+	gen := ulid.Make().String()
+	if _, err := db.ExecContext(ctx, `INSERT INTO settings (name, value) VALUES ('cache_generation', ?) ON DUPLICATE KEY UPDATE value = VALUES(value)`, gen); err != nil {
+		return err
+	}
+	cacheGeneration.Store(&gen)
+	return nil
+}
+
+func loadCacheGeneration(ctx context.Context) (string, error) {
+	var gen string
+	if err := db.GetContext(ctx, &gen, `SELECT value FROM settings WHERE name = 'cache_generation'`); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	cacheGeneration.Store(&gen)
+	return gen, nil
+}
+
+func sentStatusIDs(c *cache[string, struct{}]) []string {
+	m := c.Snapshot()
+	ids := make([]string, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func sentStatusSet(ids []string) map[string]struct{} {
+	m := make(map[string]struct{}, len(ids))
+	for _, id := range ids {
+		m[id] = struct{}{}
+	}
+	return m
+}
+
+func takeCacheSnapshot() *cacheSnapshot {
+	gen := cacheGeneration.Load()
+	if gen == nil {
+		return nil
+	}
+	// 途中で initialize が cacheSet を差し替えても、全て同じ cacheSet から取る
+	s := currentCaches()
+	return &cacheSnapshot{
+		Generation:         *gen,
+		TakenAt:            time.Now(),
+		ChairPositions:     chairPositionCache.in(s).Snapshot(),
+		OwnerEvaluations:   ownerEvaluationCache.in(s).Snapshot(),
+		ChairRideStats:     chairRideStatsCache.in(s).Snapshot(),
+		ChairRideHistory:   chairRideHistoryCache.in(s).Snapshot(),
+		CompletedRideFares: completedRideFareCache.in(s).Snapshot(),
+		UserRideStats:      userRideStatsCache.in(s).Snapshot(),
+		OwnerDailySales:    ownerDailySalesCache.in(s).Snapshot(),
+		FailedPayments:     failedPaymentCache.in(s).Snapshot(),
+		AppSentStatuses:    sentStatusIDs(appSentStatusCache.in(s)),
+		ChairSentStatuses:  sentStatusIDs(chairSentStatusCache.in(s)),
+	}
+}
+
+// 書きかけのファイルを読まないよう、一時ファイルに書いてから置き換える
+func writeCacheSnapshot(path string, snap *cacheSnapshot) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(snap); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func readCacheSnapshot(path string) (*cacheSnapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap := &cacheSnapshot{}
+	if err := gob.NewDecoder(f).Decode(snap); err != nil {
+		return nil, err
+	}
+	return snap, nil
+}
+
+// 間隔はリロードで変わるので、毎回読み直す
+func runSnapshotter() {
+	for {
+		time.Sleep(snapshotInterval.Load())
+		snap := takeCacheSnapshot()
+		if snap == nil {
+			continue
+		}
+		if err := writeCacheSnapshot(snapshotPath, snap); err != nil {
+			slog.Error("failed to write cache snapshot", "path", snapshotPath, "err", err)
+		}
+	}
+}
+
+// 今の世代のスナップショットがあれば返す。無ければ nil で、全て MySQL から作り直す
+func loadUsableSnapshot(ctx context.Context) (*cacheSnapshot, error) {
+	gen, err := loadCacheGeneration(ctx)
+	if err != nil || gen == "" {
+		return nil, err
+	}
+	snap, err := readCacheSnapshot(snapshotPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if snap.Generation != gen {
+		slog.Info("discarding cache snapshot from previous generation", "snapshot", snap.Generation, "current", gen)
+		return nil, nil
+	}
+	return snap, nil
+}
+
+func restoreCacheSnapshot(s *cacheSet, snap *cacheSnapshot) {
+	chairPositionCache.in(s).Restore(snap.ChairPositions)
+	ownerEvaluationCache.in(s).Restore(snap.OwnerEvaluations)
+	chairRideStatsCache.in(s).Restore(snap.ChairRideStats)
+	chairRideHistoryCache.in(s).Restore(snap.ChairRideHistory)
+	completedRideFareCache.in(s).Restore(snap.CompletedRideFares)
+	userRideStatsCache.in(s).Restore(snap.UserRideStats)
+	ownerDailySalesCache.in(s).Restore(snap.OwnerDailySales)
+	// 日次売上は決済失敗分を引いた後の値なので、失敗の記録も一緒に戻す
+	failedPaymentCache.in(s).Restore(snap.FailedPayments)
+	appSentStatusCache.in(s).Restore(sentStatusSet(snap.AppSentStatuses))
+	chairSentStatusCache.in(s).Restore(sentStatusSet(snap.ChairSentStatuses))
+}
+
+// 起動時に呼ぶ。スナップショットが使えればそれを載せ、残りを MySQL から読む
+func warmStartCaches(ctx context.Context) error {
+	snap, err := loadUsableSnapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load cache snapshot: %w", err)
+	}
+	cacheInitFrom(snap)
+	if snap != nil {
+		slog.Info("caches restored from snapshot", "generation", snap.Generation, "taken_at", snap.TakenAt)
+	}
+	return nil
+}
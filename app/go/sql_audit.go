@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 有効にすると、ホットなエンドポイントのハンドラから発行された SQL を呼び出し元のスタックと一緒にログに出す
+// キャッシュへ移し替えるときに、まだ DB を触っている箇所の一覧を作るためのもの
+var sqlHotRouteAudit = getEnvBool("ISUCON_SQL_HOT_ROUTE_AUDIT", false)
+
+// "METHOD /path" をカンマ区切りで指定する。パスはルーティングのパターンで書く
+var sqlHotRoutes = parseSQLHotRoutes(getEnvString("ISUCON_SQL_HOT_ROUTES",
+	"POST /api/app/rides,POST /api/chair/coordinate,GET /api/app/notification,GET /api/chair/notification,POST /api/chair/rides/{ride_id}/status"))
+
+func parseSQLHotRoutes(s string) map[string]struct{} {
+	routes := map[string]struct{}{}
+	for _, route := range strings.Split(s, ",") {
+		if route = strings.TrimSpace(route); route != "" {
+			routes[route] = struct{}{}
+		}
+	}
+	return routes
+}
+
+// 同じ場所から同じ SQL が何度も来るので、スタックはルートと SQL の組ごとに最初の 1 回だけ出す
+var sqlAuditSeen sync.Map
+
+// パターンにメソッドが含まれていてもいなくても "METHOD /path" に揃える
+func hotRouteOf(ctx context.Context) (string, bool) {
+	rctx := chi.RouteContext(ctx)
+	if rctx == nil {
+		return "", false
+	}
+	pattern := rctx.RoutePattern()
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+	route := rctx.RouteMethod + " " + pattern
+	_, ok := sqlHotRoutes[route]
+	return route, ok
+}
+
+func auditHotRouteQuery(ctx context.Context, query string) {
+	if !sqlHotRouteAudit {
+		return
+	}
+	route, ok := hotRouteOf(ctx)
+	if !ok {
+		return
+	}
+	metricCounter(metricName("sql_hot_route_queries_total", "route", route)).Inc()
+	if _, seen := sqlAuditSeen.LoadOrStore(route+"\x00"+query, struct{}{}); seen {
+		return
+	}
+	slog.Warn("sql on hot route", "route", route, "query", query, "stack", string(debug.Stack()))
+}
+
+func resetSQLAudit() {
+	sqlAuditSeen.Clear()
+}
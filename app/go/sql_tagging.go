@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// 有効にすると、SQL の末尾に呼び出し元のエンドポイントを /* app_post_rides */ のようなコメントで付ける
+// ベンチマーク後にスロークエリログをエンドポイントごとに集計するためのもの
+// コメントの違うクエリは別物として扱われ、MySQL 側のキャッシュやダイジェストが分かれるので既定では無効
+var sqlRouteComments = getEnvBool("ISUCON_SQL_ROUTE_COMMENTS", false)
+
+// 有効にすると、クエリごとの回数と所要時間を数えておき、レポートで遅い順に並べる
+// 全クエリが 1 つのロックを取り合うので、計測したいときだけ有効にする
+var sqlQueryStats = getEnvBool("ISUCON_SQL_QUERY_STATS", false)
+
+var sqlRouteTags sync.Map
+
+// "POST /api/app/rides/{ride_id}/evaluation" → "app_post_rides_ride_id_evaluation"
+func sqlRouteTag(route string) string {
+	if v, ok := sqlRouteTags.Load(route); ok {
+		return v.(string)
+	}
+	method, path, ok := strings.Cut(route, " ")
+	if !ok {
+		method, path = "", route
+	}
+	parts := strings.FieldsFunc(strings.TrimPrefix(path, "/api"), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_')
+	})
+	if len(parts) > 0 && method != "" {
+		parts = append([]string{parts[0], strings.ToLower(method)}, parts[1:]...)
+	}
+	tag := strings.Join(parts, "_")
+	sqlRouteTags.Store(route, tag)
+	return tag
+}
+
+// ワーカーや initialize の中などエンドポイントが分からないクエリには付けない
+func tagQuery(ctx context.Context, query string) string {
+	if !sqlRouteComments {
+		return query
+	}
+	rctx := chi.RouteContext(ctx)
+	if rctx == nil {
+		return query
+	}
+	route := rctx.RoutePattern()
+	if route == "" {
+		return query
+	}
+	return query + " /* " + sqlRouteTag(route) + " */"
+}
+
+type queryStat struct {
+	Route   string  `json:"route"`
+	Query   string  `json:"query"`
+	Count   int64   `json:"count"`
+	TotalMs float64 `json:"total_ms"`
+	MaxMs   float64 `json:"max_ms"`
+}
+
+type queryStatKey struct {
+	Route string
+	Query string
+}
+
+var queryStats = struct {
+	sync.Mutex
+	items map[queryStatKey]*queryStat
+}{items: map[queryStatKey]*queryStat{}}
+
+func recordQuery(ctx context.Context, query string, start time.Time) {
+	if !sqlQueryStats {
+		return
+	}
+	ms := float64(time.Since(start).Microseconds()) / 1000
+	key := queryStatKey{Route: routeFromContext(ctx), Query: query}
+	queryStats.Lock()
+	s, ok := queryStats.items[key]
+	if !ok {
+		s = &queryStat{Route: key.Route, Query: key.Query}
+		queryStats.items[key] = s
+	}
+	s.Count++
+	s.TotalMs += ms
+	s.MaxMs = max(s.MaxMs, ms)
+	queryStats.Unlock()
+}
+
+// 合計の所要時間が長い順に上位 n 件
+func slowQueryRanking(n int) []queryStat {
+	queryStats.Lock()
+	stats := make([]queryStat, 0, len(queryStats.items))
+	for _, s := range queryStats.items {
+		stats = append(stats, *s)
+	}
+	queryStats.Unlock()
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TotalMs > stats[j].TotalMs
+	})
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+// MySQL ドライバの接続をくるみ、context を受け取るクエリにコメントを付けて所要時間を数える
+type taggingConnector struct {
+	driver.Connector
+}
+
+func (c taggingConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &taggingConn{conn}, nil
+}
+
+type taggingConn struct {
+	driver.Conn
+}
+
+func (c *taggingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *taggingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, tagQuery(ctx, query))
+}
+
+func (c *taggingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer recordQuery(ctx, query, time.Now())
+	auditHotRouteQuery(ctx, query)
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, tagQuery(ctx, query), args)
+}
+
+// 行の読み出しにかかる時間は含まない
+func (c *taggingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer recordQuery(ctx, query, time.Now())
+	auditHotRouteQuery(ctx, query)
+	return c.Conn.(driver.QueryerContext).QueryContext(ctx, tagQuery(ctx, query), args)
+}
+
+func (c *taggingConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *taggingConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *taggingConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+func (c *taggingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
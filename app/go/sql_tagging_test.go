@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestSQLRouteTag(t *testing.T) {
+	tests := map[string]string{
+		"POST /api/app/rides/{ride_id}/evaluation": "app_post_rides_ride_id_evaluation",
+		"GET /api/chair/notification":              "chair_get_notification",
+		"/api/owner/sales":                         "owner_sales",
+	}
+	for route, want := range tests {
+		if got := sqlRouteTag(route); got != want {
+			t.Errorf("sqlRouteTag(%q) = %q, want %q", route, got, want)
+		}
+	}
+}
+
+func TestTagQuery(t *testing.T) {
+	prev := sqlRouteComments
+	sqlRouteComments = true
+	t.Cleanup(func() { sqlRouteComments = prev })
+
+	const query = "SELECT 1"
+	if got := tagQuery(context.Background(), query); got != query {
+		t.Errorf("query without a route was tagged: %q", got)
+	}
+	rctx := chi.NewRouteContext()
+	ctx := context.WithValue(context.Background(), chi.RouteCtxKey, rctx)
+	if got := tagQuery(ctx, query); got != query {
+		t.Errorf("query with an unmatched route was tagged: %q", got)
+	}
+	rctx.RoutePatterns = []string{"GET /api/chair/notification"}
+	if got, want := tagQuery(ctx, query), query+" /* chair_get_notification */"; got != want {
+		t.Errorf("tagQuery = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+type sentAtTarget int
+
+const (
+	sentAtApp sentAtTarget = iota
+	sentAtChair
+)
+
+type stampJob struct {
+	RideID   string
+	StatusID string
+	Seq      int
+	Target   sentAtTarget
+	SentAt   time.Time
+}
+
+var stampBatchSize = newReloadable(getEnvInt("ISUCON_STAMP_BATCH_SIZE", 256))
+
+var stampQueue = make(chan stampJob, 4096)
+
+// キューに積まれてまだ UPDATE が終わっていない件数
+var stampPending atomic.Int64
+
+// 通知済みのステータス ID。stamper の反映前後で同じステータスを二度送らないよう initialize まで保持する
+var (
+	appSentStatusCache   = NewCache[string, struct{}]()
+	chairSentStatusCache = NewCache[string, struct{}]()
+)
+
+func sentStatusCache(target sentAtTarget) *cache[string, struct{}] {
+	if target == sentAtApp {
+		return appSentStatusCache
+	}
+	return chairSentStatusCache
+}
+
+// 通知ハンドラから呼ぶ。DB への反映は stamper がまとめて行う
+func enqueueStamp(target sentAtTarget, status *RideStatus) {
+	sentStatusCache(target).Set(status.ID, struct{}{})
+	stampPending.Add(1)
+	stampQueue <- stampJob{
+		RideID:   status.RideID,
+		StatusID: status.ID,
+		Seq:      status.Seq,
+		Target:   target,
+		SentAt:   time.Now(),
+	}
+}
+
+// 未送信のステータスのうち、stamper に積まれていない最も古いものを返す
+func firstUnsentStatus(target sentAtTarget, statuses []RideStatus) *RideStatus {
+	sent := sentStatusCache(target)
+	for i := range statuses {
+		if _, ok := sent.Get(statuses[i].ID); !ok {
+			return &statuses[i]
+		}
+	}
+	return nil
+}
+
+func runStamper() {
+	batch := make([]stampJob, 0, stampBatchSize.Load())
+	for job := range stampQueue {
+		batch = append(batch[:0], job)
+		size := stampBatchSize.Load()
+	drain:
+		for len(batch) < size {
+			select {
+			case job := <-stampQueue:
+				batch = append(batch, job)
+			default:
+				break drain
+			}
+		}
+
+		// 同じライドの古いステータスが新しいものより後に stamp されないようにする
+		sort.SliceStable(batch, func(i, j int) bool {
+			if batch[i].RideID != batch[j].RideID {
+				return batch[i].RideID < batch[j].RideID
+			}
+			return batch[i].Seq < batch[j].Seq
+		})
+
+		for _, job := range batch {
+			query := `UPDATE ride_statuses SET app_sent_at = ? WHERE id = ?`
+			if job.Target == sentAtChair {
+				query = `UPDATE ride_statuses SET chair_sent_at = ? WHERE id = ?`
+			}
+			if _, err := db.ExecContext(context.Background(), query, job.SentAt, job.StatusID); err != nil {
+				slog.Error("failed to stamp sent_at", "status_id", job.StatusID, "err", err)
+			}
+		}
+		stampPending.Add(-int64(len(batch)))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// [Since, Until) の半開区間
+type timeRange struct {
+	Since time.Time
+	Until time.Time
+}
+
+var (
+	defaultRangeSince = time.Unix(0, 0)
+	defaultRangeUntil = time.Date(9999, 12, 31, 23, 59, 59, 0, time.UTC)
+)
+
+// since, until はミリ秒単位の UNIX 時刻で、どちらも含む。until はその 1ms 後を区間の終端にする
+func parseTimeRange(q url.Values) (timeRange, error) {
+	tr := timeRange{Since: defaultRangeSince, Until: defaultRangeUntil}
+
+	if v := q.Get("since"); v != "" {
+		since, err := parseEpochMilli("since", v)
+		if err != nil {
+			return tr, err
+		}
+		tr.Since = since
+	}
+	if v := q.Get("until"); v != "" {
+		until, err := parseEpochMilli("until", v)
+		if err != nil {
+			return tr, err
+		}
+		tr.Until = until.Add(time.Millisecond)
+	}
+
+	if !tr.Since.Before(tr.Until) {
+		return tr, errors.New("since must not be after until")
+	}
+	return tr, nil
+}
+
+func parseEpochMilli(name, v string) (time.Time, error) {
+	parsed, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s is invalid: %w", name, err)
+	}
+	if parsed < 0 {
+		return time.Time{}, fmt.Errorf("%s must not be negative", name)
+	}
+	return time.UnixMilli(parsed), nil
+}
+
+// レスポンスに載せる時刻は全てミリ秒単位の UNIX 時刻にする。UNIX 時刻なのでタイムゾーンには依存しない
+func epochMilli(t time.Time) int64 {
+	return t.UnixMilli()
+}
+
+// nil ならそのまま nil を返す (JSON では null か省略になる)
+func epochMilliPtr(t *time.Time) *int64 {
+	if t == nil {
+		return nil
+	}
+	ms := epochMilli(*t)
+	return &ms
+}
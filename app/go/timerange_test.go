@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		wantSince time.Time
+		wantUntil time.Time
+		wantErr   bool
+	}{
+		{name: "defaults", query: "", wantSince: defaultRangeSince, wantUntil: defaultRangeUntil},
+		{name: "since only", query: "since=1000", wantSince: time.UnixMilli(1000), wantUntil: defaultRangeUntil},
+		// until は含むので、その 1ms 後が終端になる
+		{name: "until only", query: "until=2000", wantSince: defaultRangeSince, wantUntil: time.UnixMilli(2001)},
+		{name: "both", query: "since=1000&until=2000", wantSince: time.UnixMilli(1000), wantUntil: time.UnixMilli(2001)},
+		{name: "same instant", query: "since=1000&until=1000", wantSince: time.UnixMilli(1000), wantUntil: time.UnixMilli(1001)},
+		{name: "zero", query: "since=0&until=0", wantSince: time.UnixMilli(0), wantUntil: time.UnixMilli(1)},
+		{name: "since after until", query: "since=2000&until=1000", wantErr: true},
+		{name: "since after default until", query: "since=253402300800000", wantErr: true},
+		{name: "not a number", query: "since=yesterday", wantErr: true},
+		{name: "fractional", query: "until=1.5", wantErr: true},
+		{name: "negative", query: "until=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr, err := parseTimeRange(q)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseTimeRange(%q) = %+v, want error", tt.query, tr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTimeRange(%q) failed: %v", tt.query, err)
+			}
+			if !tr.Since.Equal(tt.wantSince) || !tr.Until.Equal(tt.wantUntil) {
+				t.Fatalf("parseTimeRange(%q) = [%v, %v), want [%v, %v)", tt.query, tr.Since, tr.Until, tt.wantSince, tt.wantUntil)
+			}
+		})
+	}
+}
+
+// 区間の検証は DB に触る前に行うので、DB 無しで 400 になることを確かめられる
+func TestOwnerSalesRejectsInvertedRange(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"/api/owner/sales":     ownerGetSales,
+		"/api/owner/sales.csv": ownerGetSalesCSV,
+	}
+	for path, handler := range handlers {
+		t.Run(path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest(http.MethodGet, path+"?since=2000&until=1000", nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d (body %s)", rec.Code, http.StatusBadRequest, rec.Body)
+			}
+		})
+	}
+}
+
+func TestEpochMilliRoundTrip(t *testing.T) {
+	at := time.Date(2024, 12, 8, 10, 0, 0, 123_456_789, time.FixedZone("JST", 9*60*60))
+	ms := epochMilli(at)
+	if got := time.UnixMilli(ms); !got.Equal(at.Truncate(time.Millisecond)) {
+		t.Fatalf("UnixMilli(epochMilli(%v)) = %v", at, got)
+	}
+	if epochMilliPtr(nil) != nil {
+		t.Fatal("epochMilliPtr(nil) is not nil")
+	}
+	if got := epochMilliPtr(&at); got == nil || *got != ms {
+		t.Fatalf("epochMilliPtr() = %v, want %d", got, ms)
+	}
+}
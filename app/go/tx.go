@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// デッドロックやロック待ちタイムアウトでトランザクションをやり直す回数
+var txMaxRetries = getEnvInt("ISUCON_TX_RETRIES", 3)
+
+const txRetryBaseBackoff = 5 * time.Millisecond
+
+// トランザクションの中からレスポンスのステータスを指定して中断するためのエラー
+type statusError struct {
+	Status int
+	Err    error
+}
+
+func (e *statusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *statusError) Unwrap() error {
+	return e.Err
+}
+
+// statusError ならそのステータスで、それ以外は 500 で返す
+func writeTxError(w http.ResponseWriter, err error) {
+	var se *statusError
+	if errors.As(err, &se) {
+		writeError(w, se.Status, se.Err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+// fn をトランザクションの中で実行し、エラーが無ければコミットする
+// デッドロックした場合は最初からやり直すので、fn はコミット後の副作用を持たないこと
+func withTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, fn)
+		if err == nil || !isRetryableTxError(err) || attempt >= txMaxRetries {
+			return err
+		}
+		metricCounter("tx_retries_total").Inc()
+		slog.Debug("retrying transaction", "attempt", attempt+1, "err", err)
+
+		backoff := txRetryBaseBackoff << attempt
+		backoff += rand.N(backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func runTx(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func isRetryableTxError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return false
+	}
+	// 1213: Deadlock found, 1205: Lock wait timeout exceeded
+	return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+}
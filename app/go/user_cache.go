@@ -0,0 +1,6 @@
+package main
+
+func cacheUser(s *cacheSet, user *User) {
+	cacheAuthToken(s, "app_session", user.AccessToken, user)
+	invitationCodeIndex.in(s).Set(user.InvitationCode, user.ID)
+}
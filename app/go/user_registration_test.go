@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// 登録だけを通す DB。招待コードの使用数はいつも 0 件
+func fakeRegistrationDB() *fakeDB {
+	return (&fakeDB{}).on("FROM coupons WHERE code = ?", []string{"user_id", "code", "discount", "used_by", "created_at"})
+}
+
+func registerTestUser(t *testing.T, username, invitationCode string) (*appPostUsersResponse, *http.Cookie) {
+	t.Helper()
+	body := fmt.Sprintf(`{"username":%q,"firstname":"太郎","lastname":"山田","date_of_birth":"2000-01-01"}`, username)
+	if invitationCode != "" {
+		body = fmt.Sprintf(`{"username":%q,"firstname":"太郎","lastname":"山田","date_of_birth":"2000-01-01","invitation_code":%q}`, username, invitationCode)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/api/app/users", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	appPostUsers(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Errorf("register %s: status = %d (body %s)", username, rec.Code, rec.Body)
+		return nil, nil
+	}
+	res := &appPostUsersResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), res); err != nil {
+		t.Error(err)
+		return nil, nil
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == "app_session" {
+			return res, c
+		}
+	}
+	t.Errorf("register %s: app_session cookie was not set", username)
+	return nil, nil
+}
+
+// 認証を通った後のハンドラまで届いたユーザーを返す。届かなければ nil
+func authenticateTestUser(t *testing.T, cookie *http.Cookie) *User {
+	t.Helper()
+	var user *User
+	handler := appAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user = r.Context().Value("user").(*User)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/api/app/rides", nil)
+	req.AddCookie(cookie)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("authenticate: status = %d (body %s)", rec.Code, rec.Body)
+	}
+	return user
+}
+
+func ledgerCodes(userID string) []string {
+	coupons, _ := couponLedger.Get(userID)
+	codes := make([]string, len(coupons))
+	for i, c := range coupons {
+		codes[i] = c.Code
+	}
+	return codes
+}
+
+// 登録のレスポンスを受け取った直後のリクエストは、DB を見ずにキャッシュだけで通る
+func TestAppPostUsersWarmsCaches(t *testing.T) {
+	useFreshCaches(t)
+	f := fakeRegistrationDB()
+	useFakeDB(t, f)
+
+	inviter, inviterCookie := registerTestUser(t, "inviter", "")
+	if inviter == nil {
+		t.FailNow()
+	}
+	invitee, cookie := registerTestUser(t, "invitee", inviter.InvitationCode)
+	if invitee == nil {
+		t.FailNow()
+	}
+
+	for _, c := range []*http.Cookie{inviterCookie, cookie} {
+		if user := authenticateTestUser(t, c); user == nil || user.AccessToken != c.Value {
+			t.Fatalf("authenticated as %+v, want the registered user", user)
+		}
+	}
+	if n := f.count("FROM users"); n != 0 {
+		t.Fatalf("authentication right after registration read users from the DB %d times", n)
+	}
+
+	if got, want := ledgerCodes(invitee.ID), []string{"CP_NEW2024", "INV_" + inviter.InvitationCode}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("invitee coupons = %v, want %v", got, want)
+	}
+	if got := ledgerCodes(inviter.ID); len(got) != 2 || got[0] != "CP_NEW2024" || !strings.HasPrefix(got[1], "RWD_"+inviter.InvitationCode+"_") {
+		t.Fatalf("inviter coupons = %v, want CP_NEW2024 and a reward", got)
+	}
+	if id, ok := invitationCodeIndex.Get(invitee.InvitationCode); !ok || id != invitee.ID {
+		t.Fatalf("invitation index has %q, %v for the invitee's code", id, ok)
+	}
+}
+
+// 登録と、その直後のリクエスト (認証・クーポンの参照・招待コードでの登録) が並行して走っても競合しない
+// go test -race で確かめる
+func TestAppPostUsersConcurrentFollowUp(t *testing.T) {
+	useFreshCaches(t)
+	useFakeDB(t, fakeRegistrationDB())
+
+	inviter, _ := registerTestUser(t, "inviter", "")
+	if inviter == nil {
+		t.FailNow()
+	}
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// 招待数の上限は DB 側で数えるので、ここでは全員が同じコードを使える
+			res, cookie := registerTestUser(t, fmt.Sprintf("user-%d", i), inviter.InvitationCode)
+			if res == nil {
+				return
+			}
+			if user := authenticateTestUser(t, cookie); user == nil || user.ID != res.ID {
+				t.Errorf("user-%d authenticated as %+v", i, user)
+			}
+			coupons, _ := couponLedger.Get(res.ID)
+			if idx := pickLedgerCoupon(coupons, true); idx < 0 || coupons[idx].Code != "CP_NEW2024" {
+				t.Errorf("user-%d cannot use CP_NEW2024 right after registration: %v", i, ledgerCodes(res.ID))
+			}
+			// 招待した側のクーポンは全員の登録から同時に書き換えられる
+			ledgerCodes(inviter.ID)
+		}()
+	}
+	wg.Wait()
+
+	if got := len(ledgerCodes(inviter.ID)); got != 17 {
+		t.Fatalf("inviter has %d coupons, want 1 + 16 rewards", got)
+	}
+}
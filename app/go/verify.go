@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type cacheMismatch struct {
+	Cache string
+	Key   string
+	Field string
+	InMem any
+	InDB  any
+}
+
+func (m cacheMismatch) String() string {
+	return fmt.Sprintf("%s[%s].%s: cache=%v db=%v", m.Cache, m.Key, m.Field, m.InMem, m.InDB)
+}
+
+// 走行中のキャッシュの内容を DB から集計し直した値と突き合わせる。書き込み待ちは流しきってから見る
+func verifyCaches(ctx context.Context) ([]cacheMismatch, error) {
+	return checkChairLocations(ctx)
+}
+
+type internalGetCacheCheckResponse struct {
+	Mismatches []string `json:"mismatches"`
+}
+
+func internalGetCacheCheck(w http.ResponseWriter, r *http.Request) {
+	mismatches, err := verifyCaches(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	lines := make([]string, 0, len(mismatches))
+	for _, m := range mismatches {
+		lines = append(lines, m.String())
+	}
+	writeJSON(w, http.StatusOK, &internalGetCacheCheckResponse{Mismatches: lines})
+}
+
+// verify サブコマンドが問い合わせる起動中のインスタンス
+// 新しく DB から作り直したキャッシュは DB と一致して当然なので、実際に動いているプロセスのキャッシュを見る
+var verifyTarget = getEnvString("ISUCON_VERIFY_TARGET", "http://127.0.0.1:8080")
+
+const verifyTimeout = 30 * time.Second
+
+func runVerify() ([]string, error) {
+	client := &http.Client{Timeout: verifyTimeout}
+	res, err := client.Get(verifyTarget + "/api/internal/verify/caches")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("%s: %d %s", verifyTarget, res.StatusCode, bytes.TrimSpace(b))
+	}
+	body := &internalGetCacheCheckResponse{}
+	if err := json.NewDecoder(res.Body).Decode(body); err != nil {
+		return nil, err
+	}
+	return body.Mismatches, nil
+}
+
+func verifyChairPositionCache(ctx context.Context) ([]cacheMismatch, error) {
+	rows, err := chairLocations.Summarize(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatches := []cacheMismatch{}
+	inDB := make(map[string]struct{}, len(rows))
+	for _, row := range rows {
+		inDB[row.ChairID] = struct{}{}
+		entry, ok := chairPositionCache.Get(row.ChairID)
+		if !ok {
+			mismatches = append(mismatches, cacheMismatch{Cache: "chairPosition", Key: row.ChairID, Field: "entry", InMem: nil, InDB: row})
+			continue
+		}
+		if entry.TotalDistance != row.TotalDistance {
+			mismatches = append(mismatches, cacheMismatch{Cache: "chairPosition", Key: row.ChairID, Field: "TotalDistance", InMem: entry.TotalDistance, InDB: row.TotalDistance})
+		}
+		if dbPos := (Coordinate{Latitude: row.Latitude, Longitude: row.Longitude}); entry.Position() != dbPos {
+			mismatches = append(mismatches, cacheMismatch{
+				Cache: "chairPosition",
+				Key:   row.ChairID,
+				Field: "LastPosition",
+				InMem: entry.Position().String(),
+				InDB:  dbPos.String(),
+			})
+		}
+	}
+	// メモリにだけある椅子は、書き込みが落ちている
+	for chairID, entry := range chairPositionCache.Snapshot() {
+		if _, ok := inDB[chairID]; !ok {
+			mismatches = append(mismatches, cacheMismatch{Cache: "chairPosition", Key: chairID, Field: "entry", InMem: entry, InDB: nil})
+		}
+	}
+	return mismatches, nil
+}
+
+// 有効にするとキャッシュから返した値を毎回元の SQL でも引き直し、食い違いをログに出す
+// 読み込みを MySQL から外していく間の確認用で、本番では有効にしない
+var verifyCacheReads = getEnvBool("ISUCON_VERIFY_CACHE_READS", false)
+
+// キャッシュにヒットしたときに呼ぶ。load は元の SQL で同じ値を引く
+func verifyCacheRead[T comparable](ctx context.Context, cache, key string, inMem T, load func() (T, error)) {
+	if !verifyCacheReads {
+		return
+	}
+	inDB, err := load()
+	if err != nil {
+		slog.Warn("cache read verification failed", "cache", cache, "key", key, "err", err)
+		return
+	}
+	if inMem == inDB {
+		return
+	}
+	metricCounter(metricName("cache_read_mismatches_total", "cache", cache)).Inc()
+	slog.Warn("cache read mismatch",
+		"mismatch", cacheMismatch{Cache: cache, Key: key, Field: "value", InMem: inMem, InDB: inDB}.String(),
+		"route", routeFromContext(ctx),
+	)
+}
+
+func rideStatusIDs(statuses []RideStatus) string {
+	ids := make([]string, len(statuses))
+	for i, rs := range statuses {
+		ids[i] = rs.ID
+	}
+	return strings.Join(ids, ",")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// 起動中のインスタンスの代わりに、決まった応答を返すサーバーに問い合わせる
+func useVerifyTarget(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	prev := verifyTarget
+	verifyTarget = srv.URL
+	t.Cleanup(func() { verifyTarget = prev })
+}
+
+func TestRunVerify(t *testing.T) {
+	want := []string{"chairPosition[chair-1].TotalDistance: cache=10 db=12"}
+	useVerifyTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/internal/verify/caches" {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, http.StatusOK, &internalGetCacheCheckResponse{Mismatches: want})
+	})
+	got, err := runVerify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(got, want) {
+		t.Fatalf("runVerify() = %v, want %v", got, want)
+	}
+}
+
+func TestRunVerifyServerError(t *testing.T) {
+	useVerifyTarget(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "timed out waiting for pending chair locations to be written", http.StatusInternalServerError)
+	})
+	if _, err := runVerify(); err == nil {
+		t.Fatal("runVerify() succeeded although the instance returned 500")
+	}
+}